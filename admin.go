@@ -21,19 +21,18 @@ import (
 	"encoding/xml"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
-	"appengine/datastore"
-	"appengine/memcache"
-
-	mpg "github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler_gae"
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
+	"github.com/mjibson/goread/auth"
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/sanitizer"
 )
 
-func AllFeedsOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
-	q := datastore.NewQuery(gn.Kind(&Feed{})).KeysOnly()
+func AllFeedsOpml(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&Feed{})).KeysOnly()
 	keys, _ := gn.GetAll(q, nil)
 	fs := make([]*Feed, len(keys))
 	for i, k := range keys {
@@ -62,21 +61,21 @@ func feedsToOpml(feeds []*Feed) []byte {
 	return b
 }
 
-func AllFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
-	q := datastore.NewQuery(gn.Kind(&Feed{})).KeysOnly()
+func AllFeeds(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&Feed{})).KeysOnly()
 	keys, _ := gn.GetAll(q, nil)
 	templates.ExecuteTemplate(w, "admin-all-feeds.html", keys)
 }
 
-func AdminFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
+func AdminFeed(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
 	f := Feed{Url: r.FormValue("f")}
 	if err := gn.Get(&f); err != nil {
 		serveError(w, err)
 		return
 	}
-	q := datastore.NewQuery(gn.Kind(&Story{})).KeysOnly()
+	q := backend.NewQuery(gn.Kind(&Story{})).KeysOnly()
 	fk := gn.Key(&f)
 	q = q.Ancestor(fk)
 	q = q.Limit(100)
@@ -91,7 +90,7 @@ func AdminFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 	gn.GetMulti(stories)
 	lk := gn.Key(&Log{Parent: fk, Id: time.Now().Add(-time.Hour * 6).UnixNano()})
-	q = datastore.NewQuery(lk.Kind()).KeysOnly()
+	q = backend.NewQuery(lk.Kind()).KeysOnly()
 	q = q.Ancestor(fk)
 	q = q.Filter("__key__ >", lk)
 	keys, _ = gn.GetAll(q, nil)
@@ -104,20 +103,27 @@ func AdminFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 	gn.GetMulti(logs)
 
+	var policies []string
+	for name := range sanitizer.Policies {
+		policies = append(policies, name)
+	}
+	sort.Strings(policies)
 	templates.ExecuteTemplate(w, "admin-feed.html", struct {
-		Feed    *Feed
-		Logs    []*Log
-		Stories []*Story
-		Now     time.Time
+		Feed     *Feed
+		Logs     []*Log
+		Stories  []*Story
+		Now      time.Time
+		Policies []string
 	}{
 		&f,
 		logs,
 		stories,
 		time.Now(),
+		policies,
 	})
 }
 
-func AdminUpdateFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func AdminUpdateFeed(c Context, w http.ResponseWriter, r *http.Request) {
 	url := r.FormValue("f")
 	if feed, stories, err := fetchFeed(c, url, url); err == nil {
 		updateFeed(c, url, feed, stories, true, false, false)
@@ -127,8 +133,54 @@ func AdminUpdateFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func AdminSubHub(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
+// AdminSetPolicy sets the sanitizer policy of the f parameter's feed to
+// the p parameter, and updates the feed so the stories still in it are
+// stored again with the policy. Older stories keep the policy they were
+// stored with.
+func AdminSetPolicy(c Context, w http.ResponseWriter, r *http.Request) {
+	p := r.FormValue("p")
+	if _, ok := sanitizer.Policies[p]; !ok && p != "" {
+		http.Error(w, "unknown policy", http.StatusBadRequest)
+		return
+	}
+	gn := c.Store()
+	f := Feed{Url: r.FormValue("f")}
+	if err := gn.Get(&f); err != nil {
+		serveError(w, err)
+		return
+	}
+	f.Policy = p
+	if _, err := gn.Put(&f); err != nil {
+		serveError(w, err)
+		return
+	}
+	feed, stories, err := fetchFeed(c, f.Url, f.Url)
+	if err == nil {
+		err = updateFeed(c, f.Url, feed, stories, true, false, false)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "policy set to %q, error updating %v: %v", p, f.Url, err)
+		return
+	}
+	fmt.Fprintf(w, "policy set to %q: %v", p, f.Url)
+}
+
+// AdminSetPassword creates or updates a local account from the username,
+// email and password parameters.
+func AdminSetPassword(c Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST username, email and password", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := auth.SetPassword(c.Store(), r.FormValue("username"), r.FormValue("email"), r.FormValue("password")); err != nil {
+		serveError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "password set: %v", r.FormValue("username"))
+}
+
+func AdminSubHub(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
 	f := Feed{Url: r.FormValue("f")}
 	if err := gn.Get(&f); err != nil {
 		serveError(w, err)
@@ -139,7 +191,7 @@ func AdminSubHub(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "subscribed")
 }
 
-func AdminDateFormats(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func AdminDateFormats(c Context, w http.ResponseWriter, r *http.Request) {
 	type df struct {
 		URL, Format string
 	}
@@ -147,7 +199,7 @@ func AdminDateFormats(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	for i := range keys {
 		keys[i] = fmt.Sprintf("_dateformat-%v", i)
 	}
-	items, _ := memcache.GetMulti(c, keys)
+	items, _ := c.Cache().GetMulti(keys)
 	dfs := make(map[string]df)
 	for k, v := range items {
 		sp := strings.Split(string(v.Value), "|")
@@ -158,9 +210,9 @@ func AdminDateFormats(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func AdminStats(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
-	uc, _ := datastore.NewQuery(gn.Kind(&User{})).Count(c)
+func AdminStats(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	uc, _ := gn.Count(backend.NewQuery(gn.Kind(&User{})))
 	templates.ExecuteTemplate(w, "admin-stats.html", struct {
 		Users int
 	}{
@@ -168,9 +220,9 @@ func AdminStats(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func AdminUser(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
-	q := datastore.NewQuery(gn.Kind(&User{})).Limit(1)
+func AdminUser(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&User{})).Limit(1)
 	q = q.Filter("e =", r.FormValue("u"))
 	it := gn.Run(q)
 	var u User
@@ -199,9 +251,13 @@ func AdminUser(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			serveError(w, err)
 			return
 		}
+		if err := updateSearches(gn, ud.Parent, &opml); err != nil {
+			serveError(w, err)
+			return
+		}
 		c.Infof("opml updated")
 	}
-	q = datastore.NewQuery(gn.Kind(&Log{})).Ancestor(k)
+	q = backend.NewQuery(gn.Kind(&Log{})).Ancestor(k)
 	_, err = gn.GetAll(q, &h)
 	if err := templates.ExecuteTemplate(w, "admin-user.html", struct {
 		User User
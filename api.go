@@ -0,0 +1,521 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// Helpers shared by the APIs for third-party clients.
+
+// Item ids are the integer ids of stories. Some clients page by them, so
+// they increase with the time the story was fetched: the high bits are its
+// creation time in seconds, the low bits a hash of its feed and id. A
+// story whose hash collides with another's in the same second takes the
+// next free id, which is saved in Story.ItemID. StoryRef records map them
+// back to stories.
+const itemIDHashBits = 20
+
+func itemID(s *Story) int64 {
+	if s.ItemID != 0 {
+		return s.ItemID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s.Parent.StringID()))
+	h.Write([]byte{0})
+	h.Write([]byte(s.Id))
+	return s.Created.Unix()<<itemIDHashBits | int64(h.Sum32()&(1<<itemIDHashBits-1))
+}
+
+// nextItemID returns the id after id in the same second, wrapping around.
+func nextItemID(id int64) int64 {
+	const mask = 1<<itemIDHashBits - 1
+	return id&^mask | (id+1)&mask
+}
+
+// itemTime returns the creation time, to the second, of the story with
+// item id id.
+func itemTime(id int64) time.Time {
+	return time.Unix(id>>itemIDHashBits, 0)
+}
+
+// putStoryRefs assigns item ids to stories that have none and saves them
+// so they can be looked up when clients send them back. Nothing is saved
+// for read-only tokens, whose stories keep the ids itemID computes.
+func putStoryRefs(c Context, stories []*Story) error {
+	if readOnly(c) {
+		return nil
+	}
+	gn := c.Store()
+	var todo []*Story
+	for _, s := range stories {
+		if s.ItemID == 0 {
+			todo = append(todo, s)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	errs := make([]error, len(todo))
+	var wg sync.WaitGroup
+	for i, s := range todo {
+		wg.Add(1)
+		go func(i int, s *Story) {
+			defer wg.Done()
+			errs[i] = claimItemID(gn, s)
+		}(i, s)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	_, err := gn.PutMulti(todo)
+	return err
+}
+
+// claimItemID sets s.ItemID to the first id from itemID(s) whose StoryRef
+// is free or already s's, probing past ids taken by other stories. Each
+// StoryRef is claimed in a transaction so concurrent requests can't give
+// one id to two stories.
+func claimItemID(gn *backend.Store, s *Story) error {
+	feed := s.Parent.StringID()
+	id := itemID(s)
+	for probe := 0; probe <= 1<<itemIDHashBits; probe++ {
+		var claimed bool
+		err := gn.RunInTransaction(func(gn *backend.Store) error {
+			claimed = false
+			ref := &StoryRef{Id: id}
+			if err := gn.Get(ref); err == nil {
+				claimed = ref.Feed == feed && ref.Story == s.Id
+				return nil
+			} else if err != backend.ErrNoSuchEntity {
+				return err
+			}
+			claimed = true
+			_, err := gn.Put(&StoryRef{Id: id, Feed: feed, Story: s.Id})
+			return err
+		})
+		if err != nil {
+			return err
+		} else if claimed {
+			s.ItemID = id
+			return nil
+		}
+		id = nextItemID(id)
+	}
+	return fmt.Errorf("no free item id for %v", s.Id)
+}
+
+// lookupItems returns the stories with item ids ids. Unknown ids are
+// skipped.
+func lookupItems(gn *backend.Store, ids []int64) ([]*Story, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	refs := make([]*StoryRef, len(ids))
+	for i, id := range ids {
+		refs[i] = &StoryRef{Id: id}
+	}
+	err := gn.GetMulti(refs)
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
+		return nil, err
+	}
+	var stories []*Story
+	for i, ref := range refs {
+		if !backend.NotFound(err, i) {
+			stories = append(stories, &Story{Id: ref.Story, Parent: gn.Key(&Feed{Url: ref.Feed})})
+		} else if s, err := unsavedItem(gn, ids[i]); err != nil {
+			return nil, err
+		} else if s != nil {
+			stories = append(stories, s)
+		}
+	}
+	err = gn.GetMulti(stories)
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
+		return nil, err
+	}
+	var found []*Story
+	for i, s := range stories {
+		if !backend.NotFound(err, i) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+// unsavedItem returns the story, with only its key set, whose item id id
+// was never saved, as happens when only read-only tokens have seen it. It
+// is found among the stories created in the second of id.
+func unsavedItem(gn *backend.Store, id int64) (*Story, error) {
+	t := itemTime(id)
+	q := backend.NewQuery(gn.Kind(&Story{})).
+		Filter(IDX_COL+" >=", t).
+		Filter(IDX_COL+" <", t.Add(time.Second)).
+		KeysOnly()
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		s := &Story{Id: k.StringID(), Parent: k.Parent(), Created: t}
+		if itemID(s) == id {
+			return &Story{Id: s.Id, Parent: s.Parent}, nil
+		}
+	}
+	return nil, nil
+}
+
+// readerState is the user's data needed by most API requests.
+type readerState struct {
+	u      *User
+	uk     *backend.Key
+	ud     *UserData
+	opml   Opml
+	feeds  []string          // subscribed feeds
+	labels map[string]string // feed url to folder
+	titles map[string]string // feed url to title
+}
+
+func loadReaderState(c Context) (*readerState, error) {
+	cu := c.User()
+	gn := c.Store()
+	st := &readerState{
+		u:      &User{Id: cu.ID},
+		labels: make(map[string]string),
+		titles: make(map[string]string),
+	}
+	st.uk = gn.Key(st.u)
+	st.ud = &UserData{Id: "data", Parent: st.uk}
+	if err := gn.GetMulti([]interface{}{st.u, st.ud}); err != nil && !backend.NotFound(err, 1) {
+		return nil, err
+	}
+	json.Unmarshal(st.ud.Opml, &st.opml)
+	add := func(label string, o *OpmlOutline) {
+		st.feeds = append(st.feeds, o.XmlUrl)
+		st.labels[o.XmlUrl] = label
+		st.titles[o.XmlUrl] = o.Title
+	}
+	for _, o := range st.opml.Outline {
+		if o.XmlUrl == "" {
+			for _, so := range o.Outline {
+				add(o.Title, so)
+			}
+		} else {
+			add("", o)
+		}
+	}
+	return st, nil
+}
+
+// isRead returns whether s is read given the user's read records.
+func (st *readerState) isRead(read Read, s *Story) bool {
+	return s.Created.Before(st.u.Read) || read[readStory{Feed: s.Parent.StringID(), Story: s.Id}]
+}
+
+// storyQuery selects the stories of feeds, in item id order.
+type storyQuery struct {
+	feeds     []string
+	limit     int
+	ascending bool
+	since     int64     // only ids greater than this
+	max       int64     // only ids less than this, if set
+	after     time.Time // only stories created at or after this
+	before    time.Time // only stories created before this, if set
+	keep      func(*Story) bool
+}
+
+// queryStories returns the first stories matched by q.
+func queryStories(c Context, q *storyQuery) ([]*Story, error) {
+	after := q.after
+	if t := itemTime(q.since); q.since > 0 && t.After(after) {
+		after = t
+	}
+	before := q.before
+	if t := itemTime(q.max).Add(time.Second); q.max > 0 && (before.IsZero() || t.Before(before)) {
+		before = t
+	}
+	match := func(s *Story) bool {
+		id := itemID(s)
+		return id > q.since && (q.max <= 0 || id < q.max) && (q.keep == nil || q.keep(s))
+	}
+	var lock sync.Mutex
+	var all []*Story
+	var qerr error
+	var wg sync.WaitGroup
+	for _, f := range q.feeds {
+		wg.Add(1)
+		go func(f string) {
+			defer wg.Done()
+			gn := c.Timeout(time.Minute).Store()
+			bq := backend.NewQuery(gn.Kind(&Story{})).Ancestor(gn.Key(&Feed{Url: f}))
+			if q.ascending {
+				bq = bq.Order(IDX_COL)
+			} else {
+				bq = bq.Order("-" + IDX_COL)
+			}
+			if !after.IsZero() {
+				bq = bq.Filter(IDX_COL+" >=", after)
+			}
+			if !before.IsZero() {
+				bq = bq.Filter(IDX_COL+" <", before)
+			}
+			var stories []*Story
+			it := gn.Run(bq)
+			for {
+				s := new(Story)
+				_, err := it.Next(s)
+				if err == backend.Done {
+					break
+				} else if err != nil {
+					lock.Lock()
+					qerr = err
+					lock.Unlock()
+					return
+				}
+				// Stories created in the same second are ordered by hash,
+				// so finish the second of the last one before stopping.
+				if n := len(stories); n > 0 && n >= q.limit && s.Created.Unix() != stories[n-1].Created.Unix() {
+					break
+				}
+				if match(s) {
+					stories = append(stories, s)
+				}
+			}
+			lock.Lock()
+			all = append(all, stories...)
+			lock.Unlock()
+		}(f)
+	}
+	wg.Wait()
+	if qerr != nil {
+		return nil, qerr
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return (itemID(all[i]) < itemID(all[j])) == q.ascending
+	})
+	if len(all) > q.limit {
+		all = all[:q.limit]
+	}
+	return all, nil
+}
+
+// storyInfo is what the APIs show about a story besides the story itself.
+type storyInfo struct {
+	content string
+	feed    *Feed
+	read    bool
+	starred bool
+}
+
+// storyInfos loads the content, feed, read and starred state of stories
+// and saves their item ids.
+func storyInfos(c Context, st *readerState, stories []*Story) ([]storyInfo, error) {
+	gn := c.Store()
+	if err := putStoryRefs(c, stories); err != nil {
+		return nil, err
+	}
+	feedm := make(map[string]*Feed)
+	var feeds []*Feed
+	var feedURLs []string
+	scs := make([]*StoryContent, len(stories))
+	stars := make([]*UserStar, len(stories))
+	for i, s := range stories {
+		f := s.Parent.StringID()
+		if feedm[f] == nil {
+			feedm[f] = &Feed{Url: f}
+			feeds = append(feeds, feedm[f])
+			feedURLs = append(feedURLs, f)
+		}
+		scs[i] = &StoryContent{Id: 1, Parent: gn.Key(s)}
+		stars[i] = &UserStar{Parent: backend.NewKey("USF", f, 0, st.uk), Id: s.Id}
+	}
+	var read Read
+	var rerr, serr error
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		gn.GetMulti(scs)
+		wg.Done()
+	}()
+	go func() {
+		serr = gn.GetMulti(stars)
+		wg.Done()
+	}()
+	go func() {
+		gn.GetMulti(feeds)
+		wg.Done()
+	}()
+	go func() {
+		read, rerr = getRead(gn, st.u.Id, feedURLs)
+		wg.Done()
+	}()
+	wg.Wait()
+	if rerr != nil {
+		return nil, rerr
+	}
+	if _, ok := serr.(backend.MultiError); serr != nil && !ok {
+		return nil, serr
+	}
+	infos := make([]storyInfo, len(stories))
+	for i, s := range stories {
+		infos[i] = storyInfo{
+			content: scs[i].content(),
+			feed:    feedm[s.Parent.StringID()],
+			read:    st.isRead(read, s),
+			starred: !backend.NotFound(serr, i),
+		}
+		if infos[i].content == "" {
+			infos[i].content = s.Summary
+		}
+	}
+	return infos, nil
+}
+
+// setRead marks stories, keyed by feed, read or unread and records the
+// change for sync.
+func setRead(c Context, uk *backend.Key, stories map[string][]string, read bool) error {
+	if len(stories) == 0 {
+		return nil
+	}
+	kind := changeRead
+	var err error
+	if read {
+		err = markRead(c, uk.StringID(), stories)
+	} else {
+		kind = changeUnread
+		err = unmarkRead(c, uk.StringID(), stories)
+	}
+	if err != nil {
+		return err
+	}
+	var changes []*UserChange
+	for f, ids := range stories {
+		changes = append(changes, newChange(uk, kind, f, ids...))
+	}
+	recordChanges(c, changes...)
+	return nil
+}
+
+// setStarred stars or unstars stories, keyed by feed, and records the
+// change for sync.
+func setStarred(c Context, uk *backend.Key, stories map[string][]string, starred bool) error {
+	if len(stories) == 0 {
+		return nil
+	}
+	gn := c.Store()
+	kind := changeStar
+	var stars []*UserStar
+	var keys []*backend.Key
+	for f, ids := range stories {
+		for _, id := range ids {
+			us := &UserStar{
+				Parent:  backend.NewKey("USF", f, 0, uk),
+				Id:      id,
+				Created: time.Now(),
+			}
+			stars = append(stars, us)
+			keys = append(keys, gn.Key(us))
+		}
+	}
+	var err error
+	if starred {
+		_, err = gn.PutMulti(stars)
+	} else {
+		kind = changeUnstar
+		err = gn.DeleteMulti(keys)
+	}
+	if err != nil {
+		return err
+	}
+	var changes []*UserChange
+	for f, ids := range stories {
+		changes = append(changes, newChange(uk, kind, f, ids...))
+	}
+	recordChanges(c, changes...)
+	return nil
+}
+
+// storiesByFeed returns the ids of stories keyed by feed.
+func storiesByFeed(stories []*Story) map[string][]string {
+	m := make(map[string][]string)
+	for _, s := range stories {
+		f := s.Parent.StringID()
+		m[f] = append(m[f], s.Id)
+	}
+	return m
+}
+
+// markAllRead moves the user's unread date up to until.
+func markAllRead(c Context, uk *backend.Key, until time.Time) error {
+	if until.After(time.Now()) {
+		until = time.Now()
+	}
+	return c.Store().RunInTransaction(func(gn *backend.Store) error {
+		u := &User{Id: uk.StringID()}
+		if err := gn.Get(u); err != nil {
+			return err
+		}
+		if !u.Read.Before(until) {
+			return nil
+		}
+		u.Read = until
+		_, err := gn.PutMulti([]interface{}{u, &Log{
+			Parent: uk,
+			Id:     time.Now().UnixNano(),
+			Text:   "mark all as read",
+		}})
+		return err
+	})
+}
+
+// markFeedsRead marks the unread stories of feeds created before until as
+// read.
+func markFeedsRead(c Context, st *readerState, feeds []string, until time.Time) error {
+	gn := c.Store()
+	read, err := getRead(gn, st.u.Id, feeds)
+	if err != nil {
+		return err
+	}
+	stories := make(map[string][]string)
+	for _, f := range feeds {
+		q := backend.NewQuery(gn.Kind(&Story{})).
+			Ancestor(gn.Key(&Feed{Url: f})).
+			Filter(IDX_COL+" >=", st.u.Read).
+			Filter(IDX_COL+" <", until).
+			KeysOnly().
+			Limit(numStoriesLimit)
+		keys, err := gn.GetAll(q, nil)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if !read[readStory{Feed: f, Story: k.StringID()}] {
+				stories[f] = append(stories[f], k.StringID())
+			}
+		}
+	}
+	return setRead(c, st.uk, stories, true)
+}
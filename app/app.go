@@ -6,10 +6,11 @@ import (
 	"github.com/mjibson/goread/_third_party/github.com/gorilla/mux"
 
 	app "github.com/mjibson/goread"
+	"github.com/mjibson/goread/backend/gae"
 )
 
 func init() {
 	router := mux.NewRouter()
-	app.RegisterHandlers(router)
+	app.RegisterHandlers(router, gae.New())
 	http.Handle("/", router)
 }
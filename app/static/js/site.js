@@ -15,6 +15,7 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 	$scope.loading = 0;
 	$scope.feeds = {};
 	$scope.stories = {};
+	$scope.searches = {};
 
 	$scope.opts = {
 		folderClose: {},
@@ -187,6 +188,14 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 				}
 				$scope.opts = data.Options ? JSON.parse(data.Options) : $scope.opts;
 				$scope.trialRemaining = data.TrialRemaining;
+				// saved searches map their virtual feed to the guids of their stories
+				$scope.searches = {};
+				_.each(data.Searches, function(ids, url) {
+					$scope.searches[url] = {};
+					_.each(ids, function(id) {
+						$scope.searches[url][id] = true;
+					});
+				});
 				_.each(data.Stories, function(stories, feed) {
 					$scope.numfeeds = 1;
 					_.each(stories, function(story) {
@@ -349,6 +358,14 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 				}
 			}
 		});
+		_.each($scope.searches, function(ids, url) {
+			_.each(ids, function(v, id) {
+				var s = $scope.stories[id];
+				if (s && !s.read) {
+					$scope.unread.feeds[url]++;
+				}
+			});
+		});
 		$scope.updateUnreadCurrent();
 	};
 
@@ -548,7 +565,8 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 					return;
 				}
 			} else if ($scope.activeFeed) {
-				if (s.feed.XmlUrl != $scope.activeFeed) {
+				var search = $scope.searches[$scope.activeFeed];
+				if (search ? !search[s.guid] : s.feed.XmlUrl != $scope.activeFeed) {
 					return;
 				}
 			} else if ($scope.activeStar) {
@@ -627,6 +645,42 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 		$scope.update();
 	};
 
+	$scope.setPolicy = function(feed, policy) {
+		var f = $scope.feeds[feed];
+		$scope.http('POST', $('#story-list').attr('data-url-policy'), {feed: feed, policy: policy})
+			.success(function() {
+				f.Policy = policy;
+				f.opml.Policy = policy;
+				_.each($scope.stories, function(s) {
+					if (s.feed.XmlUrl == feed) {
+						delete s.contents;
+					}
+				});
+			})
+			.error(function(data) {
+				alert(data);
+			});
+	};
+
+	$scope.toggleFullText = function(feed) {
+		var f = $scope.feeds[feed];
+		var on = !f.FullText;
+		$scope.http('POST', $('#story-list').attr('data-url-full-text'), {feed: feed, on: on ? 1 : ''})
+			.success(function() {
+				f.FullText = on;
+				f.opml.FullText = on;
+				// refetch contents in the new form
+				_.each($scope.stories, function(s) {
+					if (s.feed.XmlUrl == feed) {
+						delete s.contents;
+					}
+				});
+			})
+			.error(function(data) {
+				alert(data);
+			});
+	};
+
 	$scope.unsubscribe = function(feed) {
 		if (!confirm('Unsubscribe from ' + $scope.feeds[feed].Title + ' (' + feed + ')?')) return;
 		for (var i = 0; i < $scope.opml.length; i++) {
@@ -729,7 +783,31 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 	$scope.getFeed = function() {
 		var success = null;
 		var url = null;
-		if ($scope.activeFeed) {
+		if ($scope.activeFeed && $scope.searches[$scope.activeFeed]) {
+			var search = $scope.activeFeed;
+			if ($scope.fetching[search]) return;
+			$scope.fetching[search] = true;
+			url = sl.attr('data-url-get-search') + '?' + $.param({
+				id: search.substr('search:'.length),
+				c: $scope.cursors[search] || ''
+			});
+			success = function(data) {
+				if (!data.Stories) return;
+				delete $scope.fetching[search];
+				$scope.cursors[search] = data.Cursor;
+				_.each(data.Feeds, function(f) {
+					if (!$scope.feeds[f.Url]) {
+						$scope.feeds[f.Url] = f;
+					}
+				});
+				_.each(data.Stories, function(stories, f) {
+					_.each(stories, function(s) {
+						$scope.procStory(f, s, true);
+						$scope.searches[search][f + '|' + s.Id] = true;
+					});
+				});
+			};
+		} else if ($scope.activeFeed) {
 			var f = $scope.activeFeed;
 			if ($scope.fetching[f]) return;
 			$scope.fetching[f] = true;
@@ -899,6 +977,7 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 		if (!confirm('Remove all folders and subscriptions?')) return;
 		$scope.feeds = {};
 		$scope.stories = {};
+		$scope.searches = {};
 		$scope.opml = [];
 		$scope.setActive();
 		$scope.uploadOpml();
@@ -912,8 +991,13 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 
 	var checkoutLoaded = false;
 	$scope.getAccount = function() {
-		$scope.loadCheckout();
 		$scope.shown = 'account';
+		$scope.listTokens();
+		$scope.listRules();
+		$scope.listShares();
+		$scope.listSearches();
+		if (!$('#account').attr('data-stripe-key')) return;
+		$scope.loadCheckout();
 		if ($scope.account) return;
 		$http.post($('#account').attr('data-url-account'))
 			.success(function(data) {
@@ -921,6 +1005,141 @@ goReadAppModule.controller('GoreadCtrl', function($scope, $http, $timeout, $wind
 			});
 	};
 
+	$scope.newToken = {scope: 'full'};
+	$scope.listTokens = function() {
+		$http.post($('#account').attr('data-url-list-tokens'))
+			.success(function(data) {
+				$scope.tokens = data;
+			});
+	};
+
+	$scope.createToken = function() {
+		$scope.http('POST', $('#account').attr('data-url-create-token'), $scope.newToken)
+			.success(function(data) {
+				$scope.createdToken = data.Token;
+				$scope.newToken = {scope: 'full'};
+				$scope.listTokens();
+			})
+			.error(function(data) {
+				alert(data);
+			});
+	};
+
+	$scope.revokeToken = function(t) {
+		if (!confirm('Revoke token ' + t.Name + '?')) return;
+		$scope.http('POST', $('#account').attr('data-url-revoke-token'), {id: t.Id})
+			.success(function() {
+				$scope.listTokens();
+			});
+	};
+
+	$scope.tokenUsed = function(t) {
+		var m = moment(t.Used);
+		if (!m.isValid() || m.year() < 2000) return 'never';
+		return m.fromNow();
+	};
+
+	$scope.newShare = {};
+	$scope.listShares = function() {
+		$http.post($('#account').attr('data-url-list-shares'))
+			.success(function(data) {
+				$scope.shares = data;
+			});
+	};
+
+	$scope.createShare = function() {
+		$scope.http('POST', $('#account').attr('data-url-create-share'), $scope.newShare)
+			.success(function() {
+				$scope.newShare = {};
+				$scope.listShares();
+			})
+			.error(function(data) {
+				alert(data);
+			});
+	};
+
+	$scope.revokeShare = function(sh, regenerate) {
+		if (!regenerate && !confirm('Stop sharing this feed?')) return;
+		$scope.http('POST', $('#account').attr('data-url-revoke-share'), {id: sh.Id, regenerate: regenerate ? 1 : ''})
+			.success(function() {
+				$scope.listShares();
+			});
+	};
+
+	var emptyRule = function() {
+		return {scope: '', field: 'title', regexp: '', action: 'hide'};
+	};
+	$scope.newRule = emptyRule();
+	$scope.listRules = function() {
+		$http.post($('#account').attr('data-url-list-rules'))
+			.success(function(data) {
+				$scope.rules = data;
+			});
+	};
+
+	$scope.saveRule = function() {
+		var r = $scope.newRule;
+		var p = {field: r.field, regexp: r.regexp, pattern: r.pattern, action: r.action};
+		var i = r.scope.indexOf(':');
+		if (i > 0) {
+			p[r.scope.substr(0, i)] = r.scope.substr(i + 1);
+		}
+		$scope.http('POST', $('#account').attr('data-url-save-rule'), p)
+			.success(function() {
+				$scope.newRule = emptyRule();
+				$scope.listRules();
+			})
+			.error(function(data) {
+				alert(data);
+			});
+	};
+
+	$scope.deleteRule = function(r) {
+		if (!confirm('Delete rule ' + r.Pattern + '?')) return;
+		$scope.http('POST', $('#account').attr('data-url-delete-rule'), {id: r.Id})
+			.success(function() {
+				$scope.listRules();
+			});
+	};
+
+	$scope.ruleScope = function(r) {
+		if (r.Feed) {
+			var f = $scope.feeds[r.Feed];
+			return f ? f.Title : r.Feed;
+		}
+		if (r.Folder) return 'folder ' + r.Folder;
+		return 'all feeds';
+	};
+
+	$scope.newSearch = {folder: ''};
+	$scope.listSearches = function() {
+		$http.post($('#account').attr('data-url-list-searches'))
+			.success(function(data) {
+				$scope.savedSearches = data;
+			});
+	};
+
+	$scope.saveSearch = function() {
+		$scope.http('POST', $('#account').attr('data-url-save-search'), $scope.newSearch)
+			.success(function() {
+				$scope.newSearch = {folder: ''};
+				$scope.listSearches();
+				$scope.refresh();
+			})
+			.error(function(data) {
+				alert(data);
+			});
+	};
+
+	$scope.deleteSearch = function(ss) {
+		if (!confirm('Delete search ' + ss.Title + '?')) return;
+		$scope.http('POST', $('#account').attr('data-url-delete-search'), {id: ss.Id})
+			.success(function() {
+				$scope.listSearches();
+				$scope.refresh();
+			});
+	};
+
 	$scope.loadCheckout = function(cb) {
 		if (!checkoutLoaded) {
 			$.getScript("https://checkout.stripe.com/v2/checkout.js", function() {
@@ -20,42 +20,48 @@ type Feed struct {
 	Updated TimeStr  `xml:"updated"`
 	Author  *Person  `xml:"author"`
 	Entry   []*Entry `xml:"entry"`
-	XMLBase string   `xml:"base,attr"`
+	XMLBase string   `xml:"base,attr,omitempty"`
 }
 
 type Entry struct {
 	Title     *Text   `xml:"title"`
 	ID        string  `xml:"id"`
 	Link      []Link  `xml:"link"`
-	Published TimeStr `xml:"published"`
+	Published TimeStr `xml:"published,omitempty"`
 	Updated   TimeStr `xml:"updated"`
 	Author    *Person `xml:"author"`
 	Summary   *Text   `xml:"summary"`
 	Content   *Text   `xml:"content"`
-	XMLBase   string  `xml:"base,attr"`
+	XMLBase   string  `xml:"base,attr,omitempty"`
 }
 
 type Link struct {
-	Rel  string `xml:"rel,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
 	Href string `xml:"href,attr"`
-	Type string `xml:"type,attr"`
+	Type string `xml:"type,attr,omitempty"`
 }
 
 type Person struct {
 	Name     string `xml:"name"`
-	URI      string `xml:"uri"`
-	Email    string `xml:"email"`
+	URI      string `xml:"uri,omitempty"`
+	Email    string `xml:"email,omitempty"`
 	InnerXML string `xml:",innerxml"`
 }
 
 type Text struct {
-	Type     string `xml:"type,attr"`
+	Type     string `xml:"type,attr,omitempty"`
 	Body     string `xml:",chardata"`
 	InnerXML string `xml:",innerxml"`
 }
 
 type TimeStr string
 
+// Namespace is the Atom XML namespace. Feeds are marshaled in it with
+// xml.Encoder.EncodeElement and a start element named FeedName.
+const Namespace = "http://www.w3.org/2005/Atom"
+
+var FeedName = xml.Name{Space: Namespace, Local: "feed"}
+
 func Time(t time.Time) TimeStr {
 	return TimeStr(t.Format("2006-01-02T15:04:05-07:00"))
 }
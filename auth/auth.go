@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package auth signs users in with pluggable providers and keeps them
+// signed in with signed session cookies.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// ErrBadLogin is returned by Callback when the user could not be signed in.
+var ErrBadLogin = errors.New("auth: bad login")
+
+// A Provider signs users in.
+type Provider interface {
+	// Name identifies the provider in URLs and on the login page.
+	Name() string
+	// Login starts signing in. It eventually sends the user to callback.
+	Login(c backend.Context, w http.ResponseWriter, r *http.Request, callback string)
+	// Callback finishes signing in and returns the signed in user.
+	Callback(c backend.Context, w http.ResponseWriter, r *http.Request) (*backend.User, error)
+	// Logout signs the user out of the provider, if needed, and redirects
+	// to dest.
+	Logout(c backend.Context, w http.ResponseWriter, r *http.Request, dest string)
+}
+
+// Sessions keeps signed in users in cookies signed with Key.
+type Sessions struct {
+	Key    []byte
+	Cookie string        // cookie name
+	MaxAge time.Duration // how long sessions last
+}
+
+type session struct {
+	ID       string `json:"i"`
+	Email    string `json:"e"`
+	Admin    bool   `json:"a,omitempty"`
+	Provider string `json:"p"`
+	Expires  int64  `json:"x"`
+}
+
+func (s *Sessions) sign(b []byte) []byte {
+	h := hmac.New(sha256.New, s.Key)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// Get returns the user of r's session and the name of the provider that
+// signed them in, or nil if there is no valid session.
+func (s *Sessions) Get(r *http.Request) (*backend.User, string) {
+	ck, err := r.Cookie(s.Cookie)
+	if err != nil {
+		return nil, ""
+	}
+	i := strings.Index(ck.Value, ".")
+	if i < 0 {
+		return nil, ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(ck.Value[:i])
+	if err != nil {
+		return nil, ""
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(ck.Value[i+1:])
+	if err != nil || !hmac.Equal(sig, s.sign(b)) {
+		return nil, ""
+	}
+	var ss session
+	if err := json.Unmarshal(b, &ss); err != nil || time.Now().Unix() > ss.Expires {
+		return nil, ""
+	}
+	return &backend.User{ID: ss.ID, Email: ss.Email, Admin: ss.Admin}, ss.Provider
+}
+
+// Set starts a session for u, signed in by provider. The cookie is only
+// sent over HTTPS if r came over HTTPS.
+func (s *Sessions) Set(w http.ResponseWriter, r *http.Request, u *backend.User, provider string) {
+	expires := time.Now().Add(s.MaxAge)
+	b, _ := json.Marshal(&session{
+		ID:       u.ID,
+		Email:    u.Email,
+		Admin:    u.Admin,
+		Provider: provider,
+		Expires:  expires.Unix(),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: s.Cookie,
+		Value: base64.RawURLEncoding.EncodeToString(b) + "." +
+			base64.RawURLEncoding.EncodeToString(s.sign(b)),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Clear ends the session.
+func (s *Sessions) Clear(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.Cookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+	})
+}
+
+// isHTTPS reports whether r came over HTTPS, directly or through a proxy
+// that sets X-Forwarded-Proto.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
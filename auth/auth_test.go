@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package auth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+func TestHashPassword(t *testing.T) {
+	// known PBKDF2-HMAC-SHA256 outputs
+	for _, tt := range []struct {
+		password, salt string
+		rounds         int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	} {
+		got := hex.EncodeToString(hashPassword(tt.password, []byte(tt.salt), tt.rounds))
+		if got != tt.want {
+			t.Errorf("hashPassword(%q, %q, %d) = %v, want %v", tt.password, tt.salt, tt.rounds, got, tt.want)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := &Sessions{Key: []byte("key"), Cookie: "s", MaxAge: time.Hour}
+	w := httptest.NewRecorder()
+	s.Set(w, httptest.NewRequest("GET", "/", nil), &backend.User{ID: "1", Email: "a@b.c", Admin: true}, "google")
+	ck := w.Result().Cookies()[0]
+	if ck.Secure {
+		t.Error("secure cookie over http")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(ck)
+	u, p := s.Get(r)
+	if u == nil || u.ID != "1" || u.Email != "a@b.c" || !u.Admin || p != "google" {
+		t.Fatalf("got %v %v", u, p)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "s", Value: "x" + ck.Value})
+	if u, _ := s.Get(r); u != nil {
+		t.Errorf("tampered session accepted: %v", u)
+	}
+
+	other := &Sessions{Key: []byte("other"), Cookie: "s", MaxAge: time.Hour}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(ck)
+	if u, _ := other.Get(r); u != nil {
+		t.Errorf("session accepted with wrong key: %v", u)
+	}
+
+	expired := &Sessions{Key: []byte("key"), Cookie: "s", MaxAge: -time.Hour}
+	w = httptest.NewRecorder()
+	expired.Set(w, httptest.NewRequest("GET", "/", nil), &backend.User{ID: "1"}, "google")
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	if u, _ := s.Get(r); u != nil {
+		t.Errorf("expired session accepted: %v", u)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	s.Set(w, r, &backend.User{ID: "1"}, "google")
+	if !w.Result().Cookies()[0].Secure {
+		t.Error("insecure cookie over https")
+	}
+}
+
+func TestEmailVerified(t *testing.T) {
+	tests := map[string]bool{
+		`{"email_verified": true}`:    true,
+		`{"email_verified": "true"}`:  true,
+		`{"email_verified": false}`:   false,
+		`{"email_verified": "false"}`: false,
+		`{}`:                          false,
+	}
+	for s, expected := range tests {
+		var c idClaims
+		if err := json.Unmarshal([]byte(s), &c); err != nil {
+			t.Fatal(err)
+		}
+		if v := c.emailVerified(); v != expected {
+			t.Errorf("%v: got %v, expected %v", s, v, expected)
+		}
+	}
+}
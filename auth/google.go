@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package auth
+
+import (
+	"net/http"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// Google signs users in with the backend's users: Google accounts on App
+// Engine, or the users of the proxy in front of the standalone server.
+// User IDs are the backend's, so users from before providers keep their
+// data.
+type Google struct{}
+
+func (Google) Name() string { return "google" }
+
+func (Google) Login(c backend.Context, w http.ResponseWriter, r *http.Request, callback string) {
+	if c.User() != nil {
+		http.Redirect(w, r, callback, http.StatusFound)
+		return
+	}
+	u, err := c.LoginURL(callback)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+func (Google) Callback(c backend.Context, w http.ResponseWriter, r *http.Request) (*backend.User, error) {
+	u := c.User()
+	if u == nil {
+		return nil, ErrBadLogin
+	}
+	return u, nil
+}
+
+func (Google) Logout(c backend.Context, w http.ResponseWriter, r *http.Request, dest string) {
+	c.Logout(w, r, dest)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// Local signs users in with usernames and passwords kept in the datastore.
+// User IDs are "local:" followed by the username. SetPassword creates
+// accounts.
+type Local struct{}
+
+// LocalLogin is a local account.
+type LocalLogin struct {
+	_kind    string `goon:"kind,LL"`
+	Username string `datastore:"-" goon:"id"`
+	Email    string `datastore:"e,noindex"`
+	Salt     []byte `datastore:"s,noindex"`
+	Hash     []byte `datastore:"h,noindex"`
+	Rounds   int    `datastore:"r,noindex"`
+}
+
+const passwordRounds = 100000
+
+// hashPassword is PBKDF2 with HMAC-SHA256 and a single block of output.
+func hashPassword(password string, salt []byte, rounds int) []byte {
+	prf := hmac.New(sha256.New, []byte(password))
+	prf.Write(salt)
+	binary.Write(prf, binary.BigEndian, uint32(1))
+	u := prf.Sum(nil)
+	t := append([]byte(nil), u...)
+	for i := 1; i < rounds; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range t {
+			t[j] ^= u[j]
+		}
+	}
+	return t
+}
+
+// SetPassword creates or updates the local account username.
+func SetPassword(gn *backend.Store, username, email, password string) error {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if username == "" || password == "" {
+		return errors.New("auth: username and password required")
+	}
+	l := &LocalLogin{
+		Username: username,
+		Email:    email,
+		Salt:     make([]byte, 16),
+		Rounds:   passwordRounds,
+	}
+	if _, err := rand.Read(l.Salt); err != nil {
+		return err
+	}
+	l.Hash = hashPassword(password, l.Salt, l.Rounds)
+	_, err := gn.Put(l)
+	return err
+}
+
+var localTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>go read</title>
+	<link rel="stylesheet" href="/static/css/bootstrap.min.css">
+</head>
+<body>
+	<div class="container">
+		<div class="col-md-offset-4 col-md-4">
+			<h1>Log in</h1>
+			<form method="POST" action="{{.}}">
+				<div class="form-group">
+					<input type="text" class="form-control" name="username" placeholder="username" autofocus>
+				</div>
+				<div class="form-group">
+					<input type="password" class="form-control" name="password" placeholder="password">
+				</div>
+				<button type="submit" class="btn btn-primary">Log in</button>
+			</form>
+		</div>
+	</div>
+</body>
+</html>
+`))
+
+func (Local) Name() string { return "local" }
+
+func (Local) Login(c backend.Context, w http.ResponseWriter, r *http.Request, callback string) {
+	if err := localTemplate.Execute(w, callback); err != nil {
+		c.Errorf("%v", err)
+	}
+}
+
+func (Local) Callback(c backend.Context, w http.ResponseWriter, r *http.Request) (*backend.User, error) {
+	if r.Method != "POST" {
+		return nil, ErrBadLogin
+	}
+	l := &LocalLogin{Username: strings.ToLower(strings.TrimSpace(r.FormValue("username")))}
+	if l.Username == "" {
+		return nil, ErrBadLogin
+	}
+	if err := c.Store().Get(l); err == backend.ErrNoSuchEntity {
+		return nil, ErrBadLogin
+	} else if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(hashPassword(r.FormValue("password"), l.Salt, l.Rounds), l.Hash) {
+		return nil, ErrBadLogin
+	}
+	return &backend.User{
+		ID:    "local:" + l.Username,
+		Email: l.Email,
+	}, nil
+}
+
+func (Local) Logout(c backend.Context, w http.ResponseWriter, r *http.Request, dest string) {
+	http.Redirect(w, r, dest, http.StatusFound)
+}
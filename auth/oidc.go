@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// OIDC signs users in with an OpenID Connect provider's authorization code
+// flow. User IDs are the provider's name and subject joined by a colon.
+type OIDC struct {
+	ProviderName string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested besides openid. The default is email.
+	Scopes []string
+
+	mu  sync.Mutex
+	cfg *oidcConfig
+}
+
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+func (o *OIDC) Name() string { return o.ProviderName }
+
+// client fetches from the provider, which the administrator configured,
+// so it may be on a private address.
+func (o *OIDC) client(c backend.Context) *http.Client {
+	return &http.Client{Transport: c.AdminTransport(0)}
+}
+
+// config returns the provider's discovery document.
+func (o *OIDC) config(c backend.Context) (*oidcConfig, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cfg != nil {
+		return o.cfg, nil
+	}
+	resp, err := o.client(c).Get(strings.TrimSuffix(o.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: oidc discovery: %v", resp.Status)
+	}
+	var cfg oidcConfig
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Issuer != o.Issuer || cfg.AuthorizationEndpoint == "" || cfg.TokenEndpoint == "" {
+		return nil, fmt.Errorf("auth: bad oidc configuration for %v", o.Issuer)
+	}
+	o.cfg = &cfg
+	return o.cfg, nil
+}
+
+func (o *OIDC) cookie() string {
+	return "goread-oidc-" + o.ProviderName
+}
+
+// absURL returns path as an absolute URL on r's host.
+func absURL(r *http.Request, path string) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (o *OIDC) Login(c backend.Context, w http.ResponseWriter, r *http.Request, callback string) {
+	cfg, err := o.config(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state, nonce := randomString(), randomString()
+	http.SetCookie(w, &http.Cookie{
+		Name:     o.cookie(),
+		Value:    state + "." + nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(callback)),
+		Path:     "/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	scopes := o.Scopes
+	if scopes == nil {
+		scopes = []string{"email"}
+	}
+	v := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.ClientID},
+		"redirect_uri":  {absURL(r, callback)},
+		"scope":         {strings.Join(append([]string{"openid"}, scopes...), " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(cfg.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, cfg.AuthorizationEndpoint+sep+v.Encode(), http.StatusFound)
+}
+
+// idClaims are the claims of an ID token goread uses.
+type idClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expires  int64    `json:"exp"`
+	Nonce    string   `json:"nonce"`
+	Email    string   `json:"email"`
+	// EmailVerified is a boolean, or a string from some providers.
+	EmailVerified interface{} `json:"email_verified"`
+}
+
+// emailVerified reports whether the provider verified the email claim.
+func (c *idClaims) emailVerified() bool {
+	return c.EmailVerified == true || c.EmailVerified == "true"
+}
+
+// audience is a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Callback exchanges the code for an ID token. The token comes straight
+// from the provider's token endpoint over TLS, so its signature is not
+// checked, as OpenID Connect Core section 3.1.3.7 allows.
+func (o *OIDC) Callback(c backend.Context, w http.ResponseWriter, r *http.Request) (*backend.User, error) {
+	ck, err := r.Cookie(o.cookie())
+	if err != nil {
+		return nil, ErrBadLogin
+	}
+	http.SetCookie(w, &http.Cookie{Name: o.cookie(), Path: "/", MaxAge: -1})
+	parts := strings.SplitN(ck.Value, ".", 3)
+	if len(parts) != 3 || r.FormValue("state") != parts[0] {
+		return nil, ErrBadLogin
+	}
+	nonce := parts[1]
+	callback, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrBadLogin
+	}
+	if e := r.FormValue("error"); e != "" {
+		return nil, fmt.Errorf("auth: %v: %v", o.ProviderName, e)
+	}
+	cfg, err := o.config(c)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", cfg.TokenEndpoint, strings.NewReader(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {r.FormValue("code")},
+		"redirect_uri": {absURL(r, string(callback))},
+	}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	resp, err := o.client(c).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: %v token: %v", o.ProviderName, resp.Status)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	jwt := strings.Split(tok.IDToken, ".")
+	if len(jwt) != 3 {
+		return nil, fmt.Errorf("auth: %v: bad id token", o.ProviderName)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwt[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims idClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	switch {
+	case claims.Issuer != cfg.Issuer,
+		!claims.Audience.contains(o.ClientID),
+		time.Now().Unix() > claims.Expires,
+		claims.Nonce != nonce,
+		claims.Subject == "":
+		return nil, ErrBadLogin
+	}
+	u := &backend.User{ID: o.ProviderName + ":" + claims.Subject}
+	// Anyone can claim an address the provider didn't verify, so only
+	// verified ones are used, as ADMIN_EMAILS trusts them.
+	if claims.emailVerified() {
+		u.Email = claims.Email
+	}
+	return u, nil
+}
+
+func (o *OIDC) Logout(c backend.Context, w http.ResponseWriter, r *http.Request, dest string) {
+	if cfg, err := o.config(c); err == nil && cfg.EndSessionEndpoint != "" {
+		v := url.Values{
+			"client_id":                {o.ClientID},
+			"post_logout_redirect_uri": {absURL(r, dest)},
+		}
+		http.Redirect(w, r, cfg.EndSessionEndpoint+"?"+v.Encode(), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, dest, http.StatusFound)
+}
@@ -50,7 +50,7 @@ func Autodiscover(b []byte) (string, error) {
 					attrs[a.Key] = a.Val
 				}
 				if attrs["rel"] == "alternate" && attrs["href"] != "" &&
-					(attrs["type"] == "application/rss+xml" || attrs["type"] == "application/atom+xml") {
+					(attrs["type"] == "application/rss+xml" || attrs["type"] == "application/atom+xml" || attrs["type"] == "application/feed+json") {
 					return attrs["href"], nil
 				}
 			}
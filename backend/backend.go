@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package backend abstracts the services goread uses from its host: the
+// datastore, task queues, blob storage, memcache, full-text search,
+// outgoing HTTP and user sign in. Package gae implements it on App
+// Engine, package local on a single machine with an embedded database.
+package backend
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// A Backend creates a Context for each request.
+type Backend interface {
+	NewContext(r *http.Request) Context
+
+	// IsDev reports whether this is a development server.
+	IsDev() bool
+}
+
+// Context is the per-request handle on a backend.
+type Context interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Criticalf(format string, args ...interface{})
+
+	Store() *Store
+	Queue() Queue
+	Blobs() BlobStore
+	Cache() Cache
+	// Index returns the search index called name.
+	Index(name string) Index
+
+	// Transport returns a RoundTripper for outgoing requests. A zero
+	// deadline uses the backend's default. Feeds and stories choose the
+	// URLs it fetches, so it only connects to addresses PublicIP allows,
+	// unless the backend is configured otherwise.
+	Transport(deadline time.Duration) http.RoundTripper
+	// AdminTransport is Transport for URLs set by the administrator,
+	// such as sign in providers, which may be on private addresses.
+	AdminTransport(deadline time.Duration) http.RoundTripper
+
+	// User returns the signed in user, or nil if there is none.
+	User() *User
+	// LoginURL returns a URL that signs the user in and then redirects
+	// to dest.
+	LoginURL(dest string) (string, error)
+	// Logout signs the current user out and redirects to dest.
+	Logout(w http.ResponseWriter, r *http.Request, dest string)
+
+	// Timeout returns a Context whose calls have a deadline of d.
+	Timeout(d time.Duration) Context
+}
+
+type User struct {
+	ID    string
+	Email string
+	Admin bool
+}
+
+func (u *User) String() string {
+	return u.Email
+}
+
+// nonPublic are the networks of addresses on the host, its local networks
+// and reserved ranges.
+var nonPublic []*net.IPNet
+
+func init() {
+	for _, s := range []string{
+		"0.0.0.0/8",      // this network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"224.0.0.0/3",    // multicast and reserved
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"64:ff9b::/96",   // IPv4 translation
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nonPublic = append(nonPublic, n)
+	}
+}
+
+// PublicIP reports whether ip is a public unicast address, not one on the
+// host or its local networks.
+func PublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range nonPublic {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
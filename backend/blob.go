@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package backend
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type BlobKey string
+
+type BlobInfo struct {
+	BlobKey      BlobKey
+	ContentType  string
+	CreationTime time.Time
+	Filename     string
+	Size         int64
+}
+
+// BlobStore holds uploaded files.
+type BlobStore interface {
+	// UploadURL returns the URL a form should upload files to. The
+	// request is then passed on to successPath.
+	UploadURL(successPath string) (string, error)
+	// ParseUpload returns the files uploaded in r by field name, and its
+	// other form values.
+	ParseUpload(r *http.Request) (map[string][]*BlobInfo, url.Values, error)
+	NewReader(key BlobKey) (io.Reader, error)
+	Delete(key BlobKey) error
+	DeleteMulti(keys []BlobKey) error
+}
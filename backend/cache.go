@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package backend
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrCacheMiss is returned when an item is not in the cache.
+	ErrCacheMiss = errors.New("backend: cache miss")
+	// ErrNotStored is returned by Add when the item already exists.
+	ErrNotStored = errors.New("backend: item not stored")
+)
+
+type Item struct {
+	Key   string
+	Value []byte
+	// Expiration is how long the item is kept. Zero means no expiration.
+	Expiration time.Duration
+}
+
+// Cache is a memcache. Items may be evicted at any time.
+type Cache interface {
+	Get(key string) (*Item, error)
+	// GetMulti returns the items found for keys.
+	GetMulti(keys []string) (map[string]*Item, error)
+	Set(item *Item) error
+	// Add sets item only if it does not already exist.
+	Add(item *Item) error
+	Delete(key string) error
+	// Increment atomically adds delta to the decimal value at key,
+	// starting from initialValue if it does not exist.
+	Increment(key string, delta int64, initialValue uint64) (uint64, error)
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoSuchEntity is returned when no entity was found for a key.
+	ErrNoSuchEntity = errors.New("backend: no such entity")
+	// ErrInvalidKey is returned when an operation is given an incomplete
+	// or malformed key.
+	ErrInvalidKey = errors.New("backend: invalid key")
+	// ErrConcurrentTransaction is returned when a transaction conflicts
+	// with another one.
+	ErrConcurrentTransaction = errors.New("backend: concurrent transaction")
+	// Done is returned by Iterator.Next when there are no more results.
+	Done = errors.New("backend: query has no more results")
+)
+
+// MultiError is returned by batch operations. Each element corresponds to
+// the item at the same index and is nil if that item succeeded.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	s, n := "", 0
+	for _, e := range m {
+		if e != nil {
+			if n == 0 {
+				s = e.Error()
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "(0 errors)"
+	case 1:
+		return s
+	case 2:
+		return s + " (and 1 other error)"
+	}
+	return fmt.Sprintf("%s (and %d other errors)", s, n-1)
+}
+
+// NotFound returns true if err is a MultiError and err[idx] is
+// ErrNoSuchEntity.
+func NotFound(err error, idx int) bool {
+	if merr, ok := err.(MultiError); ok {
+		return idx < len(merr) && merr[idx] == ErrNoSuchEntity
+	}
+	return false
+}
+
+// Key identifies an entity by kind and either a string or an integer ID,
+// under an optional parent.
+type Key struct {
+	kind     string
+	stringID string
+	intID    int64
+	parent   *Key
+}
+
+// NewKey returns a key. If stringID and intID are both zero the key is
+// incomplete, and an ID is allocated when it is put.
+func NewKey(kind, stringID string, intID int64, parent *Key) *Key {
+	return &Key{
+		kind:     kind,
+		stringID: stringID,
+		intID:    intID,
+		parent:   parent,
+	}
+}
+
+func (k *Key) Kind() string     { return k.kind }
+func (k *Key) StringID() string { return k.stringID }
+func (k *Key) IntID() int64     { return k.intID }
+func (k *Key) Parent() *Key     { return k.parent }
+
+// Incomplete returns whether the key has no ID.
+func (k *Key) Incomplete() bool {
+	return k.stringID == "" && k.intID == 0
+}
+
+// Equal returns whether k and o refer to the same entity.
+func (k *Key) Equal(o *Key) bool {
+	for k != nil && o != nil {
+		if k.kind != o.kind || k.stringID != o.stringID || k.intID != o.intID {
+			return false
+		}
+		k, o = k.parent, o.parent
+	}
+	return k == o
+}
+
+// String returns the key path, like "/F,http://example.com/feed/S,1".
+func (k *Key) String() string {
+	if k == nil {
+		return ""
+	}
+	id := k.stringID
+	if id == "" {
+		id = strconv.FormatInt(k.intID, 10)
+	}
+	return k.parent.String() + "/" + k.kind + "," + id
+}
+
+// A Filter restricts query results to entities whose property compares
+// to Value with Op, one of =, <, <=, > or >=.
+type Filter struct {
+	Property string
+	Op       string
+	Value    interface{}
+}
+
+// An Order sorts query results by a property.
+type Order struct {
+	Property   string
+	Descending bool
+}
+
+// Query is a datastore query. Its methods return a modified copy, like
+// those of appengine/datastore.Query.
+type Query struct {
+	plan Plan
+	err  error
+}
+
+// Plan is a query as seen by a Datastore implementation.
+type Plan struct {
+	// Kind is empty for a kindless query, which must have an Ancestor.
+	Kind     string
+	Ancestor *Key
+	Filters  []Filter
+	Orders   []Order
+	// Limit is negative if there is none.
+	Limit    int
+	Offset   int
+	KeysOnly bool
+	Start    Cursor
+}
+
+func NewQuery(kind string) *Query {
+	return &Query{plan: Plan{Kind: kind, Limit: -1}}
+}
+
+func (q *Query) clone() *Query {
+	c := *q
+	c.plan.Filters = append([]Filter(nil), q.plan.Filters...)
+	c.plan.Orders = append([]Order(nil), q.plan.Orders...)
+	return &c
+}
+
+func (q *Query) Ancestor(k *Key) *Query {
+	q = q.clone()
+	if k == nil {
+		q.err = ErrInvalidKey
+	}
+	q.plan.Ancestor = k
+	return q
+}
+
+// Filter adds a filter like Filter("n <=", time.Now()).
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	filterStr = strings.TrimSpace(filterStr)
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasSuffix(filterStr, op) {
+			prop := strings.TrimSpace(strings.TrimSuffix(filterStr, op))
+			if prop == "" {
+				break
+			}
+			q.plan.Filters = append(q.plan.Filters, Filter{
+				Property: prop,
+				Op:       op,
+				Value:    value,
+			})
+			return q
+		}
+	}
+	q.err = fmt.Errorf("backend: invalid filter: %q", filterStr)
+	return q
+}
+
+// Order adds a sort order, descending if fieldName is prefixed with "-".
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+	fieldName = strings.TrimSpace(fieldName)
+	o := Order{Property: fieldName}
+	if strings.HasPrefix(fieldName, "-") {
+		o = Order{Property: strings.TrimSpace(fieldName[1:]), Descending: true}
+	}
+	if o.Property == "" {
+		q.err = fmt.Errorf("backend: invalid order: %q", fieldName)
+	}
+	q.plan.Orders = append(q.plan.Orders, o)
+	return q
+}
+
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.plan.Limit = limit
+	return q
+}
+
+func (q *Query) Offset(offset int) *Query {
+	q = q.clone()
+	q.plan.Offset = offset
+	return q
+}
+
+func (q *Query) KeysOnly() *Query {
+	q = q.clone()
+	q.plan.KeysOnly = true
+	return q
+}
+
+func (q *Query) Start(c Cursor) *Query {
+	q = q.clone()
+	q.plan.Start = c
+	return q
+}
+
+// Plan returns the query's plan, or the first error made building it.
+func (q *Query) Plan() (*Plan, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	if q.plan.Kind == "" && q.plan.Ancestor == nil {
+		return nil, errors.New("backend: kindless query without an ancestor")
+	}
+	p := q.clone().plan
+	return &p, nil
+}
+
+// Cursor is a position in a query's results.
+type Cursor struct {
+	s string
+}
+
+func (c Cursor) String() string {
+	return c.s
+}
+
+// DecodeCursor decodes a cursor from its String form.
+func DecodeCursor(s string) (Cursor, error) {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_':
+		default:
+			return Cursor{}, errors.New("backend: invalid cursor")
+		}
+	}
+	return Cursor{s}, nil
+}
+
+// Iterator is the result of running a query.
+type Iterator interface {
+	// Next returns the key of the next result and, unless the query is
+	// keys only, loads it into dst. It returns Done when there are no
+	// more results.
+	Next(dst interface{}) (*Key, error)
+	// Cursor returns a cursor for the position after the last result.
+	Cursor() (Cursor, error)
+}
+
+// Datastore is implemented by storage backends. Entities are pointers to
+// structs whose properties are named by their datastore tags.
+type Datastore interface {
+	// GetMulti loads the entities for keys into dst, returning a
+	// MultiError with ErrNoSuchEntity for those missing.
+	GetMulti(keys []*Key, dst []interface{}) error
+	// PutMulti saves src under keys and returns the complete keys.
+	PutMulti(keys []*Key, src []interface{}) ([]*Key, error)
+	DeleteMulti(keys []*Key) error
+	Run(p *Plan) Iterator
+	Count(p *Plan) (int, error)
+	// RunInTransaction calls f with a Datastore whose operations are
+	// applied atomically if f returns nil.
+	RunInTransaction(f func(Datastore) error) error
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package gae
+
+import (
+	"github.com/mjibson/goread/backend"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Batch limits of the datastore API.
+const (
+	getMultiLimit    = 1000
+	putMultiLimit    = 500
+	deleteMultiLimit = 500
+)
+
+type datastoreImpl struct {
+	c appengine.Context
+}
+
+func toKey(c appengine.Context, k *backend.Key) *datastore.Key {
+	if k == nil {
+		return nil
+	}
+	return datastore.NewKey(c, k.Kind(), k.StringID(), k.IntID(), toKey(c, k.Parent()))
+}
+
+func fromKey(k *datastore.Key) *backend.Key {
+	if k == nil {
+		return nil
+	}
+	return backend.NewKey(k.Kind(), k.StringID(), k.IntID(), fromKey(k.Parent()))
+}
+
+func toKeys(c appengine.Context, keys []*backend.Key) []*datastore.Key {
+	dks := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		dks[i] = toKey(c, k)
+	}
+	return dks
+}
+
+// dsErr converts datastore errors to their backend equivalents. Fields
+// that are no longer in a struct are not errors.
+func dsErr(err error) error {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case appengine.MultiError:
+		merr := make(backend.MultiError, len(err))
+		any := false
+		for i, e := range err {
+			if merr[i] = dsErr(e); merr[i] != nil {
+				any = true
+			}
+		}
+		if !any {
+			return nil
+		}
+		return merr
+	case *datastore.ErrFieldMismatch:
+		return nil
+	}
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return backend.ErrNoSuchEntity
+	case datastore.ErrInvalidKey:
+		return backend.ErrInvalidKey
+	case datastore.ErrConcurrentTransaction:
+		return backend.ErrConcurrentTransaction
+	case datastore.Done:
+		return backend.Done
+	}
+	return err
+}
+
+func (d datastoreImpl) GetMulti(keys []*backend.Key, dst []interface{}) error {
+	dks := toKeys(d.c, keys)
+	merr := make(backend.MultiError, len(keys))
+	any := false
+	for lo := 0; lo < len(dks); lo += getMultiLimit {
+		hi := lo + getMultiLimit
+		if hi > len(dks) {
+			hi = len(dks)
+		}
+		err := dsErr(datastore.GetMulti(d.c, dks[lo:hi], dst[lo:hi]))
+		if me, ok := err.(backend.MultiError); ok {
+			copy(merr[lo:hi], me)
+			any = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if any {
+		return merr
+	}
+	return nil
+}
+
+func (d datastoreImpl) PutMulti(keys []*backend.Key, src []interface{}) ([]*backend.Key, error) {
+	dks := toKeys(d.c, keys)
+	ret := make([]*backend.Key, 0, len(keys))
+	for lo := 0; lo < len(dks); lo += putMultiLimit {
+		hi := lo + putMultiLimit
+		if hi > len(dks) {
+			hi = len(dks)
+		}
+		pks, err := datastore.PutMulti(d.c, dks[lo:hi], src[lo:hi])
+		if err != nil {
+			return nil, dsErr(err)
+		}
+		for _, k := range pks {
+			ret = append(ret, fromKey(k))
+		}
+	}
+	return ret, nil
+}
+
+func (d datastoreImpl) DeleteMulti(keys []*backend.Key) error {
+	dks := toKeys(d.c, keys)
+	for lo := 0; lo < len(dks); lo += deleteMultiLimit {
+		hi := lo + deleteMultiLimit
+		if hi > len(dks) {
+			hi = len(dks)
+		}
+		if err := datastore.DeleteMulti(d.c, dks[lo:hi]); err != nil {
+			return dsErr(err)
+		}
+	}
+	return nil
+}
+
+func (d datastoreImpl) query(p *backend.Plan) *datastore.Query {
+	q := datastore.NewQuery(p.Kind)
+	if p.Ancestor != nil {
+		q = q.Ancestor(toKey(d.c, p.Ancestor))
+	}
+	for _, f := range p.Filters {
+		v := f.Value
+		if k, ok := v.(*backend.Key); ok {
+			v = toKey(d.c, k)
+		}
+		q = q.Filter(f.Property+" "+f.Op, v)
+	}
+	for _, o := range p.Orders {
+		if o.Descending {
+			q = q.Order("-" + o.Property)
+		} else {
+			q = q.Order(o.Property)
+		}
+	}
+	if p.Limit >= 0 {
+		q = q.Limit(p.Limit)
+	}
+	if p.Offset > 0 {
+		q = q.Offset(p.Offset)
+	}
+	if p.KeysOnly {
+		q = q.KeysOnly()
+	}
+	if s := p.Start.String(); s != "" {
+		if c, err := datastore.DecodeCursor(s); err == nil {
+			q = q.Start(c)
+		}
+	}
+	return q
+}
+
+func (d datastoreImpl) Run(p *backend.Plan) backend.Iterator {
+	return iterator{d.query(p).Run(d.c)}
+}
+
+func (d datastoreImpl) Count(p *backend.Plan) (int, error) {
+	n, err := d.query(p).Count(d.c)
+	return n, dsErr(err)
+}
+
+func (d datastoreImpl) RunInTransaction(f func(backend.Datastore) error) error {
+	return dsErr(datastore.RunInTransaction(d.c, func(tc appengine.Context) error {
+		return f(datastoreImpl{tc})
+	}, nil))
+}
+
+type iterator struct {
+	it *datastore.Iterator
+}
+
+func (it iterator) Next(dst interface{}) (*backend.Key, error) {
+	k, err := it.it.Next(dst)
+	if err = dsErr(err); err != nil {
+		return nil, err
+	}
+	return fromKey(k), nil
+}
+
+func (it iterator) Cursor() (backend.Cursor, error) {
+	c, err := it.it.Cursor()
+	if err != nil {
+		return backend.Cursor{}, dsErr(err)
+	}
+	return backend.DecodeCursor(c.String())
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package gae implements backend on App Engine.
+package gae
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/memcache"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+	"appengine/user"
+)
+
+type Backend struct{}
+
+func New() Backend {
+	return Backend{}
+}
+
+func (Backend) NewContext(r *http.Request) backend.Context {
+	return Context{appengine.NewContext(r)}
+}
+
+func (Backend) IsDev() bool {
+	return appengine.IsDevAppServer()
+}
+
+// Context wraps an appengine.Context.
+type Context struct {
+	appengine.Context
+}
+
+func (c Context) Store() *backend.Store {
+	return backend.NewStore(datastoreImpl{c.Context})
+}
+
+func (c Context) Queue() backend.Queue {
+	return queue{c.Context}
+}
+
+func (c Context) Blobs() backend.BlobStore {
+	return blobs{c.Context}
+}
+
+func (c Context) Cache() backend.Cache {
+	return cache{c.Context}
+}
+
+func (c Context) Transport(deadline time.Duration) http.RoundTripper {
+	return &urlfetch.Transport{
+		Context:  c.Context,
+		Deadline: deadline,
+	}
+}
+
+// AdminTransport is Transport: urlfetch only reaches public addresses.
+func (c Context) AdminTransport(deadline time.Duration) http.RoundTripper {
+	return c.Transport(deadline)
+}
+
+func (c Context) User() *backend.User {
+	cu := user.Current(c.Context)
+	if cu == nil {
+		return nil
+	}
+	return &backend.User{
+		ID:    cu.ID,
+		Email: cu.Email,
+		Admin: cu.Admin,
+	}
+}
+
+func (c Context) LoginURL(dest string) (string, error) {
+	return user.LoginURL(c.Context, dest)
+}
+
+// Logout only clears the app's cookies in production, so the user stays
+// signed in to their Google account.
+func (c Context) Logout(w http.ResponseWriter, r *http.Request, dest string) {
+	if appengine.IsDevAppServer() {
+		if u, err := user.LogoutURL(c.Context, dest); err == nil {
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+	} else {
+		http.SetCookie(w, &http.Cookie{
+			Name:    "ACSID",
+			Value:   "",
+			Expires: time.Time{},
+		})
+		http.SetCookie(w, &http.Cookie{
+			Name:    "SACSID",
+			Value:   "",
+			Expires: time.Time{},
+		})
+	}
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+func (c Context) Timeout(d time.Duration) backend.Context {
+	return Context{appengine.Timeout(c.Context, d)}
+}
+
+type queue struct {
+	c appengine.Context
+}
+
+func newTask(t *backend.Task) *taskqueue.Task {
+	task := taskqueue.NewPOSTTask(t.Path, t.Payload)
+	task.Delay = t.Delay
+	return task
+}
+
+func (q queue) Add(t *backend.Task, name string) error {
+	_, err := taskqueue.Add(q.c, newTask(t), name)
+	return err
+}
+
+func (q queue) AddMulti(ts []*backend.Task, name string) error {
+	tasks := make([]*taskqueue.Task, len(ts))
+	for i, t := range ts {
+		tasks[i] = newTask(t)
+	}
+	_, err := taskqueue.AddMulti(q.c, tasks, name)
+	return err
+}
+
+type blobs struct {
+	c appengine.Context
+}
+
+func (b blobs) UploadURL(successPath string) (string, error) {
+	u, err := blobstore.UploadURL(b.c, successPath, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (b blobs) ParseUpload(r *http.Request) (map[string][]*backend.BlobInfo, url.Values, error) {
+	files, other, err := blobstore.ParseUpload(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	infos := make(map[string][]*backend.BlobInfo)
+	for name, fs := range files {
+		for _, f := range fs {
+			infos[name] = append(infos[name], &backend.BlobInfo{
+				BlobKey:      backend.BlobKey(f.BlobKey),
+				ContentType:  f.ContentType,
+				CreationTime: f.CreationTime,
+				Filename:     f.Filename,
+				Size:         f.Size,
+			})
+		}
+	}
+	return infos, other, nil
+}
+
+func (b blobs) NewReader(key backend.BlobKey) (io.Reader, error) {
+	return blobstore.NewReader(b.c, appengine.BlobKey(key)), nil
+}
+
+func (b blobs) Delete(key backend.BlobKey) error {
+	return blobstore.Delete(b.c, appengine.BlobKey(key))
+}
+
+func (b blobs) DeleteMulti(keys []backend.BlobKey) error {
+	bks := make([]appengine.BlobKey, len(keys))
+	for i, k := range keys {
+		bks[i] = appengine.BlobKey(k)
+	}
+	return blobstore.DeleteMulti(b.c, bks)
+}
+
+type cache struct {
+	c appengine.Context
+}
+
+func cacheErr(err error) error {
+	switch err {
+	case memcache.ErrCacheMiss:
+		return backend.ErrCacheMiss
+	case memcache.ErrNotStored:
+		return backend.ErrNotStored
+	}
+	return err
+}
+
+func fromItem(item *memcache.Item) *backend.Item {
+	return &backend.Item{
+		Key:        item.Key,
+		Value:      item.Value,
+		Expiration: item.Expiration,
+	}
+}
+
+func toItem(item *backend.Item) *memcache.Item {
+	return &memcache.Item{
+		Key:        item.Key,
+		Value:      item.Value,
+		Expiration: item.Expiration,
+	}
+}
+
+func (m cache) Get(key string) (*backend.Item, error) {
+	item, err := memcache.Get(m.c, key)
+	if err != nil {
+		return nil, cacheErr(err)
+	}
+	return fromItem(item), nil
+}
+
+func (m cache) GetMulti(keys []string) (map[string]*backend.Item, error) {
+	items, err := memcache.GetMulti(m.c, keys)
+	if err != nil {
+		return nil, cacheErr(err)
+	}
+	r := make(map[string]*backend.Item, len(items))
+	for k, item := range items {
+		r[k] = fromItem(item)
+	}
+	return r, nil
+}
+
+func (m cache) Set(item *backend.Item) error {
+	return cacheErr(memcache.Set(m.c, toItem(item)))
+}
+
+func (m cache) Add(item *backend.Item) error {
+	return cacheErr(memcache.Add(m.c, toItem(item)))
+}
+
+func (m cache) Delete(key string) error {
+	return cacheErr(memcache.Delete(m.c, key))
+}
+
+func (m cache) Increment(key string, delta int64, initialValue uint64) (uint64, error) {
+	n, err := memcache.Increment(m.c, key, delta, initialValue)
+	return n, cacheErr(err)
+}
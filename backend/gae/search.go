@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package gae
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+
+	"appengine"
+	"appengine/search"
+)
+
+// maxQueryLen is kept under the search API's limit of 2000 characters.
+// Searches of more feeds or stories than fit in one query are split into
+// batches that are searched separately and merged.
+const maxQueryLen = 1800
+
+// maxLimit is the most results the search API returns for a search. It
+// is used for searches without a limit.
+const maxLimit = 1000
+
+// searchDoc is a document as stored in the search API. Time is in Unix
+// seconds so that it sorts and compares as a number.
+type searchDoc struct {
+	Feed    search.Atom
+	Story   search.Atom
+	Time    float64
+	Title   string
+	Author  string
+	Content string
+}
+
+type index struct {
+	c    appengine.Context
+	name string
+}
+
+func (c Context) Index(name string) backend.Index {
+	return index{c.Context, name}
+}
+
+// docID returns a document's ID. Feed and story URLs can be too long or
+// contain characters IDs can't, so they are hashed.
+func docID(d *backend.Document) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s", d.Feed, d.Story)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (x index) Put(docs []*backend.Document) error {
+	idx, err := search.Open(x.name)
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		sd := &searchDoc{
+			Feed:    search.Atom(d.Feed),
+			Story:   search.Atom(d.Story),
+			Time:    float64(d.Time.Unix()),
+			Title:   d.Title,
+			Author:  d.Author,
+			Content: d.Content,
+		}
+		if _, err := idx.Put(x.c, docID(d), sd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x index) Delete(docs []*backend.Document) error {
+	idx, err := search.Open(x.name)
+	if err != nil {
+		return err
+	}
+	for _, d := range docs {
+		if err := idx.Delete(x.c, docID(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func quote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// queryString returns the search API query for q's clauses and times.
+func queryString(q *backend.SearchQuery) string {
+	var parts []string
+	for _, cl := range q.Clauses {
+		terms := make([]string, len(cl.Terms))
+		for i, t := range cl.Terms {
+			terms[i] = quote(strings.Join(t.Words, " "))
+		}
+		s := "(" + strings.Join(terms, " OR ") + ")"
+		if cl.Not {
+			s = "NOT " + s
+		}
+		parts = append(parts, s)
+	}
+	if !q.After.IsZero() {
+		parts = append(parts, "Time >= "+strconv.FormatInt(q.After.Unix(), 10))
+	}
+	if !q.Before.IsZero() {
+		parts = append(parts, "Time < "+strconv.FormatInt(q.Before.Unix(), 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// restrictions returns the alternatives that limit a search to q's
+// stories or feeds, or nil if it isn't limited.
+func restrictions(q *backend.SearchQuery) []string {
+	var r []string
+	if q.Stories != nil {
+		feeds := make([]string, 0, len(q.Stories))
+		for f := range q.Stories {
+			feeds = append(feeds, f)
+		}
+		// Batches must come out the same for every page of a search.
+		sort.Strings(feeds)
+		r = []string{}
+		for _, f := range feeds {
+			for _, s := range q.Stories[f] {
+				r = append(r, "(Feed:"+quote(f)+" Story:"+quote(s)+")")
+			}
+		}
+		return r
+	}
+	for _, f := range q.Feeds {
+		r = append(r, "Feed:"+quote(f))
+	}
+	return r
+}
+
+// batchQueries returns base restricted to each batch of alts that fits in
+// maxQueryLen, or just base if alts is nil.
+func batchQueries(base string, alts []string) []string {
+	if alts == nil {
+		return []string{base}
+	}
+	var qs, batch []string
+	n := 0
+	for _, a := range alts {
+		if len(batch) > 0 && len(base)+len(" ()")+n+len(" OR ")+len(a) > maxQueryLen {
+			qs = append(qs, strings.TrimSpace(base+" ("+strings.Join(batch, " OR ")+")"))
+			batch, n = nil, 0
+		}
+		if len(batch) > 0 {
+			n += len(" OR ")
+		}
+		n += len(a)
+		batch = append(batch, a)
+	}
+	if len(batch) > 0 {
+		qs = append(qs, strings.TrimSpace(base+" ("+strings.Join(batch, " OR ")+")"))
+	}
+	return qs
+}
+
+// searchCursor is where a search is in each of its batches. Cursors are
+// the search API cursors of the last results used from each batch, empty
+// before the first, and Done marks the batches with no more results. Hash
+// identifies the batches' queries.
+type searchCursor struct {
+	Hash    string
+	Cursors []string
+	Done    []bool
+}
+
+// batchResult is a result of a batch, with the cursor that continues the
+// batch after it.
+type batchResult struct {
+	doc    *backend.Document
+	batch  int
+	cursor search.Cursor
+}
+
+// searchBatch returns up to limit results of query, continuing from
+// cursor.
+func (x index) searchBatch(idx *search.Index, query string, batch int, cursor search.Cursor, limit int) ([]batchResult, error) {
+	opts := &search.SearchOptions{
+		Limit:  limit,
+		Fields: []string{"Feed", "Story", "Time"},
+		Sort: &search.SortOptions{
+			Expressions: []search.SortExpression{
+				{Expr: "Time", Default: 0.0},
+			},
+		},
+		Cursor: cursor,
+	}
+	var rs []batchResult
+	it := idx.Search(x.c, query, opts)
+	for {
+		var sd searchDoc
+		_, err := it.Next(&sd)
+		if err == search.Done {
+			return rs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rs = append(rs, batchResult{
+			doc: &backend.Document{
+				Feed:  string(sd.Feed),
+				Story: string(sd.Story),
+				Time:  time.Unix(int64(sd.Time), 0),
+			},
+			batch:  batch,
+			cursor: it.Cursor(),
+		})
+	}
+}
+
+// Search searches each batch of q's feeds or stories for a page of
+// results, and merges them by time. The batches whose results weren't
+// all used continue after the last one that was.
+func (x index) Search(q *backend.SearchQuery) (*backend.SearchResult, error) {
+	res := &backend.SearchResult{}
+	alts := restrictions(q)
+	if alts != nil && len(alts) == 0 {
+		return res, nil
+	}
+	qs := batchQueries(queryString(q), alts)
+	h := sha1.New()
+	for _, s := range qs {
+		fmt.Fprintf(h, "%s\x00", s)
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	sc := searchCursor{Hash: hash, Cursors: make([]string, len(qs)), Done: make([]bool, len(qs))}
+	if q.Cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || json.Unmarshal(b, &sc) != nil || sc.Hash != hash || len(sc.Cursors) != len(qs) || len(sc.Done) != len(qs) {
+			return nil, backend.ErrBadCursor
+		}
+	}
+	limit := q.Limit
+	if limit <= 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+	idx, err := search.Open(x.name)
+	if err != nil {
+		return nil, err
+	}
+	found := make([][]batchResult, len(qs))
+	errs := make([]error, len(qs))
+	var wg sync.WaitGroup
+	for i := range qs {
+		if sc.Done[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			found[i], errs[i] = x.searchBatch(idx, qs[i], i, search.Cursor(sc.Cursors[i]), limit)
+		}(i)
+	}
+	wg.Wait()
+	var all []batchResult
+	for i, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, found[i]...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].doc.Time.After(all[j].doc.Time)
+	})
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	used := make([]int, len(qs))
+	for _, r := range all {
+		res.Docs = append(res.Docs, r.doc)
+		sc.Cursors[r.batch] = string(r.cursor)
+		used[r.batch]++
+	}
+	// A batch is done when it had fewer results than asked for and all of
+	// them were used. Every other batch had a result, so a page with a
+	// cursor is never empty.
+	more := false
+	for i := range qs {
+		if !sc.Done[i] && len(found[i]) < limit && used[i] == len(found[i]) {
+			sc.Done[i] = true
+		}
+		more = more || !sc.Done[i]
+	}
+	if more {
+		b, err := json.Marshal(&sc)
+		if err != nil {
+			return nil, err
+		}
+		res.Cursor = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return res, nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/boltdb/bolt"
+	"github.com/mjibson/goread/backend"
+)
+
+var blobBucket = []byte("blobs")
+
+// maxUploadMemory is how much of an upload is kept in memory before
+// spilling to temporary files.
+const maxUploadMemory = 32 << 20
+
+type blobs struct {
+	db *bolt.DB
+}
+
+// UploadURL is successPath: uploads are posted straight to the handler,
+// which stores them with ParseUpload.
+func (b blobs) UploadURL(successPath string) (string, error) {
+	return successPath, nil
+}
+
+func (b blobs) ParseUpload(r *http.Request) (map[string][]*backend.BlobInfo, url.Values, error) {
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return nil, nil, err
+	}
+	infos := make(map[string][]*backend.BlobInfo)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(blobBucket)
+		if err != nil {
+			return err
+		}
+		for name, fhs := range r.MultipartForm.File {
+			for _, fh := range fhs {
+				f, err := fh.Open()
+				if err != nil {
+					return err
+				}
+				data, err := ioutil.ReadAll(f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+				var id [16]byte
+				if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+					return err
+				}
+				key := hex.EncodeToString(id[:])
+				if err := bucket.Put([]byte(key), data); err != nil {
+					return err
+				}
+				infos[name] = append(infos[name], &backend.BlobInfo{
+					BlobKey:      backend.BlobKey(key),
+					ContentType:  fh.Header.Get("Content-Type"),
+					CreationTime: time.Now(),
+					Filename:     fh.Filename,
+					Size:         int64(len(data)),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return infos, url.Values(r.MultipartForm.Value), nil
+}
+
+func (b blobs) NewReader(key backend.BlobKey) (io.Reader, error) {
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(blobBucket); bucket != nil {
+			if v := bucket.Get([]byte(key)); v != nil {
+				data = append([]byte(nil), v...)
+				return nil
+			}
+		}
+		return backend.ErrNoSuchEntity
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (b blobs) Delete(key backend.BlobKey) error {
+	return b.DeleteMulti([]backend.BlobKey{key})
+}
+
+func (b blobs) DeleteMulti(keys []backend.BlobKey) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(blobBucket)
+		if bucket == nil {
+			return nil
+		}
+		for _, k := range keys {
+			if err := bucket.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
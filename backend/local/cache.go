@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// cache is an in-memory memcache.
+type cache struct {
+	sync.Mutex
+	items map[string]cacheEntry
+}
+
+func newCache() *cache {
+	return &cache{items: make(map[string]cacheEntry)}
+}
+
+// get returns the entry at key. Callers must hold the lock.
+func (m *cache) get(key string) (cacheEntry, bool) {
+	e, ok := m.items[key]
+	if ok && !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(m.items, key)
+		return e, false
+	}
+	return e, ok
+}
+
+func (m *cache) set(item *backend.Item) {
+	e := cacheEntry{value: append([]byte(nil), item.Value...)}
+	if item.Expiration > 0 {
+		e.expires = time.Now().Add(item.Expiration)
+	}
+	m.items[item.Key] = e
+}
+
+func (m *cache) Get(key string) (*backend.Item, error) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.get(key)
+	if !ok {
+		return nil, backend.ErrCacheMiss
+	}
+	return &backend.Item{Key: key, Value: e.value}, nil
+}
+
+func (m *cache) GetMulti(keys []string) (map[string]*backend.Item, error) {
+	m.Lock()
+	defer m.Unlock()
+	items := make(map[string]*backend.Item)
+	for _, k := range keys {
+		if e, ok := m.get(k); ok {
+			items[k] = &backend.Item{Key: k, Value: e.value}
+		}
+	}
+	return items, nil
+}
+
+func (m *cache) Set(item *backend.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	m.set(item)
+	return nil
+}
+
+func (m *cache) Add(item *backend.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.get(item.Key); ok {
+		return backend.ErrNotStored
+	}
+	m.set(item)
+	return nil
+}
+
+func (m *cache) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.get(key); !ok {
+		return backend.ErrCacheMiss
+	}
+	delete(m.items, key)
+	return nil
+}
+
+// Increment wraps at zero like memcache: decrementing below zero
+// leaves zero.
+func (m *cache) Increment(key string, delta int64, initialValue uint64) (uint64, error) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.get(key)
+	n := initialValue
+	if ok {
+		var err error
+		if n, err = strconv.ParseUint(string(e.value), 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	if delta < 0 && uint64(-delta) > n {
+		n = 0
+	} else {
+		n += uint64(delta)
+	}
+	e.value = []byte(strconv.FormatUint(n, 10))
+	m.items[key] = e
+	return n, nil
+}
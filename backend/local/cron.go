@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronConfig configures a job as an entry in cron.yaml does.
+type CronConfig struct {
+	URL string
+	// Schedule is how often the job runs, like "every 2 minutes".
+	Schedule string
+}
+
+// ParseSchedule parses a cron.yaml interval schedule of the form
+// "every N units".
+func ParseSchedule(s string) (time.Duration, error) {
+	f := strings.Fields(s)
+	if len(f) != 3 || f[0] != "every" {
+		return 0, fmt.Errorf("local: unsupported schedule %q", s)
+	}
+	n, err := strconv.Atoi(f[1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("local: bad schedule %q", s)
+	}
+	var unit time.Duration
+	switch f[2] {
+	case "seconds", "second":
+		unit = time.Second
+	case "minutes", "minute", "mins", "min":
+		unit = time.Minute
+	case "hours", "hour":
+		unit = time.Hour
+	default:
+		return 0, fmt.Errorf("local: bad schedule %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// runCron requests j's URL on its schedule until the backend closes. A
+// run that is still going when the next is due delays it.
+func (b *Backend) runCron(j CronConfig) {
+	defer b.wg.Done()
+	// Checked by Open.
+	d, _ := ParseSchedule(j.Schedule)
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.done:
+			return
+		}
+		req, err := http.NewRequest("GET", j.URL, nil)
+		if err != nil {
+			logf("ERROR", "cron %v: %v", j.URL, err)
+			continue
+		}
+		req.Header.Set("X-AppEngine-Cron", "true")
+		b.serve(req)
+	}
+}
@@ -0,0 +1,600 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/boltdb/bolt"
+	"github.com/mjibson/goread/backend"
+)
+
+func init() {
+	gob.Register(time.Time{})
+}
+
+// Entities are stored in one bucket per kind, under their encoded key
+// path so that an ancestor's encoding prefixes those of its descendants.
+const entityPrefix = "e/"
+
+func kindBucket(kind string) []byte {
+	return []byte(entityPrefix + kind)
+}
+
+const (
+	idInt    = 1
+	idString = 2
+)
+
+// appendEscaped appends s terminated by 0x00 0x01, escaping 0x00 as
+// 0x00 0xff so that encodings sort like the strings they encode.
+func appendEscaped(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i])
+		if s[i] == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	return append(b, 0, 1)
+}
+
+func readEscaped(b []byte) (string, []byte, error) {
+	var s []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0 {
+			s = append(s, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			break
+		}
+		switch b[i+1] {
+		case 1:
+			return string(s), b[i+2:], nil
+		case 0xff:
+			s = append(s, 0)
+			i++
+			continue
+		}
+		break
+	}
+	return "", nil, errors.New("local: bad key encoding")
+}
+
+func encodeKey(k *backend.Key) []byte {
+	if k == nil {
+		return nil
+	}
+	b := appendEscaped(encodeKey(k.Parent()), k.Kind())
+	if k.StringID() != "" {
+		return appendEscaped(append(b, idString), k.StringID())
+	}
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(k.IntID())^(1<<63))
+	return append(append(b, idInt), n[:]...)
+}
+
+func decodeKey(b []byte) (*backend.Key, error) {
+	var k *backend.Key
+	for len(b) > 0 {
+		kind, rest, err := readEscaped(b)
+		if err != nil || len(rest) == 0 {
+			return nil, errors.New("local: bad key encoding")
+		}
+		switch rest[0] {
+		case idInt:
+			if len(rest) < 9 {
+				return nil, errors.New("local: bad key encoding")
+			}
+			id := int64(binary.BigEndian.Uint64(rest[1:9]) ^ (1 << 63))
+			k = backend.NewKey(kind, "", id, k)
+			b = rest[9:]
+		case idString:
+			id, r, err := readEscaped(rest[1:])
+			if err != nil {
+				return nil, err
+			}
+			k = backend.NewKey(kind, id, 0, k)
+			b = r
+		default:
+			return nil, errors.New("local: bad key encoding")
+		}
+	}
+	return k, nil
+}
+
+func encodeEntity(src interface{}) ([]byte, error) {
+	props, err := backend.SaveStruct(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(props); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEntity(b []byte) ([]backend.Property, error) {
+	var props []backend.Property
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&props)
+	return props, err
+}
+
+// datastoreImpl runs each call in its own bolt transaction, or in tx if
+// set.
+type datastoreImpl struct {
+	db *bolt.DB
+	tx *bolt.Tx
+}
+
+func (d datastoreImpl) view(f func(*bolt.Tx) error) error {
+	if d.tx != nil {
+		return f(d.tx)
+	}
+	return d.db.View(f)
+}
+
+func (d datastoreImpl) update(f func(*bolt.Tx) error) error {
+	if d.tx != nil {
+		return f(d.tx)
+	}
+	return d.db.Update(f)
+}
+
+func (d datastoreImpl) GetMulti(keys []*backend.Key, dst []interface{}) error {
+	merr := make(backend.MultiError, len(keys))
+	any := false
+	err := d.view(func(tx *bolt.Tx) error {
+		for i, k := range keys {
+			var v []byte
+			if b := tx.Bucket(kindBucket(k.Kind())); b != nil {
+				v = b.Get(encodeKey(k))
+			}
+			if v == nil {
+				merr[i] = backend.ErrNoSuchEntity
+				any = true
+				continue
+			}
+			props, err := decodeEntity(v)
+			if err == nil {
+				err = backend.LoadStruct(dst[i], props)
+			}
+			if err != nil {
+				merr[i] = err
+				any = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if any {
+		return merr
+	}
+	return nil
+}
+
+func (d datastoreImpl) PutMulti(keys []*backend.Key, src []interface{}) ([]*backend.Key, error) {
+	ret := make([]*backend.Key, len(keys))
+	err := d.update(func(tx *bolt.Tx) error {
+		for i, k := range keys {
+			b, err := tx.CreateBucketIfNotExists(kindBucket(k.Kind()))
+			if err != nil {
+				return err
+			}
+			if k.Incomplete() {
+				id, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				k = backend.NewKey(k.Kind(), "", int64(id), k.Parent())
+			}
+			v, err := encodeEntity(src[i])
+			if err != nil {
+				return err
+			}
+			if err := b.Put(encodeKey(k), v); err != nil {
+				return err
+			}
+			ret[i] = k
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (d datastoreImpl) DeleteMulti(keys []*backend.Key) error {
+	return d.update(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			if b := tx.Bucket(kindBucket(k.Kind())); b != nil {
+				if err := b.Delete(encodeKey(k)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (d datastoreImpl) RunInTransaction(f func(backend.Datastore) error) error {
+	if d.tx != nil {
+		return f(d)
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return f(datastoreImpl{db: d.db, tx: tx})
+	})
+}
+
+type result struct {
+	key   []byte
+	props []backend.Property
+}
+
+// Cursors are the last key returned, for queries in key order, or the
+// number of results passed, for sorted ones.
+func decodeCursor(c backend.Cursor) (key []byte, offset int, err error) {
+	if c.String() == "" {
+		return nil, 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c.String())
+	if err != nil || len(b) == 0 {
+		return nil, 0, errors.New("local: bad cursor")
+	}
+	switch b[0] {
+	case 'k':
+		return b[1:], 0, nil
+	case 'o':
+		offset, err = strconv.Atoi(string(b[1:]))
+		return nil, offset, err
+	}
+	return nil, 0, errors.New("local: bad cursor")
+}
+
+// query returns the results of p in order, and the index of the first
+// result after p's start cursor.
+func (d datastoreImpl) query(p *backend.Plan) ([]result, int, error) {
+	startKey, start, err := decodeCursor(p.Start)
+	if err != nil {
+		return nil, 0, err
+	}
+	var filters, keyFilters []backend.Filter
+	for _, f := range p.Filters {
+		if f.Property == "__key__" {
+			k, ok := f.Value.(*backend.Key)
+			if !ok {
+				return nil, 0, fmt.Errorf("local: filter __key__: %T is not a key", f.Value)
+			}
+			keyFilters = append(keyFilters, backend.Filter{Property: f.Property, Op: f.Op, Value: encodeKey(k)})
+			continue
+		}
+		v, err := normalize(f.Value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("local: filter %s: %v", f.Property, err)
+		}
+		filters = append(filters, backend.Filter{Property: f.Property, Op: f.Op, Value: v})
+	}
+	load := !p.KeysOnly || len(filters) > 0 || len(p.Orders) > 0
+	prefix := encodeKey(p.Ancestor)
+	var results []result
+	err = d.view(func(tx *bolt.Tx) error {
+		var buckets []*bolt.Bucket
+		if p.Kind != "" {
+			if b := tx.Bucket(kindBucket(p.Kind)); b != nil {
+				buckets = append(buckets, b)
+			}
+		} else {
+			tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				if bytes.HasPrefix(name, []byte(entityPrefix)) {
+					buckets = append(buckets, b)
+				}
+				return nil
+			})
+		}
+		for _, b := range buckets {
+			c := b.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if !match([]backend.Property{{Name: "__key__", Value: k}}, keyFilters) {
+					continue
+				}
+				r := result{key: append([]byte(nil), k...)}
+				if load {
+					props, err := decodeEntity(v)
+					if err != nil {
+						return err
+					}
+					if !match(props, filters) {
+						continue
+					}
+					r.props = props
+				}
+				results = append(results, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(p.Orders) > 0 {
+		results = sortResults(results, p.Orders)
+	} else {
+		if p.Kind == "" {
+			sort.Slice(results, func(i, j int) bool {
+				return bytes.Compare(results[i].key, results[j].key) < 0
+			})
+		}
+		if startKey != nil {
+			start = sort.Search(len(results), func(i int) bool {
+				return bytes.Compare(results[i].key, startKey) > 0
+			})
+		}
+	}
+	return results, start, nil
+}
+
+func (d datastoreImpl) Run(p *backend.Plan) backend.Iterator {
+	results, start, err := d.query(p)
+	if err != nil {
+		return &iterator{err: err}
+	}
+	it := &iterator{
+		results:  results,
+		pos:      start + p.Offset,
+		end:      len(results),
+		ordered:  len(p.Orders) > 0,
+		keysOnly: p.KeysOnly,
+	}
+	if p.Limit >= 0 && it.pos+p.Limit < it.end {
+		it.end = it.pos + p.Limit
+	}
+	return it
+}
+
+func (d datastoreImpl) Count(p *backend.Plan) (int, error) {
+	it := d.Run(p).(*iterator)
+	if it.err != nil {
+		return 0, it.err
+	}
+	if it.pos > it.end {
+		return 0, nil
+	}
+	return it.end - it.pos, nil
+}
+
+type iterator struct {
+	results  []result
+	pos, end int
+	ordered  bool
+	keysOnly bool
+	err      error
+}
+
+func (it *iterator) Next(dst interface{}) (*backend.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.pos >= it.end {
+		return nil, backend.Done
+	}
+	r := it.results[it.pos]
+	it.pos++
+	k, err := decodeKey(r.key)
+	if err != nil {
+		return nil, err
+	}
+	if dst != nil && !it.keysOnly {
+		if err := backend.LoadStruct(dst, r.props); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (it *iterator) Cursor() (backend.Cursor, error) {
+	if it.err != nil {
+		return backend.Cursor{}, it.err
+	}
+	var b []byte
+	if it.ordered {
+		b = append([]byte{'o'}, strconv.Itoa(it.pos)...)
+	} else if it.pos > 0 && it.pos <= len(it.results) {
+		b = append([]byte{'k'}, it.results[it.pos-1].key...)
+	}
+	return backend.DecodeCursor(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// normalize converts v to a property value type.
+func normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case time.Time, []byte:
+		return v, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return rv.String(), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+// compare returns -1, 0 or 1 as a is less than, equal to or greater than
+// b. Values of different types order by type.
+func compare(a, b interface{}) int {
+	ta, tb := typeRank(a), typeRank(b)
+	if ta != tb {
+		if ta < tb {
+			return -1
+		}
+		return 1
+	}
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		switch {
+		case a == b:
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return bytes.Compare([]byte(a), []byte(b.(string)))
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case int64:
+		return 1
+	case time.Time:
+		return 2
+	case bool:
+		return 3
+	case string, []byte:
+		return 4
+	case float64:
+		return 5
+	}
+	return 0
+}
+
+// match returns whether props satisfy all filters. A filter on a
+// multi-valued property matches if any value does.
+func match(props []backend.Property, filters []backend.Filter) bool {
+	for _, f := range filters {
+		ok := false
+		for _, p := range props {
+			if p.Name != f.Property || p.NoIndex {
+				continue
+			}
+			c := compare(p.Value, f.Value)
+			switch f.Op {
+			case "=":
+				ok = c == 0
+			case "<":
+				ok = c < 0
+			case "<=":
+				ok = c <= 0
+			case ">":
+				ok = c > 0
+			case ">=":
+				ok = c >= 0
+			}
+			if ok {
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sortResults sorts by orders, dropping results without the ordered
+// properties as the App Engine datastore does.
+func sortResults(results []result, orders []backend.Order) []result {
+	value := func(r result, o backend.Order) (interface{}, bool) {
+		var v interface{}
+		found := false
+		for _, p := range r.props {
+			if p.Name != o.Property || p.NoIndex {
+				continue
+			}
+			if !found || (compare(p.Value, v) < 0) != o.Descending {
+				v = p.Value
+			}
+			found = true
+		}
+		return v, found
+	}
+	kept := results[:0]
+	for _, r := range results {
+		ok := true
+		for _, o := range orders {
+			if _, ok = value(r, o); !ok {
+				break
+			}
+		}
+		if ok {
+			kept = append(kept, r)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		for _, o := range orders {
+			a, _ := value(kept[i], o)
+			b, _ := value(kept[j], o)
+			if c := compare(a, b); c != 0 {
+				return (c < 0) != o.Descending
+			}
+		}
+		return bytes.Compare(kept[i].key, kept[j].key) < 0
+	})
+	return kept
+}
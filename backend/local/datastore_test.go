@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+type testFeed struct {
+	_kind string `goon:"kind,F"`
+	Url   string `datastore:"-" goon:"id"`
+	Title string
+}
+
+type testLog struct {
+	_kind  string       `goon:"kind,FL"`
+	Id     int64        `datastore:"-" goon:"id"`
+	Parent *backend.Key `datastore:"-" goon:"parent"`
+	Text   string       `datastore:"t,noindex"`
+	Date   time.Time
+	Tags   []string
+}
+
+func testStore(t *testing.T) (*backend.Store, func()) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(Config{Database: filepath.Join(dir, "goread.db")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return b.NewContext(nil).Store(), func() {
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	keys := []*backend.Key{
+		backend.NewKey("F", "a", 0, nil),
+		backend.NewKey("F", "a\x00b", 0, nil),
+		backend.NewKey("FL", "", -3, backend.NewKey("F", "a", 0, nil)),
+		backend.NewKey("FL", "", 1<<40, backend.NewKey("F", "a", 0, nil)),
+	}
+	for _, k := range keys {
+		d, err := decodeKey(encodeKey(k))
+		if err != nil {
+			t.Fatal(k, err)
+		}
+		if !d.Equal(k) {
+			t.Errorf("got %v, expected %v", d, k)
+		}
+	}
+	if string(encodeKey(keys[2])) >= string(encodeKey(keys[3])) {
+		t.Error("int ids out of order")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s, done := testStore(t)
+	defer done()
+	f := &testFeed{Url: "http://example.com/", Title: "example"}
+	fk, err := s.Put(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	var logs []*testLog
+	for i := 0; i < 5; i++ {
+		logs = append(logs, &testLog{
+			Id:     int64(i + 1),
+			Parent: fk,
+			Text:   "log",
+			Date:   now.Add(-time.Duration(i) * time.Hour),
+			Tags:   []string{"all", string('a' + rune(i))},
+		})
+	}
+	if _, err := s.PutMulti(logs); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &testFeed{Url: f.Url}
+	if err := s.Get(g); err != nil || g.Title != f.Title {
+		t.Fatalf("got %+v, %v", g, err)
+	}
+	if err := s.Get(&testFeed{Url: "missing"}); err != backend.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity, got %v", err)
+	}
+
+	var got []*testLog
+	q := backend.NewQuery("FL").Ancestor(fk).Order("-Date").Limit(2)
+	if _, err := s.GetAll(q, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Id != 1 || got[1].Id != 2 || got[0].Parent == nil {
+		t.Fatalf("bad ordered results: %+v", got)
+	}
+
+	n, err := s.Count(backend.NewQuery("FL").Filter("Tags =", "c"))
+	if err != nil || n != 1 {
+		t.Errorf("multi-valued filter: got %v, %v", n, err)
+	}
+	n, err = s.Count(backend.NewQuery("FL").Filter("t =", "log"))
+	if err != nil || n != 0 {
+		t.Errorf("noindex filter: got %v, %v", n, err)
+	}
+	lk := s.Key(&testLog{Id: 3, Parent: fk})
+	keys, err := s.GetAll(backend.NewQuery("FL").Ancestor(fk).KeysOnly().Filter("__key__ >", lk), nil)
+	if err != nil || len(keys) != 2 || keys[0].IntID() != 4 {
+		t.Errorf("key filter: got %v, %v", keys, err)
+	}
+
+	it := s.Run(backend.NewQuery("FL").Limit(3))
+	for {
+		if _, err := it.Next(&testLog{}); err == backend.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = s.GetAll(backend.NewQuery("FL").KeysOnly().Start(c), nil)
+	if err != nil || len(keys) != 2 || keys[0].IntID() != 4 {
+		t.Errorf("cursor: got %v, %v", keys, err)
+	}
+}
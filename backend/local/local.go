@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package local implements backend on a single machine. Entities, blobs
+// and search indexes are kept in a bolt database, memcache in memory, and
+// users are signed in by a reverse proxy in front of goread.
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/boltdb/bolt"
+	"github.com/mjibson/goread/backend"
+)
+
+type Config struct {
+	// Database is the path of the bolt database file.
+	Database string
+	// UserHeader names the request header in which the reverse proxy
+	// passes the signed in user's email. The proxy must remove it from
+	// client requests.
+	UserHeader string
+	// Admins are the emails of admin users.
+	Admins []string
+	// LoginURL and LogoutURL are the proxy's sign in and sign out pages.
+	// "{dest}" in them is replaced by the escaped URL to return to.
+	LoginURL  string
+	LogoutURL string
+	// Dev serves goread as a development server.
+	Dev bool
+	// FetchPrivate lets feed and story requests reach loopback, private
+	// and link-local addresses, such as feeds on the local network.
+	// Anyone who can add a feed or write a story can then make goread
+	// request them. Sign in providers may always be private.
+	FetchPrivate bool
+	// Queues configures task queues as queue.yaml does.
+	Queues []QueueConfig
+	// Cron lists jobs to run as cron.yaml does.
+	Cron []CronConfig
+}
+
+type Backend struct {
+	cfg       Config
+	db        *bolt.DB
+	cache     *cache
+	transport http.RoundTripper
+	// admin is the unrestricted transport of AdminTransport.
+	admin http.RoundTripper
+
+	mu      sync.Mutex
+	handler http.Handler
+	workers map[string]*worker
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Open opens or creates the database at cfg.Database.
+func Open(cfg Config) (*Backend, error) {
+	for _, q := range cfg.Queues {
+		if _, err := newWorker(nil, q); err != nil {
+			return nil, err
+		}
+	}
+	for _, j := range cfg.Cron {
+		if _, err := ParseSchedule(j.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(cfg.Database, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		cfg:       cfg,
+		db:        db,
+		cache:     newCache(),
+		transport: newTransport(cfg.FetchPrivate),
+		admin:     newTransport(true),
+		workers:   make(map[string]*worker),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Start sends tasks and cron jobs to h. Until it is called tasks are
+// only stored.
+func (b *Backend) Start(h http.Handler) error {
+	b.mu.Lock()
+	b.handler = h
+	// Queues added to before now have workers that are not running.
+	for _, w := range b.workers {
+		b.wg.Add(1)
+		go w.run()
+	}
+	b.mu.Unlock()
+	if err := b.startWorkers(); err != nil {
+		return err
+	}
+	for _, j := range b.cfg.Cron {
+		b.wg.Add(1)
+		go b.runCron(j)
+	}
+	return nil
+}
+
+// Close waits for running tasks and closes the database.
+func (b *Backend) Close() error {
+	close(b.done)
+	b.wg.Wait()
+	return b.db.Close()
+}
+
+func (b *Backend) NewContext(r *http.Request) backend.Context {
+	return &Context{b: b, r: r}
+}
+
+func (b *Backend) IsDev() bool {
+	return b.cfg.Dev
+}
+
+type Context struct {
+	b *Backend
+	r *http.Request
+}
+
+func logf(level, format string, args ...interface{}) {
+	log.Printf("%s: %s", level, fmt.Sprintf(format, args...))
+}
+
+func (c *Context) Debugf(format string, args ...interface{}) {
+	if c.b.cfg.Dev {
+		logf("DEBUG", format, args...)
+	}
+}
+
+func (c *Context) Infof(format string, args ...interface{}) {
+	logf("INFO", format, args...)
+}
+
+func (c *Context) Warningf(format string, args ...interface{}) {
+	logf("WARNING", format, args...)
+}
+
+func (c *Context) Errorf(format string, args ...interface{}) {
+	logf("ERROR", format, args...)
+}
+
+func (c *Context) Criticalf(format string, args ...interface{}) {
+	logf("CRITICAL", format, args...)
+}
+
+func (c *Context) Store() *backend.Store {
+	return backend.NewStore(datastoreImpl{db: c.b.db})
+}
+
+func (c *Context) Queue() backend.Queue {
+	return queue{c.b}
+}
+
+func (c *Context) Blobs() backend.BlobStore {
+	return blobs{c.b.db}
+}
+
+func (c *Context) Cache() backend.Cache {
+	return c.b.cache
+}
+
+func (c *Context) Index(name string) backend.Index {
+	return searchIndex{c.b.db, name}
+}
+
+// defaultDeadline matches urlfetch's.
+const defaultDeadline = time.Second * 5
+
+func (c *Context) Transport(deadline time.Duration) http.RoundTripper {
+	if deadline == 0 {
+		deadline = defaultDeadline
+	}
+	return deadlineTransport{c.b.transport, deadline}
+}
+
+func (c *Context) AdminTransport(deadline time.Duration) http.RoundTripper {
+	if deadline == 0 {
+		deadline = defaultDeadline
+	}
+	return deadlineTransport{c.b.admin, deadline}
+}
+
+func (c *Context) User() *backend.User {
+	if c.b.cfg.UserHeader == "" || c.r == nil {
+		return nil
+	}
+	email := strings.TrimSpace(c.r.Header.Get(c.b.cfg.UserHeader))
+	if email == "" {
+		return nil
+	}
+	u := &backend.User{
+		ID:    email,
+		Email: email,
+	}
+	for _, a := range c.b.cfg.Admins {
+		if strings.EqualFold(a, email) {
+			u.Admin = true
+		}
+	}
+	return u
+}
+
+func expand(page, dest string) string {
+	return strings.Replace(page, "{dest}", url.QueryEscape(dest), -1)
+}
+
+func (c *Context) LoginURL(dest string) (string, error) {
+	if c.b.cfg.LoginURL == "" {
+		return dest, nil
+	}
+	return expand(c.b.cfg.LoginURL, dest), nil
+}
+
+func (c *Context) Logout(w http.ResponseWriter, r *http.Request, dest string) {
+	if c.b.cfg.LogoutURL != "" {
+		dest = expand(c.b.cfg.LogoutURL, dest)
+	}
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+func (c *Context) Timeout(d time.Duration) backend.Context {
+	return c
+}
+
+// newTransport returns the transport of outgoing requests. Unless private
+// is set it only connects to public addresses. It checks the addresses
+// it dials, so redirects and host names that resolve to private
+// addresses are refused too.
+func newTransport(private bool) *http.Transport {
+	d := &net.Dialer{
+		Timeout:   time.Second * 30,
+		KeepAlive: time.Second * 30,
+	}
+	t := &http.Transport{
+		DialContext:           d.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       time.Second * 90,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ExpectContinueTimeout: time.Second,
+	}
+	if private {
+		t.Proxy = http.ProxyFromEnvironment
+	} else {
+		// Without a proxy the dialed address is the server's.
+		d.Control = dialPublic
+	}
+	return t
+}
+
+// dialPublic refuses connections to addresses that aren't public.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !backend.PublicIP(ip) {
+		return fmt.Errorf("local: refusing to connect to non-public address %v", host)
+	}
+	return nil
+}
+
+// deadlineTransport cancels requests that are not done after d, including
+// reading the body.
+type deadlineTransport struct {
+	rt http.RoundTripper
+	d  time.Duration
+}
+
+func (t deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.d)
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Read(p []byte) (int, error) {
+	return b.body.Read(p)
+}
+
+func (b cancelBody) Close() error {
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
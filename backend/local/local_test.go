@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjibson/goread/backend"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"::ffff:10.0.0.1": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+	}
+	for s, expected := range tests {
+		if p := backend.PublicIP(net.ParseIP(s)); p != expected {
+			t.Errorf("%v: got %v, expected %v", s, p, expected)
+		}
+	}
+}
+
+func TestTransportPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	for _, private := range []bool{false, true} {
+		b, err := Open(Config{
+			Database:     filepath.Join(dir, "goread.db"),
+			FetchPrivate: private,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl := &http.Client{Transport: b.NewContext(nil).Transport(0)}
+		resp, err := cl.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != private {
+			t.Errorf("private %v: got %v", private, err)
+		}
+		// Sign in providers may be private either way.
+		cl = &http.Client{Transport: b.NewContext(nil).AdminTransport(0)}
+		if resp, err = cl.Get(srv.URL); err != nil {
+			t.Errorf("private %v: admin transport: %v", private, err)
+		} else {
+			resp.Body.Close()
+		}
+		b.Close()
+	}
+}
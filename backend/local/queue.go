@@ -0,0 +1,527 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/boltdb/bolt"
+	"github.com/mjibson/goread/backend"
+)
+
+// QueueConfig configures a task queue as an entry in queue.yaml does.
+type QueueConfig struct {
+	Name string
+	// Rate is how fast tasks are started, like "10/s", "30/m" or "1/h".
+	Rate string
+	// BucketSize is how many tasks may be started in a burst.
+	BucketSize int
+	// RetryLimit is how many times a failed task is retried. Nil means
+	// no limit.
+	RetryLimit *int
+	// TaskAgeLimit is how long after it was added a failed task is
+	// retried, like "30m" or "2d". Empty means no limit. With RetryLimit
+	// too, a task is retried until both limits are reached.
+	TaskAgeLimit string
+	// MinBackoffSeconds and MaxBackoffSeconds bound the wait before a
+	// retry. The wait doubles MaxDoublings times and then grows linearly.
+	// Zero or nil uses App Engine's defaults.
+	MinBackoffSeconds float64
+	MaxBackoffSeconds float64
+	MaxDoublings      *int
+	// MaxConcurrentRequests is how many of the queue's tasks may run at
+	// once. Zero means no limit.
+	MaxConcurrentRequests int
+}
+
+// Queues that are not configured get App Engine's defaults.
+const (
+	defaultRate         = 5
+	defaultBucketSize   = 5
+	defaultMinBackoff   = time.Millisecond * 100
+	defaultMaxBackoff   = time.Hour
+	defaultMaxDoublings = 16
+)
+
+// leaseDuration is how long a running task is kept from running again.
+// A task leased when goread stops is retried once its lease expires.
+const leaseDuration = time.Minute * 10
+
+const queuePrefix = "q/"
+
+// ParseRate parses a queue rate like "10/s" into tasks per second.
+func ParseRate(s string) (float64, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return 0, fmt.Errorf("local: bad rate %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("local: bad rate %q", s)
+	}
+	switch s[i+1:] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	case "d":
+		return n / 86400, nil
+	}
+	return 0, fmt.Errorf("local: bad rate %q", s)
+}
+
+// parseAge parses a task age limit like "2d" or "30m".
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("local: bad age %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("local: bad age %q", s)
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = time.Hour * 24
+	default:
+		return 0, fmt.Errorf("local: bad age %q", s)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
+
+// storedTask is a task waiting in the database. Its key is its ETA in
+// nanoseconds followed by a sequence number, both big-endian, so the
+// next task to run is first in its queue's bucket.
+type storedTask struct {
+	Path    string
+	Payload url.Values
+	Retries int
+	// Added is when the task was added, for the queue's age limit.
+	Added time.Time
+}
+
+func taskKey(eta time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(eta.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func taskETA(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+// putTask stores t in queue to run at eta.
+func putTask(tx *bolt.Tx, queue string, t *storedTask, eta time.Time) ([]byte, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(queuePrefix + queue))
+	if err != nil {
+		return nil, err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(t); err != nil {
+		return nil, err
+	}
+	k := taskKey(eta, seq)
+	return k, b.Put(k, buf.Bytes())
+}
+
+// queue stores tasks in the database, where each queue's worker picks
+// them up.
+type queue struct {
+	b *Backend
+}
+
+func (q queue) Add(t *backend.Task, name string) error {
+	return q.AddMulti([]*backend.Task{t}, name)
+}
+
+func (q queue) AddMulti(ts []*backend.Task, name string) error {
+	now := time.Now()
+	err := q.b.db.Update(func(tx *bolt.Tx) error {
+		for _, t := range ts {
+			st := &storedTask{Path: t.Path, Payload: t.Payload, Added: now}
+			if _, err := putTask(tx, name, st, now.Add(t.Delay)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.b.worker(name).notify()
+	return nil
+}
+
+// worker runs the tasks of one queue, starting them at most at its rate
+// with bursts of up to its bucket size, and at most maxConcurrent at once.
+type worker struct {
+	b             *Backend
+	name          string
+	rate          float64
+	bucketSize    int
+	retryLimit    int
+	ageLimit      time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxDoublings  int
+	maxConcurrent int
+	running       int32
+	wake          chan struct{}
+}
+
+func newWorker(b *Backend, cfg QueueConfig) (*worker, error) {
+	w := &worker{
+		b:             b,
+		name:          cfg.Name,
+		rate:          defaultRate,
+		bucketSize:    cfg.BucketSize,
+		retryLimit:    -1,
+		minBackoff:    defaultMinBackoff,
+		maxBackoff:    defaultMaxBackoff,
+		maxDoublings:  defaultMaxDoublings,
+		maxConcurrent: cfg.MaxConcurrentRequests,
+		wake:          make(chan struct{}, 1),
+	}
+	if cfg.Rate != "" {
+		r, err := ParseRate(cfg.Rate)
+		if err != nil {
+			return nil, err
+		}
+		w.rate = r
+	}
+	if w.bucketSize <= 0 {
+		w.bucketSize = defaultBucketSize
+	}
+	if cfg.RetryLimit != nil {
+		w.retryLimit = *cfg.RetryLimit
+	}
+	if cfg.TaskAgeLimit != "" {
+		a, err := parseAge(cfg.TaskAgeLimit)
+		if err != nil {
+			return nil, err
+		}
+		w.ageLimit = a
+	}
+	if cfg.MinBackoffSeconds > 0 {
+		w.minBackoff = time.Duration(cfg.MinBackoffSeconds * float64(time.Second))
+	}
+	if cfg.MaxBackoffSeconds > 0 {
+		w.maxBackoff = time.Duration(cfg.MaxBackoffSeconds * float64(time.Second))
+	}
+	if w.minBackoff > w.maxBackoff {
+		return nil, fmt.Errorf("local: queue %v: min backoff above max backoff", cfg.Name)
+	}
+	if cfg.MaxDoublings != nil {
+		w.maxDoublings = *cfg.MaxDoublings
+	}
+	if w.maxDoublings < 0 || cfg.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("local: queue %v: negative limit", cfg.Name)
+	}
+	return w, nil
+}
+
+// worker returns the worker of queue name, starting it if needed.
+func (b *Backend) worker(name string) *worker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w := b.workers[name]; w != nil {
+		return w
+	}
+	w, _ := newWorker(b, QueueConfig{Name: name})
+	for _, cfg := range b.cfg.Queues {
+		if cfg.Name == name {
+			// Configurations were checked by Open.
+			w, _ = newWorker(b, cfg)
+		}
+	}
+	b.workers[name] = w
+	select {
+	case <-b.done:
+		// Closing: the task runs when goread next starts.
+		return w
+	default:
+	}
+	if b.handler != nil {
+		b.wg.Add(1)
+		go w.run()
+	}
+	return w
+}
+
+// notify wakes w to look for new tasks.
+func (w *worker) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sleep waits for d or until w is notified. It returns false if the
+// backend is closing.
+func (w *worker) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-w.wake:
+	case <-w.b.done:
+		return false
+	}
+	return true
+}
+
+func (w *worker) run() {
+	defer w.b.wg.Done()
+	tokens := float64(w.bucketSize)
+	last := time.Now()
+	for {
+		now := time.Now()
+		tokens = math.Min(float64(w.bucketSize), tokens+now.Sub(last).Seconds()*w.rate)
+		last = now
+		if w.maxConcurrent > 0 && int(atomic.LoadInt32(&w.running)) >= w.maxConcurrent {
+			// runTask notifies w when a task finishes.
+			if !w.sleep(time.Hour) {
+				return
+			}
+			continue
+		}
+		if tokens < 1 {
+			if !w.sleep(time.Duration((1 - tokens) / w.rate * float64(time.Second))) {
+				return
+			}
+			continue
+		}
+		key, t, next, err := w.lease(now)
+		if err != nil {
+			logf("ERROR", "queue %v: %v", w.name, err)
+			next = now.Add(time.Second)
+		}
+		if t == nil {
+			wait := time.Hour
+			if !next.IsZero() {
+				wait = next.Sub(now)
+			}
+			if !w.sleep(wait) {
+				return
+			}
+			continue
+		}
+		tokens--
+		atomic.AddInt32(&w.running, 1)
+		w.b.wg.Add(1)
+		go w.runTask(key, t)
+	}
+}
+
+// lease takes the first task due by now and pushes its ETA past the
+// lease duration. If no task is due it returns the next ETA, or zero if
+// the queue is empty.
+func (w *worker) lease(now time.Time) (key []byte, t *storedTask, next time.Time, err error) {
+	err = w.b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(queuePrefix + w.name))
+		if b == nil {
+			return nil
+		}
+		k, v := b.Cursor().First()
+		if k == nil {
+			return nil
+		}
+		if eta := taskETA(k); eta.After(now) {
+			next = eta
+			return nil
+		}
+		st := new(storedTask)
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(st); err != nil {
+			logf("ERROR", "queue %v: dropping bad task: %v", w.name, err)
+			return b.Delete(k)
+		}
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		nk, err := putTask(tx, w.name, st, now.Add(leaseDuration))
+		if err != nil {
+			return err
+		}
+		key, t = nk, st
+		return nil
+	})
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	return
+}
+
+// runTask runs t, then deletes it or schedules its retry.
+func (w *worker) runTask(key []byte, t *storedTask) {
+	defer w.b.wg.Done()
+	code := w.b.runTask(&backend.Task{Path: t.Path, Payload: t.Payload}, w.name, t.Retries)
+	atomic.AddInt32(&w.running, -1)
+	retry := code < 200 || code >= 300
+	if retry && w.expired(t, time.Now()) {
+		logf("WARNING", "task %v on queue %v: giving up after %v retries", t.Path, w.name, t.Retries)
+		retry = false
+	}
+	err := w.b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(queuePrefix + w.name)).Delete(key); err != nil {
+			return err
+		}
+		if !retry {
+			return nil
+		}
+		t.Retries++
+		_, err := putTask(tx, w.name, t, time.Now().Add(w.backoff(t.Retries)))
+		return err
+	})
+	if err != nil {
+		logf("ERROR", "task %v on queue %v: %v", t.Path, w.name, err)
+	}
+	if retry || w.maxConcurrent > 0 {
+		w.notify()
+	}
+}
+
+// expired reports whether t has reached the queue's retry limits. With
+// both a retry and an age limit, it must reach both.
+func (w *worker) expired(t *storedTask, now time.Time) bool {
+	retries := w.retryLimit >= 0 && t.Retries >= w.retryLimit
+	// Tasks stored before Added was recorded have no age.
+	age := w.ageLimit > 0 && !t.Added.IsZero() && now.Sub(t.Added) >= w.ageLimit
+	if w.retryLimit >= 0 && w.ageLimit > 0 {
+		return retries && age
+	}
+	return retries || age
+}
+
+// backoff is the wait before the given retry. It doubles from minBackoff
+// maxDoublings times, then grows by the last doubled wait, up to
+// maxBackoff.
+func (w *worker) backoff(retries int) time.Duration {
+	d := w.minBackoff
+	for i := 1; i < retries && d < w.maxBackoff; i++ {
+		if i <= w.maxDoublings {
+			d *= 2
+		} else {
+			d += w.minBackoff << uint(w.maxDoublings)
+		}
+	}
+	if d > w.maxBackoff {
+		d = w.maxBackoff
+	}
+	return d
+}
+
+// startWorkers starts the workers of configured queues and of queues
+// with tasks left from a previous run.
+func (b *Backend) startWorkers() error {
+	names := make(map[string]bool)
+	for _, cfg := range b.cfg.Queues {
+		names[cfg.Name] = true
+	}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bytes.HasPrefix(name, []byte(queuePrefix)) {
+				names[string(name[len(queuePrefix):])] = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for name := range names {
+		b.worker(name)
+	}
+	return nil
+}
+
+// runTask posts t to the backend's handler and returns the response
+// status.
+func (b *Backend) runTask(t *backend.Task, queue string, retries int) int {
+	if b.handler == nil {
+		logf("ERROR", "task %v: no handler", t.Path)
+		return http.StatusServiceUnavailable
+	}
+	req, err := http.NewRequest("POST", t.Path, strings.NewReader(t.Payload.Encode()))
+	if err != nil {
+		logf("ERROR", "task %v: %v", t.Path, err)
+		return http.StatusBadRequest
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-AppEngine-QueueName", queue)
+	req.Header.Set("X-AppEngine-TaskRetryCount", strconv.Itoa(retries))
+	return b.serve(req)
+}
+
+// serve runs req on the backend's handler and returns the response
+// status.
+func (b *Backend) serve(req *http.Request) int {
+	w := &taskResponse{header: make(http.Header)}
+	b.handler.ServeHTTP(w, req)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if w.code >= 300 {
+		logf("WARNING", "%v %v: status %v", req.Method, req.URL.Path, w.code)
+	}
+	return w.code
+}
+
+// taskResponse discards the body of a task's response.
+type taskResponse struct {
+	header http.Header
+	code   int
+}
+
+func (w *taskResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *taskResponse) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *taskResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
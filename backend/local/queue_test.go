@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]float64{
+		"10/s": 10,
+		"30/m": 0.5,
+		"1/h":  1.0 / 3600,
+	}
+	for s, expected := range tests {
+		if r, err := ParseRate(s); err != nil || r != expected {
+			t.Errorf("%v: got %v, %v, expected %v", s, r, err, expected)
+		}
+	}
+	for _, s := range []string{"", "10", "0/s", "5/y"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"30s": time.Second * 30,
+		"2h":  time.Hour * 2,
+		"1d":  time.Hour * 24,
+	}
+	for s, expected := range tests {
+		if a, err := parseAge(s); err != nil || a != expected {
+			t.Errorf("%v: got %v, %v, expected %v", s, a, err, expected)
+		}
+	}
+	for _, s := range []string{"", "d", "10", "0s", "5y"} {
+		if _, err := parseAge(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	doublings := 2
+	w, err := newWorker(nil, QueueConfig{
+		Name:              "q",
+		MinBackoffSeconds: 1,
+		MaxBackoffSeconds: 10,
+		MaxDoublings:      &doublings,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if d := w.backoff(i + 1); d != expected*time.Second {
+			t.Errorf("retry %v: got %v, expected %v", i+1, d, expected*time.Second)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	limit := 1
+	w, err := newWorker(nil, QueueConfig{Name: "q", RetryLimit: &limit, TaskAgeLimit: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		retries  int
+		age      time.Duration
+		expected bool
+	}{
+		{0, 0, false},
+		{1, 0, false},
+		{0, time.Hour * 2, false},
+		{1, time.Hour * 2, true},
+	}
+	for _, test := range tests {
+		st := &storedTask{Retries: test.retries, Added: now.Add(-test.age)}
+		if e := w.expired(st, now); e != test.expected {
+			t.Errorf("%v retries, age %v: got %v, expected %v", test.retries, test.age, e, test.expected)
+		}
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	limit := 1
+	b, err := Open(Config{
+		Database: filepath.Join(dir, "goread.db"),
+		Queues:   []QueueConfig{{Name: "q", Rate: "100/s", RetryLimit: &limit}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	retries := make(chan string, 10)
+	err = b.NewContext(nil).Queue().Add(backend.NewPOSTTask("/task", url.Values{"a": {"b"}}), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("a") != "b" {
+			t.Error("bad payload")
+		}
+		retries <- r.Header.Get("X-AppEngine-TaskRetryCount")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	for _, expected := range []string{"0", "1"} {
+		select {
+		case r := <-retries:
+			if r != expected {
+				t.Errorf("got retry %v, expected %v", r, expected)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("task did not run")
+		}
+	}
+	select {
+	case r := <-retries:
+		t.Errorf("retried past limit: %v", r)
+	case <-time.After(time.Millisecond * 500):
+	}
+}
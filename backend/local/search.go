@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/boltdb/bolt"
+	"github.com/mjibson/goread/backend"
+)
+
+// A search index is two buckets. The docs bucket holds each document's
+// words under its key, the escaped feed and story. The words bucket is
+// the inverted index: its keys are an escaped word followed by a document
+// key, and its values the document's time so that searches can filter
+// by feed and time without loading documents.
+const searchPrefix = "s/"
+
+func docsBucket(index string) []byte {
+	return []byte(searchPrefix + index + "/docs")
+}
+
+func wordsBucket(index string) []byte {
+	return []byte(searchPrefix + index + "/words")
+}
+
+// indexedDoc is a document as stored in the docs bucket.
+type indexedDoc struct {
+	Feed   string
+	Story  string
+	Time   time.Time
+	Fields [][]string
+}
+
+func docKey(feed, story string) []byte {
+	return appendEscaped(appendEscaped(nil, feed), story)
+}
+
+func timeValue(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+type searchIndex struct {
+	db   *bolt.DB
+	name string
+}
+
+func (x searchIndex) Put(docs []*backend.Document) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		db, err := tx.CreateBucketIfNotExists(docsBucket(x.name))
+		if err != nil {
+			return err
+		}
+		wb, err := tx.CreateBucketIfNotExists(wordsBucket(x.name))
+		if err != nil {
+			return err
+		}
+		for _, d := range docs {
+			k := docKey(d.Feed, d.Story)
+			if err := x.remove(db, wb, k); err != nil {
+				return err
+			}
+			doc := indexedDoc{
+				Feed:   d.Feed,
+				Story:  d.Story,
+				Time:   d.Time,
+				Fields: d.Fields(),
+			}
+			v, err := json.Marshal(&doc)
+			if err != nil {
+				return err
+			}
+			if err := db.Put(k, v); err != nil {
+				return err
+			}
+			t := timeValue(d.Time)
+			seen := make(map[string]bool)
+			for _, f := range doc.Fields {
+				for _, w := range f {
+					if seen[w] {
+						continue
+					}
+					seen[w] = true
+					if err := wb.Put(append(appendEscaped(nil, w), k...), t); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// remove deletes the document at k and its words.
+func (x searchIndex) remove(db, wb *bolt.Bucket, k []byte) error {
+	v := db.Get(k)
+	if v == nil {
+		return nil
+	}
+	var doc indexedDoc
+	if err := json.Unmarshal(v, &doc); err != nil {
+		return err
+	}
+	for _, f := range doc.Fields {
+		for _, w := range f {
+			if err := wb.Delete(append(appendEscaped(nil, w), k...)); err != nil {
+				return err
+			}
+		}
+	}
+	return db.Delete(k)
+}
+
+func (x searchIndex) Delete(docs []*backend.Document) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		db, wb := tx.Bucket(docsBucket(x.name)), tx.Bucket(wordsBucket(x.name))
+		if db == nil || wb == nil {
+			return nil
+		}
+		for _, d := range docs {
+			if err := x.remove(db, wb, docKey(d.Feed, d.Story)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hit is a candidate search result.
+type hit struct {
+	key  string
+	time int64
+}
+
+// before reports whether h sorts before o: newest first, then by key.
+func (h hit) before(o hit) bool {
+	if h.time != o.time {
+		return h.time > o.time
+	}
+	return h.key < o.key
+}
+
+// searchCursor encodes the last hit of a page.
+func searchCursor(h hit) string {
+	b := append(timeValue(time.Unix(0, h.time)), h.key...)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseSearchCursor(s string) (hit, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) < 8 {
+		return hit{}, backend.ErrBadCursor
+	}
+	return hit{key: string(b[8:]), time: int64(binary.BigEndian.Uint64(b))}, nil
+}
+
+// postings returns the documents with word, keyed by document key, with
+// their times.
+func postings(wb *bolt.Bucket, word string) map[string]int64 {
+	m := make(map[string]int64)
+	prefix := appendEscaped(nil, word)
+	c := wb.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		m[string(k[len(prefix):])] = int64(binary.BigEndian.Uint64(v))
+	}
+	return m
+}
+
+// Search finds candidates with the words index, filters them by feed and
+// time, and then loads them to check phrases and negated clauses.
+func (x searchIndex) Search(q *backend.SearchQuery) (*backend.SearchResult, error) {
+	var after hit
+	if q.Cursor != "" {
+		var err error
+		if after, err = parseSearchCursor(q.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	feeds := make(map[string]bool)
+	for _, f := range q.Feeds {
+		feeds[string(appendEscaped(nil, f))] = true
+	}
+	var stories map[string]bool
+	if q.Stories != nil {
+		stories = make(map[string]bool)
+		for f, ids := range q.Stories {
+			for _, id := range ids {
+				stories[string(docKey(f, id))] = true
+			}
+		}
+	}
+	res := &backend.SearchResult{}
+	err := x.db.View(func(tx *bolt.Tx) error {
+		db, wb := tx.Bucket(docsBucket(x.name)), tx.Bucket(wordsBucket(x.name))
+		if db == nil || wb == nil {
+			return nil
+		}
+		var candidates map[string]int64
+		for _, cl := range q.Clauses {
+			if cl.Not {
+				continue
+			}
+			union := make(map[string]int64)
+			for _, t := range cl.Terms {
+				if len(t.Words) == 0 {
+					continue
+				}
+				for k, v := range postings(wb, t.Words[0]) {
+					union[k] = v
+				}
+			}
+			if candidates == nil {
+				candidates = union
+				continue
+			}
+			for k := range candidates {
+				if _, ok := union[k]; !ok {
+					delete(candidates, k)
+				}
+			}
+		}
+		var hits []hit
+		for k, t := range candidates {
+			if stories != nil {
+				if !stories[k] {
+					continue
+				}
+			} else if len(feeds) > 0 {
+				_, rest, err := readEscaped([]byte(k))
+				if err != nil || !feeds[k[:len(k)-len(rest)]] {
+					continue
+				}
+			}
+			if !q.After.IsZero() && t < q.After.UnixNano() {
+				continue
+			}
+			if !q.Before.IsZero() && t >= q.Before.UnixNano() {
+				continue
+			}
+			h := hit{key: k, time: t}
+			if q.Cursor != "" && !after.before(h) {
+				continue
+			}
+			hits = append(hits, h)
+		}
+		sort.Slice(hits, func(i, j int) bool {
+			return hits[i].before(hits[j])
+		})
+		for _, h := range hits {
+			if q.Limit > 0 && len(res.Docs) == q.Limit {
+				res.Cursor = searchCursor(after)
+				break
+			}
+			var doc indexedDoc
+			if err := json.Unmarshal(db.Get([]byte(h.key)), &doc); err != nil {
+				return err
+			}
+			if !backend.Match(q.Clauses, doc.Fields) {
+				continue
+			}
+			res.Docs = append(res.Docs, &backend.Document{
+				Feed:  doc.Feed,
+				Story: doc.Story,
+				Time:  doc.Time,
+			})
+			after = h
+		}
+		return nil
+	})
+	return res, err
+}
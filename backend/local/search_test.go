@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := Open(Config{Database: filepath.Join(dir, "goread.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	x := b.NewContext(nil).Index("stories")
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	docs := []*backend.Document{
+		{Feed: "a", Story: "1", Time: day, Title: "Kubernetes release notes", Content: "The new release of Kubernetes."},
+		{Feed: "a", Story: "2", Time: day.Add(time.Hour), Title: "etcd", Author: "Notes Team"},
+		{Feed: "b", Story: "1", Time: day.Add(2 * time.Hour), Title: "Release", Content: "notes on the release"},
+	}
+	if err := x.Put(docs); err != nil {
+		t.Fatal(err)
+	}
+	// Replacing a document drops its old words.
+	docs[1].Content = "etcd operator"
+	if err := x.Put(docs[1:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	term := func(s string) backend.Term {
+		return backend.Term{Words: backend.Tokenize(s)}
+	}
+	all := func(terms ...string) []backend.Clause {
+		var cl []backend.Clause
+		for _, s := range terms {
+			cl = append(cl, backend.Clause{Terms: []backend.Term{term(s)}})
+		}
+		return cl
+	}
+	tests := []struct {
+		q    backend.SearchQuery
+		want []string
+	}{
+		{backend.SearchQuery{Clauses: all("release")}, []string{"b1", "a1"}},
+		{backend.SearchQuery{Clauses: all("release notes")}, []string{"a1"}},
+		{backend.SearchQuery{Clauses: all("release", "notes")}, []string{"b1", "a1"}},
+		{backend.SearchQuery{Clauses: []backend.Clause{{Terms: []backend.Term{term("kubernetes"), term("etcd")}}}}, []string{"a2", "a1"}},
+		{backend.SearchQuery{Clauses: append(all("notes"), backend.Clause{Terms: []backend.Term{term("kubernetes")}, Not: true})}, []string{"b1", "a2"}},
+		{backend.SearchQuery{Clauses: all("notes"), Feeds: []string{"a"}}, []string{"a2", "a1"}},
+		{backend.SearchQuery{Clauses: all("notes"), Feeds: []string{"a"}, Stories: map[string][]string{"a": {"1"}, "b": {"1"}}}, []string{"b1", "a1"}},
+		{backend.SearchQuery{Clauses: all("notes"), Stories: map[string][]string{}}, nil},
+		{backend.SearchQuery{Clauses: all("notes"), After: day.Add(time.Hour), Before: day.Add(2 * time.Hour)}, []string{"a2"}},
+		{backend.SearchQuery{Clauses: all("operator")}, []string{"a2"}},
+		{backend.SearchQuery{Clauses: all("missing")}, nil},
+	}
+	ids := func(r *backend.SearchResult) []string {
+		var s []string
+		for _, d := range r.Docs {
+			s = append(s, d.Feed+d.Story)
+		}
+		return s
+	}
+	for i, test := range tests {
+		r, err := x.Search(&test.q)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := ids(r); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: got %v, want %v", i, got, test.want)
+		}
+	}
+
+	// Page through results one at a time.
+	q := &backend.SearchQuery{Clauses: all("notes"), Limit: 1}
+	var got []string
+	for {
+		r, err := x.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ids(r)...)
+		if r.Cursor == "" {
+			break
+		}
+		q.Cursor = r.Cursor
+	}
+	if want := []string{"b1", "a2", "a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pages: got %v, want %v", got, want)
+	}
+
+	if err := x.Delete(docs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	r, err := x.Search(&backend.SearchQuery{Clauses: all("kubernetes")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Docs) != 0 {
+		t.Errorf("deleted document found: %v", ids(r))
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Property is a named value of an entity. Value is an int64, float64,
+// bool, string, []byte or time.Time.
+type Property struct {
+	Name    string
+	Value   interface{}
+	NoIndex bool
+	// Multiple is set for the values of a slice field.
+	Multiple bool
+}
+
+var (
+	typeOfTime  = reflect.TypeOf(time.Time{})
+	typeOfBytes = reflect.TypeOf([]byte(nil))
+)
+
+type field struct {
+	index   int
+	name    string
+	noIndex bool
+}
+
+// fields returns the saved fields of struct type t, named by their
+// datastore tags.
+func fields(t reflect.Type) []field {
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(sf.Tag.Get("datastore"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = sf.Name
+		}
+		fs = append(fs, field{
+			index:   i,
+			name:    name,
+			noIndex: len(tag) > 1 && tag[1] == "noindex",
+		})
+	}
+	return fs
+}
+
+// SaveStruct returns the properties of src, a pointer to a struct, for
+// Datastore implementations without their own encoding.
+func SaveStruct(src interface{}) ([]Property, error) {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("backend: expected struct, got %T", src)
+	}
+	var props []Property
+	for _, f := range fields(v.Type()) {
+		fv := v.Field(f.index)
+		if fv.Kind() == reflect.Slice && fv.Type() != typeOfBytes {
+			for j := 0; j < fv.Len(); j++ {
+				x, err := propertyValue(fv.Index(j))
+				if err != nil {
+					return nil, fmt.Errorf("backend: %s: %v", f.name, err)
+				}
+				props = append(props, Property{
+					Name:     f.name,
+					Value:    x,
+					NoIndex:  f.noIndex,
+					Multiple: true,
+				})
+			}
+			continue
+		}
+		x, err := propertyValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("backend: %s: %v", f.name, err)
+		}
+		props = append(props, Property{
+			Name:    f.name,
+			Value:   x,
+			NoIndex: f.noIndex,
+		})
+	}
+	return props, nil
+}
+
+func propertyValue(v reflect.Value) (interface{}, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice:
+		if v.Type() == typeOfBytes {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+	case reflect.Struct:
+		if v.Type() == typeOfTime {
+			return v.Interface().(time.Time), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported type %v", v.Type())
+}
+
+// LoadStruct sets the fields of dst, a pointer to a struct, from props.
+// Properties without a matching field are ignored.
+func LoadStruct(dst interface{}, props []Property) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("backend: expected pointer to struct, got %T", dst)
+	}
+	v = v.Elem()
+	byName := make(map[string]reflect.Value)
+	for _, f := range fields(v.Type()) {
+		fv := v.Field(f.index)
+		if fv.Kind() == reflect.Slice && fv.Type() != typeOfBytes {
+			fv.SetLen(0)
+		}
+		byName[f.name] = fv
+	}
+	for _, p := range props {
+		fv, ok := byName[p.Name]
+		if !ok {
+			continue
+		}
+		if fv.Kind() == reflect.Slice && fv.Type() != typeOfBytes {
+			ev := reflect.New(fv.Type().Elem()).Elem()
+			if err := setValue(ev, p.Value); err != nil {
+				return fmt.Errorf("backend: %s: %v", p.Name, err)
+			}
+			fv.Set(reflect.Append(fv, ev))
+		} else if err := setValue(fv, p.Value); err != nil {
+			return fmt.Errorf("backend: %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, x interface{}) error {
+	switch x := x.(type) {
+	case bool:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(x)
+			return nil
+		}
+	case int64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(x)
+			return nil
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+			v.SetUint(uint64(x))
+			return nil
+		}
+	case float64:
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			v.SetFloat(x)
+			return nil
+		}
+	case string:
+		if v.Kind() == reflect.String {
+			v.SetString(x)
+			return nil
+		}
+	case []byte:
+		if v.Type() == typeOfBytes {
+			v.SetBytes(x)
+			return nil
+		}
+	case time.Time:
+		if v.Type() == typeOfTime {
+			v.Set(reflect.ValueOf(x))
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot load %T into %v", x, v.Type())
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package backend
+
+import (
+	"net/url"
+	"time"
+)
+
+// Task is a POST request to Path with Payload as its form values.
+type Task struct {
+	Path    string
+	Payload url.Values
+	// Delay is how long to wait before running the task.
+	Delay time.Duration
+}
+
+func NewPOSTTask(path string, params url.Values) *Task {
+	return &Task{
+		Path:    path,
+		Payload: params,
+	}
+}
+
+// Queue adds tasks to named queues.
+type Queue interface {
+	Add(task *Task, queue string) error
+	AddMulti(tasks []*Task, queue string) error
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package backend
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrBadCursor is returned by Search when the query's cursor is invalid.
+var ErrBadCursor = errors.New("backend: bad search cursor")
+
+// Document is a story in a search index. Feed and Story identify it.
+type Document struct {
+	Feed  string
+	Story string
+	Time  time.Time
+
+	// The searched text. Content is plain text, not HTML.
+	Title   string
+	Author  string
+	Content string
+}
+
+// Term is a word, or a phrase of several words, that must appear in one
+// of a document's fields. Words are as returned by Tokenize.
+type Term struct {
+	Words []string
+}
+
+// Clause matches documents that contain any of its terms, or with Not
+// set, none of them.
+type Clause struct {
+	Terms []Term
+	Not   bool
+}
+
+// SearchQuery matches documents that match all of its clauses. At least
+// one clause must not be Not.
+type SearchQuery struct {
+	Clauses []Clause
+
+	// Feeds, if set, limits results to documents of those feeds.
+	Feeds []string
+	// Stories, if not nil, limits results to those stories, keyed by feed,
+	// instead of Feeds.
+	Stories map[string][]string
+	// After and Before, if set, limit results to documents whose Time is
+	// at or after After and before Before. Backends may round them to a
+	// day.
+	After, Before time.Time
+
+	// Cursor continues a previous search.
+	Cursor string
+	Limit  int
+}
+
+// SearchResult is a page of search results, newest first. Only the Feed,
+// Story and Time of Docs are set. Cursor is empty on the last page, and
+// pages with a Cursor have Docs.
+type SearchResult struct {
+	Docs   []*Document
+	Cursor string
+}
+
+// Index is a full-text search index of stories.
+type Index interface {
+	// Put adds docs to the index, replacing those with the same feed and
+	// story.
+	Put(docs []*Document) error
+	// Delete removes the documents with the feeds and stories of docs.
+	Delete(docs []*Document) error
+	Search(q *SearchQuery) (*SearchResult, error)
+}
+
+// Tokenize returns the lower case words of s.
+func Tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Fields returns the tokenized title, author and content of d.
+func (d *Document) Fields() [][]string {
+	return [][]string{
+		Tokenize(d.Title),
+		Tokenize(d.Author),
+		Tokenize(d.Content),
+	}
+}
+
+// Match reports whether a document with the tokenized fields matches all
+// clauses.
+func Match(clauses []Clause, fields [][]string) bool {
+	for _, cl := range clauses {
+		any := false
+		for _, t := range cl.Terms {
+			if matchTerm(fields, t.Words) {
+				any = true
+				break
+			}
+		}
+		if any == cl.Not {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTerm reports whether words appear in order in one of fields.
+func matchTerm(fields [][]string, words []string) bool {
+	if len(words) == 0 {
+		return false
+	}
+	for _, f := range fields {
+	next:
+		for i := 0; i+len(words) <= len(f); i++ {
+			for j, w := range words {
+				if f[i+j] != w {
+					continue next
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
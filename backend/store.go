@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Store reads and writes entities through a Datastore. Entity keys come
+// from struct tags, as with goon: `goon:"kind,K"` on a string field names
+// the kind, `goon:"id"` marks the string or int64 ID field, and
+// `goon:"parent"` marks a *Key parent field.
+type Store struct {
+	ds Datastore
+}
+
+func NewStore(ds Datastore) *Store {
+	return &Store{ds: ds}
+}
+
+// Key returns the key of src, or nil if it has none.
+func (s *Store) Key(src interface{}) *Key {
+	k, _, err := structKey(src)
+	if err != nil {
+		return nil
+	}
+	return k
+}
+
+// Kind returns the kind of src, or "" on error.
+func (s *Store) Kind(src interface{}) string {
+	if k := s.Key(src); k != nil {
+		return k.Kind()
+	}
+	return ""
+}
+
+// Get loads dst, a pointer to a struct, by its key.
+func (s *Store) Get(dst interface{}) error {
+	if err := s.GetMulti([]interface{}{dst}); err != nil {
+		if me, ok := err.(MultiError); ok {
+			return me[0]
+		}
+		return err
+	}
+	return nil
+}
+
+// GetMulti is a batch version of Get. dst must be a []*S, *[]*S or
+// []interface{} of struct pointers.
+func (s *Store) GetMulti(dst interface{}) error {
+	keys, srcs, err := extractKeys(dst, false)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.ds.GetMulti(keys, srcs)
+}
+
+// Put saves src, a pointer to a struct. If its key is incomplete the
+// allocated ID is set on src.
+func (s *Store) Put(src interface{}) (*Key, error) {
+	keys, err := s.PutMulti([]interface{}{src})
+	if err != nil {
+		if me, ok := err.(MultiError); ok {
+			return nil, me[0]
+		}
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// PutMulti is a batch version of Put.
+func (s *Store) PutMulti(src interface{}) ([]*Key, error) {
+	keys, srcs, err := extractKeys(src, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	keys, err = s.ds.PutMulti(keys, srcs)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		setStructKey(srcs[i], k)
+	}
+	return keys, nil
+}
+
+func (s *Store) Delete(key *Key) error {
+	return s.DeleteMulti([]*Key{key})
+}
+
+func (s *Store) DeleteMulti(keys []*Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.ds.DeleteMulti(keys)
+}
+
+// Run runs q. Results loaded by the iterator have their keys set.
+func (s *Store) Run(q *Query) Iterator {
+	p, err := q.Plan()
+	if err != nil {
+		return errIterator{err}
+	}
+	return keyIterator{s.ds.Run(p)}
+}
+
+// GetAll runs q and returns the keys of all results. Unless dst is nil,
+// results are appended to it, which must be a *[]S or *[]*S.
+func (s *Store) GetAll(q *Query, dst interface{}) ([]*Key, error) {
+	var sv reflect.Value
+	var et reflect.Type
+	if dst != nil {
+		sv = reflect.ValueOf(dst)
+		if sv.Kind() != reflect.Ptr || sv.Elem().Kind() != reflect.Slice {
+			return nil, fmt.Errorf("backend: GetAll dst must be a pointer to a slice, got %T", dst)
+		}
+		sv = sv.Elem()
+		et = sv.Type().Elem()
+	} else {
+		q = q.KeysOnly()
+	}
+	var keys []*Key
+	it := s.Run(q)
+	for {
+		var ev reflect.Value
+		var d interface{}
+		if dst != nil {
+			if et.Kind() == reflect.Ptr {
+				ev = reflect.New(et.Elem())
+			} else {
+				ev = reflect.New(et)
+			}
+			d = ev.Interface()
+		}
+		k, err := it.Next(d)
+		if err == Done {
+			break
+		} else if err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+		if dst != nil {
+			if et.Kind() != reflect.Ptr {
+				ev = ev.Elem()
+			}
+			sv.Set(reflect.Append(sv, ev))
+		}
+	}
+	return keys, nil
+}
+
+func (s *Store) Count(q *Query) (int, error) {
+	p, err := q.Plan()
+	if err != nil {
+		return 0, err
+	}
+	return s.ds.Count(p)
+}
+
+// RunInTransaction runs f in a transaction. f should use the Store it is
+// passed for all its operations.
+func (s *Store) RunInTransaction(f func(*Store) error) error {
+	return s.ds.RunInTransaction(func(ds Datastore) error {
+		return f(NewStore(ds))
+	})
+}
+
+type keyIterator struct {
+	Iterator
+}
+
+func (it keyIterator) Next(dst interface{}) (*Key, error) {
+	k, err := it.Iterator.Next(dst)
+	if err == nil && dst != nil {
+		setStructKey(dst, k)
+	}
+	return k, err
+}
+
+type errIterator struct {
+	err error
+}
+
+func (it errIterator) Next(dst interface{}) (*Key, error) { return nil, it.err }
+func (it errIterator) Cursor() (Cursor, error)            { return Cursor{}, it.err }
+
+// extractKeys returns the keys of and pointers to each element of src.
+func extractKeys(src interface{}, put bool) ([]*Key, []interface{}, error) {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() != reflect.Slice {
+		return nil, nil, fmt.Errorf("backend: value must be a slice or pointer-to-slice, got %T", src)
+	}
+	keys := make([]*Key, v.Len())
+	srcs := make([]interface{}, v.Len())
+	for i := range keys {
+		vi := v.Index(i)
+		if vi.Kind() == reflect.Interface {
+			vi = vi.Elem()
+		}
+		if vi.Kind() == reflect.Struct {
+			vi = vi.Addr()
+		}
+		key, hasStringID, err := structKey(vi.Interface())
+		if err != nil {
+			return nil, nil, err
+		}
+		if key.Incomplete() && (!put || hasStringID) {
+			return nil, nil, fmt.Errorf("backend: %v has no id", key)
+		}
+		keys[i] = key
+		srcs[i] = vi.Interface()
+	}
+	return keys, srcs, nil
+}
+
+// structKey returns the key of src based on its tags. The second return
+// value is true if src has a string id.
+func structKey(src interface{}) (key *Key, hasStringID bool, err error) {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() != reflect.Struct {
+		return nil, false, fmt.Errorf("backend: expected struct, got %T", src)
+	}
+	t := v.Type()
+	var kind, stringID string
+	var intID int64
+	var parent *Key
+	for i := 0; i < v.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("goon"), ",")
+		vf := v.Field(i)
+		switch tag[0] {
+		case "id":
+			switch vf.Kind() {
+			case reflect.Int64:
+				intID = vf.Int()
+			case reflect.String:
+				stringID = vf.String()
+				hasStringID = true
+			default:
+				return nil, false, fmt.Errorf("backend: id field must be int64 or string in %v", t.Name())
+			}
+		case "kind":
+			if vf.Kind() == reflect.String {
+				kind = vf.String()
+				if kind == "" && len(tag) > 1 {
+					kind = tag[1]
+				}
+			}
+		case "parent":
+			if !vf.CanInterface() {
+				continue
+			}
+			if p, ok := vf.Interface().(*Key); ok {
+				parent = p
+			}
+		}
+	}
+	if kind == "" {
+		kind = t.Name()
+	}
+	return NewKey(kind, stringID, intID, parent), hasStringID, nil
+}
+
+func setStructKey(dst interface{}, key *Key) {
+	v := reflect.Indirect(reflect.ValueOf(dst))
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		vf := v.Field(i)
+		if !vf.CanSet() {
+			continue
+		}
+		switch strings.Split(t.Field(i).Tag.Get("goon"), ",")[0] {
+		case "id":
+			switch vf.Kind() {
+			case reflect.Int64:
+				vf.SetInt(key.IntID())
+			case reflect.String:
+				vf.SetString(key.StringID())
+			}
+		case "parent":
+			if vf.Type() == reflect.TypeOf(key) {
+				vf.Set(reflect.ValueOf(key.Parent()))
+			}
+		}
+	}
+}
@@ -18,6 +18,7 @@ package goapp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -25,12 +26,7 @@ import (
 	"strings"
 	"time"
 
-	mpg "github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler_gae"
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
-
-	"appengine/datastore"
-	"appengine/urlfetch"
-	"appengine/user"
+	"github.com/mjibson/goread/backend"
 )
 
 type Plan struct {
@@ -40,9 +36,9 @@ type Plan struct {
 
 // parent: User, key: 1
 type UserCharge struct {
-	_kind  string         `goon:"kind,UC"`
-	Id     int64          `datastore:"-" goon:"id"`
-	Parent *datastore.Key `datastore:"-" goon:"parent"`
+	_kind  string       `goon:"kind,UC"`
+	Id     int64        `datastore:"-" goon:"id"`
+	Parent *backend.Key `datastore:"-" goon:"parent"`
 
 	Customer string    `datastore:"c,noindex" json:"-"`
 	Created  time.Time `datastore:"r,noindex"`
@@ -75,9 +71,9 @@ type StripeError struct {
 	} `json:"error"`
 }
 
-func Charge(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func Charge(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	uc := &UserCharge{Id: 1, Parent: gn.Key(&u)}
 	if err := gn.Get(&u); err != nil {
@@ -90,7 +86,7 @@ func Charge(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	if err := gn.Get(uc); err == nil && len(uc.Customer) > 0 {
 		serveError(w, fmt.Errorf("You're already subscribed."))
 		return
-	} else if err != datastore.ErrNoSuchEntity {
+	} else if err != backend.ErrNoSuchEntity {
 		serveError(w, err)
 		return
 	}
@@ -108,7 +104,7 @@ func Charge(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		defer resp.Body.Close()
 		b, _ := ioutil.ReadAll(resp.Body)
 		if err := json.Unmarshal(b, &se); err == nil {
-			serveError(w, fmt.Errorf(se.Error.Message))
+			serveError(w, errors.New(se.Error.Message))
 		} else {
 			serveError(w, fmt.Errorf("Error"))
 		}
@@ -124,7 +120,7 @@ func Charge(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func setCharge(c mpg.Context, r *http.Response) (*UserCharge, error) {
+func setCharge(c Context, r *http.Response) (*UserCharge, error) {
 	var sc StripeCustomer
 	defer r.Body.Close()
 	b, err := ioutil.ReadAll(r.Body)
@@ -134,15 +130,15 @@ func setCharge(c mpg.Context, r *http.Response) (*UserCharge, error) {
 	if err := json.Unmarshal(b, &sc); err != nil {
 		return nil, err
 	}
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	uc := UserCharge{Id: 1, Parent: gn.Key(&u)}
-	if err := gn.RunInTransaction(func(gn *goon.Goon) error {
-		if err := gn.Get(&u); err != nil && err != datastore.ErrNoSuchEntity {
+	if err := gn.RunInTransaction(func(gn *backend.Store) error {
+		if err := gn.Get(&u); err != nil && err != backend.ErrNoSuchEntity {
 			return err
 		}
-		if err := gn.Get(&uc); err != nil && err != datastore.ErrNoSuchEntity {
+		if err := gn.Get(&uc); err != nil && err != backend.ErrNoSuchEntity {
 			return err
 		}
 		u.Account = APaid
@@ -155,15 +151,15 @@ func setCharge(c mpg.Context, r *http.Response) (*UserCharge, error) {
 		uc.Plan = sc.Subscription.Plan.Id
 		_, err := gn.PutMulti([]interface{}{&u, &uc})
 		return err
-	}, nil); err != nil {
+	}); err != nil {
 		return nil, err
 	}
 	return &uc, nil
 }
 
-func Account(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func Account(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	uc := &UserCharge{Id: 1, Parent: gn.Key(&u)}
 	if err := gn.Get(uc); err == nil {
@@ -177,13 +173,13 @@ func Account(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		}
 		b, _ := json.Marshal(&uc)
 		w.Write(b)
-	} else if err != datastore.ErrNoSuchEntity {
+	} else if err != backend.ErrNoSuchEntity {
 		serveError(w, err)
 		return
 	}
 }
 
-func Uncheckout(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func Uncheckout(c Context, w http.ResponseWriter, r *http.Request) {
 	uc, err := doUncheckout(c)
 	if err != nil {
 		serveError(w, err)
@@ -193,9 +189,9 @@ func Uncheckout(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func doUncheckout(c mpg.Context) (*UserCharge, error) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func doUncheckout(c Context) (*UserCharge, error) {
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	uc := UserCharge{Id: 1, Parent: gn.Key(&u)}
 	if err := gn.Get(&u); err != nil {
@@ -211,8 +207,8 @@ func doUncheckout(c mpg.Context) (*UserCharge, error) {
 		c.Errorf("%s", resp.Body)
 		c.Errorf("stripe delete error, but proceeding")
 	}
-	if err := gn.RunInTransaction(func(gn *goon.Goon) error {
-		if err := gn.Get(&u); err != nil && err != datastore.ErrNoSuchEntity {
+	if err := gn.RunInTransaction(func(gn *backend.Store) error {
+		if err := gn.Get(&u); err != nil && err != backend.ErrNoSuchEntity {
 			return err
 		}
 		u.Account = AFree
@@ -224,18 +220,15 @@ func doUncheckout(c mpg.Context) (*UserCharge, error) {
 		}
 		_, err := gn.Put(&u)
 		return err
-	}, nil); err != nil {
+	}); err != nil {
 		return nil, err
 	}
 	return &uc, nil
 }
 
-func stripe(c mpg.Context, method, urlStr, body string) (*http.Response, error) {
+func stripe(c Context, method, urlStr, body string) (*http.Response, error) {
 	cl := &http.Client{
-		Transport: &urlfetch.Transport{
-			Context:  c,
-			Deadline: time.Minute,
-		},
+		Transport: c.Transport(time.Minute),
 	}
 	req, err := http.NewRequest(method, fmt.Sprintf("https://api.stripe.com/v1/%s", urlStr), strings.NewReader(body))
 	if err != nil {
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Command goread serves goread without App Engine. It stores everything
+// in a bolt database, runs the task queues and cron jobs of queue.yaml and
+// cron.yaml itself. Users sign in with the providers of AUTH_PROVIDERS;
+// auth.Google trusts a reverse proxy in front of it (see
+// local.Config.UserHeader).
+//
+// Run it from goread's app directory, where the templates and static
+// files are:
+//
+//	cd app && goread -config ../cmd/goread/goread.sample.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/gorilla/mux"
+
+	app "github.com/mjibson/goread"
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/backend/local"
+)
+
+type Config struct {
+	// Listen is the address to serve on.
+	Listen string
+	// PubSubHubbub subscribes to feed hubs, which must be able to reach
+	// goread at PUBSUBHUBBUB_HOST. It is off by default.
+	PubSubHubbub bool
+	local.Config
+}
+
+func main() {
+	configPath := flag.String("config", "goread.json", "configuration file")
+	flag.Parse()
+
+	cfg := Config{Listen: ":8080"}
+	f, err := os.Open(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = json.NewDecoder(f).Decode(&cfg)
+	f.Close()
+	if err != nil {
+		log.Fatalf("%v: %v", *configPath, err)
+	}
+	if cfg.Database == "" {
+		cfg.Database = "goread.db"
+	}
+
+	b, err := local.Open(cfg.Config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.ENABLE_PUBSUBHUBBUB = cfg.PubSubHubbub
+	router := new(mux.Router)
+	app.RegisterHandlers(router, b)
+	// Tasks and cron jobs go straight to the router, so they skip the
+	// access checks of requests from outside.
+	if err := b.Start(router); err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: handler(b, router),
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	log.Printf("serving on %v", cfg.Listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Print(err)
+	}
+	if err := b.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// handler serves the static files of app.yaml and restricts access to
+// router as its login settings do.
+func handler(b backend.Backend, router http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	static := http.FileServer(http.Dir("static"))
+	mux.Handle("/static/", http.StripPrefix("/static/", static))
+	for _, name := range []string{"service-worker.js", "manifest.json", "index.html"} {
+		mux.Handle("/"+name, static)
+	}
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/favicon.png")
+	})
+	// miniprofiler registers its resources on the default mux.
+	mux.Handle("/mini-profiler-resources/", http.DefaultServeMux)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// goread checks /user/ itself, which also accepts API tokens.
+		p := r.URL.Path
+		if strings.HasPrefix(p, "/admin/") || strings.HasPrefix(p, "/tasks/") {
+			u := app.CurrentUser(r)
+			if u == nil && r.Method == "GET" {
+				v := url.Values{"dest": {r.URL.RequestURI()}}
+				http.Redirect(w, r, "/login?"+v.Encode(), http.StatusFound)
+				return
+			} else if u == nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			} else if !u.Admin {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		router.ServeHTTP(w, r)
+	})
+	return mux
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler"
+	"github.com/mjibson/goread/auth"
+	"github.com/mjibson/goread/backend"
+)
+
+// be is the backend goread runs on, set by RegisterHandlers.
+var be backend.Backend
+
+// Context is passed to handlers: the backend's context for the request,
+// profiled by miniprofiler.
+type Context struct {
+	backend.Context
+	miniprofiler.Timer
+}
+
+// Step profiles f as a child step named name.
+func (c Context) Step(name string, f func(Context)) {
+	if c.Timer != nil {
+		c.Timer.Step(name, func(t miniprofiler.Timer) {
+			f(Context{
+				Context: c.Context,
+				Timer:   t,
+			})
+		})
+	} else {
+		f(c)
+	}
+}
+
+func newHandler(f func(Context, http.ResponseWriter, *http.Request)) http.Handler {
+	return miniprofiler.NewHandler(func(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
+		t.SetName(miniprofiler.FuncName(f))
+		f(Context{
+			Context: newContext(r),
+			Timer:   t,
+		}, w, r)
+	})
+}
+
+// newContext returns the backend's context for r with the user of r's
+// session as its user.
+func newContext(r *http.Request) backend.Context {
+	c := be.NewContext(r)
+	return userContext{c, sessionUser(c, r), false}
+}
+
+// CurrentUser returns the user signed in to r's session, or nil.
+func CurrentUser(r *http.Request) *backend.User {
+	return sessionUser(be.NewContext(r), r)
+}
+
+func sessionUser(c backend.Context, r *http.Request) *backend.User {
+	u, _ := sessions(c).Get(r)
+	if u == nil {
+		return nil
+	}
+	for _, a := range ADMIN_EMAILS {
+		if strings.EqualFold(a, u.Email) {
+			u.Admin = true
+		}
+	}
+	return u
+}
+
+var (
+	sessionsLock sync.Mutex
+	sessionStore *auth.Sessions
+)
+
+// sessionKeyID is the id of the SessionKey that signs sessions.
+const sessionKeyID = 1
+
+// sessions returns the session store, signed with SESSION_KEY or else a
+// random key kept in the datastore.
+func sessions(c backend.Context) *auth.Sessions {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if sessionStore != nil {
+		return sessionStore
+	}
+	s := &auth.Sessions{
+		Key:    []byte(SESSION_KEY),
+		Cookie: "goread-session",
+		MaxAge: time.Hour * 24 * 30,
+	}
+	if len(s.Key) == 0 {
+		key, err := storedKey(c, sessionKeyID)
+		if err != nil {
+			// Sign with a throwaway key, so no session is valid, and
+			// try again next time.
+			c.Errorf("session key: %v", err)
+			s.Key = make([]byte, 32)
+			rand.Read(s.Key)
+			return s
+		}
+		s.Key = key
+	}
+	sessionStore = s
+	return s
+}
+
+// storedKey returns the random SessionKey with id, creating it if there
+// is none.
+func storedKey(c backend.Context, id int64) ([]byte, error) {
+	sk := &SessionKey{Id: id}
+	err := c.Store().RunInTransaction(func(gn *backend.Store) error {
+		if err := gn.Get(sk); err != backend.ErrNoSuchEntity {
+			return err
+		}
+		sk.Key = make([]byte, 32)
+		if _, err := rand.Read(sk.Key); err != nil {
+			return err
+		}
+		_, err := gn.Put(sk)
+		return err
+	})
+	return sk.Key, err
+}
+
+// Profiles are shown on dev servers and to admins, and kept in memcache.
+func setupMiniprofiler() {
+	miniprofiler.Enable = func(r *http.Request) bool {
+		if be.IsDev() {
+			return true
+		}
+		u := CurrentUser(r)
+		return u != nil && u.Admin
+	}
+	miniprofiler.Store = func(r *http.Request, p *miniprofiler.Profile) {
+		be.NewContext(r).Cache().Set(&backend.Item{
+			Key:   profileKey(p.Id),
+			Value: p.Json(),
+		})
+	}
+	miniprofiler.Get = func(r *http.Request, id string) *miniprofiler.Profile {
+		item, err := be.NewContext(r).Cache().Get(profileKey(id))
+		if err != nil {
+			return nil
+		}
+		return miniprofiler.ProfileFromJson(item.Value)
+	}
+}
+
+func profileKey(id string) string {
+	return fmt.Sprintf("mini-profiler-results:%s", id)
+}
@@ -21,20 +21,16 @@ import (
 	"net/http"
 	"time"
 
-	mpg "github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler_gae"
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
-
-	"appengine/datastore"
-	"appengine/user"
+	"github.com/mjibson/goread/backend"
 )
 
-func ClearRead(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func ClearRead(c Context, w http.ResponseWriter, r *http.Request) {
 	if !isDevServer {
 		return
 	}
 
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+	cu := c.User()
+	gn := c.Store()
 	u := &User{Id: cu.ID}
 	ud := &UserData{Id: "data", Parent: gn.Key(u)}
 	if err := gn.Get(u); err != nil {
@@ -45,16 +41,17 @@ func ClearRead(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	u.Read = time.Time{}
 	ud.Read = nil
 	gn.PutMulti([]interface{}{u, ud})
+	deleteUserRead(gn, cu.ID)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func ClearFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func ClearFeeds(c Context, w http.ResponseWriter, r *http.Request) {
 	if !isDevServer {
 		return
 	}
 
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+	cu := c.User()
+	gn := c.Store()
 	done := make(chan bool)
 	go func() {
 		u := &User{Id: cu.ID}
@@ -73,7 +70,7 @@ func ClearFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}()
 	del := func(kind string) {
 		defer func() { done <- true }()
-		q := datastore.NewQuery(kind).KeysOnly()
+		q := backend.NewQuery(kind).KeysOnly()
 		keys, err := gn.GetAll(q, nil)
 		if err != nil {
 			c.Errorf("err: %v", err.Error())
@@ -91,6 +88,7 @@ func ClearFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		&StoryContent{},
 		&Log{},
 		&UserOpml{},
+		&UserRead{},
 	}
 	for _, i := range types {
 		k := gn.Kind(i)
@@ -104,7 +102,7 @@ func ClearFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("%s?url=http://localhost:8080%s", routeUrl("add-subscription"), routeUrl("test-atom")), http.StatusFound)
 }
 
-func TestAtom(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func TestAtom(c Context, w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(testAtom))
 }
 
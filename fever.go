@@ -0,0 +1,411 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// Fever API, as spoken by third-party clients. Clients sign in with the MD5
+// of "email:token", where token is an API token, and send all requests to
+// /fever/?api with flags naming what to return.
+
+const feverItemsLimit = 50
+
+// feverID returns the integer id of a feed or group.
+func feverID(s string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	id := int64(h.Sum32() &^ (1 << 31))
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+func feverIDs(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(s, ",")
+}
+
+type feverFeed struct {
+	Id                int64  `json:"id"`
+	FaviconId         int64  `json:"favicon_id"`
+	Title             string `json:"title"`
+	Url               string `json:"url"`
+	SiteUrl           string `json:"site_url"`
+	IsSpark           int    `json:"is_spark"`
+	LastUpdatedOnTime int64  `json:"last_updated_on_time"`
+}
+
+type feverGroup struct {
+	Id    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+type feverFeedsGroup struct {
+	GroupId int64  `json:"group_id"`
+	FeedIds string `json:"feed_ids"`
+}
+
+type feverItem struct {
+	Id            int64  `json:"id"`
+	FeedId        int64  `json:"feed_id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	Html          string `json:"html"`
+	Url           string `json:"url"`
+	IsSaved       int    `json:"is_saved"`
+	IsRead        int    `json:"is_read"`
+	CreatedOnTime int64  `json:"created_on_time"`
+}
+
+func Fever(c Context, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	o := map[string]interface{}{
+		"api_version": 3,
+		"auth":        0,
+	}
+	u, ut, err := feverUser(c.Store(), r.FormValue("api_key"))
+	if err == errBadToken {
+		serveJSON(w, o)
+		return
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	useToken(c, ut)
+	c = asUser(c, u, ut)
+	o["auth"] = 1
+	o["last_refreshed_on_time"] = time.Now().Unix()
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if r.FormValue("mark") != "" {
+		if !ut.allows(scopeFull) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := feverMark(c, st, r); err != nil {
+			serveError(w, err)
+			return
+		}
+		// Marking everything read moves the unread date.
+		if st, err = loadReaderState(c); err != nil {
+			serveError(w, err)
+			return
+		}
+		// Reply with the changed ids.
+		switch r.FormValue("as") {
+		case "read", "unread":
+			r.Form["unread_item_ids"] = nil
+		case "saved", "unsaved":
+			r.Form["saved_item_ids"] = nil
+		}
+	}
+	flag := func(name string) bool {
+		_, ok := r.Form[name]
+		return ok
+	}
+	if flag("groups") || flag("feeds") {
+		groups := []feverGroup{}
+		feedsGroups := []feverFeedsGroup{}
+		for _, ol := range st.opml.Outline {
+			if ol.XmlUrl != "" {
+				continue
+			}
+			g := feverGroup{feverID(ol.Title), ol.Title}
+			var ids []int64
+			for _, so := range ol.Outline {
+				ids = append(ids, feverID(so.XmlUrl))
+			}
+			groups = append(groups, g)
+			feedsGroups = append(feedsGroups, feverFeedsGroup{g.Id, feverIDs(ids)})
+		}
+		if flag("groups") {
+			o["groups"] = groups
+		}
+		o["feeds_groups"] = feedsGroups
+	}
+	if flag("feeds") {
+		feeds := make([]*Feed, len(st.feeds))
+		for i, f := range st.feeds {
+			feeds[i] = &Feed{Url: f}
+		}
+		c.Store().GetMulti(feeds)
+		ffs := make([]feverFeed, len(feeds))
+		for i, f := range feeds {
+			ffs[i] = feverFeed{
+				Id:                feverID(f.Url),
+				Title:             st.titles[f.Url],
+				Url:               f.Url,
+				SiteUrl:           f.Link,
+				LastUpdatedOnTime: f.Updated.Unix(),
+			}
+			if ffs[i].Title == "" {
+				ffs[i].Title = f.Title
+			}
+			if f.Updated.IsZero() {
+				ffs[i].LastUpdatedOnTime = 0
+			}
+		}
+		o["feeds"] = ffs
+	}
+	if flag("favicons") {
+		// goread keeps icon urls, not icons
+		o["favicons"] = []struct{}{}
+	}
+	if flag("links") {
+		o["links"] = []struct{}{}
+	}
+	if flag("items") {
+		items, total, err := feverItems(c, st, r)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		o["items"] = items
+		o["total_items"] = total
+	}
+	if flag("unread_item_ids") {
+		stories, err := queryStories(c, &storyQuery{
+			feeds:     st.feeds,
+			limit:     numStoriesLimit,
+			ascending: true,
+			after:     st.u.Read,
+			keep:      unreadFilter(c, st),
+		})
+		if err == nil {
+			err = putStoryRefs(c, stories)
+		}
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		o["unread_item_ids"] = feverIDs(storyItemIDs(stories))
+	}
+	if flag("saved_item_ids") {
+		stories, err := savedStories(c, st)
+		if err == nil {
+			err = putStoryRefs(c, stories)
+		}
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		o["saved_item_ids"] = feverIDs(storyItemIDs(stories))
+	}
+	serveJSON(w, o)
+}
+
+func storyItemIDs(stories []*Story) []int64 {
+	ids := make([]int64, len(stories))
+	for i, s := range stories {
+		ids[i] = itemID(s)
+	}
+	return ids
+}
+
+// unreadFilter returns a storyQuery keep function selecting unread stories.
+func unreadFilter(c Context, st *readerState) func(*Story) bool {
+	read, err := getRead(c.Store(), st.u.Id, st.feeds)
+	if err != nil {
+		c.Errorf("get read: %v", err)
+	}
+	return func(s *Story) bool {
+		return !st.isRead(read, s)
+	}
+}
+
+// savedStories returns the stories the user starred.
+func savedStories(c Context, st *readerState) ([]*Story, error) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserStar{})).
+		Ancestor(st.uk).
+		KeysOnly().
+		Limit(numStoriesLimit)
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	stories := make([]*Story, len(keys))
+	for i, k := range keys {
+		stories[i] = &Story{
+			Id:     k.StringID(),
+			Parent: gn.Key(&Feed{Url: k.Parent().StringID()}),
+		}
+	}
+	err = gn.GetMulti(stories)
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
+		return nil, err
+	}
+	var found []*Story
+	for i, s := range stories {
+		if !backend.NotFound(err, i) {
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+// feverItems returns the items selected by the with_ids, max_id or
+// since_id parameters and the number of stories in the user's feeds.
+func feverItems(c Context, st *readerState, r *http.Request) ([]*feverItem, int, error) {
+	var stories []*Story
+	var err error
+	if ids := r.FormValue("with_ids"); ids != "" {
+		var iids []int64
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				continue
+			}
+			iids = append(iids, id)
+			if len(iids) == feverItemsLimit {
+				break
+			}
+		}
+		stories, err = lookupItems(c.Store(), iids)
+	} else {
+		q := &storyQuery{
+			feeds:     st.feeds,
+			limit:     feverItemsLimit,
+			ascending: true,
+		}
+		if max, err := strconv.ParseInt(r.FormValue("max_id"), 10, 64); err == nil && max > 0 {
+			q.max = max
+			q.ascending = false
+		} else {
+			q.since, _ = strconv.ParseInt(r.FormValue("since_id"), 10, 64)
+		}
+		stories, err = queryStories(c, q)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	infos, err := storyInfos(c, st, stories)
+	if err != nil {
+		return nil, 0, err
+	}
+	items := make([]*feverItem, len(stories))
+	for i, s := range stories {
+		items[i] = &feverItem{
+			Id:            itemID(s),
+			FeedId:        feverID(s.Parent.StringID()),
+			Title:         s.Title,
+			Author:        s.Author,
+			Html:          infos[i].content,
+			Url:           s.Link,
+			CreatedOnTime: s.Published.Unix(),
+		}
+		if s.Published.IsZero() {
+			items[i].CreatedOnTime = s.Created.Unix()
+		}
+		if infos[i].read {
+			items[i].IsRead = 1
+		}
+		if infos[i].starred {
+			items[i].IsSaved = 1
+		}
+	}
+	return items, countStories(c, st.feeds), nil
+}
+
+// countStories returns the number of stories in feeds.
+func countStories(c Context, feeds []string) int {
+	var lock sync.Mutex
+	var total int
+	var wg sync.WaitGroup
+	for _, f := range feeds {
+		wg.Add(1)
+		go func(f string) {
+			defer wg.Done()
+			gn := c.Store()
+			q := backend.NewQuery(gn.Kind(&Story{})).Ancestor(gn.Key(&Feed{Url: f}))
+			n, err := gn.Count(q)
+			if err != nil {
+				c.Errorf("count %v: %v", f, err)
+				return
+			}
+			lock.Lock()
+			total += n
+			lock.Unlock()
+		}(f)
+	}
+	wg.Wait()
+	return total
+}
+
+// feverMark handles the mark, as, id and before parameters.
+func feverMark(c Context, st *readerState, r *http.Request) error {
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	before := time.Now()
+	if b, err := strconv.ParseInt(r.FormValue("before"), 10, 64); err == nil && b > 0 {
+		before = time.Unix(b, 0)
+	}
+	switch r.FormValue("mark") {
+	case "item":
+		stories, err := lookupItems(c.Store(), []int64{id})
+		if err != nil {
+			return err
+		}
+		byFeed := storiesByFeed(stories)
+		switch r.FormValue("as") {
+		case "read":
+			return setRead(c, st.uk, byFeed, true)
+		case "unread":
+			return setRead(c, st.uk, byFeed, false)
+		case "saved":
+			return setStarred(c, st.uk, byFeed, true)
+		case "unsaved":
+			return setStarred(c, st.uk, byFeed, false)
+		}
+	case "feed":
+		for _, f := range st.feeds {
+			if feverID(f) == id {
+				return markFeedsRead(c, st, []string{f}, before)
+			}
+		}
+	case "group":
+		if id == 0 {
+			// Kindling, all feeds
+			return markAllRead(c, st.uk, before)
+		}
+		var feeds []string
+		for _, f := range st.feeds {
+			if l := st.labels[f]; l != "" && feverID(l) == id {
+				feeds = append(feeds, f)
+			}
+		}
+		if len(feeds) > 0 {
+			return markFeedsRead(c, st, feeds, before)
+		}
+	}
+	return nil
+}
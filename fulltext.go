@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/golang.org/x/text/transform"
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/readability"
+	"github.com/mjibson/goread/sanitizer"
+)
+
+// Full text extraction is for feeds that only publish summaries. Users
+// opt in per feed, and while any subscriber of a feed wants it, the pages
+// of its new stories are fetched and their articles, found by
+// readability, stored as a second StoryContent. GetContents returns it to
+// the users who opted in.
+
+const (
+	// fullContentID is the StoryContent key of extracted articles.
+	fullContentID = 2
+	// maxPageSize is the largest story page fetched.
+	maxPageSize = 1 << 21
+	// maxFullText is the largest article stored.
+	maxFullText = 1 << 18
+	// extractBatch is the most stories extracted by a task.
+	extractBatch = 20
+)
+
+// fullTextFeeds returns the feeds of o whose full text the user wants.
+func fullTextFeeds(o *Opml) map[string]bool {
+	feeds := make(map[string]bool)
+	var walk func([]*OpmlOutline)
+	walk = func(outlines []*OpmlOutline) {
+		for _, o := range outlines {
+			if o.FullText && o.XmlUrl != "" {
+				feeds[o.XmlUrl] = true
+			}
+			walk(o.Outline)
+		}
+	}
+	walk(o.Outline)
+	return feeds
+}
+
+// countFullText updates the full text subscriber counts of the feeds
+// wanted in only one of from and to, the before and after of a change to
+// a user's subscriptions.
+func countFullText(c Context, from, to map[string]bool) {
+	delta := make(map[string]int)
+	for f := range from {
+		if !to[f] {
+			delta[f]--
+		}
+	}
+	for f := range to {
+		if !from[f] {
+			delta[f]++
+		}
+	}
+	for url, d := range delta {
+		err := c.Store().RunInTransaction(func(gn *backend.Store) error {
+			f := &Feed{Url: url}
+			if err := gn.Get(f); err != nil {
+				return err
+			}
+			if f.FullText += d; f.FullText < 0 {
+				f.FullText = 0
+			}
+			_, err := gn.Put(f)
+			return err
+		})
+		if err != nil && err != backend.ErrNoSuchEntity {
+			c.Errorf("full text count %v: %v", url, err)
+		}
+	}
+}
+
+// queueExtract adds tasks to extract the articles of stories of feed.
+func queueExtract(c Context, feed string, stories []*Story) error {
+	var tasks []*backend.Task
+	for len(stories) > 0 {
+		n := len(stories)
+		if n > extractBatch {
+			n = extractBatch
+		}
+		v := url.Values{"feed": {feed}}
+		for _, s := range stories[:n] {
+			v.Add("story", s.Id)
+		}
+		tasks = append(tasks, backend.NewPOSTTask(routeUrl("extract-stories"), v))
+		stories = stories[n:]
+	}
+	if len(tasks) == 0 {
+		return nil
+	}
+	return c.Queue().AddMulti(tasks, "")
+}
+
+// extractArticle fetches link and returns its article sanitized by p.
+func extractArticle(c Context, link string, p *sanitizer.Policy) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("not a web page")
+	}
+	cl := &http.Client{Transport: c.Transport(time.Minute)}
+	resp, err := cl.Get(link)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad response code: %s", resp.Status)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if !strings.Contains(ct, "html") {
+		return "", fmt.Errorf("not HTML: %q", ct)
+	}
+	reader := &io.LimitedReader{R: resp.Body, N: maxPageSize}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	if reader.N == 0 {
+		return "", fmt.Errorf("page larger than %d bytes", maxPageSize)
+	}
+	e, err := encodingReader(b, ct)
+	if err != nil {
+		return "", err
+	}
+	article, err := readability.Extract(transform.NewReader(bytes.NewReader(b), e.NewDecoder()))
+	if err != nil {
+		return "", err
+	}
+	content, _ := sanitizer.SanitizePolicy(article, resp.Request.URL, p)
+	if len(content) > maxFullText {
+		return "", fmt.Errorf("article larger than %d bytes", maxFullText)
+	}
+	return content, nil
+}
+
+// ExtractStories stores the articles of the story parameters of the feed
+// parameter's feed. Failures are logged to the feed.
+func ExtractStories(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Timeout(time.Minute).Store()
+	fk := gn.Key(&Feed{Url: r.FormValue("feed")})
+	policy := feedPolicy(gn, r.FormValue("feed"))
+	ids := r.Form["story"]
+	stories := make([]*Story, len(ids))
+	scs := make([]*StoryContent, len(ids))
+	for i, id := range ids {
+		stories[i] = &Story{Id: id, Parent: fk}
+		scs[i] = &StoryContent{Id: fullContentID, Parent: gn.Key(stories[i])}
+	}
+	serr := gn.GetMulti(stories)
+	scerr := gn.GetMulti(scs)
+	var puts []interface{}
+	for i, s := range stories {
+		if backend.NotFound(serr, i) || !backend.NotFound(scerr, i) {
+			continue
+		}
+		content, err := extractArticle(c, s.Link, policy)
+		if err != nil {
+			c.Warningf("extract %v: %v", s.Link, err)
+			puts = append(puts, &Log{
+				Parent: fk,
+				Id:     time.Now().UnixNano(),
+				Text:   fmt.Sprintf("full text %v: %v", s.Link, err),
+			})
+			continue
+		}
+		scs[i].setContent(content)
+		puts = append(puts, scs[i])
+	}
+	if len(puts) == 0 {
+		return
+	}
+	if _, err := gn.PutMulti(puts); err != nil {
+		c.Errorf("put err: %v", err)
+	}
+}
+
+// SetFullText sets whether the user wants the full text of the feed
+// parameter's stories, from the on parameter. Turning it on also extracts
+// the feed's latest stories.
+func SetFullText(c Context, w http.ResponseWriter, r *http.Request) {
+	feed := r.FormValue("feed")
+	on := r.FormValue("on") == "1"
+	found := false
+	err := editOpml(c, func(o *Opml) bool {
+		changed := false
+		var walk func([]*OpmlOutline)
+		walk = func(outlines []*OpmlOutline) {
+			for _, o := range outlines {
+				if o.XmlUrl == feed {
+					found = true
+					changed = changed || o.FullText != on
+					o.FullText = on
+				}
+				walk(o.Outline)
+			}
+		}
+		walk(o.Outline)
+		return changed
+	})
+	if err != nil {
+		serveError(w, err)
+		return
+	} else if !found {
+		http.Error(w, "not subscribed", http.StatusBadRequest)
+		return
+	}
+	if !on {
+		return
+	}
+	gn := c.Store()
+	fk := gn.Key(&Feed{Url: feed})
+	q := backend.NewQuery(gn.Kind(&Story{})).Ancestor(fk).KeysOnly().Order("-" + IDX_COL).Limit(extractBatch)
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	stories := make([]*Story, len(keys))
+	for i, k := range keys {
+		stories[i] = &Story{Id: k.StringID(), Parent: fk}
+	}
+	if err := queueExtract(c, feed, stories); err != nil {
+		serveError(w, err)
+	}
+}
+
+// userOpml returns the subscriptions of the user of uk.
+func userOpml(gn *backend.Store, uk *backend.Key) *Opml {
+	var o Opml
+	ud := &UserData{Id: "data", Parent: uk}
+	if err := gn.Get(ud); err == nil {
+		json.Unmarshal(ud.Opml, &o)
+	}
+	return &o
+}
@@ -0,0 +1,855 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// Google Reader API, as spoken by third-party clients. Requests sign in with
+// ClientLogin, using an API token as the password, and pass the token back
+// in the Authorization header.
+
+const (
+	greaderItemPrefix     = "tag:google.com,2005:reader/item/"
+	greaderReadingList    = "user/-/state/com.google/reading-list"
+	greaderRead           = "user/-/state/com.google/read"
+	greaderStarred        = "user/-/state/com.google/starred"
+	greaderKeptUnread     = "user/-/state/com.google/kept-unread"
+	greaderLabelPrefix    = "user/-/label/"
+	greaderFeedPrefix     = "feed/"
+	greaderStreamContents = "/reader/api/0/stream/contents/"
+	greaderMaxItems       = 1000
+	greaderDefaultItems   = 20
+)
+
+// parseItemID parses the long hex form or the decimal form of an item id.
+func parseItemID(s string) (int64, error) {
+	if strings.HasPrefix(s, greaderItemPrefix) {
+		n, err := strconv.ParseUint(s[len(greaderItemPrefix):], 16, 64)
+		return int64(n), err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// greaderStream returns a stream id in its user/-/ form.
+func greaderStream(s string) string {
+	if strings.HasPrefix(s, "user/") {
+		if i := strings.Index(s[len("user/"):], "/"); i >= 0 {
+			return "user/-" + s[len("user/")+i:]
+		}
+	}
+	return s
+}
+
+// greader serves f to requests signed in with an API token allowing scope.
+func greader(f func(Context, http.ResponseWriter, *http.Request), scope string) http.Handler {
+	return newHandler(func(c Context, w http.ResponseWriter, r *http.Request) {
+		const prefix = "GoogleLogin auth="
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		u, ut, err := tokenUser(c.Store(), strings.TrimPrefix(auth, prefix))
+		if err == errBadToken {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			serveError(w, err)
+			return
+		}
+		if !ut.allows(scope) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		useToken(c, ut)
+		f(asUser(c, u, ut), w, r)
+	})
+}
+
+// GReaderLogin implements ClientLogin. Passwd is an API token.
+func GReaderLogin(c Context, w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("Passwd")
+	u, _, err := tokenUser(c.Store(), token)
+	if err == errBadToken || (err == nil && !strings.EqualFold(u.Email, r.FormValue("Email"))) {
+		http.Error(w, "Error=BadAuthentication", http.StatusForbidden)
+		return
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "SID=%s\nLSID=%s\nAuth=%s\n", token, token, token)
+}
+
+// GReaderToken returns the token for edit requests. Requests are already
+// authenticated by their header, so it is not checked.
+func GReaderToken(c Context, w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, tokenHash(c.User().ID)[:57])
+}
+
+func GReaderUserInfo(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	serveJSON(w, map[string]string{
+		"userId":        cu.ID,
+		"userName":      cu.Email,
+		"userProfileId": cu.ID,
+		"userEmail":     cu.Email,
+	})
+}
+
+// streamFeeds returns the feeds in stream s, which is not the starred
+// stream.
+func (st *readerState) streamFeeds(s string) ([]string, error) {
+	s = greaderStream(s)
+	switch {
+	case s == greaderReadingList:
+		return st.feeds, nil
+	case strings.HasPrefix(s, greaderFeedPrefix):
+		return []string{s[len(greaderFeedPrefix):]}, nil
+	case strings.HasPrefix(s, greaderLabelPrefix):
+		label := s[len(greaderLabelPrefix):]
+		var feeds []string
+		for _, f := range st.feeds {
+			if st.labels[f] == label {
+				feeds = append(feeds, f)
+			}
+		}
+		return feeds, nil
+	}
+	return nil, fmt.Errorf("unsupported stream: %v", s)
+}
+
+func GReaderSubscriptionList(c Context, w http.ResponseWriter, r *http.Request) {
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	feeds := make([]*Feed, len(st.feeds))
+	for i, f := range st.feeds {
+		feeds[i] = &Feed{Url: f}
+	}
+	merr := c.Store().GetMulti(feeds)
+	type category struct {
+		Id    string `json:"id"`
+		Label string `json:"label"`
+	}
+	type subscription struct {
+		Id         string     `json:"id"`
+		Title      string     `json:"title"`
+		Categories []category `json:"categories"`
+		Url        string     `json:"url"`
+		HtmlUrl    string     `json:"htmlUrl"`
+		IconUrl    string     `json:"iconUrl"`
+	}
+	subs := []subscription{}
+	for i, f := range feeds {
+		s := subscription{
+			Id:         greaderFeedPrefix + f.Url,
+			Title:      st.titles[f.Url],
+			Categories: []category{},
+			Url:        f.Url,
+		}
+		if !backend.NotFound(merr, i) {
+			s.HtmlUrl = f.Link
+			s.IconUrl = f.Image
+			if s.Title == "" {
+				s.Title = f.Title
+			}
+		}
+		if l := st.labels[f.Url]; l != "" {
+			s.Categories = append(s.Categories, category{greaderLabelPrefix + l, l})
+		}
+		subs = append(subs, s)
+	}
+	serveJSON(w, map[string]interface{}{"subscriptions": subs})
+}
+
+func GReaderTagList(c Context, w http.ResponseWriter, r *http.Request) {
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	type tag struct {
+		Id   string `json:"id"`
+		Type string `json:"type,omitempty"`
+	}
+	tags := []tag{{Id: greaderStarred}}
+	for _, o := range st.opml.Outline {
+		if o.XmlUrl == "" {
+			tags = append(tags, tag{greaderLabelPrefix + o.Title, "folder"})
+		}
+	}
+	serveJSON(w, map[string]interface{}{"tags": tags})
+}
+
+// editOpml changes the user's subscriptions with f, which returns whether
+// it changed them.
+func editOpml(c Context, f func(o *Opml) bool) error {
+	backupOPML(c)
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	var from, to map[string]bool
+	err := gn.RunInTransaction(func(gn *backend.Store) error {
+		ud := &UserData{Id: "data", Parent: uk}
+		if err := gn.Get(ud); err != nil && err != backend.ErrNoSuchEntity {
+			return err
+		}
+		var o Opml
+		json.Unmarshal(ud.Opml, &o)
+		from = fullTextFeeds(&o)
+		if !f(&o) {
+			to = from
+			return nil
+		}
+		to = fullTextFeeds(&o)
+		b, err := json.Marshal(&o)
+		if err != nil {
+			return err
+		}
+		ud.Opml = b
+		if _, err := gn.PutMulti([]interface{}{ud, newChange(uk, changeOpml, "")}); err != nil {
+			return err
+		}
+		return updateSearches(gn, uk, &o)
+	})
+	if err == nil {
+		countFullText(c, from, to)
+	}
+	return err
+}
+
+// moveOutline removes feed from o and, unless remove is set, adds it back
+// to the folder label with title, keeping its title if title is empty.
+func moveOutline(o *Opml, feed, label, title string, remove bool) bool {
+	var found *OpmlOutline
+	var outlines []*OpmlOutline
+	for _, ol := range o.Outline {
+		if ol.XmlUrl == feed {
+			found = ol
+			continue
+		}
+		if ol.XmlUrl == "" {
+			var sub []*OpmlOutline
+			for _, so := range ol.Outline {
+				if so.XmlUrl == feed {
+					found = so
+				} else {
+					sub = append(sub, so)
+				}
+			}
+			if len(sub) == 0 {
+				continue
+			}
+			ol.Outline = sub
+		}
+		outlines = append(outlines, ol)
+	}
+	if found == nil {
+		return false
+	}
+	o.Outline = outlines
+	if remove {
+		return true
+	}
+	if title != "" {
+		found.Title = title
+	}
+	if label == "" {
+		o.Outline = append(o.Outline, found)
+		return true
+	}
+	for _, ol := range o.Outline {
+		if ol.XmlUrl == "" && ol.Title == label {
+			ol.Outline = append(ol.Outline, found)
+			return true
+		}
+	}
+	o.Outline = append(o.Outline, &OpmlOutline{Title: label, Outline: []*OpmlOutline{found}})
+	return true
+}
+
+func GReaderSubscriptionEdit(c Context, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	label := ""
+	if a := greaderStream(r.FormValue("a")); strings.HasPrefix(a, greaderLabelPrefix) {
+		label = a[len(greaderLabelPrefix):]
+	}
+	removeLabel := strings.HasPrefix(greaderStream(r.FormValue("r")), greaderLabelPrefix)
+	title := r.FormValue("t")
+	for _, s := range r.Form["s"] {
+		if !strings.HasPrefix(s, greaderFeedPrefix) {
+			http.Error(w, "bad stream: "+s, http.StatusBadRequest)
+			return
+		}
+		feed := s[len(greaderFeedPrefix):]
+		var err error
+		switch r.FormValue("ac") {
+		case "subscribe":
+			o := &OpmlOutline{
+				Title:   label,
+				Outline: []*OpmlOutline{{XmlUrl: feed, Title: title}},
+			}
+			err = addSubscription(c, o)
+		case "unsubscribe":
+			err = editOpml(c, func(o *Opml) bool {
+				return moveOutline(o, feed, "", "", true)
+			})
+		case "edit":
+			err = editOpml(c, func(o *Opml) bool {
+				l := label
+				if l == "" && !removeLabel {
+					// keep the feed where it is
+					for _, ol := range o.Outline {
+						for _, so := range ol.Outline {
+							if so.XmlUrl == feed {
+								l = ol.Title
+							}
+						}
+					}
+				}
+				return moveOutline(o, feed, l, title, false)
+			})
+		default:
+			http.Error(w, "bad action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+	}
+	fmt.Fprint(w, "OK")
+}
+
+func GReaderQuickAdd(c Context, w http.ResponseWriter, r *http.Request) {
+	feed := strings.TrimPrefix(r.FormValue("quickadd"), greaderFeedPrefix)
+	o := &OpmlOutline{Outline: []*OpmlOutline{{XmlUrl: feed}}}
+	if err := addSubscription(c, o); err != nil {
+		serveJSON(w, map[string]interface{}{
+			"numResults": 0,
+			"query":      feed,
+			"error":      err.Error(),
+		})
+		return
+	}
+	feed = o.Outline[0].XmlUrl
+	serveJSON(w, map[string]interface{}{
+		"numResults": 1,
+		"query":      feed,
+		"streamId":   greaderFeedPrefix + feed,
+	})
+}
+
+func GReaderUnreadCount(c Context, w http.ResponseWriter, r *http.Request) {
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	gn := c.Store()
+	read, err := getRead(gn, st.u.Id, st.feeds)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	feeds := make([]*Feed, len(st.feeds))
+	for i, f := range st.feeds {
+		feeds[i] = &Feed{Url: f}
+	}
+	gn.GetMulti(feeds)
+	counts := make([]int, len(feeds))
+	var wg sync.WaitGroup
+	for i, f := range feeds {
+		wg.Add(1)
+		go func(i int, f *Feed) {
+			defer wg.Done()
+			if f.Date.Before(st.u.Read) {
+				return
+			}
+			q := backend.NewQuery(gn.Kind(&Story{})).
+				Ancestor(gn.Key(f)).
+				Filter(IDX_COL+" >=", st.u.Read).
+				KeysOnly().
+				Limit(greaderMaxItems)
+			keys, _ := gn.GetAll(q, nil)
+			for _, k := range keys {
+				if !read[readStory{Feed: f.Url, Story: k.StringID()}] {
+					counts[i]++
+				}
+			}
+		}(i, f)
+	}
+	wg.Wait()
+	type unreadCount struct {
+		Id                      string `json:"id"`
+		Count                   int    `json:"count"`
+		NewestItemTimestampUsec string `json:"newestItemTimestampUsec"`
+	}
+	total := unreadCount{Id: greaderReadingList}
+	var newest time.Time
+	labels := make(map[string]*unreadCount)
+	unreadcounts := []*unreadCount{}
+	for i, f := range feeds {
+		if counts[i] == 0 {
+			continue
+		}
+		usec := strconv.FormatInt(f.Date.UnixNano()/1000, 10)
+		unreadcounts = append(unreadcounts, &unreadCount{greaderFeedPrefix + f.Url, counts[i], usec})
+		total.Count += counts[i]
+		if f.Date.After(newest) {
+			newest = f.Date
+			total.NewestItemTimestampUsec = usec
+		}
+		if l := st.labels[f.Url]; l != "" {
+			lc := labels[l]
+			if lc == nil {
+				lc = &unreadCount{Id: greaderLabelPrefix + l}
+				labels[l] = lc
+				unreadcounts = append(unreadcounts, lc)
+			}
+			lc.Count += counts[i]
+			if usec > lc.NewestItemTimestampUsec {
+				lc.NewestItemTimestampUsec = usec
+			}
+		}
+	}
+	unreadcounts = append(unreadcounts, &total)
+	serveJSON(w, map[string]interface{}{
+		"max":          greaderMaxItems,
+		"unreadcounts": unreadcounts,
+	})
+}
+
+// streamParams are the paging and filtering parameters of stream requests.
+type streamParams struct {
+	stream      string
+	n           int
+	oldestFirst bool
+	excludeRead bool
+	after       time.Time // ot: only items newer than this
+	before      time.Time // nt: only items older than this
+	cont        string
+}
+
+func parseStreamParams(r *http.Request, stream string) *streamParams {
+	p := &streamParams{
+		stream:      greaderStream(stream),
+		n:           greaderDefaultItems,
+		oldestFirst: r.FormValue("r") == "o",
+		excludeRead: greaderStream(r.FormValue("xt")) == greaderRead,
+		cont:        r.FormValue("c"),
+	}
+	if n, err := strconv.Atoi(r.FormValue("n")); err == nil && n > 0 {
+		p.n = n
+	}
+	if p.n > greaderMaxItems {
+		p.n = greaderMaxItems
+	}
+	if ot, err := strconv.ParseInt(r.FormValue("ot"), 10, 64); err == nil {
+		p.after = time.Unix(ot, 0)
+	}
+	if nt, err := strconv.ParseInt(r.FormValue("nt"), 10, 64); err == nil {
+		p.before = time.Unix(nt, 0)
+	}
+	return p
+}
+
+// streamStories returns the stories of a stream and the continuation of
+// the next page, which is the item id of the last story.
+func streamStories(c Context, st *readerState, p *streamParams) ([]*Story, string, error) {
+	if p.stream == greaderStarred {
+		return starredStories(c, st, p)
+	}
+	if p.stream == greaderRead {
+		// Read stories are not indexed.
+		return nil, "", nil
+	}
+	feeds, err := st.streamFeeds(p.stream)
+	if err != nil {
+		return nil, "", err
+	}
+	q := &storyQuery{
+		feeds:     feeds,
+		limit:     p.n,
+		ascending: p.oldestFirst,
+		after:     p.after,
+		before:    p.before,
+	}
+	if p.cont != "" {
+		id, err := strconv.ParseInt(p.cont, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("bad continuation: %v", p.cont)
+		}
+		if p.oldestFirst {
+			q.since = id
+		} else {
+			q.max = id
+		}
+	}
+	if p.excludeRead {
+		read, err := getRead(c.Store(), st.u.Id, feeds)
+		if err != nil {
+			return nil, "", err
+		}
+		if q.after.Before(st.u.Read) {
+			q.after = st.u.Read
+		}
+		q.keep = func(s *Story) bool {
+			return !st.isRead(read, s)
+		}
+	}
+	stories, err := queryStories(c, q)
+	if err != nil {
+		return nil, "", err
+	}
+	cont := ""
+	if len(stories) == p.n {
+		cont = strconv.FormatInt(itemID(stories[len(stories)-1]), 10)
+	}
+	return stories, cont, nil
+}
+
+// starredStories returns the stories the user starred, newest first.
+func starredStories(c Context, st *readerState, p *streamParams) ([]*Story, string, error) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserStar{})).
+		Ancestor(st.uk).
+		KeysOnly().
+		Order("-c")
+	if p.cont != "" {
+		cur, err := backend.DecodeCursor(p.cont)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(cur)
+	}
+	it := gn.Run(q)
+	var stories []*Story
+	for len(stories) < p.n {
+		k, err := it.Next(nil)
+		if err == backend.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		stories = append(stories, &Story{
+			Id:     k.StringID(),
+			Parent: gn.Key(&Feed{Url: k.Parent().StringID()}),
+		})
+	}
+	cont := ""
+	if len(stories) == p.n {
+		if cur, err := it.Cursor(); err == nil {
+			cont = cur.String()
+		}
+	}
+	err := gn.GetMulti(stories)
+	if merr, ok := err.(backend.MultiError); ok {
+		var found []*Story
+		for i, s := range stories {
+			if merr[i] == nil {
+				found = append(found, s)
+			}
+		}
+		stories = found
+	} else if err != nil {
+		return nil, "", err
+	}
+	return stories, cont, nil
+}
+
+type greaderItem struct {
+	Id            string            `json:"id"`
+	CrawlTimeMsec string            `json:"crawlTimeMsec"`
+	TimestampUsec string            `json:"timestampUsec"`
+	Published     int64             `json:"published"`
+	Updated       int64             `json:"updated"`
+	Title         string            `json:"title"`
+	Author        string            `json:"author,omitempty"`
+	Canonical     []greaderLink     `json:"canonical"`
+	Alternate     []greaderLink     `json:"alternate"`
+	Summary       greaderContent    `json:"summary"`
+	Categories    []string          `json:"categories"`
+	Origin        greaderItemOrigin `json:"origin"`
+}
+
+type greaderLink struct {
+	Href string `json:"href"`
+	Type string `json:"type,omitempty"`
+}
+
+type greaderContent struct {
+	Direction string `json:"direction"`
+	Content   string `json:"content"`
+}
+
+type greaderItemOrigin struct {
+	StreamId string `json:"streamId"`
+	Title    string `json:"title"`
+	HtmlUrl  string `json:"htmlUrl"`
+}
+
+// greaderItems returns the API form of stories.
+func greaderItems(c Context, st *readerState, stories []*Story) ([]*greaderItem, error) {
+	infos, err := storyInfos(c, st, stories)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*greaderItem, len(stories))
+	for i, s := range stories {
+		f := s.Parent.StringID()
+		info := infos[i]
+		title := st.titles[f]
+		if title == "" {
+			title = info.feed.Title
+		}
+		it := &greaderItem{
+			Id:            fmt.Sprintf("%s%016x", greaderItemPrefix, itemID(s)),
+			CrawlTimeMsec: strconv.FormatInt(s.Created.UnixNano()/1e6, 10),
+			TimestampUsec: strconv.FormatInt(s.Created.UnixNano()/1e3, 10),
+			Published:     s.Published.Unix(),
+			Updated:       s.Updated.Unix(),
+			Title:         s.Title,
+			Author:        s.Author,
+			Canonical:     []greaderLink{{Href: s.Link}},
+			Alternate:     []greaderLink{{Href: s.Link, Type: "text/html"}},
+			Summary:       greaderContent{Direction: "ltr", Content: info.content},
+			Categories:    []string{greaderReadingList},
+			Origin: greaderItemOrigin{
+				StreamId: greaderFeedPrefix + f,
+				Title:    title,
+				HtmlUrl:  info.feed.Link,
+			},
+		}
+		if s.Published.IsZero() {
+			it.Published = s.Created.Unix()
+		}
+		if s.Updated.IsZero() {
+			it.Updated = it.Published
+		}
+		if l := st.labels[f]; l != "" {
+			it.Categories = append(it.Categories, greaderLabelPrefix+l)
+		}
+		if info.read {
+			it.Categories = append(it.Categories, greaderRead)
+		}
+		if info.starred {
+			it.Categories = append(it.Categories, greaderStarred)
+		}
+		items[i] = it
+	}
+	return items, nil
+}
+
+// GReaderStreamContents serves /reader/api/0/stream/contents/<stream>.
+func GReaderStreamContents(c Context, w http.ResponseWriter, r *http.Request) {
+	stream := strings.TrimPrefix(r.URL.Path, greaderStreamContents)
+	// Path cleaning by the router turns feed/http://host into
+	// feed/http:/host, so put the slash back.
+	if i := strings.Index(stream, ":/"); i >= 0 && !strings.HasPrefix(stream[i:], "://") {
+		stream = stream[:i] + "://" + stream[i+2:]
+	}
+	if s := r.FormValue("s"); s != "" {
+		stream = s
+	}
+	if stream == "" {
+		stream = greaderReadingList
+	}
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	p := parseStreamParams(r, stream)
+	stories, cont, err := streamStories(c, st, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := greaderItems(c, st, stories)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	o := map[string]interface{}{
+		"id":      stream,
+		"updated": time.Now().Unix(),
+		"items":   items,
+	}
+	if cont != "" {
+		o["continuation"] = cont
+	}
+	serveJSON(w, o)
+}
+
+func GReaderItemIds(c Context, w http.ResponseWriter, r *http.Request) {
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	p := parseStreamParams(r, r.FormValue("s"))
+	stories, cont, err := streamStories(c, st, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := putStoryRefs(c, stories); err != nil {
+		serveError(w, err)
+		return
+	}
+	type itemRef struct {
+		Id              string   `json:"id"`
+		DirectStreamIds []string `json:"directStreamIds"`
+		TimestampUsec   string   `json:"timestampUsec"`
+	}
+	refs := make([]itemRef, len(stories))
+	for i, s := range stories {
+		f := s.Parent.StringID()
+		refs[i] = itemRef{
+			Id:              strconv.FormatInt(itemID(s), 10),
+			DirectStreamIds: []string{greaderFeedPrefix + f},
+			TimestampUsec:   strconv.FormatInt(s.Created.UnixNano()/1e3, 10),
+		}
+	}
+	o := map[string]interface{}{"itemRefs": refs}
+	if cont != "" {
+		o["continuation"] = cont
+	}
+	serveJSON(w, o)
+}
+
+// greaderLookup returns the stories with the item ids in ids.
+func greaderLookup(gn *backend.Store, ids []string) ([]*Story, error) {
+	var iids []int64
+	for _, s := range ids {
+		id, err := parseItemID(s)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("bad item id: %v", s)
+		}
+		iids = append(iids, id)
+	}
+	return lookupItems(gn, iids)
+}
+
+func GReaderItemContents(c Context, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	stories, err := greaderLookup(c.Store(), r.Form["i"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := greaderItems(c, st, stories)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, map[string]interface{}{
+		"id":      greaderReadingList,
+		"updated": time.Now().Unix(),
+		"items":   items,
+	})
+}
+
+func GReaderEditTag(c Context, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	found, err := greaderLookup(gn, r.Form["i"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stories := storiesByFeed(found)
+	apply := func(tags []string, add bool) error {
+		for _, t := range tags {
+			switch greaderStream(t) {
+			case greaderRead:
+				if err := setRead(c, uk, stories, add); err != nil {
+					return err
+				}
+			case greaderKeptUnread:
+				if err := setRead(c, uk, stories, !add); err != nil {
+					return err
+				}
+			case greaderStarred:
+				if err := setStarred(c, uk, stories, add); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := apply(r.Form["a"], true); err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := apply(r.Form["r"], false); err != nil {
+		serveError(w, err)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+// GReaderMarkAllAsRead marks the stories of a stream created before ts, in
+// microseconds, as read. Marking the reading list moves the user's unread
+// date.
+func GReaderMarkAllAsRead(c Context, w http.ResponseWriter, r *http.Request) {
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	until := time.Now()
+	if ts, err := strconv.ParseInt(r.FormValue("ts"), 10, 64); err == nil && ts > 0 {
+		until = time.Unix(0, ts*1000)
+	}
+	stream := greaderStream(r.FormValue("s"))
+	if stream == greaderReadingList {
+		err = markAllRead(c, st.uk, until)
+	} else {
+		var feeds []string
+		feeds, err = st.streamFeeds(stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = markFeedsRead(c, st, feeds, until)
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
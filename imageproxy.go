@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/sanitizer"
+)
+
+// Images in story content are loaded through the image proxy, so their
+// hosts see neither readers' addresses nor when they read. GetContents
+// rewrites image URLs to the proxy's, signed so that it can't be used to
+// fetch anything else. Images are fetched on their first request and kept
+// as Image entities until DeleteOldImages deletes them.
+
+const (
+	// imageKeyID is the id of the SessionKey that signs image URLs.
+	imageKeyID = 2
+	// maxImageSize is the largest image proxied, which must fit in an
+	// entity.
+	maxImageSize = 900 << 10
+	// imageMaxAge is how long images are cached, by the proxy and by
+	// browsers.
+	imageMaxAge = time.Hour * 24 * 30
+)
+
+var (
+	imageKeyLock sync.Mutex
+	imageKey     []byte
+)
+
+// imageProxyKey returns the key that signs image URLs: IMAGE_PROXY_KEY,
+// or else a random key kept in the datastore.
+func imageProxyKey(c backend.Context) ([]byte, error) {
+	imageKeyLock.Lock()
+	defer imageKeyLock.Unlock()
+	if imageKey != nil {
+		return imageKey, nil
+	}
+	if IMAGE_PROXY_KEY != "" {
+		imageKey = []byte(IMAGE_PROXY_KEY)
+		return imageKey, nil
+	}
+	key, err := storedKey(c, imageKeyID)
+	if err != nil {
+		return nil, err
+	}
+	imageKey = key
+	return key, nil
+}
+
+func signImage(key []byte, src string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(src))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// imageURL returns a function that returns the proxy's URL for images,
+// signed with key.
+func imageURL(key []byte) func(u *url.URL) string {
+	return func(u *url.URL) string {
+		src := u.String()
+		v := url.Values{
+			"u": {src},
+			"s": {signImage(key, src)},
+		}
+		return routeUrl("image") + "?" + v.Encode()
+	}
+}
+
+// proxyImages returns p with its images loaded through the proxy, or p if
+// the proxy's key can't be loaded.
+func proxyImages(c Context, p *sanitizer.Policy) *sanitizer.Policy {
+	key, err := imageProxyKey(c)
+	if err != nil {
+		c.Errorf("image proxy key: %v", err)
+		return p
+	}
+	return p.WithImageURL(imageURL(key))
+}
+
+// fetchImage fetches the image at src.
+func fetchImage(c Context, src string) (*Image, error) {
+	cl := &http.Client{
+		Transport: c.Transport(time.Minute),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return checkPublicURL(req.URL)
+		},
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPublicURL(u); err != nil {
+		return nil, err
+	}
+	resp, err := cl.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad response code: %s", resp.Status)
+	}
+	// SVG images are documents that can run scripts, so aren't served.
+	ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(ct, "image/") || strings.Contains(ct, "svg") {
+		return nil, fmt.Errorf("not an image: %q", resp.Header.Get("Content-Type"))
+	}
+	reader := &io.LimitedReader{R: resp.Body, N: maxImageSize + 1}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if reader.N == 0 {
+		return nil, fmt.Errorf("image larger than %d bytes", maxImageSize)
+	}
+	return &Image{
+		Url:     src,
+		Type:    ct,
+		Data:    b,
+		Fetched: time.Now(),
+	}, nil
+}
+
+// ImageProxy serves the image at the u parameter, if the s parameter is
+// its signature.
+func ImageProxy(c Context, w http.ResponseWriter, r *http.Request) {
+	src := r.FormValue("u")
+	key, err := imageProxyKey(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if !hmac.Equal([]byte(r.FormValue("s")), []byte(signImage(key, src))) {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+	gn := c.Store()
+	h := sha1.Sum([]byte(src))
+	img := &Image{Id: hex.EncodeToString(h[:])}
+	if err := gn.Get(img); err != nil || img.Url != src || time.Since(img.Fetched) > imageMaxAge {
+		fetched, ferr := fetchImage(c, src)
+		if ferr == nil {
+			fetched.Id = img.Id
+			img = fetched
+			if _, err := gn.Put(img); err != nil {
+				c.Errorf("put image %v: %v", src, err)
+			}
+		} else if err == nil && img.Url == src {
+			// Serve the stale image rather than none.
+			c.Warningf("image %v: %v", src, ferr)
+		} else {
+			c.Warningf("image %v: %v", src, ferr)
+			http.Error(w, ferr.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	wh := w.Header()
+	wh.Set("Content-Type", img.Type)
+	wh.Set("Content-Length", strconv.Itoa(len(img.Data)))
+	wh.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(imageMaxAge.Seconds())))
+	wh.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	wh.Set("X-Content-Type-Options", "nosniff")
+	w.Write(img.Data)
+}
+
+// checkPublicURL returns an error unless u is an http or https URL whose
+// host isn't obviously on the server or its network. Story authors choose
+// image URLs, so they mustn't be able to make the proxy fetch private
+// ones. Backends also refuse to connect to such addresses, which catches
+// host names that resolve to them.
+func checkPublicURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("not an http URL: %v", u)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".internal") {
+		return fmt.Errorf("not a public host: %v", u)
+	}
+	if ip := net.ParseIP(host); ip != nil && !backend.PublicIP(ip) {
+		return fmt.Errorf("not a public address: %v", u)
+	}
+	return nil
+}
+
+// DeleteOldImages deletes the images fetched more than imageMaxAge ago,
+// which are fetched again if they are requested.
+func DeleteOldImages(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Timeout(time.Minute).Store()
+	q := backend.NewQuery(gn.Kind(&Image{})).
+		Filter("f <", time.Now().Add(-imageMaxAge)).
+		KeysOnly().
+		Limit(500)
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		c.Errorf("old images: %v", err)
+		return
+	}
+	if err := gn.DeleteMulti(keys); err != nil {
+		c.Errorf("delete images: %v", err)
+		return
+	}
+	c.Infof("deleted %v images", len(keys))
+	if len(keys) == 500 {
+		if err := c.Queue().Add(backend.NewPOSTTask(routeUrl("delete-old-images"), nil), ""); err != nil {
+			c.Errorf("taskqueue error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package jsonfeed defines JSON data structures for a JSON Feed
+// (https://jsonfeed.org/version/1.1). Both 1.0 and 1.1 feeds decode into
+// the same types.
+package jsonfeed
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+type Feed struct {
+	Version     string   `json:"version"`
+	Title       string   `json:"title"`
+	HomePageURL string   `json:"home_page_url"`
+	FeedURL     string   `json:"feed_url"`
+	Description string   `json:"description"`
+	NextURL     string   `json:"next_url"`
+	Icon        string   `json:"icon"`
+	Favicon     string   `json:"favicon"`
+	Author      *Author  `json:"author"`
+	Authors     []Author `json:"authors"`
+	Language    string   `json:"language"`
+	Expired     bool     `json:"expired"`
+	Hubs        []Hub    `json:"hubs"`
+	Items       []*Item  `json:"items"`
+}
+
+// Hub returns the URL of the feed's WebSub hub, if any.
+func (f *Feed) Hub() string {
+	for _, h := range f.Hubs {
+		if strings.EqualFold(h.Type, "websub") || strings.EqualFold(h.Type, "pubsubhubbub") {
+			return h.URL
+		}
+	}
+	return ""
+}
+
+type Hub struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type Author struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Avatar string `json:"avatar"`
+}
+
+type Item struct {
+	ID            ID           `json:"id"`
+	URL           string       `json:"url"`
+	ExternalURL   string       `json:"external_url"`
+	Title         string       `json:"title"`
+	ContentHTML   string       `json:"content_html"`
+	ContentText   string       `json:"content_text"`
+	Summary       string       `json:"summary"`
+	Image         string       `json:"image"`
+	BannerImage   string       `json:"banner_image"`
+	DatePublished string       `json:"date_published"`
+	DateModified  string       `json:"date_modified"`
+	Author        *Author      `json:"author"`
+	Authors       []Author     `json:"authors"`
+	Tags          []string     `json:"tags"`
+	Language      string       `json:"language"`
+	Attachments   []Attachment `json:"attachments"`
+}
+
+// AuthorName returns the name of the first listed author. The 1.1 authors
+// array is preferred over the deprecated 1.0 author object.
+func (i *Item) AuthorName() string {
+	for _, a := range i.Authors {
+		if a.Name != "" {
+			return a.Name
+		}
+	}
+	if i.Author != nil {
+		return i.Author.Name
+	}
+	return ""
+}
+
+type Attachment struct {
+	URL               string  `json:"url"`
+	MimeType          string  `json:"mime_type"`
+	Title             string  `json:"title"`
+	SizeInBytes       int64   `json:"size_in_bytes"`
+	DurationInSeconds float64 `json:"duration_in_seconds"`
+}
+
+// ID is an item id. The spec requires a string, but many feeds publish
+// numbers, so both are accepted.
+type ID string
+
+func (id *ID) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*id = ID(s)
+		return nil
+	}
+	if bytes.Equal(b, []byte("null")) {
+		*id = ""
+		return nil
+	}
+	if _, err := strconv.ParseFloat(string(b), 64); err != nil {
+		return err
+	}
+	*id = ID(b)
+	return nil
+}
+
+// Sniff reports whether body looks like a JSON Feed document.
+func Sniff(body []byte) bool {
+	// skip a UTF-8 byte order mark
+	body = bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if len(body) == 0 || body[0] != '{' {
+		return false
+	}
+	// the version URL may be written with escaped slashes, so only look
+	// for the host
+	return bytes.Contains(body, []byte("jsonfeed.org"))
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package jsonfeed
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	var f Feed
+	if err := json.Unmarshal([]byte(JSON_FEED), &f); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Items) != 2 {
+		t.Fatal("expected 2 items, got", len(f.Items))
+	}
+	if f.Items[0].ID != "1" || f.Items[1].ID != "https://example.org/second" {
+		t.Error("bad ids", f.Items[0].ID, f.Items[1].ID)
+	}
+	if n := f.Items[0].AuthorName(); n != "Jane" {
+		t.Error("bad 1.1 author", n)
+	}
+	if n := f.Items[1].AuthorName(); n != "John" {
+		t.Error("bad 1.0 author", n)
+	}
+	if h := f.Hub(); h != "https://hub.example.org/" {
+		t.Error("bad hub", h)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{JSON_FEED, true},
+		{"\xef\xbb\xbf" + JSON_FEED, true},
+		{`{"version":"https:\/\/jsonfeed.org\/version\/1"}`, true},
+		{`{"some":"json"}`, false},
+		{`<?xml version="1.0"?><rss></rss>`, false},
+		{``, false},
+	}
+	for i, test := range tests {
+		if ok := Sniff([]byte(test.body)); ok != test.ok {
+			t.Errorf("%d: expected %v, got %v", i, test.ok, ok)
+		}
+	}
+}
+
+const JSON_FEED = `
+{
+	"version": "https://jsonfeed.org/version/1.1",
+	"title": "Example",
+	"home_page_url": "https://example.org/",
+	"hubs": [{"type": "WebSub", "url": "https://hub.example.org/"}],
+	"items": [
+		{
+			"id": 1,
+			"content_html": "<p>first</p>",
+			"authors": [{"name": "Jane"}],
+			"date_published": "2020-01-02T03:04:05Z"
+		},
+		{
+			"id": "https://example.org/second",
+			"url": "https://example.org/second",
+			"content_text": "second",
+			"author": {"name": "John"}
+		}
+	]
+}
+`
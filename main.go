@@ -28,12 +28,8 @@ import (
 	"time"
 
 	"github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler"
-	mpg "github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler_gae"
 	"github.com/mjibson/goread/_third_party/github.com/gorilla/mux"
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
-
-	"appengine"
-	"appengine/datastore"
+	"github.com/mjibson/goread/backend"
 )
 
 var (
@@ -43,6 +39,13 @@ var (
 )
 
 func init() {
+	miniprofiler.ToggleShortcut = "Alt+C"
+	miniprofiler.Position = "bottomleft"
+}
+
+// loadTemplates reads the templates and mobile page from the app
+// directory, which is the working directory.
+func loadTemplates() {
 	var err error
 	if templates, err = template.New("").Funcs(funcs).
 		ParseFiles(
@@ -59,56 +62,113 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	miniprofiler.ToggleShortcut = "Alt+C"
-	miniprofiler.Position = "bottomleft"
 }
 
-func RegisterHandlers(r *mux.Router) {
+// RegisterHandlers registers goread's handlers on r, running them on b.
+func RegisterHandlers(r *mux.Router, b backend.Backend) {
+	loadTemplates()
 	router = r
-	router.Handle("/", mpg.NewHandler(Main)).Name("main")
-	router.Handle("/login/google", mpg.NewHandler(LoginGoogle)).Name("login-google")
-	router.Handle("/login/redirect", mpg.NewHandler(LoginRedirect))
-	router.Handle("/logout", mpg.NewHandler(Logout)).Name("logout")
-	router.Handle("/push", mpg.NewHandler(SubscribeCallback)).Name("subscribe-callback")
-	router.Handle("/tasks/import-opml", mpg.NewHandler(ImportOpmlTask)).Name("import-opml-task")
-	router.Handle("/tasks/subscribe-feed", mpg.NewHandler(SubscribeFeed)).Name("subscribe-feed")
-	router.Handle("/tasks/update-feed-last", mpg.NewHandler(UpdateFeedLast)).Name("update-feed-last")
-	router.Handle("/tasks/update-feed-manual", mpg.NewHandler(UpdateFeed)).Name("update-feed-manual")
-	router.Handle("/tasks/update-feed", mpg.NewHandler(UpdateFeed)).Name("update-feed")
-	router.Handle("/tasks/update-feeds", mpg.NewHandler(UpdateFeeds)).Name("update-feeds")
-	router.Handle("/tasks/delete-old-feeds", mpg.NewHandler(DeleteOldFeeds)).Name("delete-old-feeds")
-	router.Handle("/tasks/delete-old-feed", mpg.NewHandler(DeleteOldFeed)).Name("delete-old-feed")
+	be = b
+	isDevServer = b.IsDev()
+	setIncludes(isDevServer)
+	setupMiniprofiler()
+	router.Handle("/", newHandler(Main)).Name("main")
+	router.Handle("/login", newHandler(Login)).Name("login")
+	router.Handle("/login/redirect", newHandler(LoginRedirect))
+	router.Handle("/login/{provider}", newHandler(LoginProvider)).Name("login-provider")
+	router.Handle("/login/{provider}/callback", newHandler(LoginCallback)).Name("login-callback")
+	router.Handle("/logout", newHandler(Logout)).Name("logout")
+	router.Handle("/push", newHandler(SubscribeCallback)).Name("subscribe-callback")
+	router.Handle("/tasks/import-opml", newHandler(ImportOpmlTask)).Name("import-opml-task")
+	router.Handle("/tasks/subscribe-feed", newHandler(SubscribeFeed)).Name("subscribe-feed")
+	router.Handle("/tasks/update-feed-last", newHandler(UpdateFeedLast)).Name("update-feed-last")
+	router.Handle("/tasks/update-feed-manual", newHandler(UpdateFeed)).Name("update-feed-manual")
+	router.Handle("/tasks/update-feed", newHandler(UpdateFeed)).Name("update-feed")
+	router.Handle("/tasks/update-feeds", newHandler(UpdateFeeds)).Name("update-feeds")
+	router.Handle("/tasks/extract-stories", newHandler(ExtractStories)).Name("extract-stories")
+	router.Handle("/tasks/delete-old-feeds", newHandler(DeleteOldFeeds)).Name("delete-old-feeds")
+	router.Handle("/tasks/delete-old-feed", newHandler(DeleteOldFeed)).Name("delete-old-feed")
+	router.Handle("/tasks/delete-old-images", newHandler(DeleteOldImages)).Name("delete-old-images")
+	router.Handle("/tasks/migrate-feed", newHandler(MigrateFeed)).Name("migrate-feed")
+	router.Handle("/tasks/migrate-read", newHandler(MigrateRead)).Name("migrate-read")
+
+	router.Handle("/accounts/ClientLogin", newHandler(GReaderLogin)).Name("greader-login")
+	router.Handle("/reader/api/0/token", greader(GReaderToken, scopeRead)).Name("greader-token")
+	router.Handle("/reader/api/0/user-info", greader(GReaderUserInfo, scopeRead)).Name("greader-user-info")
+	router.Handle("/reader/api/0/tag/list", greader(GReaderTagList, scopeRead)).Name("greader-tag-list")
+	router.Handle("/reader/api/0/subscription/list", greader(GReaderSubscriptionList, scopeRead)).Name("greader-subscription-list")
+	router.Handle("/reader/api/0/subscription/edit", greader(GReaderSubscriptionEdit, scopeFull)).Name("greader-subscription-edit")
+	router.Handle("/reader/api/0/subscription/quickadd", greader(GReaderQuickAdd, scopeFull)).Name("greader-quickadd")
+	router.Handle("/reader/api/0/unread-count", greader(GReaderUnreadCount, scopeRead)).Name("greader-unread-count")
+	router.Handle("/reader/api/0/stream/items/ids", greader(GReaderItemIds, scopeRead)).Name("greader-item-ids")
+	router.Handle("/reader/api/0/stream/items/contents", greader(GReaderItemContents, scopeRead)).Name("greader-item-contents")
+	router.PathPrefix(greaderStreamContents).Handler(greader(GReaderStreamContents, scopeRead)).Name("greader-stream-contents")
+	router.Handle("/reader/api/0/edit-tag", greader(GReaderEditTag, scopeFull)).Name("greader-edit-tag")
+	router.Handle("/reader/api/0/mark-all-as-read", greader(GReaderMarkAllAsRead, scopeFull)).Name("greader-mark-all-as-read")
+
+	router.Handle("/fever/", newHandler(Fever)).Name("fever")
+	router.Handle("/image", newHandler(ImageProxy)).Name("image")
+	router.Handle("/share/{id}", newHandler(Share)).Name("share")
 
 	router.Handle("/user/add-subscription", wrap(AddSubscription)).Name("add-subscription")
-	router.Handle("/user/delete-account", wrap(DeleteAccount)).Name("delete-account")
-	router.Handle("/user/export-opml", wrap(ExportOpml)).Name("export-opml")
-	router.Handle("/user/feed-history", wrap(FeedHistory)).Name("feed-history")
-	router.Handle("/user/get-contents", wrap(GetContents)).Name("get-contents")
-	router.Handle("/user/get-feed", wrap(GetFeed)).Name("get-feed")
-	router.Handle("/user/get-stars", wrap(GetStars)).Name("get-stars")
+	router.Handle("/user/create-share", wrapSession(CreateShare)).Name("create-share")
+	router.Handle("/user/create-tag", wrap(CreateTag)).Name("create-tag")
+	router.Handle("/user/create-token", wrapSession(CreateToken)).Name("create-token")
+	router.Handle("/user/delete-account", wrapSession(DeleteAccount)).Name("delete-account")
+	router.Handle("/user/delete-rule", wrap(DeleteRule)).Name("delete-rule")
+	router.Handle("/user/delete-search", wrap(DeleteSearch)).Name("delete-search")
+	router.Handle("/user/delete-tag", wrap(DeleteTag)).Name("delete-tag")
+	router.Handle("/user/export-opml", wrapRead(ExportOpml)).Name("export-opml")
+	router.Handle("/user/export-rules", wrapRead(ExportRules)).Name("export-rules")
+	router.Handle("/user/export-stars", wrapRead(ExportStars)).Name("export-stars")
+	router.Handle("/user/feed-history", wrapRead(FeedHistory)).Name("feed-history")
+	router.Handle("/user/get-contents", wrapRead(GetContents)).Name("get-contents")
+	router.Handle("/user/get-feed", wrapRead(GetFeed)).Name("get-feed")
+	router.Handle("/user/get-search", wrapRead(GetSearch)).Name("get-search")
+	router.Handle("/user/get-stars", wrapRead(GetStars)).Name("get-stars")
+	router.Handle("/user/get-tagged", wrapRead(GetTagged)).Name("get-tagged")
 	router.Handle("/user/import/get-url", wrap(UploadUrl)).Name("upload-url")
 	router.Handle("/user/import/opml", wrap(ImportOpml)).Name("import-opml")
-	router.Handle("/user/list-feeds", wrap(ListFeeds)).Name("list-feeds")
+	router.Handle("/user/import-rules", wrap(ImportRules)).Name("import-rules")
+	router.Handle("/user/list-tokens", wrapSession(ListTokens)).Name("list-tokens")
+	router.Handle("/user/list-feeds", wrapRead(ListFeeds)).Name("list-feeds")
+	router.Handle("/user/list-rules", wrapRead(ListRules)).Name("list-rules")
+	router.Handle("/user/list-searches", wrapRead(ListSearches)).Name("list-searches")
+	router.Handle("/user/list-shares", wrapSession(ListShares)).Name("list-shares")
+	router.Handle("/user/list-tags", wrapRead(ListTags)).Name("list-tags")
 	router.Handle("/user/mark-read", wrap(MarkRead)).Name("mark-read")
 	router.Handle("/user/mark-unread", wrap(MarkUnread)).Name("mark-unread")
+	router.Handle("/user/rename-tag", wrap(RenameTag)).Name("rename-tag")
+	router.Handle("/user/revoke-share", wrapSession(RevokeShare)).Name("revoke-share")
+	router.Handle("/user/revoke-token", wrapSession(RevokeToken)).Name("revoke-token")
+	router.Handle("/user/save-note", wrap(SaveNote)).Name("save-note")
 	router.Handle("/user/save-options", wrap(SaveOptions)).Name("save-options")
+	router.Handle("/user/save-rule", wrap(SaveRule)).Name("save-rule")
+	router.Handle("/user/save-search", wrap(SaveSearch)).Name("save-search")
+	router.Handle("/user/search", wrapRead(Search)).Name("search")
+	router.Handle("/user/search-stars", wrapRead(SearchStars)).Name("search-stars")
+	router.Handle("/user/set-full-text", wrap(SetFullText)).Name("set-full-text")
+	router.Handle("/user/set-policy", wrap(SetPolicy)).Name("set-policy")
 	router.Handle("/user/set-star", wrap(SetStar)).Name("set-star")
+	router.Handle("/user/sync", wrapRead(Sync)).Name("sync")
+	router.Handle("/user/tag-stories", wrap(TagStories)).Name("tag-stories")
 	router.Handle("/user/upload-opml", wrap(UploadOpml)).Name("upload-opml")
 
-	router.Handle("/admin/all-feeds", mpg.NewHandler(AllFeeds)).Name("all-feeds")
-	router.Handle("/admin/all-feeds-opml", mpg.NewHandler(AllFeedsOpml)).Name("all-feeds-opml")
-	router.Handle("/admin/user", mpg.NewHandler(AdminUser)).Name("admin-user")
-	router.Handle("/date-formats", mpg.NewHandler(AdminDateFormats)).Name("admin-date-formats")
-	router.Handle("/admin/feed", mpg.NewHandler(AdminFeed)).Name("admin-feed")
-	router.Handle("/admin/subhub", mpg.NewHandler(AdminSubHub)).Name("admin-subhub-feed")
-	router.Handle("/admin/stats", mpg.NewHandler(AdminStats)).Name("admin-stats")
-	router.Handle("/admin/update-feed", mpg.NewHandler(AdminUpdateFeed)).Name("admin-update-feed")
-	router.Handle("/user/charge", mpg.NewHandler(Charge)).Name("charge")
-	router.Handle("/user/account", mpg.NewHandler(Account)).Name("account")
-	router.Handle("/user/uncheckout", mpg.NewHandler(Uncheckout)).Name("uncheckout")
+	router.Handle("/admin/all-feeds", newHandler(AllFeeds)).Name("all-feeds")
+	router.Handle("/admin/all-feeds-opml", newHandler(AllFeedsOpml)).Name("all-feeds-opml")
+	router.Handle("/admin/user", newHandler(AdminUser)).Name("admin-user")
+	router.Handle("/date-formats", newHandler(AdminDateFormats)).Name("admin-date-formats")
+	router.Handle("/admin/feed", newHandler(AdminFeed)).Name("admin-feed")
+	router.Handle("/admin/set-password", newHandler(AdminSetPassword)).Name("admin-set-password")
+	router.Handle("/admin/set-policy", newHandler(AdminSetPolicy)).Name("admin-set-policy")
+	router.Handle("/admin/subhub", newHandler(AdminSubHub)).Name("admin-subhub-feed")
+	router.Handle("/admin/stats", newHandler(AdminStats)).Name("admin-stats")
+	router.Handle("/admin/update-feed", newHandler(AdminUpdateFeed)).Name("admin-update-feed")
+	router.Handle("/user/charge", wrapSession(Charge)).Name("charge")
+	router.Handle("/user/account", wrapSession(Account)).Name("account")
+	router.Handle("/user/uncheckout", wrapSession(Uncheckout)).Name("uncheckout")
 
-	//router.Handle("/tasks/delete-blobs", mpg.NewHandler(DeleteBlobs)).Name("delete-blobs")
+	//router.Handle("/tasks/delete-blobs", newHandler(DeleteBlobs)).Name("delete-blobs")
 
 	if len(PUBSUBHUBBUB_HOST) > 0 {
 		u := url.URL{
@@ -123,13 +183,57 @@ func RegisterHandlers(r *mux.Router) {
 	if !isDevServer {
 		return
 	}
-	router.Handle("/user/clear-feeds", mpg.NewHandler(ClearFeeds)).Name("clear-feeds")
-	router.Handle("/user/clear-read", mpg.NewHandler(ClearRead)).Name("clear-read")
-	router.Handle("/test/atom.xml", mpg.NewHandler(TestAtom)).Name("test-atom")
+	router.Handle("/user/clear-feeds", wrapSession(ClearFeeds)).Name("clear-feeds")
+	router.Handle("/user/clear-read", wrapSession(ClearRead)).Name("clear-read")
+	router.Handle("/test/atom.xml", newHandler(TestAtom)).Name("test-atom")
+}
+
+// wrap serves f to signed in users and to API tokens with full scope.
+func wrap(f func(Context, http.ResponseWriter, *http.Request)) http.Handler {
+	return wrapScope(f, scopeFull)
 }
 
-func wrap(f func(mpg.Context, http.ResponseWriter, *http.Request)) http.Handler {
-	handler := mpg.NewHandler(f)
+// wrapRead serves f, which doesn't change the user's data, to signed in
+// users and to API tokens of any scope.
+func wrapRead(f func(Context, http.ResponseWriter, *http.Request)) http.Handler {
+	return wrapScope(f, scopeRead)
+}
+
+// wrapSession serves f to signed in users but not to API tokens.
+func wrapSession(f func(Context, http.ResponseWriter, *http.Request)) http.Handler {
+	return wrapScope(f, "")
+}
+
+// wrapScope serves f to signed in users and, unless scope is empty, to
+// requests with an Authorization: Bearer header holding an API token that
+// allows scope.
+func wrapScope(f func(Context, http.ResponseWriter, *http.Request), scope string) http.Handler {
+	handler := newHandler(func(c Context, w http.ResponseWriter, r *http.Request) {
+		if token, ok := bearerToken(r); ok {
+			if scope == "" {
+				http.Error(w, "API tokens may not be used here", http.StatusForbidden)
+				return
+			}
+			u, ut, err := tokenUser(c.Store(), token)
+			if err == errBadToken {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				serveError(w, err)
+				return
+			}
+			if !ut.allows(scope) {
+				http.Error(w, "token scope does not allow this", http.StatusForbidden)
+				return
+			}
+			useToken(c, ut)
+			c = asUser(c, u, ut)
+		} else if c.User() == nil {
+			requireLogin(c, w, r)
+			return
+		}
+		f(c, w, r)
+	})
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if isDevServer {
 			w.Header().Add("Access-Control-Allow-Origin", r.Header.Get("Origin"))
@@ -139,7 +243,7 @@ func wrap(f func(mpg.Context, http.ResponseWriter, *http.Request)) http.Handler
 	})
 }
 
-func Main(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func Main(c Context, w http.ResponseWriter, r *http.Request) {
 	ua := r.Header.Get("User-Agent")
 	mobile := strings.Contains(ua, "Mobi")
 	if desktop, _ := r.Cookie("goread-desktop"); desktop != nil {
@@ -160,8 +264,8 @@ func Main(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func addFeed(c mpg.Context, userid string, outline *OpmlOutline) error {
-	gn := goon.FromContext(c)
+func addFeed(c Context, userid string, outline *OpmlOutline) error {
+	gn := c.Store()
 	o := outline.Outline[0]
 	c.Infof("adding feed %v to user %s", o.XmlUrl, userid)
 	fu, ferr := url.Parse(o.XmlUrl)
@@ -172,7 +276,14 @@ func addFeed(c mpg.Context, userid string, outline *OpmlOutline) error {
 	o.XmlUrl = fu.String()
 
 	f := Feed{Url: o.XmlUrl}
-	if err := gn.Get(&f); err == datastore.ErrNoSuchEntity {
+	err := gn.Get(&f)
+	if err == nil && f.MovedTo != "" {
+		c.Infof("feed %v moved to %v", f.Url, f.MovedTo)
+		o.XmlUrl = f.MovedTo
+		f = Feed{Url: o.XmlUrl}
+		err = gn.Get(&f)
+	}
+	if err == backend.ErrNoSuchEntity {
 		if feed, stories, err := fetchFeed(c, o.XmlUrl, o.XmlUrl); err != nil {
 			return fmt.Errorf("could not add feed %s: %v", o.XmlUrl, err)
 		} else {
@@ -208,7 +319,7 @@ func addFeed(c mpg.Context, userid string, outline *OpmlOutline) error {
 	return nil
 }
 
-func mergeUserOpml(c appengine.Context, ud *UserData, outlines ...*OpmlOutline) error {
+func mergeUserOpml(c backend.Context, ud *UserData, outlines ...*OpmlOutline) error {
 	var fs Opml
 	json.Unmarshal(ud.Opml, &fs)
 	urls := make(map[string]bool)
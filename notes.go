@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// maxSearchWords caps the words indexed for each note.
+const maxSearchWords = 500
+
+// starHighlight is a highlighted range of a story's text. Start and End
+// are offsets into the story content with its tags removed, the content's
+// textContent in a browser, in UTF-16 code units as browsers count them.
+// Text is the highlighted text. Clients may send it to have it checked.
+type starHighlight struct {
+	Start, End int
+	Text       string
+}
+
+// starNote is the JSON form of a UserStarNote.
+type starNote struct {
+	Note       string          `json:",omitempty"`
+	Highlights []starHighlight `json:",omitempty"`
+	Updated    time.Time
+}
+
+func (n *UserStarNote) info() *starNote {
+	sn := &starNote{Note: n.Note, Updated: n.Updated}
+	json.Unmarshal(n.Highlights, &sn.Highlights)
+	return sn
+}
+
+// noteKey returns the key of the note on story in feed.
+func noteKey(uk *backend.Key, feed, story string) *UserStarNote {
+	return &UserStarNote{Parent: backend.NewKey("USF", feed, 0, uk), Id: story}
+}
+
+// searchWords returns the distinct lower case words of s.
+func searchWords(s string) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, w := range backend.Tokenize(s) {
+		if seen[w] || len(words) == maxSearchWords {
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+	}
+	return words
+}
+
+// storyText returns the text of s's content, or of its summary if it has
+// no content.
+func storyText(gn *backend.Store, s *Story) (string, error) {
+	if err := gn.Get(s); err != nil {
+		return "", err
+	}
+	sc := &StoryContent{Id: 1, Parent: gn.Key(s)}
+	if err := gn.Get(sc); err != nil && err != backend.ErrNoSuchEntity {
+		return "", err
+	}
+	// Browsers read line breaks as \n.
+	return strings.Replace(contentText(sc.content(), s.Summary), "\r\n", "\n", -1), nil
+}
+
+// highlightText returns the text of h in text, which is in UTF-16 code
+// units, or false if h isn't a range of text or doesn't match its Text.
+func highlightText(text []uint16, h starHighlight) (string, bool) {
+	if h.Start < 0 || h.End <= h.Start || h.End > len(text) {
+		return "", false
+	}
+	// Don't split surrogate pairs.
+	for _, i := range []int{h.Start, h.End} {
+		if i < len(text) && text[i] >= 0xdc00 && text[i] <= 0xdfff {
+			return "", false
+		}
+	}
+	t := string(utf16.Decode(text[h.Start:h.End]))
+	if h.Text != "" && h.Text != t {
+		return "", false
+	}
+	return t, true
+}
+
+// storyNotes returns the notes, by star id, of the stories of keys whose
+// parents are UserStarFeeds and whose ids are story ids.
+func storyNotes(gn *backend.Store, keys []*backend.Key) map[string]*starNote {
+	notes := make([]*UserStarNote, len(keys))
+	for i, k := range keys {
+		notes[i] = &UserStarNote{Parent: k.Parent(), Id: k.StringID()}
+	}
+	err := gn.GetMulti(notes)
+	me, _ := err.(backend.MultiError)
+	m := make(map[string]*starNote)
+	if err != nil && me == nil {
+		return m
+	}
+	for i, n := range notes {
+		if me == nil || me[i] == nil {
+			m[starID(keys[i])] = n.info()
+		}
+	}
+	return m
+}
+
+// SaveNote sets the note and highlights of the starred story named by the
+// feed and story parameters. The note parameter is the note and the
+// highlights parameter a JSON list of ranges with Start and End set, and
+// optionally Text. An empty note without highlights deletes it.
+func SaveNote(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	feed, story := r.FormValue("feed"), r.FormValue("story")
+	if feed == "" || story == "" {
+		http.Error(w, "no story", http.StatusBadRequest)
+		return
+	}
+	us := &UserStar{Parent: backend.NewKey("USF", feed, 0, uk), Id: story}
+	if err := gn.Get(us); err == backend.ErrNoSuchEntity {
+		http.Error(w, "story is not starred", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	var highlights []starHighlight
+	if h := r.FormValue("highlights"); h != "" {
+		if err := json.Unmarshal([]byte(h), &highlights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	n := noteKey(uk, feed, story)
+	n.Note = strings.TrimSpace(r.FormValue("note"))
+	if n.Note == "" && len(highlights) == 0 {
+		if err := gn.Delete(gn.Key(n)); err != nil {
+			serveError(w, err)
+		}
+		return
+	}
+	text := n.Note
+	if len(highlights) > 0 {
+		st, err := storyText(gn, &Story{Id: story, Parent: gn.Key(&Feed{Url: feed})})
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		units := utf16.Encode([]rune(st))
+		for i, h := range highlights {
+			t, ok := highlightText(units, h)
+			if !ok {
+				http.Error(w, "bad highlight range", http.StatusBadRequest)
+				return
+			}
+			highlights[i].Text = t
+			text += " " + t
+		}
+		n.Highlights, _ = json.Marshal(highlights)
+	}
+	n.Words = searchWords(text)
+	n.Updated = time.Now()
+	if _, err := gn.Put(n); err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, n.info())
+}
+
+// SearchStars returns the starred stories whose notes or highlights have
+// all the words of the q parameter.
+func SearchStars(c Context, w http.ResponseWriter, r *http.Request) {
+	words := searchWords(r.FormValue("q"))
+	if len(words) == 0 {
+		http.Error(w, "no search words", http.StatusBadRequest)
+		return
+	}
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserStarNote{})).
+		Ancestor(gn.Key(&User{Id: c.User().ID})).
+		KeysOnly().
+		Limit(50)
+	for _, w := range words {
+		q = q.Filter("w =", w)
+	}
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	smap, feeds := starStories(gn, keys)
+	serveJSON(w, struct {
+		Stories map[string][]*Story
+		Notes   map[string]*starNote
+		Feeds   []*Feed
+	}{
+		Stories: smap,
+		Notes:   storyNotes(gn, keys),
+		Feeds:   feeds,
+	})
+}
+
+// starExport is a starred story as exported by ExportStars.
+type starExport struct {
+	Feed      string
+	FeedTitle string `json:",omitempty"`
+	Story     string
+	Title     string
+	Link      string
+	Author    string `json:",omitempty"`
+	Starred   time.Time
+	Tags      []string `json:",omitempty"`
+	*starNote
+}
+
+// ExportStars downloads the user's starred stories with their notes,
+// highlights and tags as JSON.
+func ExportStars(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	var stars []*UserStar
+	keys, err := gn.GetAll(backend.NewQuery(gn.Kind(&UserStar{})).Ancestor(uk).Order("-c"), &stars)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	exports := []*starExport{}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		smap, feeds := starStories(gn, keys[:n])
+		notes := storyNotes(gn, keys[:n])
+		titles := make(map[string]string)
+		for _, f := range feeds {
+			titles[f.Url] = f.Title
+		}
+		stories := make(map[string]*Story)
+		for _, ss := range smap {
+			for _, s := range ss {
+				stories[starID(gn.Key(s))] = s
+			}
+		}
+		tagged := make([]*UserTagged, n)
+		for i, k := range keys[:n] {
+			tagged[i] = taggedKey(uk, k.Parent().StringID(), k.StringID())
+		}
+		gn.GetMulti(tagged)
+		for i, k := range keys[:n] {
+			id := starID(k)
+			e := &starExport{
+				Feed:      k.Parent().StringID(),
+				FeedTitle: titles[k.Parent().StringID()],
+				Story:     k.StringID(),
+				Starred:   stars[i].Created,
+				Tags:      tagged[i].Tags,
+				starNote:  notes[id],
+			}
+			if s := stories[id]; s != nil {
+				e.Title, e.Link, e.Author = s.Title, s.Link, s.Author
+			}
+			exports = append(exports, e)
+		}
+		keys, stars = keys[n:], stars[n:]
+	}
+	b, err := json.MarshalIndent(exports, "", "\t")
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Header().Add("Content-Disposition", "attachment; filename=stars.json")
+	w.Write(b)
+}
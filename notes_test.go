@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"testing"
+	"unicode/utf16"
+)
+
+func TestHighlightText(t *testing.T) {
+	// "😀" is two UTF-16 code units, as "😀".length is in a browser.
+	text := utf16.Encode([]rune(contentText("<p>I 😀 caf&eacute;s</p> <b>très</b> bien", "")))
+	tests := []struct {
+		h    starHighlight
+		text string
+		ok   bool
+	}{
+		{starHighlight{Start: 0, End: 1}, "I", true},
+		{starHighlight{Start: 2, End: 4}, "😀", true},
+		{starHighlight{Start: 5, End: 10}, "cafés", true},
+		{starHighlight{Start: 11, End: 15}, "très", true},
+		{starHighlight{Start: 11, End: 20}, "très bien", true},
+		{starHighlight{Start: 11, End: 15, Text: "très"}, "très", true},
+		{starHighlight{Start: 11, End: 15, Text: "tres"}, "", false},
+		{starHighlight{Start: 2, End: 3}, "", false},
+		{starHighlight{Start: 3, End: 4}, "", false},
+		{starHighlight{Start: 4, End: 4}, "", false},
+		{starHighlight{Start: -1, End: 4}, "", false},
+		{starHighlight{Start: 11, End: 21}, "", false},
+	}
+	for i, test := range tests {
+		s, ok := highlightText(text, test.h)
+		if s != test.text || ok != test.ok {
+			t.Errorf("%v: got %q %v, expected %q %v", i, s, ok, test.text, test.ok)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"net/http"
+
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/sanitizer"
+)
+
+// Stories are sanitized when they are fetched, with the policy an admin
+// has set for their feed, or the default. Users may also pick a policy
+// per feed, which GetContents applies to the stored content. Since that
+// has already been sanitized, a user's policy can only remove more.
+
+// feedPolicy returns the policy the stories of the feed at url are
+// stored with, which removes TRACKING.
+func feedPolicy(gn *backend.Store, url string) *sanitizer.Policy {
+	f := &Feed{Url: url}
+	if err := gn.Get(f); err != nil {
+		return sanitizer.Default.WithTracking(TRACKING)
+	}
+	return sanitizer.PolicyNamed(f.Policy).WithTracking(TRACKING)
+}
+
+// userPolicies returns the policies the user of o has picked, by feed.
+func userPolicies(o *Opml) map[string]*sanitizer.Policy {
+	policies := make(map[string]*sanitizer.Policy)
+	var walk func([]*OpmlOutline)
+	walk = func(outlines []*OpmlOutline) {
+		for _, o := range outlines {
+			if o.Policy != "" && o.XmlUrl != "" {
+				policies[o.XmlUrl] = sanitizer.PolicyNamed(o.Policy)
+			}
+			walk(o.Outline)
+		}
+	}
+	walk(o.Outline)
+	return policies
+}
+
+// SetPolicy sets the policy the user wants the stories of the feed
+// parameter shown with to the policy parameter. An empty policy shows
+// them as stored.
+func SetPolicy(c Context, w http.ResponseWriter, r *http.Request) {
+	feed := r.FormValue("feed")
+	policy := r.FormValue("policy")
+	if _, ok := sanitizer.Policies[policy]; !ok && policy != "" {
+		http.Error(w, "unknown policy", http.StatusBadRequest)
+		return
+	}
+	found := false
+	err := editOpml(c, func(o *Opml) bool {
+		changed := false
+		var walk func([]*OpmlOutline)
+		walk = func(outlines []*OpmlOutline) {
+			for _, o := range outlines {
+				if o.XmlUrl == feed {
+					found = true
+					changed = changed || o.Policy != policy
+					o.Policy = policy
+				}
+				walk(o.Outline)
+			}
+		}
+		walk(o.Outline)
+		return changed
+	})
+	if err != nil {
+		serveError(w, err)
+	} else if !found {
+		http.Error(w, "not subscribed", http.StatusBadRequest)
+	}
+}
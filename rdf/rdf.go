@@ -31,6 +31,9 @@ type Channel struct {
 	Description string `xml:"description"`
 	Link        string `xml:"link"`
 	Date        string `xml:"date"`
+
+	UpdatePeriod    string `xml:"updatePeriod"`
+	UpdateFrequency string `xml:"updateFrequency"`
 }
 
 type Item struct {
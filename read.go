@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync"
+
+	"github.com/mjibson/goread/backend"
+)
+
+func userReadID(uid, feed string) string {
+	return uid + "|" + feed
+}
+
+// updateRead applies f to the user's read record of feed in a
+// transaction. f returns whether it changed the record. Empty records are
+// deleted.
+func updateRead(c backend.Context, uid, feed string, f func(ur *UserRead) bool) error {
+	return c.Store().RunInTransaction(func(gn *backend.Store) error {
+		ur := &UserRead{Id: userReadID(uid, feed)}
+		if err := gn.Get(ur); err != nil && err != backend.ErrNoSuchEntity {
+			return err
+		}
+		if !f(ur) {
+			return nil
+		}
+		if len(ur.Stories) == 0 {
+			return gn.Delete(gn.Key(ur))
+		}
+		ur.User = uid
+		ur.Feed = feed
+		_, err := gn.Put(ur)
+		return err
+	})
+}
+
+// updateReads calls updateRead for each feed of stories concurrently.
+func updateReads(c backend.Context, uid string, stories map[string][]string, f func(ur *UserRead, ids []string) bool) error {
+	var wg sync.WaitGroup
+	errc := make(chan error, len(stories))
+	for feed, ids := range stories {
+		wg.Add(1)
+		go func(feed string, ids []string) {
+			defer wg.Done()
+			errc <- updateRead(c, uid, feed, func(ur *UserRead) bool {
+				return f(ur, ids)
+			})
+		}(feed, ids)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markRead adds stories, keyed by feed, to the user's read records.
+func markRead(c backend.Context, uid string, stories map[string][]string) error {
+	return updateReads(c, uid, stories, func(ur *UserRead, ids []string) bool {
+		has := make(map[string]bool, len(ur.Stories))
+		for _, id := range ur.Stories {
+			has[id] = true
+		}
+		changed := false
+		for _, id := range ids {
+			if !has[id] {
+				has[id] = true
+				ur.Stories = append(ur.Stories, id)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// unmarkRead removes stories, keyed by feed, from the user's read records.
+func unmarkRead(c backend.Context, uid string, stories map[string][]string) error {
+	return updateReads(c, uid, stories, func(ur *UserRead, ids []string) bool {
+		remove := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			remove[id] = true
+		}
+		n := ur.Stories[:0]
+		for _, id := range ur.Stories {
+			if !remove[id] {
+				n = append(n, id)
+			}
+		}
+		changed := len(n) != len(ur.Stories)
+		ur.Stories = n
+		return changed
+	})
+}
+
+// getRead returns the stories of feeds the user has read since User.Read.
+func getRead(gn *backend.Store, uid string, feeds []string) (Read, error) {
+	urs := make([]*UserRead, len(feeds))
+	for i, f := range feeds {
+		urs[i] = &UserRead{Id: userReadID(uid, f)}
+	}
+	read := make(Read)
+	err := gn.GetMulti(urs)
+	merr, _ := err.(backend.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+	for i, ur := range urs {
+		if merr != nil && merr[i] != nil {
+			if merr[i] != backend.ErrNoSuchEntity {
+				return nil, merr[i]
+			}
+			continue
+		}
+		for _, id := range ur.Stories {
+			read[readStory{Feed: feeds[i], Story: id}] = true
+		}
+	}
+	return read, nil
+}
+
+// deleteUserRead deletes all of the user's read records.
+func deleteUserRead(gn *backend.Store, uid string) error {
+	q := backend.NewQuery(gn.Kind(&UserRead{})).Filter("u =", uid).KeysOnly()
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		return err
+	}
+	return gn.DeleteMulti(keys)
+}
+
+// migrateUserRead converts the user's UserData.Read to UserRead records.
+func migrateUserRead(c backend.Context, uk *backend.Key) error {
+	gn := c.Store()
+	ud := &UserData{Id: "data", Parent: uk}
+	if err := gn.Get(ud); err == backend.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(ud.Read) == 0 {
+		return nil
+	}
+	old := ud.Read
+	read := make(Read)
+	if err := gob.NewDecoder(bytes.NewReader(old)).Decode(&read); err != nil {
+		c.Warningf("dropping bad read data of %v: %v", uk.StringID(), err)
+	}
+	stories := make(map[string][]string)
+	for rs := range read {
+		stories[rs.Feed] = append(stories[rs.Feed], rs.Story)
+	}
+	if err := markRead(c, uk.StringID(), stories); err != nil {
+		return err
+	}
+	return gn.RunInTransaction(func(gn *backend.Store) error {
+		ud := &UserData{Id: "data", Parent: uk}
+		if err := gn.Get(ud); err != nil {
+			return err
+		}
+		if !bytes.Equal(ud.Read, old) {
+			return errors.New("read data changed during migration")
+		}
+		ud.Read = nil
+		_, err := gn.Put(ud)
+		return err
+	})
+}
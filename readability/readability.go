@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package readability extracts the main content of an article's web page,
+// in the manner of Arc90's Readability: paragraphs score the elements that
+// contain them, and the best scoring element and its related siblings are
+// the article.
+package readability
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/mjibson/goread/_third_party/golang.org/x/net/html"
+	"github.com/mjibson/goread/_third_party/golang.org/x/net/html/atom"
+)
+
+// ErrNoContent is returned when a page has no article.
+var ErrNoContent = errors.New("readability: no article content found")
+
+// minLength is the least text an article can have.
+const minLength = 250
+
+var (
+	// unlikely marks class names and ids of page furniture, unless maybe
+	// also matches.
+	unlikely = regexp.MustCompile(`(?i)banner|combx|comment|community|cookie|disqus|extra|foot|header|menu|modal|nav|newsletter|pager|pagination|popup|remark|rss|share|shoutbox|sidebar|social|sponsor|subscribe`)
+	maybe    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positive = regexp.MustCompile(`(?i)article|blog|body|content|entry|hentry|main|page|post|story|text`)
+	negative = regexp.MustCompile(`(?i)(^|[-_ ])ads?([-_ ]|$)|combx|comment|contact|foot|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|sponsor|shopping|social|tags|tool|widget`)
+)
+
+// removed are elements that are never part of an article.
+var removed = map[atom.Atom]bool{
+	atom.Aside:    true,
+	atom.Button:   true,
+	atom.Footer:   true,
+	atom.Form:     true,
+	atom.Input:    true,
+	atom.Link:     true,
+	atom.Meta:     true,
+	atom.Nav:      true,
+	atom.Noscript: true,
+	atom.Script:   true,
+	atom.Select:   true,
+	atom.Style:    true,
+	atom.Svg:      true,
+	atom.Textarea: true,
+}
+
+// blocks are elements that keep a div from being scored as a paragraph.
+var blocks = map[atom.Atom]bool{
+	atom.A:          true,
+	atom.Blockquote: true,
+	atom.Div:        true,
+	atom.Dl:         true,
+	atom.Img:        true,
+	atom.Ol:         true,
+	atom.P:          true,
+	atom.Pre:        true,
+	atom.Table:      true,
+	atom.Ul:         true,
+}
+
+// Extract returns the HTML of the article in the page read from r.
+func Extract(r io.Reader) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+	prune(doc)
+	scores := score(doc)
+	var top *html.Node
+	for n, s := range scores {
+		if top == nil || s > scores[top] {
+			top = n
+		}
+	}
+	if top == nil {
+		return "", ErrNoContent
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("<div>")
+	length := 0
+	for _, n := range related(top, scores) {
+		clean(n)
+		length += len(text(n))
+		if err := html.Render(buf, n); err != nil {
+			return "", err
+		}
+	}
+	buf.WriteString("</div>")
+	if length < minLength {
+		return "", ErrNoContent
+	}
+	return buf.String(), nil
+}
+
+// prune removes elements that are never, or unlikely to be, part of an
+// article.
+func prune(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode || c.Type == html.ElementNode && (removed[c.DataAtom] || isUnlikely(c)) {
+			n.RemoveChild(c)
+		} else {
+			prune(c)
+		}
+		c = next
+	}
+}
+
+func isUnlikely(n *html.Node) bool {
+	switch n.Data {
+	case "html", "body", "article", "main":
+		return false
+	}
+	s := attr(n, "class") + " " + attr(n, "id")
+	return unlikely.MatchString(s) && !maybe.MatchString(s)
+}
+
+// score returns the scores of the elements that contain paragraphs.
+func score(doc *html.Node) map[*html.Node]float64 {
+	scores := make(map[*html.Node]float64)
+	add := func(n *html.Node, s float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = initialScore(n)
+		}
+		scores[n] += s
+	}
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if !isParagraph(n) {
+			return
+		}
+		t := strings.TrimSpace(text(n))
+		if len(t) < 25 {
+			return
+		}
+		s := 1 + float64(strings.Count(t, ","))
+		if l := float64(len(t)) / 100; l < 3 {
+			s += l
+		} else {
+			s += 3
+		}
+		add(n.Parent, s)
+		if n.Parent != nil {
+			add(n.Parent.Parent, s/2)
+		}
+	}
+	walk(doc)
+	for n := range scores {
+		scores[n] *= 1 - linkDensity(n)
+	}
+	return scores
+}
+
+func isParagraph(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Pre, atom.Td:
+		return true
+	case atom.Div:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && blocks[c.DataAtom] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func initialScore(n *html.Node) float64 {
+	s := classWeight(n)
+	switch n.Data {
+	case "article", "main":
+		s += 10
+	case "div":
+		s += 5
+	case "blockquote", "pre", "td":
+		s += 3
+	case "address", "dd", "dl", "dt", "li", "ol", "ul":
+		s -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		s -= 5
+	}
+	return s
+}
+
+func classWeight(n *html.Node) float64 {
+	var w float64
+	for _, v := range []string{attr(n, "class"), attr(n, "id")} {
+		if v == "" {
+			continue
+		}
+		if negative.MatchString(v) {
+			w -= 25
+		}
+		if positive.MatchString(v) {
+			w += 25
+		}
+	}
+	return w
+}
+
+// related returns top and its siblings that are also part of the article.
+func related(top *html.Node, scores map[*html.Node]float64) []*html.Node {
+	if top.Parent == nil {
+		return []*html.Node{top}
+	}
+	threshold := scores[top] * 0.2
+	if threshold < 10 {
+		threshold = 10
+	}
+	var nodes []*html.Node
+	for c := top.Parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		keep := c == top
+		if s, ok := scores[c]; ok && s >= threshold {
+			keep = true
+		} else if c.DataAtom == atom.P {
+			t := strings.TrimSpace(text(c))
+			ld := linkDensity(c)
+			keep = len(t) > 80 && ld < 0.25 || len(t) > 0 && ld == 0 && strings.HasSuffix(t, ".")
+		}
+		if keep {
+			nodes = append(nodes, c)
+		}
+	}
+	return nodes
+}
+
+// clean removes lists, tables and divs from n that look like page
+// furniture: those with negative class names, or mostly links.
+func clean(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode {
+			switch c.DataAtom {
+			case atom.Div, atom.Section, atom.Table, atom.Ul, atom.Ol:
+				t := text(c)
+				if classWeight(c) < 0 || linkDensity(c) > 0.5 && strings.Count(t, ",") < 10 {
+					n.RemoveChild(c)
+					c = next
+					continue
+				}
+			}
+			clean(c)
+		}
+		c = next
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// text returns the text of n and its descendants.
+func text(n *html.Node) string {
+	buf := &bytes.Buffer{}
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return buf.String()
+}
+
+// linkDensity returns the fraction of n's text that is in links.
+func linkDensity(n *html.Node) float64 {
+	total := len(text(n))
+	if total == 0 {
+		return 0
+	}
+	links := 0
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			links += len(text(n))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return float64(links) / float64(total)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package readability
+
+import (
+	"strings"
+	"testing"
+)
+
+const page = `<html>
+<head><title>A story</title><script>track()</script></head>
+<body>
+<div id="header"><a href="/">Home</a> <a href="/news">News</a> <a href="/about">About</a></div>
+<nav><ul><li><a href="/1">One</a></li><li><a href="/2">Two</a></li></ul></nav>
+<div class="sidebar">
+	<p>Subscribe to our newsletter, it has all the news you could want, every day.</p>
+	<ul><li><a href="/popular/1">A popular story with a long title</a></li><li><a href="/popular/2">Another popular story</a></li></ul>
+</div>
+<div class="post">
+	<h1>The story</h1>
+	<div class="entry-content">
+		<p>The first paragraph of the story, which goes on for a while so that it counts as a paragraph, with commas, and more words.</p>
+		<p>The second paragraph continues the story. It has enough text to be scored, and it mentions <a href="/thing">a thing</a> in passing.</p>
+		<p>The third paragraph ends the story, with a conclusion, a moral, and a final thought for the reader to consider.</p>
+		<div class="share-tools"><a href="/share/tw">Tweet</a> <a href="/share/fb">Share</a></div>
+	</div>
+</div>
+<div id="comments"><p>First comment, which is long enough to be a paragraph but is not part of the story at all.</p></div>
+<footer>Copyright</footer>
+</body>
+</html>`
+
+func TestExtract(t *testing.T) {
+	got, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"first paragraph", "second paragraph", `<a href="/thing">a thing</a>`, "third paragraph"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("missing %q in %s", s, got)
+		}
+	}
+	for _, s := range []string{"track()", "Home", "One", "newsletter", "popular", "Tweet", "comment", "Copyright"} {
+		if strings.Contains(got, s) {
+			t.Errorf("unexpected %q in %s", s, got)
+		}
+	}
+}
+
+func TestExtractNoContent(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"<html><body><p>Too short.</p></body></html>",
+		`<html><body><div class="sidebar"><p>A sidebar paragraph with enough text in it to be scored as a paragraph.</p></div></body></html>`,
+	} {
+		if got, err := Extract(strings.NewReader(s)); err != ErrNoContent {
+			t.Errorf("%q: got %q, %v; want ErrNoContent", s, got, err)
+		}
+	}
+}
@@ -4,6 +4,12 @@
 
 package rss
 
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
 type Rss struct {
 	XMLName       string  `xml:"rss"`
 	Title         string  `xml:"channel>title"`
@@ -12,6 +18,79 @@ type Rss struct {
 	PubDate       string  `xml:"channel>pubDate,omitempty"`
 	LastBuildDate string  `xml:"channel>lastBuildDate,omitempty"`
 	Items         []*Item `xml:"channel>item"`
+
+	TTL       string   `xml:"channel>ttl,omitempty"`
+	SkipHours []string `xml:"channel>skipHours>hour"`
+	SkipDays  []string `xml:"channel>skipDays>day"`
+
+	// http://web.resource.org/rss/1.0/modules/syndication/
+	UpdatePeriod    string `xml:"channel>updatePeriod,omitempty"`
+	UpdateFrequency string `xml:"channel>updateFrequency,omitempty"`
+}
+
+// Interval returns the minimum time between updates requested by the feed
+// through ttl or the syndication module, or 0 if there is none.
+func (r *Rss) Interval() time.Duration {
+	var d time.Duration
+	if m, err := strconv.Atoi(strings.TrimSpace(r.TTL)); err == nil && m > 0 {
+		d = time.Minute * time.Duration(m)
+	}
+	if s := SyndicationInterval(r.UpdatePeriod, r.UpdateFrequency); s > d {
+		d = s
+	}
+	return d
+}
+
+// Hours returns the valid GMT hours listed in skipHours.
+func (r *Rss) Hours() []int {
+	var hours []int
+	for _, h := range r.SkipHours {
+		i, err := strconv.Atoi(strings.TrimSpace(h))
+		if err != nil || i < 0 || i > 24 {
+			continue
+		}
+		hours = append(hours, i%24)
+	}
+	return hours
+}
+
+// Days returns the valid days listed in skipDays.
+func (r *Rss) Days() []time.Weekday {
+	var days []time.Weekday
+	for _, d := range r.SkipDays {
+		d = strings.TrimSpace(d)
+		for w := time.Sunday; w <= time.Saturday; w++ {
+			if strings.EqualFold(d, w.String()) {
+				days = append(days, w)
+				break
+			}
+		}
+	}
+	return days
+}
+
+// SyndicationInterval converts the syndication module's updatePeriod and
+// updateFrequency to a duration, or 0 if period is not recognized.
+func SyndicationInterval(period, frequency string) time.Duration {
+	var d time.Duration
+	switch strings.ToLower(strings.TrimSpace(period)) {
+	case "hourly":
+		d = time.Hour
+	case "daily":
+		d = time.Hour * 24
+	case "weekly":
+		d = time.Hour * 24 * 7
+	case "monthly":
+		d = time.Hour * 24 * 30
+	case "yearly":
+		d = time.Hour * 24 * 365
+	default:
+		return 0
+	}
+	if f, err := strconv.Atoi(strings.TrimSpace(frequency)); err == nil && f > 1 {
+		d /= time.Duration(f)
+	}
+	return d
 }
 
 func (r *Rss) Hub() string {
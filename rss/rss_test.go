@@ -18,8 +18,10 @@ package rss
 
 import (
 	"encoding/xml"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mjibson/goread/_third_party/code.google.com/p/go-charset/charset"
 )
@@ -97,3 +99,46 @@ const WP_FEED = `
 </channel>
 </rss>
 `
+
+func TestScheduleHints(t *testing.T) {
+	r := Rss{}
+	d := xml.NewDecoder(strings.NewReader(WP_FEED))
+	d.CharsetReader = charset.NewReader
+	d.DefaultSpace = "DefaultSpace"
+	if err := d.Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if i := r.Interval(); i != time.Hour {
+		t.Error("bad sy interval", i)
+	}
+
+	r = Rss{}
+	d = xml.NewDecoder(strings.NewReader(HINTS_FEED))
+	d.DefaultSpace = "DefaultSpace"
+	if err := d.Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if i := r.Interval(); i != time.Hour*12 {
+		t.Error("bad interval", i)
+	}
+	if h := r.Hours(); !reflect.DeepEqual(h, []int{0, 1, 23}) {
+		t.Error("bad hours", h)
+	}
+	if w := r.Days(); !reflect.DeepEqual(w, []time.Weekday{time.Saturday, time.Sunday}) {
+		t.Error("bad days", w)
+	}
+}
+
+const HINTS_FEED = `
+<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/">
+<channel>
+	<title>hints</title>
+	<ttl>60</ttl>
+	<sy:updatePeriod>daily</sy:updatePeriod>
+	<sy:updateFrequency>2</sy:updateFrequency>
+	<skipHours><hour>24</hour><hour> 1 </hour><hour>23</hour><hour>99</hour></skipHours>
+	<skipDays><day>Saturday</day><day>sunday</day><day>someday</day></skipDays>
+</channel>
+</rss>
+`
@@ -0,0 +1,460 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// Story rules let users hide, mark read, star or highlight the stories
+// they match. Hide and highlight are applied whenever a story list is
+// built. Read and star are applied to unread stories only, so once a user
+// has seen a story the rules leave it alone.
+
+// Rule fields.
+const (
+	ruleTitle   = "title"
+	ruleAuthor  = "author"
+	ruleHost    = "host"
+	ruleContent = "content"
+)
+
+// Rule actions.
+const (
+	ruleHide      = "hide"
+	ruleRead      = "read"
+	ruleStar      = "star"
+	ruleHighlight = "highlight"
+)
+
+// compiledRule is a UserRule ready to match stories.
+type compiledRule struct {
+	*UserRule
+	re       *regexp.Regexp
+	keywords []string
+}
+
+func compileRule(ur *UserRule) (*compiledRule, error) {
+	switch ur.Field {
+	case ruleTitle, ruleAuthor, ruleHost, ruleContent:
+	default:
+		return nil, errors.New("bad field")
+	}
+	switch ur.Action {
+	case ruleHide, ruleRead, ruleStar, ruleHighlight:
+	default:
+		return nil, errors.New("bad action")
+	}
+	if ur.Feed != "" && ur.Folder != "" {
+		return nil, errors.New("rule has both a feed and a folder")
+	}
+	cr := &compiledRule{UserRule: ur}
+	if ur.Regexp {
+		re, err := regexp.Compile(ur.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		cr.re = re
+	} else {
+		// Keywords are comma separated and match case insensitively.
+		for _, k := range strings.Split(ur.Pattern, ",") {
+			if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+				cr.keywords = append(cr.keywords, k)
+			}
+		}
+	}
+	if ur.Pattern == "" || (!ur.Regexp && len(cr.keywords) == 0) {
+		return nil, errors.New("no pattern")
+	}
+	return cr, nil
+}
+
+// text returns the part of s that cr matches. content is the text of s's
+// content, which story lists don't load themselves.
+func (cr *compiledRule) text(s *Story, content string) string {
+	switch cr.Field {
+	case ruleTitle:
+		return s.Title
+	case ruleAuthor:
+		return s.Author
+	case ruleHost:
+		if u, err := url.Parse(s.Link); err == nil {
+			return strings.ToLower(u.Host)
+		}
+		return ""
+	default:
+		return content
+	}
+}
+
+func (cr *compiledRule) match(s *Story, content string) bool {
+	t := cr.text(s, content)
+	if cr.re != nil {
+		return cr.re.MatchString(t)
+	}
+	t = strings.ToLower(t)
+	for _, k := range cr.keywords {
+		if strings.Contains(t, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleSet is a user's rules.
+type ruleSet struct {
+	rules   []*compiledRule
+	folders map[string]string // feed url to folder
+	// contents are the texts of stories' contents by feed|story, for
+	// content rules.
+	contents map[string]string
+}
+
+// loadRules returns the rules of the user uk. Rules that no longer compile
+// are logged and skipped.
+func loadRules(c Context, uk *backend.Key) (*ruleSet, error) {
+	gn := c.Store()
+	var urs []*UserRule
+	q := backend.NewQuery(gn.Kind(&UserRule{})).Ancestor(uk)
+	if _, err := gn.GetAll(q, &urs); err != nil {
+		return nil, err
+	}
+	rs := &ruleSet{
+		folders:  make(map[string]string),
+		contents: make(map[string]string),
+	}
+	folders := false
+	for _, ur := range urs {
+		cr, err := compileRule(ur)
+		if err != nil {
+			c.Errorf("rule %v: %v", ur.Id, err)
+			continue
+		}
+		rs.rules = append(rs.rules, cr)
+		folders = folders || ur.Folder != ""
+	}
+	if folders {
+		ud := &UserData{Id: "data", Parent: uk}
+		if err := gn.Get(ud); err != nil && err != backend.ErrNoSuchEntity {
+			return nil, err
+		}
+		var uf Opml
+		json.Unmarshal(ud.Opml, &uf)
+		for _, o := range uf.Outline {
+			for _, so := range o.Outline {
+				rs.folders[so.XmlUrl] = o.Title
+			}
+		}
+	}
+	return rs, nil
+}
+
+// applies returns whether cr applies to the stories of feed.
+func (rs *ruleSet) applies(cr *compiledRule, feed string) bool {
+	return (cr.Feed == "" || cr.Feed == feed) && (cr.Folder == "" || cr.Folder == rs.folders[feed])
+}
+
+// loadContents loads the contents of the stories, keyed by feed, that
+// content rules apply to.
+func (rs *ruleSet) loadContents(c Context, stories map[string][]*Story) error {
+	gn := c.Store()
+	var todo []*Story
+	for f, v := range stories {
+		for _, cr := range rs.rules {
+			if cr.Field == ruleContent && rs.applies(cr, f) {
+				todo = append(todo, v...)
+				break
+			}
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	scs := make([]*StoryContent, len(todo))
+	for i, s := range todo {
+		scs[i] = &StoryContent{Id: 1, Parent: gn.Key(s)}
+	}
+	err := gn.GetMulti(scs)
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
+		return err
+	}
+	for i, s := range todo {
+		content := ""
+		if !backend.NotFound(err, i) {
+			content = scs[i].content()
+		}
+		rs.contents[s.Parent.StringID()+"|"+s.Id] = contentText(content, s.Summary)
+	}
+	return nil
+}
+
+// actions returns the actions of the rules that match s in feed.
+func (rs *ruleSet) actions(feed string, s *Story) map[string]bool {
+	var a map[string]bool
+	for _, cr := range rs.rules {
+		if !rs.applies(cr, feed) {
+			continue
+		}
+		if a[cr.Action] || !cr.match(s, rs.contents[feed+"|"+s.Id]) {
+			continue
+		}
+		if a == nil {
+			a = make(map[string]bool)
+		}
+		a[cr.Action] = true
+	}
+	return a
+}
+
+// filter removes hidden stories from stories, keyed by feed, and
+// highlights the rest. Content rules need loadContents to have been called
+// for stories. If unread is set the stories matched by read rules
+// are removed as well, and the ids by feed of the stories matched by read
+// and star rules are returned.
+func (rs *ruleSet) filter(stories map[string][]*Story, unread bool) (read, star map[string][]string) {
+	read = make(map[string][]string)
+	star = make(map[string][]string)
+	if len(rs.rules) == 0 {
+		return
+	}
+	for f, v := range stories {
+		kept := v[:0]
+		for _, s := range v {
+			a := rs.actions(f, s)
+			if a[ruleHide] {
+				continue
+			}
+			if unread && a[ruleStar] {
+				star[f] = append(star[f], s.Id)
+			}
+			if unread && a[ruleRead] {
+				read[f] = append(read[f], s.Id)
+				continue
+			}
+			s.Highlight = a[ruleHighlight]
+			kept = append(kept, s)
+		}
+		if len(kept) == 0 {
+			delete(stories, f)
+		} else {
+			stories[f] = kept
+		}
+	}
+	return
+}
+
+// applyRules runs rs on the unread stories of the user uk, keyed by feed.
+// Stories matched by read rules are marked read and those matched by star
+// rules starred. The star ids of newly starred stories are returned.
+// Read-only tokens only see the stories filtered, without saving anything.
+func applyRules(c Context, uk *backend.Key, rs *ruleSet, stories map[string][]*Story) []string {
+	if err := rs.loadContents(c, stories); err != nil {
+		c.Errorf("rules contents: %v", err)
+	}
+	read, star := rs.filter(stories, true)
+	if readOnly(c) {
+		return nil
+	}
+	if err := setRead(c, uk, read, true); err != nil {
+		c.Errorf("rules read: %v", err)
+	}
+	// Leave existing stars alone so their dates don't change.
+	gn := c.Store()
+	var stars []*UserStar
+	for f, ids := range star {
+		for _, id := range ids {
+			stars = append(stars, &UserStar{Parent: backend.NewKey("USF", f, 0, uk), Id: id})
+		}
+	}
+	if len(stars) == 0 {
+		return nil
+	}
+	err := gn.GetMulti(stars)
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
+		c.Errorf("rules stars: %v", err)
+		return nil
+	}
+	var ids []string
+	star = make(map[string][]string)
+	for i, us := range stars {
+		if backend.NotFound(err, i) {
+			f := us.Parent.StringID()
+			star[f] = append(star[f], us.Id)
+			ids = append(ids, f+"|"+us.Id)
+		}
+	}
+	if err := setStarred(c, uk, star, true); err != nil {
+		c.Errorf("rules star: %v", err)
+		return nil
+	}
+	return ids
+}
+
+// ruleForm returns the rule described by the parameters of r.
+func ruleForm(r *http.Request) *UserRule {
+	re, _ := strconv.ParseBool(r.FormValue("regexp"))
+	return &UserRule{
+		Feed:    r.FormValue("feed"),
+		Folder:  r.FormValue("folder"),
+		Field:   r.FormValue("field"),
+		Regexp:  re,
+		Pattern: r.FormValue("pattern"),
+		Action:  r.FormValue("action"),
+	}
+}
+
+func ListRules(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserRule{})).Ancestor(gn.Key(&User{Id: c.User().ID}))
+	rules := []*UserRule{}
+	if _, err := gn.GetAll(q, &rules); err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, rules)
+}
+
+// SaveRule creates a rule from the feed, folder, field, regexp, pattern
+// and action parameters. If the id parameter is set that rule is replaced.
+func SaveRule(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	ur := ruleForm(r)
+	ur.Parent = gn.Key(&User{Id: c.User().ID})
+	ur.Created = time.Now()
+	if id := r.FormValue("id"); id != "" {
+		old := &UserRule{Parent: ur.Parent}
+		var err error
+		if old.Id, err = strconv.ParseInt(id, 10, 64); err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		if err := gn.Get(old); err == backend.ErrNoSuchEntity {
+			http.Error(w, "no such rule", http.StatusNotFound)
+			return
+		} else if err != nil {
+			serveError(w, err)
+			return
+		}
+		ur.Id = old.Id
+		ur.Created = old.Created
+	}
+	if _, err := compileRule(ur); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := gn.Put(ur); err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, ur)
+}
+
+// DeleteRule deletes the rule with the id parameter as its id.
+func DeleteRule(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	ur := &UserRule{Parent: gn.Key(&User{Id: c.User().ID})}
+	var err error
+	if ur.Id, err = strconv.ParseInt(r.FormValue("id"), 10, 64); err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	if err := gn.Delete(gn.Key(ur)); err != nil {
+		serveError(w, err)
+		return
+	}
+}
+
+func ExportRules(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserRule{})).Ancestor(gn.Key(&User{Id: c.User().ID}))
+	rules := []*UserRule{}
+	if _, err := gn.GetAll(q, &rules); err != nil {
+		serveError(w, err)
+		return
+	}
+	b, err := json.MarshalIndent(rules, "", "\t")
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Header().Add("Content-Disposition", "attachment; filename=rules.json")
+	w.Write(b)
+}
+
+// ImportRules adds the rules of a JSON array, as made by ExportRules, in
+// the request body. Rules the user already has are skipped. Nothing is
+// imported if any rule is invalid.
+func ImportRules(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	var rules []*UserRule
+	defer r.Body.Close()
+	b, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(b, &rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var existing []*UserRule
+	if _, err := gn.GetAll(backend.NewQuery(gn.Kind(&UserRule{})).Ancestor(uk), &existing); err != nil {
+		serveError(w, err)
+		return
+	}
+	type ruleKey struct {
+		Feed, Folder, Field, Pattern, Action string
+		Regexp                               bool
+	}
+	key := func(ur *UserRule) ruleKey {
+		return ruleKey{ur.Feed, ur.Folder, ur.Field, ur.Pattern, ur.Action, ur.Regexp}
+	}
+	seen := make(map[ruleKey]bool)
+	for _, ur := range existing {
+		seen[key(ur)] = true
+	}
+	added := []*UserRule{}
+	for i, ur := range rules {
+		if _, err := compileRule(ur); err != nil {
+			http.Error(w, "rule "+strconv.Itoa(i)+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if seen[key(ur)] {
+			continue
+		}
+		seen[key(ur)] = true
+		ur.Id = 0
+		ur.Parent = uk
+		ur.Created = time.Now()
+		added = append(added, ur)
+	}
+	if len(added) > 0 {
+		if _, err := gn.PutMulti(added); err != nil {
+			serveError(w, err)
+			return
+		}
+	}
+	serveJSON(w, added)
+}
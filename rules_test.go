@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCompileRule(t *testing.T) {
+	tests := []struct {
+		rule     UserRule
+		ok       bool
+		keywords []string
+	}{
+		{UserRule{Field: ruleTitle, Pattern: "Go, Rust ,", Action: ruleHide}, true, []string{"go", "rust"}},
+		{UserRule{Field: ruleContent, Pattern: "^a.*b$", Regexp: true, Action: ruleStar}, true, nil},
+		{UserRule{Field: ruleHost, Pattern: "example.com", Action: ruleRead, Folder: "news"}, true, []string{"example.com"}},
+		{UserRule{Field: "summary", Pattern: "x", Action: ruleHide}, false, nil},
+		{UserRule{Field: ruleTitle, Pattern: "x", Action: "delete"}, false, nil},
+		{UserRule{Field: ruleTitle, Pattern: "x", Action: ruleHide, Feed: "f", Folder: "d"}, false, nil},
+		{UserRule{Field: ruleTitle, Pattern: " , ", Action: ruleHide}, false, nil},
+		{UserRule{Field: ruleTitle, Pattern: "", Regexp: true, Action: ruleHide}, false, nil},
+		{UserRule{Field: ruleTitle, Pattern: "(", Regexp: true, Action: ruleHide}, false, nil},
+	}
+	for i, test := range tests {
+		cr, err := compileRule(&test.rule)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: got error %v, expected ok %v", i, err, test.ok)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(cr.keywords, test.keywords) {
+			t.Errorf("%v: got keywords %q, expected %q", i, cr.keywords, test.keywords)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	s := &Story{
+		Title:   "Go 2 released",
+		Author:  "Gopher",
+		Link:    "https://Blog.Example.com/go2",
+		Summary: "short",
+	}
+	const content = "The full text mentions generics."
+	tests := []struct {
+		rule  UserRule
+		match bool
+	}{
+		{UserRule{Field: ruleTitle, Pattern: "rust, go 2"}, true},
+		{UserRule{Field: ruleTitle, Pattern: "rust"}, false},
+		{UserRule{Field: ruleTitle, Pattern: "^Go [0-9]", Regexp: true}, true},
+		{UserRule{Field: ruleTitle, Pattern: "^go", Regexp: true}, false},
+		{UserRule{Field: ruleAuthor, Pattern: "GOPHER"}, true},
+		{UserRule{Field: ruleHost, Pattern: "blog.example.com"}, true},
+		{UserRule{Field: ruleHost, Pattern: "go2"}, false},
+		{UserRule{Field: ruleContent, Pattern: "generics"}, true},
+		{UserRule{Field: ruleContent, Pattern: "short"}, false},
+	}
+	for i, test := range tests {
+		test.rule.Action = ruleHide
+		cr, err := compileRule(&test.rule)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if m := cr.match(s, content); m != test.match {
+			t.Errorf("%v: got %v, expected %v", i, m, test.match)
+		}
+	}
+}
+
+func TestRuleSetFilter(t *testing.T) {
+	rule := func(field, pattern, action, feed, folder string) *compiledRule {
+		cr, err := compileRule(&UserRule{Field: field, Pattern: pattern, Action: action, Feed: feed, Folder: folder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cr
+	}
+	rs := &ruleSet{
+		rules: []*compiledRule{
+			rule(ruleTitle, "spam", ruleHide, "", ""),
+			rule(ruleTitle, "boring", ruleRead, "a", ""),
+			rule(ruleTitle, "great", ruleStar, "", "news"),
+			rule(ruleContent, "important", ruleHighlight, "", ""),
+		},
+		folders: map[string]string{"b": "news"},
+		contents: map[string]string{
+			"a|4": "very important",
+			"b|4": "not so",
+		},
+	}
+	stories := func() map[string][]*Story {
+		m := make(map[string][]*Story)
+		for _, f := range []string{"a", "b"} {
+			for id, title := range []string{"spam", "boring", "great", "fine", "other"} {
+				m[f] = append(m[f], &Story{Id: string('0' + rune(id)), Title: title})
+			}
+		}
+		return m
+	}
+	ids := func(m map[string][]*Story) map[string][]string {
+		r := make(map[string][]string)
+		for f, v := range m {
+			for _, s := range v {
+				id := s.Id
+				if s.Highlight {
+					id += "*"
+				}
+				r[f] = append(r[f], id)
+			}
+			sort.Strings(r[f])
+		}
+		return r
+	}
+
+	fl := stories()
+	read, star := rs.filter(fl, true)
+	if expected := map[string][]string{"a": {"2", "3", "4*"}, "b": {"1", "2", "3", "4"}}; !reflect.DeepEqual(ids(fl), expected) {
+		t.Errorf("unread: got %v, expected %v", ids(fl), expected)
+	}
+	if expected := map[string][]string{"a": {"1"}}; !reflect.DeepEqual(read, expected) {
+		t.Errorf("unread: got read %v, expected %v", read, expected)
+	}
+	if expected := map[string][]string{"b": {"2"}}; !reflect.DeepEqual(star, expected) {
+		t.Errorf("unread: got star %v, expected %v", star, expected)
+	}
+
+	// Read and star rules leave stories that aren't unread alone.
+	fl = stories()
+	read, star = rs.filter(fl, false)
+	if expected := map[string][]string{"a": {"1", "2", "3", "4*"}, "b": {"1", "2", "3", "4"}}; !reflect.DeepEqual(ids(fl), expected) {
+		t.Errorf("read: got %v, expected %v", ids(fl), expected)
+	}
+	if len(read) != 0 || len(star) != 0 {
+		t.Errorf("read: got read %v and star %v", read, star)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sanitizer
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/mjibson/goread/_third_party/golang.org/x/net/html"
+)
+
+// Embedded content (iframe, embed and object elements) is only kept for
+// the players of the policy's Embeds, whose URLs are rewritten to their
+// privacy-friendly hosts and framed in a sandbox. Anything else becomes a
+// link to its URL.
+
+// An Embed is a provider of embeddable players.
+type Embed struct {
+	Name string
+	// Rewrite returns the URL of the player to embed for u, or nil if u is
+	// not one of the provider's players.
+	Rewrite func(u *url.URL) *url.URL
+}
+
+// embedSandbox are the permissions of embedded players, which need
+// scripts and their own origin's storage to play.
+const embedSandbox = "allow-scripts allow-same-origin allow-presentation allow-popups"
+
+var (
+	youtubeIDRe = regexp.MustCompile(`^/(?:embed|v)/([A-Za-z0-9_-]{6,20})$`)
+	vimeoIDRe   = regexp.MustCompile(`^/video/([0-9]+)$`)
+	embedParam  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+var (
+	// YouTube players are embedded from youtube-nocookie.com, which
+	// doesn't set cookies until the video is played.
+	YouTube = &Embed{
+		Name: "youtube",
+		Rewrite: func(u *url.URL) *url.URL {
+			switch u.Host {
+			case "youtube.com", "www.youtube.com", "m.youtube.com",
+				"youtube-nocookie.com", "www.youtube-nocookie.com":
+			default:
+				return nil
+			}
+			q := u.Query()
+			v := make(url.Values)
+			id := "videoseries"
+			if m := youtubeIDRe.FindStringSubmatch(u.Path); m != nil {
+				id = m[1]
+			} else if u.Path != "/embed/videoseries" || q.Get("list") == "" {
+				return nil
+			}
+			for _, p := range []string{"list", "start", "end"} {
+				if s := q.Get(p); embedParam.MatchString(s) {
+					v.Set(p, s)
+				}
+			}
+			return &url.URL{
+				Scheme:   "https",
+				Host:     "www.youtube-nocookie.com",
+				Path:     "/embed/" + id,
+				RawQuery: v.Encode(),
+			}
+		},
+	}
+
+	// Vimeo players are embedded with Do Not Track set, which stops
+	// them tracking sessions.
+	Vimeo = &Embed{
+		Name: "vimeo",
+		Rewrite: func(u *url.URL) *url.URL {
+			m := vimeoIDRe.FindStringSubmatch(u.Path)
+			if u.Host != "player.vimeo.com" || m == nil {
+				return nil
+			}
+			v := url.Values{"dnt": {"1"}}
+			// Unlisted videos need their hash.
+			if h := u.Query().Get("h"); embedParam.MatchString(h) {
+				v.Set("h", h)
+			}
+			return &url.URL{
+				Scheme:   "https",
+				Host:     "player.vimeo.com",
+				Path:     "/video/" + m[1],
+				RawQuery: v.Encode(),
+			}
+		},
+	}
+
+	// SoundCloud players are embedded with only the track or playlist
+	// to play.
+	SoundCloud = &Embed{
+		Name: "soundcloud",
+		Rewrite: func(u *url.URL) *url.URL {
+			if u.Host != "w.soundcloud.com" || (u.Path != "/player" && u.Path != "/player/") {
+				return nil
+			}
+			t, err := url.Parse(u.Query().Get("url"))
+			if err != nil || t.Scheme != "https" || t.Host != "api.soundcloud.com" {
+				return nil
+			}
+			return &url.URL{
+				Scheme:   "https",
+				Host:     "w.soundcloud.com",
+				Path:     "/player/",
+				RawQuery: url.Values{"url": {t.String()}}.Encode(),
+			}
+		},
+	}
+)
+
+// embedElements are the elements of embedded content, and the attribute
+// holding their URL.
+var embedElements = map[string]string{
+	"iframe": "src",
+	"embed":  "src",
+	"object": "data",
+}
+
+// sanitizeEmbed returns the HTML to replace the embedded content of t
+// with, and whether t's contents should be skipped.
+func (p *Policy) sanitizeEmbed(u *url.URL, t *html.Token) (string, bool) {
+	var src, width, height string
+	for _, a := range t.Attr {
+		switch a.Key {
+		case embedElements[t.Data]:
+			src = a.Val
+		case "width":
+			width = a.Val
+		case "height":
+			height = a.Val
+		}
+	}
+	// An object without data plays its params or children, so is
+	// replaced by its children.
+	if src == "" {
+		return "", t.Data == "iframe"
+	}
+	var e *url.URL
+	var err error
+	if u == nil {
+		e, err = url.Parse(src)
+	} else {
+		e, err = u.Parse(src)
+	}
+	if err != nil || (e.Scheme != "http" && e.Scheme != "https") {
+		return "", true
+	}
+	for _, embed := range p.Embeds {
+		r := embed.Rewrite(e)
+		if r == nil {
+			continue
+		}
+		s := `<iframe src="` + html.EscapeString(r.String()) + `"`
+		if _, err := strconv.Atoi(width); err == nil {
+			s += ` width="` + width + `"`
+		}
+		if _, err := strconv.Atoi(height); err == nil {
+			s += ` height="` + height + `"`
+		}
+		s += ` sandbox="` + embedSandbox + `" allowfullscreen="" frameborder="0"></iframe>`
+		return s, true
+	}
+	l := html.EscapeString(e.String())
+	return `<p class="embed"><a href="` + l + `" target="_blank">` + l + `</a></p>`, true
+}
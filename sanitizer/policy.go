@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sanitizer
+
+import "net/url"
+
+// A Policy lists the HTML that is kept when sanitizing. Elements not in
+// Elements are removed but their contents kept, unless they are also in
+// Skip, in which case their contents are removed too. Attributes not in
+// Attributes are removed, as are links whose scheme is not in Schemes.
+// Embedded content is kept only for the players of Embeds.
+type Policy struct {
+	Name       string
+	Elements   map[string]bool
+	Skip       map[string]bool
+	Attributes map[string]bool
+	Schemes    map[string]bool
+	Embeds     []*Embed
+
+	// ImageURL, if set, returns the URL to load the image at u from.
+	ImageURL func(u *url.URL) string
+	// Tracking, if set, is removed from links and images.
+	Tracking *Tracking
+}
+
+var (
+	// Permissive keeps everything that can't run scripts or restyle the
+	// reader.
+	Permissive = &Policy{
+		Name:       "permissive",
+		Elements:   acceptableElements,
+		Skip:       unacceptableElementsWithEndTag,
+		Attributes: acceptableAttributes,
+		Schemes:    acceptableUriSchemes,
+		Embeds:     []*Embed{YouTube, Vimeo, SoundCloud},
+	}
+
+	// Default is Permissive without forms or attributes that change how
+	// the reader behaves.
+	Default = Permissive.without("default",
+		[]string{
+			"form", "fieldset", "legend", "label", "input", "button", "select",
+			"datalist", "optgroup", "option", "textarea", "keygen", "output",
+			"canvas",
+		},
+		[]string{"select", "datalist", "textarea"},
+		[]string{
+			"accept", "accept-charset", "action", "async", "autocomplete",
+			"challenge", "checked", "code", "codebase", "contenteditable",
+			"contextmenu", "defer", "dirname", "disabled", "draggable",
+			"dropzone", "enctype", "for", "form", "http-equiv", "keytype",
+			"language", "list", "manifest", "max", "maxlength", "method",
+			"min", "multiple", "name", "novalidate", "pattern", "ping",
+			"placeholder", "radiogroup", "readonly", "required", "selected",
+			"spellcheck", "value",
+		},
+	)
+
+	// Strict keeps text, links, images, lists and tables, and shows
+	// embedded content as links.
+	Strict = &Policy{
+		Name: "strict",
+		Elements: set(
+			"p", "br", "hr", "pre", "blockquote", "div", "span", "address",
+			"h1", "h2", "h3", "h4", "h5", "h6",
+			"ol", "ul", "li", "dl", "dt", "dd", "figure", "figcaption",
+			"a", "em", "strong", "small", "s", "cite", "q", "dfn", "abbr",
+			"time", "code", "var", "samp", "kbd", "sub", "sup", "i", "b", "u",
+			"mark", "ins", "del", "img",
+			"table", "caption", "colgroup", "col", "thead", "tbody", "tfoot",
+			"tr", "td", "th",
+		),
+		Skip: set(
+			"script", "applet", "style", "noscript", "video", "audio", "svg",
+			"math", "canvas", "select", "datalist", "textarea",
+		),
+		Attributes: set(
+			"abbr", "align", "alt", "cite", "colspan", "datetime", "dir",
+			"headers", "height", "href", "lang", "reversed", "rowspan",
+			"scope", "span", "src", "srcset", "sizes", "start", "title", "type",
+			"valign", "width",
+		),
+		Schemes: set("http", "https", "mailto"),
+	}
+)
+
+// Policies are the named policies.
+var Policies = map[string]*Policy{
+	Strict.Name:     Strict,
+	Default.Name:    Default,
+	Permissive.Name: Permissive,
+}
+
+// PolicyNamed returns the policy called name, or Default if there is none.
+func PolicyNamed(name string) *Policy {
+	if p := Policies[name]; p != nil {
+		return p
+	}
+	return Default
+}
+
+// WithImageURL returns a copy of p that loads images from the URLs f
+// returns.
+func (p *Policy) WithImageURL(f func(u *url.URL) string) *Policy {
+	np := *p
+	np.ImageURL = f
+	return &np
+}
+
+// WithTracking returns a copy of p that removes t.
+func (p *Policy) WithTracking(t *Tracking) *Policy {
+	np := *p
+	np.Tracking = t
+	return &np
+}
+
+// without returns a copy of p named name without elements, skipping the
+// contents of skip, and without attributes.
+func (p *Policy) without(name string, elements, skip, attributes []string) *Policy {
+	np := &Policy{
+		Name:       name,
+		Elements:   copySet(p.Elements, elements),
+		Skip:       copySet(p.Skip, nil),
+		Attributes: copySet(p.Attributes, attributes),
+		Schemes:    p.Schemes,
+		Embeds:     p.Embeds,
+	}
+	for _, s := range skip {
+		np.Skip[s] = true
+	}
+	return np
+}
+
+func set(keys ...string) map[string]bool {
+	m := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		m[k] = true
+	}
+	return m
+}
+
+// copySet returns a copy of m without the keys of remove.
+func copySet(m map[string]bool, remove []string) map[string]bool {
+	c := make(map[string]bool, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	for _, k := range remove {
+		delete(c, k)
+	}
+	return c
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sanitizer
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// TestPolicies sanitizes each testdata/*.html with each policy and
+// compares the result to testdata/*.policy.golden. Run with -update to
+// rewrite them after a policy change, and review the diff.
+func TestPolicies(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test files")
+	}
+	u, _ := url.Parse("http://example.com/story")
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, p := range Policies {
+			got, _ := SanitizePolicy(string(b), u, p)
+			golden := strings.TrimSuffix(file, ".html") + "." + name + ".golden"
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("%s: %s policy:\ngot:\n%s\nwant:\n%s", file, name, got, want)
+			}
+		}
+	}
+}
+
+func TestPolicyNamed(t *testing.T) {
+	for name, want := range map[string]*Policy{
+		"strict":     Strict,
+		"default":    Default,
+		"permissive": Permissive,
+		"":           Default,
+		"bogus":      Default,
+	} {
+		if got := PolicyNamed(name); got != want {
+			t.Errorf("%q: got %s, expected %s", name, got.Name, want.Name)
+		}
+	}
+}
+
+func TestWithImageURL(t *testing.T) {
+	p := Default.WithImageURL(func(u *url.URL) string {
+		return "/image?u=" + url.QueryEscape(u.String())
+	})
+	if Default.ImageURL != nil {
+		t.Fatal("Default changed")
+	}
+	u, _ := url.Parse("http://example.com/story")
+	in := `<img src="/a.png" srcset="/a.png 1x, /b.png 2x"><a href="/c.png">c</a><video src="/v.mp4" poster="v.png"></video><p style="background-image: url(/d.png)">d</p>`
+	want := `<img src="/image?u=http%3A%2F%2Fexample.com%2Fa.png" srcset="/image?u=http%3A%2F%2Fexample.com%2Fa.png 1x, /image?u=http%3A%2F%2Fexample.com%2Fb.png 2x">` +
+		`<a href="http://example.com/c.png" target="_blank">c</a>` +
+		`<video src="http://example.com/v.mp4" poster="/image?u=http%3A%2F%2Fexample.com%2Fv.png"></video>` +
+		`<p style="background-image: url(&#34;/image?u=http%3A%2F%2Fexample.com%2Fd.png&#34;)">d</p>`
+	if got, _ := SanitizePolicy(in, u, p); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
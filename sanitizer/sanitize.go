@@ -25,42 +25,102 @@ import (
 	"github.com/mjibson/goread/_third_party/golang.org/x/net/html"
 )
 
-func sanitizeLink(u *url.URL, v string) string {
-	var p *url.URL
+func sanitizeLink(p *Policy, u *url.URL, v string) string {
+	var l *url.URL
 	var err error
 	if u == nil {
-		p, err = url.Parse(v)
+		l, err = url.Parse(v)
 		if err != nil {
 			return ""
 		}
 	} else {
-		p, err = u.Parse(v)
+		l, err = u.Parse(v)
 		if err != nil {
 			return ""
 		}
 	}
-	if !acceptableUriSchemes[p.Scheme] {
+	if !p.Schemes[l.Scheme] {
 		return ""
 	}
+	if p.Tracking != nil && (l.Scheme == "http" || l.Scheme == "https") {
+		l = p.Tracking.CleanURL(l)
+	}
+
+	return l.String()
+}
 
-	return p.String()
+// sanitizeImage returns the URL to load the image at v, relative to u,
+// from.
+func sanitizeImage(p *Policy, u *url.URL, v string) string {
+	v = sanitizeLink(p, u, v)
+	if v == "" || p.ImageURL == nil {
+		return v
+	}
+	l, err := url.Parse(v)
+	if err != nil || (l.Scheme != "http" && l.Scheme != "https") {
+		return ""
+	}
+	return p.ImageURL(l)
 }
 
-func sanitizeStyle(v string) string {
-	return v
+// sanitizeSrcset returns the srcset v with its images' URLs sanitized.
+// Candidates are a URL, optionally followed by a descriptor, separated by
+// commas.
+func sanitizeSrcset(p *Policy, u *url.URL, v string) string {
+	var candidates []string
+	for {
+		v = strings.TrimLeft(v, " \t\n\r\f,")
+		if v == "" {
+			break
+		}
+		i := strings.IndexAny(v, " \t\n\r\f")
+		if i < 0 {
+			i = len(v)
+		}
+		src := v[:i]
+		v = v[i:]
+		descriptor := ""
+		if strings.HasSuffix(src, ",") {
+			src = strings.TrimRight(src, ",")
+		} else if i := strings.IndexByte(v, ','); i >= 0 {
+			descriptor, v = strings.TrimSpace(v[:i]), v[i+1:]
+		} else {
+			descriptor, v = strings.TrimSpace(v), ""
+		}
+		if src = sanitizeImage(p, u, src); src == "" {
+			continue
+		}
+		if descriptor != "" {
+			src += " " + descriptor
+		}
+		candidates = append(candidates, src)
+	}
+	return strings.Join(candidates, ", ")
 }
 
-func sanitizeAttributes(u *url.URL, t *html.Token) {
+func sanitizeAttributes(p *Policy, u *url.URL, t *html.Token) {
 	var attrs []html.Attribute
 	var isLink = false
 	for _, a := range t.Attr {
-		if a.Key == "target" {
-		} else if a.Key == "style" {
-			a.Val = sanitizeStyle(a.Val)
+		switch {
+		case a.Key == "target", !p.Attributes[a.Key]:
+		case a.Key == "style":
+			a.Val = sanitizeStyle(p, u, a.Val)
+			if a.Val != "" {
+				attrs = append(attrs, a)
+			}
+		case a.Key == "srcset":
+			a.Val = sanitizeSrcset(p, u, a.Val)
+			if a.Val != "" {
+				attrs = append(attrs, a)
+			}
+		case a.Key == "poster", a.Key == "background",
+			a.Key == "src" && t.Data == "img":
+			a.Val = sanitizeImage(p, u, strings.TrimSpace(a.Val))
 			attrs = append(attrs, a)
-		} else if acceptableAttributes[a.Key] {
+		default:
 			if a.Key == "href" || a.Key == "src" {
-				a.Val = sanitizeLink(u, strings.TrimSpace(a.Val))
+				a.Val = sanitizeLink(p, u, strings.TrimSpace(a.Val))
 			}
 			if a.Key == "href" {
 				isLink = true
@@ -77,12 +137,24 @@ func sanitizeAttributes(u *url.URL, t *html.Token) {
 	t.Attr = attrs
 }
 
+// Sanitize returns s sanitized by the Default policy, and its text. Links
+// are resolved against u.
 func Sanitize(s string, u *url.URL) (string, string) {
+	return SanitizePolicy(s, u, Default)
+}
+
+// SanitizePolicy returns s sanitized by p, and its text. Links are
+// resolved against u.
+func SanitizePolicy(s string, u *url.URL, p *Policy) (string, string) {
 	r := bytes.NewReader([]byte(strings.TrimSpace(s)))
 	z := html.NewTokenizer(r)
 	buf := &bytes.Buffer{}
 	strip := &bytes.Buffer{}
 	skip := 0
+	// whether the contents of each open iframe and object are skipped, and
+	// how many of them are
+	var embeds []bool
+	skipEmbeds := 0
 	if u != nil {
 		u.RawQuery = ""
 		u.Fragment = ""
@@ -97,18 +169,42 @@ func Sanitize(s string, u *url.URL) (string, string) {
 		}
 
 		t := z.Token()
-		if t.Type == html.StartTagToken || t.Type == html.SelfClosingTagToken {
-			if !acceptableElements[t.Data] {
-				if unacceptableElementsWithEndTag[t.Data] && t.Type != html.SelfClosingTagToken {
+		_, isEmbed := embedElements[t.Data]
+		if isEmbed && t.Type != html.EndTagToken {
+			e, skipContents := p.sanitizeEmbed(u, &t)
+			if skipEmbeds > 0 {
+				e, skipContents = "", false
+			}
+			buf.WriteString(e)
+			if t.Data != "embed" && t.Type == html.StartTagToken {
+				embeds = append(embeds, skipContents)
+				if skipContents {
+					skip += 1
+					skipEmbeds += 1
+				}
+			}
+		} else if isEmbed {
+			if n := len(embeds); n > 0 && t.Data != "embed" {
+				if embeds[n-1] {
+					skip -= 1
+					skipEmbeds -= 1
+				}
+				embeds = embeds[:n-1]
+			}
+		} else if t.Data == "img" && p.Tracking != nil && p.Tracking.isPixel(u, &t) {
+			// drop tracking images
+		} else if t.Type == html.StartTagToken || t.Type == html.SelfClosingTagToken {
+			if !p.Elements[t.Data] {
+				if p.Skip[t.Data] && t.Type != html.SelfClosingTagToken {
 					skip += 1
 				}
 			} else {
-				sanitizeAttributes(u, &t)
+				sanitizeAttributes(p, u, &t)
 				buf.WriteString(t.String())
 			}
 		} else if t.Type == html.EndTagToken {
-			if !acceptableElements[t.Data] {
-				if unacceptableElementsWithEndTag[t.Data] {
+			if !p.Elements[t.Data] {
+				if p.Skip[t.Data] {
 					skip -= 1
 				}
 			} else {
@@ -211,11 +307,11 @@ var acceptableElements = map[string]bool{
 	"del": true,
 
 	// Embedded content
-	"img":    true,
-	"iframe": true,
-	"embed":  true,
-	"object": true,
-	"param":  true,
+	"img": true,
+	// "iframe": true,
+	// "embed":  true,
+	// "object": true,
+	// "param":  true,
 	"video":  true,
 	"audio":  true,
 	"source": true,
@@ -271,6 +367,7 @@ var unacceptableElementsWithEndTag = map[string]bool{
 // Based on list from MDN's HTML attribute reference
 // https://developer.mozilla.org/en-US/docs/Web/HTML/Attributes
 var acceptableAttributes = map[string]bool{
+	"abbr":           true,
 	"accept":         true,
 	"accept-charset": true,
 	// "accesskey":       true,
@@ -365,6 +462,7 @@ var acceptableAttributes = map[string]bool{
 	"shape":    true,
 	"size":     true,
 	"sizes":    true,
+	"srcset":   true,
 	"span":     true,
 	"src":      true,
 	// "srcdoc":          true,
@@ -0,0 +1,350 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sanitizer
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Style attributes are parsed into declarations, and only declarations of
+// allowed properties whose values match the property's grammar are kept.
+// Positioning, stacking and transforms are dropped so that stories can't
+// cover the reader, sizes are capped so they can't break its layout, and
+// url() is kept only for http and https images.
+
+// cssValidator reports whether a property's value, split into fields, is
+// acceptable.
+type cssValidator func(fields []string) bool
+
+var (
+	cssCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssPropRe    = regexp.MustCompile(`^[a-z][a-z-]*$`)
+	cssNumberRe  = regexp.MustCompile(`^([+-]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+))([a-z%]*)$`)
+	cssHexRe     = regexp.MustCompile(`^#([0-9a-f]{3}|[0-9a-f]{4}|[0-9a-f]{6}|[0-9a-f]{8})$`)
+	cssFuncRe    = regexp.MustCompile(`^(rgba?|hsla?)\(([0-9.,%\s]+)\)$`)
+	cssIdentRe   = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	cssFontRe    = regexp.MustCompile(`^([a-zA-Z0-9 -]+|"[a-zA-Z0-9 -]+"|'[a-zA-Z0-9 -]+')$`)
+)
+
+// cssPixels are the approximate sizes in pixels of CSS units.
+var cssPixels = map[string]float64{
+	"px":  1,
+	"em":  16,
+	"rem": 16,
+	"ex":  8,
+	"ch":  8,
+	"pt":  4.0 / 3,
+	"pc":  16,
+	"in":  96,
+	"cm":  96 / 2.54,
+	"mm":  96 / 25.4,
+}
+
+// cssLength reports whether f is a length of at least min and at most max
+// pixels. Percentages are allowed with percentOf.
+func cssLength(f string, min, max float64) bool {
+	m := cssNumberRe.FindStringSubmatch(strings.ToLower(f))
+	if m == nil {
+		return false
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return false
+	}
+	px, ok := cssPixels[m[2]]
+	if m[2] == "" && n == 0 {
+		px, ok = 0, true
+	}
+	return ok && n*px >= min && n*px <= max
+}
+
+func length(min, max float64, keywords ...string) func(string) bool {
+	kw := keyword(keywords...)
+	return func(f string) bool {
+		return kw(f) || cssLength(f, min, max)
+	}
+}
+
+func keyword(keywords ...string) func(string) bool {
+	return func(f string) bool {
+		f = strings.ToLower(f)
+		for _, k := range keywords {
+			if f == k {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func cssColor(f string) bool {
+	f = strings.ToLower(f)
+	if cssHexRe.MatchString(f) || cssFuncRe.MatchString(f) {
+		return true
+	}
+	// Named colors.
+	return cssIdentRe.MatchString(f) && !strings.Contains(f, "-")
+}
+
+func cssURL(f string) bool {
+	return strings.HasPrefix(strings.ToLower(f), "url(")
+}
+
+// upTo returns a validator of 1 to n fields that each match one of preds.
+func upTo(n int, preds ...func(string) bool) cssValidator {
+	return func(fields []string) bool {
+		if len(fields) == 0 || len(fields) > n {
+			return false
+		}
+	next:
+		for _, f := range fields {
+			for _, p := range preds {
+				if p(f) {
+					continue next
+				}
+			}
+			return false
+		}
+		return true
+	}
+}
+
+func one(preds ...func(string) bool) cssValidator {
+	return upTo(1, preds...)
+}
+
+var (
+	borderStyle = keyword("none", "hidden", "solid", "dashed", "dotted", "double", "groove", "ridge", "inset", "outset")
+	borderWidth = length(0, 20, "thin", "medium", "thick")
+	margin      = upTo(4, length(0, 200, "auto"), percentOf(50))
+	padding     = upTo(4, length(0, 200), percentOf(50))
+	size        = one(length(0, 4000, "auto", "none"), percentOf(100))
+	position    = keyword("left", "right", "center", "top", "bottom")
+	repeat      = keyword("repeat", "repeat-x", "repeat-y", "no-repeat")
+	border      = upTo(3, borderWidth, borderStyle, cssColor)
+)
+
+// cssProperties are the allowed properties and their grammars.
+var cssProperties = map[string]cssValidator{
+	"color":               one(cssColor),
+	"background":          upTo(5, cssColor, cssURL, repeat, position, length(0, 4000), percentOf(100)),
+	"background-color":    one(cssColor),
+	"background-image":    one(cssURL, keyword("none")),
+	"background-repeat":   one(repeat),
+	"background-position": upTo(2, position, length(0, 4000), percentOf(100)),
+	"background-size":     upTo(2, length(0, 4000, "auto", "cover", "contain"), percentOf(100)),
+
+	"font-family":     fontFamily,
+	"font-size":       one(length(6, 48, "xx-small", "x-small", "small", "medium", "large", "x-large", "xx-large", "smaller", "larger"), percentOf(300)),
+	"font-style":      one(keyword("normal", "italic", "oblique")),
+	"font-variant":    one(keyword("normal", "small-caps")),
+	"font-weight":     one(keyword("normal", "bold", "bolder", "lighter", "100", "200", "300", "400", "500", "600", "700", "800", "900")),
+	"line-height":     one(keyword("normal"), unitless(3), length(0, 64), percentOf(300)),
+	"letter-spacing":  one(length(-4, 16, "normal")),
+	"word-spacing":    one(length(-4, 32, "normal")),
+	"text-align":      one(keyword("left", "right", "center", "justify", "start", "end")),
+	"text-decoration": upTo(3, keyword("none", "underline", "overline", "line-through", "solid", "double", "dotted", "dashed", "wavy"), cssColor),
+	"text-indent":     one(length(-100, 200), percentOf(50)),
+	"text-transform":  one(keyword("none", "capitalize", "uppercase", "lowercase")),
+	"vertical-align":  one(keyword("baseline", "sub", "super", "top", "text-top", "middle", "bottom", "text-bottom"), length(-32, 32), percentOf(100)),
+	"white-space":     one(keyword("normal", "nowrap", "pre", "pre-wrap", "pre-line")),
+	"direction":       one(keyword("ltr", "rtl")),
+
+	"margin":         margin,
+	"margin-top":     margin,
+	"margin-right":   margin,
+	"margin-bottom":  margin,
+	"margin-left":    margin,
+	"padding":        padding,
+	"padding-top":    padding,
+	"padding-right":  padding,
+	"padding-bottom": padding,
+	"padding-left":   padding,
+	"width":          size,
+	"height":         size,
+	"min-width":      size,
+	"min-height":     size,
+	"max-width":      size,
+	"max-height":     size,
+
+	"border":          border,
+	"border-top":      border,
+	"border-right":    border,
+	"border-bottom":   border,
+	"border-left":     border,
+	"border-color":    upTo(4, cssColor),
+	"border-style":    upTo(4, borderStyle),
+	"border-width":    upTo(4, borderWidth),
+	"border-radius":   upTo(4, length(0, 200), percentOf(50)),
+	"border-collapse": one(keyword("collapse", "separate")),
+	"border-spacing":  upTo(2, length(0, 20)),
+
+	"display":             one(keyword("none", "inline", "block", "inline-block", "list-item", "table", "table-row", "table-cell", "table-caption")),
+	"float":               one(keyword("left", "right", "none")),
+	"clear":               one(keyword("left", "right", "both", "none")),
+	"overflow":            one(keyword("visible", "hidden", "auto", "scroll")),
+	"overflow-x":          one(keyword("visible", "hidden", "auto", "scroll")),
+	"overflow-y":          one(keyword("visible", "hidden", "auto", "scroll")),
+	"list-style-type":     one(keyword("none", "disc", "circle", "square", "decimal", "lower-alpha", "upper-alpha", "lower-roman", "upper-roman")),
+	"list-style-position": one(keyword("inside", "outside")),
+	"table-layout":        one(keyword("auto", "fixed")),
+	"caption-side":        one(keyword("top", "bottom")),
+	"empty-cells":         one(keyword("show", "hide")),
+}
+
+// percentOf returns a predicate of percentages up to max.
+func percentOf(max float64) func(string) bool {
+	return func(f string) bool {
+		if !strings.HasSuffix(f, "%") {
+			return false
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(f, "%"), 64)
+		return err == nil && n >= 0 && n <= max
+	}
+}
+
+// unitless returns a predicate of numbers without units up to max.
+func unitless(max float64) func(string) bool {
+	return func(f string) bool {
+		n, err := strconv.ParseFloat(f, 64)
+		return err == nil && n >= 0 && n <= max
+	}
+}
+
+// fontFamily allows a comma separated list of names, quoted or not.
+func fontFamily(fields []string) bool {
+	for _, name := range strings.Split(strings.Join(fields, " "), ",") {
+		if !cssFontRe.MatchString(strings.TrimSpace(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// cssSplit splits s at sep where it is not in parentheses or quotes.
+func cssSplit(s string, sep func(rune) bool) []string {
+	var parts []string
+	depth := 0
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case depth == 0 && sep(r):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// sanitizeURLs rewrites the url() fields of fields to absolute http or
+// https URLs resolved against u, loaded as p's images. It returns false if
+// one can't be.
+func sanitizeURLs(p *Policy, u *url.URL, fields []string) bool {
+	for i, f := range fields {
+		if !cssURL(f) {
+			continue
+		}
+		if !strings.HasSuffix(f, ")") {
+			return false
+		}
+		v := strings.TrimSpace(f[4 : len(f)-1])
+		if len(v) > 1 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		if strings.ContainsAny(v, "\"'()\\ \t\n\r\f") {
+			return false
+		}
+		var l *url.URL
+		var err error
+		if u == nil {
+			l, err = url.Parse(v)
+		} else {
+			l, err = u.Parse(v)
+		}
+		if err != nil || (l.Scheme != "http" && l.Scheme != "https") {
+			return false
+		}
+		s := l.String()
+		if p.ImageURL != nil {
+			s = p.ImageURL(l)
+		}
+		if strings.ContainsAny(s, "\"'()\\") {
+			return false
+		}
+		fields[i] = `url("` + s + `")`
+	}
+	return true
+}
+
+// sanitizeStyle returns the declarations of the style attribute v that
+// are allowed, with url()s resolved against u and loaded as p's images.
+func sanitizeStyle(p *Policy, u *url.URL, v string) string {
+	v = cssCommentRe.ReplaceAllString(v, " ")
+	// Escapes are only needed to disguise things.
+	if strings.ContainsAny(v, "\\") {
+		return ""
+	}
+	var decls []string
+	for _, d := range cssSplit(v, func(r rune) bool { return r == ';' }) {
+		i := strings.IndexByte(d, ':')
+		if i < 0 {
+			continue
+		}
+		prop := strings.ToLower(strings.TrimSpace(d[:i]))
+		value := strings.TrimSpace(d[i+1:])
+		if j := strings.LastIndex(value, "!"); j >= 0 && strings.EqualFold(strings.TrimSpace(value[j+1:]), "important") {
+			value = strings.TrimSpace(value[:j])
+		}
+		valid := cssProperties[prop]
+		if valid == nil || !cssPropRe.MatchString(prop) {
+			continue
+		}
+		var fields []string
+		for _, f := range cssSplit(value, isCSSSpace) {
+			if f != "" {
+				fields = append(fields, f)
+			}
+		}
+		if !valid(fields) || !sanitizeURLs(p, u, fields) {
+			continue
+		}
+		if prop == "font-family" {
+			decls = append(decls, prop+": "+value)
+		} else {
+			decls = append(decls, prop+": "+strings.Join(fields, " "))
+		}
+	}
+	return strings.Join(decls, "; ")
+}
+
+func isCSSSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f'
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sanitizer
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var styleTests = []struct {
+	in, out string
+}{
+	{"color: red", "color: red"},
+	{"COLOR:Red;", "color: Red"},
+	{"color: #ff0000; background-color: rgb(0, 0, 255)", "color: #ff0000; background-color: rgb(0, 0, 255)"},
+	{"color: #ggg", ""},
+	{`color: "red"`, ""},
+	{"color: red !important", "color: red"},
+	{"color: /* blue */ red", "color: red"},
+	{"font-weight: bold; font-style: italic", "font-weight: bold; font-style: italic"},
+	{`font-family: "Helvetica Neue", Arial, sans-serif`, `font-family: "Helvetica Neue", Arial, sans-serif`},
+	{"font-family: x; behavior: url(x.htc)", "font-family: x"},
+	{"font-size: 120%", "font-size: 120%"},
+	{"font-size: 300px", ""},
+	{"font-size: 1000%", ""},
+	{"font-size: 0.1px", ""},
+	{"margin: 0 auto", "margin: 0 auto"},
+	{"margin: -9999px", ""},
+	{"margin-top: -20px", ""},
+	{"padding: 1em 2em 1em 2em", "padding: 1em 2em 1em 2em"},
+	{"padding: 1px 1px 1px 1px 1px", ""},
+	{"text-indent: -9999px", ""},
+	{"width: 100%; max-width: 600px", "width: 100%; max-width: 600px"},
+	{"width: 100vw", ""},
+	{"width: 5000%", ""},
+	{"margin-left: 10%", "margin-left: 10%"},
+	{"margin-left: 9999%", ""},
+	{"padding: 200%", ""},
+	{"letter-spacing: 50%", ""},
+	{"border: 1px solid #ccc", "border: 1px solid #ccc"},
+
+	// Covering the page.
+	{"position:fixed;top:0;left:0;width:100%;height:100%;z-index:9999", "width: 100%; height: 100%"},
+	{"position: absolute", ""},
+	{"opacity: 0", ""},
+	{"visibility: hidden", ""},
+	{"transform: scale(100)", ""},
+	{"-webkit-transform: scale(100)", ""},
+	{"clip: rect(0 0 0 0)", ""},
+	{"content: 'x'", ""},
+	{"animation: spin 1s", ""},
+
+	// Scripts and resources.
+	{"width: expression(alert(1))", ""},
+	{"color: expression(alert(1))", ""},
+	{"behavior: url(script.htc)", ""},
+	{"-moz-binding: url(http://example.com/xbl.xml#x)", ""},
+	{"background-image: url(javascript:alert(1))", ""},
+	{"background-image: url('javascript:alert(1)')", ""},
+	{"background: url(data:image/png;base64,AAAA); color: red", "color: red"},
+	{"background-image: url(vbscript:x)", ""},
+	{"background-image: url(/a.png)", `background-image: url("http://example.com/a.png")`},
+	{`background: #fff url("http://example.com/b.png") no-repeat`, `background: #fff url("http://example.com/b.png") no-repeat`},
+	{"background-image: url(http://example.com/a.png) x", ""},
+	{"background-image: url(http://example.com/a(b).png)", ""},
+	{`background-image: url("http://example.com/a.png\"), x")`, ""},
+
+	// Escapes and garbage.
+	{`color: \72 ed`, ""},
+	{`wid\th: 100px`, ""},
+	{`background: u\rl(javascript:alert(1))`, ""},
+	{"col/**/or: red", ""},
+	{"color", ""},
+	{": red", ""},
+	{";;;", ""},
+	{"color: red; }body{color: blue", "color: red"},
+	{"color: red; @import url(http://example.com/x.css)", "color: red"},
+}
+
+func TestSanitizeStyle(t *testing.T) {
+	u, _ := url.Parse("http://example.com/story")
+	for _, st := range styleTests {
+		if got := sanitizeStyle(Default, u, st.in); got != st.out {
+			t.Errorf("%q: got %q, expected %q", st.in, got, st.out)
+		}
+	}
+}
+
+func TestSanitizeStyleAttribute(t *testing.T) {
+	u, _ := url.Parse("http://example.com/story")
+	got, _ := Sanitize(`<p style="position:fixed;color:red">a</p><p style="z-index:10">b</p>`, u)
+	if !strings.Contains(got, `<p style="color: red">a</p>`) {
+		t.Errorf("style not sanitized: %s", got)
+	}
+	if !strings.Contains(got, `<p>b</p>`) {
+		t.Errorf("empty style not removed: %s", got)
+	}
+}
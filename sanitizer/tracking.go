@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sanitizer
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mjibson/goread/_third_party/golang.org/x/net/html"
+)
+
+// Tracking lists what is removed from stories as tracking.
+type Tracking struct {
+	// Params are query parameters removed from links. A name ending in
+	// * matches any parameter it is a prefix of.
+	Params []string
+	// Images are the hosts, with their subdomains, whose images are
+	// removed.
+	Images []string
+	// Redirectors are the redirectors whose links are replaced by their
+	// targets.
+	Redirectors []*Redirector
+}
+
+// A Redirector is a URL that redirects to another.
+type Redirector struct {
+	// Host is the redirector's host, with its subdomains, and Path its
+	// path, or a prefix of it if it ends in /.
+	Host, Path string
+	// Param is the query parameter holding the target.
+	Param string
+	// Target, if set, returns the target of u instead.
+	Target func(u *url.URL) string
+}
+
+// DefaultTracking are well known analytics parameters, beacons and
+// redirectors.
+var DefaultTracking = &Tracking{
+	Params: []string{
+		"utm_*", "fbclid", "gclid", "dclid", "msclkid", "yclid", "igshid",
+		"mc_cid", "mc_eid", "_hsenc", "_hsmi", "mkt_tok", "wt.mc_id",
+	},
+	Images: []string{
+		"feeds.feedburner.com", "feedproxy.google.com", "feedsportal.com",
+		"pixel.wp.com", "stats.wordpress.com", "feeds.wordpress.com",
+		"google-analytics.com", "doubleclick.net", "scorecardresearch.com",
+		"quantserve.com",
+	},
+	Redirectors: []*Redirector{
+		{Host: "www.google.com", Path: "/url", Param: "q"},
+		{Host: "www.google.com", Path: "/url", Param: "url"},
+		{Host: "news.google.com", Path: "/news/url", Param: "url"},
+		{Host: "l.facebook.com", Path: "/l.php", Param: "u"},
+		{Host: "lm.facebook.com", Path: "/l.php", Param: "u"},
+		{Host: "www.youtube.com", Path: "/redirect", Param: "q"},
+		{Host: "t.umblr.com", Path: "/redirect", Param: "z"},
+		{Host: "slack-redir.net", Path: "/link", Param: "url"},
+		{Host: "steamcommunity.com", Path: "/linkfilter/", Param: "url"},
+		{Host: "feedsportal.com", Path: "/c/", Target: feedsportalTarget},
+	},
+}
+
+// feedsportalCodes are the escapes feedsportal encodes its targets with.
+var feedsportalCodes = strings.NewReplacer(
+	"0A", "0", "0B", ".", "0C", "/", "0D", "?", "0E", "-", "0F", "=",
+	"0G", "&", "0H", ",", "0I", "_", "0J", "%", "0K", "+", "0L", "http://",
+	"0M", "&amp;", "0N", ".com", "0O", ".co.uk", "0P", ";", "0Q", "|",
+	"0R", ":", "0S", "www.", "0T", "#", "0U", "$", "0V", "~", "0W", "!",
+	"0X", "(", "0Y", ")", "0Z", "Z",
+)
+
+// feedsportalTarget decodes the target of feedsportal links like
+// http://da.feedsportal.com/c/1/f/2/s/3/l/0L0Sexample0N0Cstory/story01.htm,
+// which is the path segment after /l/.
+func feedsportalTarget(u *url.URL) string {
+	i := strings.Index(u.Path, "/l/")
+	if i < 0 {
+		return ""
+	}
+	target := u.Path[i+3:]
+	if i := strings.IndexByte(target, '/'); i >= 0 {
+		target = target[:i]
+	}
+	return feedsportalCodes.Replace(target)
+}
+
+// hostIn reports whether host is one of hosts or their subdomains.
+func hostIn(host string, hosts ...string) bool {
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the target of u if r redirects it.
+func (r *Redirector) target(u *url.URL) (*url.URL, bool) {
+	if !hostIn(u.Host, r.Host) {
+		return nil, false
+	}
+	if u.Path != r.Path && !(strings.HasSuffix(r.Path, "/") && strings.HasPrefix(u.Path, r.Path)) {
+		return nil, false
+	}
+	var s string
+	if r.Target != nil {
+		s = r.Target(u)
+	} else {
+		s = u.Query().Get(r.Param)
+	}
+	t, err := url.Parse(s)
+	if err != nil || (t.Scheme != "http" && t.Scheme != "https") || t.Host == "" {
+		return nil, false
+	}
+	return t, true
+}
+
+// CleanURL returns u, unwrapped from its redirectors, without its
+// tracking parameters. A nil Tracking returns u.
+func (t *Tracking) CleanURL(u *url.URL) *url.URL {
+	if t == nil {
+		return u
+	}
+	// Redirectors can redirect to each other, but not forever.
+	for i := 0; i < 5; i++ {
+		unwrapped := false
+		for _, r := range t.Redirectors {
+			if target, ok := r.target(u); ok {
+				u, unwrapped = target, true
+				break
+			}
+		}
+		if !unwrapped {
+			break
+		}
+	}
+	if u.RawQuery == "" {
+		return u
+	}
+	var kept []string
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		k := kv
+		if i := strings.IndexByte(k, '='); i >= 0 {
+			k = k[:i]
+		}
+		if k, err := url.QueryUnescape(k); err != nil || !t.isParam(k) {
+			kept = append(kept, kv)
+		}
+	}
+	c := *u
+	c.RawQuery = strings.Join(kept, "&")
+	return &c
+}
+
+// CleanLink returns the link s, unwrapped from its redirectors, without
+// its tracking parameters. A nil Tracking returns s.
+func (t *Tracking) CleanLink(s string) string {
+	if t == nil {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return t.CleanURL(u).String()
+}
+
+func (t *Tracking) isParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range t.Params {
+		if name == p || (strings.HasSuffix(p, "*") && strings.HasPrefix(name, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPixel reports whether the image t, relative to u, is a tracking
+// image: one from a host of Images, or one too small to see.
+func (t *Tracking) isPixel(u *url.URL, img *html.Token) bool {
+	var width, height = -1, -1
+	for _, a := range img.Attr {
+		switch a.Key {
+		case "src":
+			var l *url.URL
+			var err error
+			if u == nil {
+				l, err = url.Parse(strings.TrimSpace(a.Val))
+			} else {
+				l, err = u.Parse(strings.TrimSpace(a.Val))
+			}
+			if err == nil && hostIn(l.Host, t.Images...) {
+				return true
+			}
+		case "width":
+			width = pixels(a.Val)
+		case "height":
+			height = pixels(a.Val)
+		}
+	}
+	return width == 0 || height == 0 || (width == 1 && height == 1)
+}
+
+// pixels returns the size of the width or height attribute v, or -1 if it
+// isn't in pixels.
+func pixels(v string) int {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "px"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
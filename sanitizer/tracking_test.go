@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sanitizer
+
+import (
+	"net/url"
+	"testing"
+)
+
+var cleanLinkTests = []struct {
+	in, out string
+}{
+	{"http://example.com/a", "http://example.com/a"},
+	{"http://example.com/a?id=1", "http://example.com/a?id=1"},
+	{"http://example.com/a?utm_source=feed&utm_medium=rss&id=1&UTM_Campaign=x", "http://example.com/a?id=1"},
+	{"http://example.com/a?id=1&fbclid=abc&gclid=def#frag", "http://example.com/a?id=1#frag"},
+	{"http://example.com/a?utm_source=feed", "http://example.com/a"},
+	{"http://example.com/a?utm=1&utmost=2", "http://example.com/a?utm=1&utmost=2"},
+	{"http://example.com/a?q=a%26b&utm_source=x", "http://example.com/a?q=a%26b"},
+	{"https://www.google.com/url?q=http://example.com/a%3Futm_source%3Dx%26id%3D2&sa=U", "http://example.com/a?id=2"},
+	{"https://www.google.com/url?sa=t&url=https%3A%2F%2Fexample.com%2Fb", "https://example.com/b"},
+	{"https://l.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2Fc&h=x", "https://example.com/c"},
+	{"https://t.umblr.com/redirect?z=http%3A%2F%2Fexample.com%2Fd&t=x", "http://example.com/d"},
+	{"https://steamcommunity.com/linkfilter/?url=https://example.com/e", "https://example.com/e"},
+	{"https://www.google.com/url?q=https%3A%2F%2Fl.facebook.com%2Fl.php%3Fu%3Dhttp%253A%252F%252Fexample.com%252Ff", "http://example.com/f"},
+	{"http://da.feedsportal.com/c/34112/f/619230/s/4f4e0c4d/sc/8/l/0L0Sbbc0O0Cnews0Cworld0E311770A0A3/story01.htm", "http://www.bbc.co.uk/news/world-31177003"},
+	{"http://rss.feedsportal.com/c/1/f/2/index.rss", "http://rss.feedsportal.com/c/1/f/2/index.rss"},
+
+	// Targets that aren't web pages are left alone.
+	{"https://www.google.com/url?q=javascript:alert(1)", "https://www.google.com/url?q=javascript:alert(1)"},
+	{"https://www.google.com/url?q=/relative", "https://www.google.com/url?q=/relative"},
+	{"https://www.google.com/search?q=http://example.com/", "https://www.google.com/search?q=http://example.com/"},
+	{"https://l.facebook.com.evil.example/l.php?u=https%3A%2F%2Fexample.com%2F", "https://l.facebook.com.evil.example/l.php?u=https%3A%2F%2Fexample.com%2F"},
+}
+
+func TestCleanLink(t *testing.T) {
+	for _, lt := range cleanLinkTests {
+		if got := DefaultTracking.CleanLink(lt.in); got != lt.out {
+			t.Errorf("%s: got %s, expected %s", lt.in, got, lt.out)
+		}
+	}
+}
+
+func TestCleanLinkRules(t *testing.T) {
+	tr := &Tracking{
+		Params:      []string{"ref", "src_*"},
+		Redirectors: []*Redirector{{Host: "go.example", Path: "/", Param: "to"}},
+	}
+	in := "http://go.example/?to=http%3A%2F%2Fexample.com%2F%3Fref%3Dx%26src_a%3Dy%26utm_source%3Dz"
+	if got, want := tr.CleanLink(in), "http://example.com/?utm_source=z"; got != want {
+		t.Errorf("got %s, expected %s", got, want)
+	}
+}
+
+func TestCleanLinkNil(t *testing.T) {
+	var tr *Tracking
+	in := "http://example.com/?utm_source=z"
+	if got := tr.CleanLink(in); got != in {
+		t.Errorf("got %s, expected %s", got, in)
+	}
+}
+
+var pixelTests = []struct {
+	in, out string
+}{
+	{`<img src="/a.png">`, `<img src="http://example.com/a.png">`},
+	{`<img src="/a.png" width="1" height="1">`, ``},
+	{`<img src="/a.png" width="1px" height="1px" alt="">`, ``},
+	{`<img src="/a.png" width="0">`, ``},
+	{`<img src="/a.png" height="0" width="100">`, ``},
+	{`<img src="/a.png" width="1" height="100">`, `<img src="http://example.com/a.png" width="1" height="100">`},
+	{`<img src="/a.png" width="100%" height="1">`, `<img src="http://example.com/a.png" width="100%" height="1">`},
+	{`<img src="http://feeds.feedburner.com/~r/example/~4/abc" height="1" width="1"/>`, ``},
+	{`<img src="http://feeds.feedburner.com/~r/example/~4/abc">`, ``},
+	{`<img src="https://pixel.wp.com/b.gif?host=example.com">`, ``},
+	{`<img src="http://res3.feedsportal.com/social/twitter.png">`, ``},
+	{`<img src="https://stats.wordpress.com.example.com/a.png">`, `<img src="https://stats.wordpress.com.example.com/a.png">`},
+	{`<a href="/a?utm_source=rss&x=1">a</a>`, `<a href="http://example.com/a?x=1" target="_blank">a</a>`},
+	{`<p>text<img src="//www.google-analytics.com/collect?v=1"></p>`, `<p>text</p>`},
+}
+
+func TestTrackingSanitize(t *testing.T) {
+	u, _ := url.Parse("http://example.com/story")
+	p := Default.WithTracking(DefaultTracking)
+	for _, pt := range pixelTests {
+		if got, _ := SanitizePolicy(pt.in, u, p); got != pt.out {
+			t.Errorf("%s: got %s, expected %s", pt.in, got, pt.out)
+		}
+	}
+	// Without tracking rules, nothing is removed.
+	in := `<img src="/a.png" width="1" height="1">`
+	if got, _ := SanitizePolicy(in, u, Default); got == "" {
+		t.Errorf("%s removed without tracking rules", in)
+	}
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// Saved searches are virtual feeds. Their stories are found when they are
+// saved, from the search index, and after that as updateFeed stores new
+// stories, so listing them never runs a search. A saved search's stories
+// are the real stories of its feeds, so reading them in either place
+// reads both.
+
+// searchFeedPrefix begins the URLs of saved search virtual feeds.
+const searchFeedPrefix = "search:"
+
+// backfillLimit caps the stories found when a search is saved.
+const backfillLimit = 100
+
+func searchFeedURL(id int64) string {
+	return searchFeedPrefix + strconv.FormatInt(id, 10)
+}
+
+// searchFeeds returns the feeds of opml in folder, or all of them if
+// folder is empty.
+func searchFeeds(folder string, opml *Opml) []string {
+	feeds := []string{}
+	for _, o := range opml.Outline {
+		if o.XmlUrl != "" {
+			if folder == "" {
+				feeds = append(feeds, o.XmlUrl)
+			}
+			continue
+		}
+		if folder == "" || o.Title == folder {
+			for _, so := range o.Outline {
+				feeds = append(feeds, so.XmlUrl)
+			}
+		}
+	}
+	return feeds
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadSearches returns the user's saved searches.
+func loadSearches(gn *backend.Store, uk *backend.Key) ([]*UserSearch, error) {
+	var searches []*UserSearch
+	q := backend.NewQuery(gn.Kind(&UserSearch{})).Ancestor(uk)
+	_, err := gn.GetAll(q, &searches)
+	return searches, err
+}
+
+// updateSearches updates the feeds of the user's saved searches to the
+// subscriptions of opml. It is called wherever the subscriptions are
+// saved, in the same transaction if there is one, so that matchSearches
+// finds the searches of new feeds and not of removed ones.
+func updateSearches(gn *backend.Store, uk *backend.Key, opml *Opml) error {
+	searches, err := loadSearches(gn, uk)
+	if err != nil {
+		return err
+	}
+	var puts []*UserSearch
+	for _, us := range searches {
+		if feeds := searchFeeds(us.Folder, opml); !equalStrings(feeds, us.Feeds) {
+			us.Feeds = feeds
+			puts = append(puts, us)
+		}
+	}
+	if len(puts) == 0 {
+		return nil
+	}
+	_, err = gn.PutMulti(puts)
+	return err
+}
+
+// withSearches returns outlines with the virtual feeds of searches added,
+// in their folders if they have one. outlines is not modified.
+func withSearches(outlines []*OpmlOutline, searches []*UserSearch) []*OpmlOutline {
+	out := append([]*OpmlOutline{}, outlines...)
+	for _, us := range searches {
+		o := &OpmlOutline{
+			Title:  us.Title,
+			XmlUrl: searchFeedURL(us.Id),
+			Type:   "search",
+		}
+		placed := false
+		for i, f := range out {
+			if us.Folder != "" && f.XmlUrl == "" && f.Title == us.Folder {
+				nf := *f
+				nf.Outline = append(append([]*OpmlOutline{}, f.Outline...), o)
+				out[i] = &nf
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// withoutSearches returns outlines without saved search virtual feeds,
+// which clients send back with the rest of the tree.
+func withoutSearches(outlines []*OpmlOutline) []*OpmlOutline {
+	var out []*OpmlOutline
+	for _, o := range outlines {
+		if strings.HasPrefix(o.XmlUrl, searchFeedPrefix) {
+			continue
+		}
+		if o.Outline != nil {
+			o.Outline = withoutSearches(o.Outline)
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+func searchMatch(sk *backend.Key, feed string, s *Story) *UserSearchMatch {
+	return &UserSearchMatch{
+		Parent:  sk,
+		Id:      feed + "|" + s.Id,
+		Feed:    feed,
+		Story:   s.Id,
+		Created: s.Created,
+	}
+}
+
+// matchSearches records the stories of feed that match saved searches of
+// feed.
+func matchSearches(c Context, feed string, stories []*Story) error {
+	if len(stories) == 0 {
+		return nil
+	}
+	gn := c.Store()
+	var searches []*UserSearch
+	q := backend.NewQuery(gn.Kind(&UserSearch{})).Filter("f =", feed)
+	keys, err := gn.GetAll(q, &searches)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	fields := make([][][]string, len(stories))
+	for i, s := range stories {
+		fields[i] = storyDoc(feed, s).Fields()
+	}
+	var matches []*UserSearchMatch
+	for i, us := range searches {
+		clauses, err := parseSearch(us.Query)
+		if err != nil {
+			c.Errorf("search %v: %v", keys[i], err)
+			continue
+		}
+		for j, s := range stories {
+			if backend.Match(clauses, fields[j]) {
+				matches = append(matches, searchMatch(keys[i], feed, s))
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	_, err = gn.PutMulti(matches)
+	return err
+}
+
+// searchUnread returns the ids, as feed|story, of the stories matched by
+// the search of sk since since that are in unread.
+func searchUnread(gn *backend.Store, sk *backend.Key, since time.Time, unread map[string]bool) ([]string, error) {
+	q := backend.NewQuery(gn.Kind(&UserSearchMatch{})).
+		Ancestor(sk).
+		Filter("c >=", since).
+		Order("-c").
+		KeysOnly().
+		Limit(numStoriesLimit)
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, k := range keys {
+		if unread[k.StringID()] {
+			ids = append(ids, k.StringID())
+		}
+	}
+	return ids, nil
+}
+
+// backfillSearch records the newest stories that match us from the
+// search index.
+func backfillSearch(c Context, us *UserSearch) error {
+	clauses, err := parseSearch(us.Query)
+	if err != nil || len(us.Feeds) == 0 {
+		return err
+	}
+	res, err := c.Index(storyIndex).Search(&backend.SearchQuery{
+		Clauses: clauses,
+		Feeds:   us.Feeds,
+		Limit:   backfillLimit,
+	})
+	if err != nil || len(res.Docs) == 0 {
+		return err
+	}
+	gn := c.Store()
+	stories := make([]*Story, len(res.Docs))
+	for i, d := range res.Docs {
+		stories[i] = &Story{Id: d.Story, Parent: gn.Key(&Feed{Url: d.Feed})}
+	}
+	err = gn.GetMulti(stories)
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
+		return err
+	}
+	sk := gn.Key(us)
+	var matches []*UserSearchMatch
+	for i, s := range stories {
+		if !backend.NotFound(err, i) {
+			matches = append(matches, searchMatch(sk, res.Docs[i].Feed, s))
+		}
+	}
+	_, err = gn.PutMulti(matches)
+	return err
+}
+
+// deleteMatches deletes the stories found by the search of sk.
+func deleteMatches(gn *backend.Store, sk *backend.Key) error {
+	q := backend.NewQuery(gn.Kind(&UserSearchMatch{})).Ancestor(sk).KeysOnly()
+	keys, err := gn.GetAll(q, nil)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return gn.DeleteMulti(keys)
+}
+
+// searchKey returns the user's search named by the id parameter.
+func searchKey(c Context, r *http.Request) (*UserSearch, error) {
+	us := &UserSearch{Parent: c.Store().Key(&User{Id: c.User().ID})}
+	var err error
+	us.Id, err = strconv.ParseInt(r.FormValue("id"), 10, 64)
+	return us, err
+}
+
+func ListSearches(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserSearch{})).Ancestor(gn.Key(&User{Id: c.User().ID}))
+	searches := []*UserSearch{}
+	if _, err := gn.GetAll(q, &searches); err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, searches)
+}
+
+// SaveSearch saves the q parameter as a search of the folder parameter's
+// feeds, or all feeds, named by the title parameter. With an id parameter
+// it replaces that search.
+func SaveSearch(c Context, w http.ResponseWriter, r *http.Request) {
+	if _, err := parseSearch(r.FormValue("q")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	st, err := loadReaderState(c)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	gn := c.Store()
+	us := &UserSearch{
+		Parent:  st.uk,
+		Title:   strings.TrimSpace(r.FormValue("title")),
+		Query:   strings.TrimSpace(r.FormValue("q")),
+		Folder:  r.FormValue("folder"),
+		Created: time.Now(),
+	}
+	if us.Title == "" {
+		us.Title = us.Query
+	}
+	us.Feeds = searchFeeds(us.Folder, &st.opml)
+	if r.FormValue("id") != "" {
+		old, err := searchKey(c, r)
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		if err := gn.Get(old); err == backend.ErrNoSuchEntity {
+			http.Error(w, "no such search", http.StatusNotFound)
+			return
+		} else if err != nil {
+			serveError(w, err)
+			return
+		}
+		us.Id = old.Id
+		us.Created = old.Created
+		if old.Query == us.Query && old.Folder == us.Folder {
+			if _, err := gn.Put(us); err != nil {
+				serveError(w, err)
+				return
+			}
+			serveJSON(w, us)
+			return
+		}
+		if err := deleteMatches(gn, gn.Key(us)); err != nil {
+			serveError(w, err)
+			return
+		}
+	}
+	if _, err := gn.Put(us); err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := backfillSearch(c, us); err != nil {
+		c.Errorf("backfill search %v: %v", us.Id, err)
+	}
+	serveJSON(w, us)
+}
+
+func DeleteSearch(c Context, w http.ResponseWriter, r *http.Request) {
+	us, err := searchKey(c, r)
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	gn := c.Store()
+	sk := gn.Key(us)
+	if err := deleteMatches(gn, sk); err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := gn.Delete(sk); err != nil {
+		serveError(w, err)
+		return
+	}
+}
+
+// GetSearch returns a page of the stories of the saved search named by
+// the id parameter, newest first, read or not. The c parameter is the
+// previous page's cursor.
+func GetSearch(c Context, w http.ResponseWriter, r *http.Request) {
+	us, err := searchKey(c, r)
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	gn := c.Store()
+	cursor := r.FormValue("c")
+	var smap map[string][]*Story
+	var feeds []*Feed
+	// Matches can outlive their stories, so pages of only those are
+	// skipped rather than returned empty with a cursor.
+	for {
+		q := backend.NewQuery(gn.Kind(&UserSearchMatch{})).
+			Ancestor(gn.Key(us)).
+			Order("-c").
+			Limit(20)
+		if cursor != "" {
+			if dc, err := backend.DecodeCursor(cursor); err == nil {
+				q = q.Start(dc)
+			}
+		}
+		iter := gn.Run(q)
+		var refs []readStory
+		for {
+			var m UserSearchMatch
+			if _, err := iter.Next(&m); err == nil {
+				refs = append(refs, readStory{Feed: m.Feed, Story: m.Story})
+			} else if err == backend.Done {
+				break
+			} else {
+				serveError(w, err)
+				return
+			}
+		}
+		cursor = ""
+		if ic, err := iter.Cursor(); err == nil && len(refs) > 0 {
+			cursor = ic.String()
+		}
+		smap, feeds = loadStories(gn, refs)
+		if smap != nil || cursor == "" {
+			break
+		}
+	}
+	serveJSON(w, struct {
+		Cursor  string
+		Stories map[string][]*Story
+		Feeds   []*Feed
+	}{
+		Cursor:  cursor,
+		Stories: smap,
+		Feeds:   feeds,
+	})
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mjibson/goread/backend/local"
+)
+
+// outlineURLs returns the feed URLs of outlines, with those in folders as
+// folder/url.
+func outlineURLs(outlines []*OpmlOutline) []string {
+	var urls []string
+	for _, o := range outlines {
+		if o.XmlUrl != "" {
+			urls = append(urls, o.XmlUrl)
+			continue
+		}
+		for _, so := range o.Outline {
+			urls = append(urls, o.Title+"/"+so.XmlUrl)
+		}
+	}
+	return urls
+}
+
+func TestWithSearches(t *testing.T) {
+	outlines := []*OpmlOutline{
+		{XmlUrl: "a"},
+		{Title: "news", Outline: []*OpmlOutline{{XmlUrl: "b"}}},
+		{Title: "empty", Outline: []*OpmlOutline{}},
+	}
+	tests := []struct {
+		searches []*UserSearch
+		urls     []string
+	}{
+		{nil, []string{"a", "news/b"}},
+		{[]*UserSearch{{Id: 1}}, []string{"a", "news/b", "search:1"}},
+		{[]*UserSearch{{Id: 1, Folder: "news"}, {Id: 2, Folder: "empty"}}, []string{"a", "news/b", "news/search:1", "empty/search:2"}},
+		{[]*UserSearch{{Id: 1, Folder: "gone"}, {Id: 2, Folder: "news"}}, []string{"a", "news/b", "news/search:2", "search:1"}},
+	}
+	for i, test := range tests {
+		out := withSearches(outlines, test.searches)
+		if urls := outlineURLs(out); !reflect.DeepEqual(urls, test.urls) {
+			t.Errorf("%v: got %v, expected %v", i, urls, test.urls)
+		}
+		// The outlines passed in are left alone.
+		if urls := outlineURLs(outlines); !reflect.DeepEqual(urls, []string{"a", "news/b"}) {
+			t.Fatalf("%v: modified outlines: %v", i, urls)
+		}
+		if urls := outlineURLs(withoutSearches(out)); !reflect.DeepEqual(urls, []string{"a", "news/b"}) {
+			t.Errorf("%v: without searches: got %v", i, urls)
+		}
+	}
+}
+
+func TestWithoutSearches(t *testing.T) {
+	tests := []struct {
+		outlines []*OpmlOutline
+		urls     []string
+	}{
+		{nil, nil},
+		{[]*OpmlOutline{{XmlUrl: "search:1"}}, nil},
+		{[]*OpmlOutline{{XmlUrl: "a"}, {XmlUrl: "search:1"}, {XmlUrl: "b"}}, []string{"a", "b"}},
+		{[]*OpmlOutline{{Title: "news", Outline: []*OpmlOutline{{XmlUrl: "search:1"}, {XmlUrl: "b"}}}}, []string{"news/b"}},
+		{[]*OpmlOutline{{XmlUrl: "http://example.com/search:1"}}, []string{"http://example.com/search:1"}},
+	}
+	for i, test := range tests {
+		if urls := outlineURLs(withoutSearches(test.outlines)); !reflect.DeepEqual(urls, test.urls) {
+			t.Errorf("%v: got %v, expected %v", i, urls, test.urls)
+		}
+	}
+	// A folder left with only searches is kept, so it isn't lost.
+	out := withoutSearches([]*OpmlOutline{{Title: "news", Outline: []*OpmlOutline{{XmlUrl: "search:1"}}}})
+	if len(out) != 1 || out[0].Title != "news" || len(out[0].Outline) != 0 {
+		t.Errorf("got %+v", out)
+	}
+}
+
+func TestEditOpmlSearches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := local.Open(local.Config{Database: filepath.Join(dir, "goread.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := Context{Context: b.NewContext(nil)}
+	gn := c.Store()
+	u := &User{Id: "test", Email: "test@example.com"}
+	uk := gn.Key(u)
+	opml, _ := json.Marshal(&Opml{Outline: []*OpmlOutline{
+		{Title: "news", Outline: []*OpmlOutline{{XmlUrl: "a"}}},
+		{XmlUrl: "b"},
+	}})
+	_, ut, err := newToken(uk, u.Email, "test", scopeFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := &UserSearch{Id: 1, Parent: uk, Query: "go", Feeds: []string{"a", "b"}}
+	news := &UserSearch{Id: 2, Parent: uk, Query: "go", Folder: "news", Feeds: []string{"a"}}
+	if _, err := gn.PutMulti([]interface{}{u, &UserData{Id: "data", Parent: uk, Opml: opml}, all, news}); err != nil {
+		t.Fatal(err)
+	}
+
+	c = asUser(c, u, ut)
+	if err := editOpml(c, func(o *Opml) bool {
+		return moveOutline(o, "b", "news", "", false)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := editOpml(c, func(o *Opml) bool {
+		return moveOutline(o, "a", "", "", true)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	searches, err := loadSearches(gn, uk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(searches) != 2 {
+		t.Fatalf("got %v searches", len(searches))
+	}
+	for _, us := range searches {
+		if expected := []string{"b"}; !reflect.DeepEqual(us.Feeds, expected) {
+			t.Errorf("search %v: got feeds %v, expected %v", us.Id, us.Feeds, expected)
+		}
+	}
+}
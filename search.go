@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"errors"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/sanitizer"
+)
+
+// storyIndex is the name of the search index of stories.
+const storyIndex = "stories"
+
+// maxSearchTerms caps the words and phrases of a search.
+const maxSearchTerms = 20
+
+// contentText returns the text of a story's HTML content, or of its
+// summary if it has no content.
+func contentText(content, summary string) string {
+	if content == "" {
+		content = summary
+	}
+	return html.UnescapeString(sanitizer.StripTags(content))
+}
+
+// storyDoc returns the search document of s in feed.
+func storyDoc(feed string, s *Story) *backend.Document {
+	d := &backend.Document{
+		Feed:    feed,
+		Story:   s.Id,
+		Time:    s.Created,
+		Title:   s.Title,
+		Author:  s.Author,
+		Content: contentText(s.content, s.Summary),
+	}
+	if s.Date != 0 {
+		d.Time = time.Unix(s.Date, 0)
+	}
+	return d
+}
+
+// indexStories adds stories of feed, with their content, to the search
+// index.
+func indexStories(c Context, feed string, stories []*Story) error {
+	if len(stories) == 0 {
+		return nil
+	}
+	docs := make([]*backend.Document, len(stories))
+	for i, s := range stories {
+		docs[i] = storyDoc(feed, s)
+	}
+	return c.Index(storyIndex).Put(docs)
+}
+
+// loadStories loads the stories of refs, keyed by feed, and their feeds.
+// Stories that no longer exist are skipped. Like starStories, it returns
+// nil if there are no stories so clients know there are no more pages.
+func loadStories(gn *backend.Store, refs []readStory) (map[string][]*Story, []*Feed) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	smap := make(map[string][]*Story)
+	var feeds []*Feed
+	stories := make([]*Story, len(refs))
+	seen := make(map[string]bool)
+	for i, ref := range refs {
+		stories[i] = &Story{Id: ref.Story, Parent: gn.Key(&Feed{Url: ref.Feed})}
+		if !seen[ref.Feed] {
+			seen[ref.Feed] = true
+			feeds = append(feeds, &Feed{Url: ref.Feed})
+		}
+	}
+	err := gn.GetMulti(stories)
+	for i, s := range stories {
+		if !backend.NotFound(err, i) {
+			smap[refs[i].Feed] = append(smap[refs[i].Feed], s)
+		}
+	}
+	if len(smap) == 0 {
+		return nil, nil
+	}
+	gn.GetMulti(&feeds)
+	return smap, feeds
+}
+
+// parseSearch parses a search of words and "quoted phrases". Terms
+// joined by OR match either, and a term preceded by - excludes stories
+// that have it.
+func parseSearch(s string) ([]backend.Clause, error) {
+	var clauses []backend.Clause
+	terms := 0
+	or := false
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeftFunc(s, unicode.IsSpace) {
+		not := false
+		if len(s) > 1 && s[0] == '-' {
+			not = true
+			s = s[1:]
+		}
+		var text string
+		if s[0] == '"' {
+			s = s[1:]
+			i := strings.IndexByte(s, '"')
+			if i < 0 {
+				i = len(s)
+			}
+			text, s = s[:i], strings.TrimPrefix(s[i:], `"`)
+		} else {
+			i := strings.IndexFunc(s, unicode.IsSpace)
+			if i < 0 {
+				i = len(s)
+			}
+			text, s = s[:i], s[i:]
+			if text == "OR" && !not {
+				or = true
+				continue
+			}
+		}
+		words := backend.Tokenize(text)
+		if len(words) == 0 {
+			continue
+		}
+		if terms++; terms > maxSearchTerms {
+			return nil, errors.New("too many search terms")
+		}
+		t := backend.Term{Words: words}
+		if last := len(clauses) - 1; or && !not && last >= 0 && !clauses[last].Not {
+			clauses[last].Terms = append(clauses[last].Terms, t)
+		} else {
+			clauses = append(clauses, backend.Clause{Terms: []backend.Term{t}, Not: not})
+		}
+		or = false
+	}
+	for _, cl := range clauses {
+		if !cl.Not {
+			return clauses, nil
+		}
+	}
+	return nil, errors.New("no search words")
+}
+
+// Search returns a page of the stories matching the q parameter, newest
+// first. The feed or folder parameter limits it to a feed or folder of the
+// user's subscriptions, and stars=1 to the user's starred stories. The
+// after and before parameters, dates as 2006-01-02, limit it to stories
+// from after and before the start of those days. The c parameter is the
+// previous page's cursor.
+func Search(c Context, w http.ResponseWriter, r *http.Request) {
+	clauses, err := parseSearch(r.FormValue("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sq := &backend.SearchQuery{
+		Clauses: clauses,
+		Cursor:  r.FormValue("c"),
+		Limit:   20,
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"after", &sq.After},
+		{"before", &sq.Before},
+	} {
+		if v := r.FormValue(p.name); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				http.Error(w, "bad "+p.name+" date", http.StatusBadRequest)
+				return
+			}
+			*p.t = t
+		}
+	}
+	gn := c.Store()
+	if r.FormValue("stars") == "1" {
+		uk := gn.Key(&User{Id: c.User().ID})
+		q := backend.NewQuery(gn.Kind(&UserStar{})).Ancestor(uk).KeysOnly()
+		keys, err := gn.GetAll(q, nil)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		sq.Stories = make(map[string][]string)
+		for _, k := range keys {
+			f := k.Parent().StringID()
+			sq.Stories[f] = append(sq.Stories[f], k.StringID())
+		}
+	} else {
+		st, err := loadReaderState(c)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		feed, folder := r.FormValue("feed"), r.FormValue("folder")
+		for _, f := range st.feeds {
+			if (feed == "" || f == feed) && (folder == "" || st.labels[f] == folder) {
+				sq.Feeds = append(sq.Feeds, f)
+			}
+		}
+	}
+	var smap map[string][]*Story
+	var feeds []*Feed
+	// The index can still have stories that were deleted, so pages of
+	// only those are skipped rather than returned empty with a cursor.
+	for len(sq.Feeds) > 0 || len(sq.Stories) > 0 {
+		res, err := c.Index(storyIndex).Search(sq)
+		if err == backend.ErrBadCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			serveError(w, err)
+			return
+		}
+		refs := make([]readStory, len(res.Docs))
+		for i, d := range res.Docs {
+			refs[i] = readStory{Feed: d.Feed, Story: d.Story}
+		}
+		smap, feeds = loadStories(gn, refs)
+		sq.Cursor = res.Cursor
+		if smap != nil || sq.Cursor == "" {
+			break
+		}
+	}
+	if smap == nil {
+		sq.Cursor = ""
+	}
+	serveJSON(w, struct {
+		Cursor  string
+		Stories map[string][]*Story
+		Feeds   []*Feed
+	}{
+		Cursor:  sq.Cursor,
+		Stories: smap,
+		Feeds:   feeds,
+	})
+}
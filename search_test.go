@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/backend/local"
+)
+
+func TestParseSearch(t *testing.T) {
+	term := func(s string) backend.Term {
+		return backend.Term{Words: backend.Tokenize(s)}
+	}
+	clause := func(not bool, terms ...string) backend.Clause {
+		cl := backend.Clause{Not: not}
+		for _, s := range terms {
+			cl.Terms = append(cl.Terms, term(s))
+		}
+		return cl
+	}
+	tests := []struct {
+		s       string
+		ok      bool
+		clauses []backend.Clause
+	}{
+		{"go", true, []backend.Clause{clause(false, "go")}},
+		{"  Go   Rust ", true, []backend.Clause{clause(false, "go"), clause(false, "rust")}},
+		{"go OR rust", true, []backend.Clause{clause(false, "go", "rust")}},
+		{"go OR rust OR zig c", true, []backend.Clause{clause(false, "go", "rust", "zig"), clause(false, "c")}},
+		{"go or rust", true, []backend.Clause{clause(false, "go"), clause(false, "or"), clause(false, "rust")}},
+		{"OR go", true, []backend.Clause{clause(false, "go")}},
+		{"go -rust", true, []backend.Clause{clause(false, "go"), clause(true, "rust")}},
+		{"go OR -rust", true, []backend.Clause{clause(false, "go"), clause(true, "rust")}},
+		{"-rust OR go", true, []backend.Clause{clause(true, "rust"), clause(false, "go")}},
+		{"go -OR", true, []backend.Clause{clause(false, "go"), clause(true, "or")}},
+		{"a - b", true, []backend.Clause{clause(false, "a"), clause(false, "b")}},
+		{`"release notes" go`, true, []backend.Clause{clause(false, "release notes"), clause(false, "go")}},
+		{`-"release notes" go`, true, []backend.Clause{clause(true, "release notes"), clause(false, "go")}},
+		{`"go OR rust"`, true, []backend.Clause{clause(false, "go or rust")}},
+		{`"unclosed phrase`, true, []backend.Clause{clause(false, "unclosed phrase")}},
+		{`go "" "!!"`, true, []backend.Clause{clause(false, "go")}},
+		{"", false, nil},
+		{"  ", false, nil},
+		{"-go", false, nil},
+		{"!!", false, nil},
+		{strings.Repeat("w ", maxSearchTerms), true, nil},
+		{strings.Repeat("w ", maxSearchTerms+1), false, nil},
+		{strings.Repeat(`"w w" `, maxSearchTerms+1), false, nil},
+	}
+	for i, test := range tests {
+		clauses, err := parseSearch(test.s)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: %q: got error %v, expected ok %v", i, test.s, err, test.ok)
+			continue
+		}
+		if test.clauses != nil && !reflect.DeepEqual(clauses, test.clauses) {
+			t.Errorf("%v: %q: got %v, expected %v", i, test.s, clauses, test.clauses)
+		}
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := local.Open(local.Config{Database: filepath.Join(dir, "goread.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// A full page of the newest results are stories that were deleted,
+	// and only two older ones still exist.
+	c := Context{Context: b.NewContext(nil)}
+	gn := c.Store()
+	u := &User{Id: "test", Email: "test@example.com"}
+	uk := gn.Key(u)
+	const feed = "http://example.com/feed"
+	fk := gn.Key(&Feed{Url: feed})
+	opml, _ := json.Marshal(&Opml{Outline: []*OpmlOutline{{Title: "Example", XmlUrl: feed}}})
+	_, ut, err := newToken(uk, u.Email, "test", scopeFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var docs []*backend.Document
+	for i := 0; i < 25; i++ {
+		docs = append(docs, &backend.Document{Feed: feed, Story: strconv.Itoa(i), Time: day.Add(time.Duration(i) * time.Hour), Title: "word"})
+	}
+	if err := c.Index(storyIndex).Put(docs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gn.PutMulti([]interface{}{
+		u,
+		&UserData{Id: "data", Parent: uk, Opml: opml},
+		&Feed{Url: feed, Title: "Example"},
+		&Story{Id: "0", Parent: fk, Title: "word"},
+		&Story{Id: "3", Parent: fk, Title: "word"},
+		&UserStar{Id: "0", Parent: gn.Key(&UserStarFeed{Id: feed, Parent: uk}), Created: day},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target  string
+		stories []string
+	}{
+		{"/user/search?q=word", []string{"3", "0"}},
+		{"/user/search?q=word&stars=1", []string{"0"}},
+		{"/user/search?q=missing", nil},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", test.target, nil)
+		w := httptest.NewRecorder()
+		Search(asUser(Context{Context: b.NewContext(r)}, u, ut), w, r)
+		var res struct {
+			Cursor  string
+			Stories map[string][]*Story
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%v: %v: %s", i, err, w.Body)
+		}
+		var ids []string
+		for _, s := range res.Stories[feed] {
+			ids = append(ids, s.Id)
+		}
+		if !reflect.DeepEqual(ids, test.stories) || res.Cursor != "" {
+			t.Errorf("%v: got %v with cursor %q, expected %v", i, ids, res.Cursor, test.stories)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/gorilla/mux"
+	"github.com/mjibson/goread/atom"
+	"github.com/mjibson/goread/backend"
+)
+
+// Shared feeds publish a user's stars, or a tag, as Atom. Their ids are
+// random, and a ShareRef finds the user of each, so the URL doesn't say
+// whose feed it is. Anyone with the URL can read the feed, so revoking or
+// regenerating a share is the only way to take it back.
+
+// shareEntries is how many stories a shared feed has.
+const shareEntries = 50
+
+// shareInfo is the JSON form of a UserShare.
+type shareInfo struct {
+	Id      string
+	URL     string
+	Tag     string
+	Notes   bool
+	Created time.Time
+}
+
+func (us *UserShare) info(r *http.Request) *shareInfo {
+	return &shareInfo{
+		Id:      us.Id,
+		URL:     absURL(r, routeUrl("share", "id", us.Id)),
+		Tag:     us.Tag,
+		Notes:   us.Notes,
+		Created: us.Created,
+	}
+}
+
+// newShare returns a share of tag for the user uk with a new secret.
+func newShare(uk *backend.Key, tag string, notes bool) (*UserShare, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &UserShare{
+		Parent:  uk,
+		Id:      hex.EncodeToString(b),
+		Tag:     tag,
+		Notes:   notes,
+		Created: time.Now(),
+	}, nil
+}
+
+// userShare returns the share with id of the user uk, or of whichever
+// user has it if uk is nil.
+func userShare(gn *backend.Store, uk *backend.Key, id string) (*UserShare, error) {
+	if id == "" {
+		return nil, backend.ErrNoSuchEntity
+	}
+	if uk == nil {
+		ref := &ShareRef{Id: id}
+		if err := gn.Get(ref); err != nil {
+			return nil, err
+		}
+		uk = gn.Key(&User{Id: ref.User})
+	}
+	us := &UserShare{Parent: uk, Id: id}
+	if err := gn.Get(us); err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+// putShare saves us and its ShareRef.
+func putShare(gn *backend.Store, us *UserShare) error {
+	_, err := gn.PutMulti([]interface{}{us, &ShareRef{Id: us.Id, User: us.Parent.StringID()}})
+	return err
+}
+
+// deleteShares deletes the shares with keys and their ShareRefs.
+func deleteShares(gn *backend.Store, keys []*backend.Key) error {
+	var del []*backend.Key
+	for _, k := range keys {
+		del = append(del, k, gn.Key(&ShareRef{Id: k.StringID()}))
+	}
+	return gn.DeleteMulti(del)
+}
+
+// CreateShare shares the stories with the tag parameter, or stars if it is
+// empty. If the notes parameter is set, notes and highlights are shared
+// too.
+func CreateShare(c Context, w http.ResponseWriter, r *http.Request) {
+	tag, err := tagName(r.FormValue("tag"))
+	if r.FormValue("tag") == "" {
+		tag, err = tagStar, nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notes, _ := strconv.ParseBool(r.FormValue("notes"))
+	gn := c.Store()
+	us, err := newShare(gn.Key(&User{Id: c.User().ID}), tag, notes)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := putShare(gn, us); err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, us.info(r))
+}
+
+func ListShares(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserShare{})).Ancestor(gn.Key(&User{Id: c.User().ID}))
+	var shares []*UserShare
+	if _, err := gn.GetAll(q, &shares); err != nil {
+		serveError(w, err)
+		return
+	}
+	infos := []*shareInfo{}
+	for _, us := range shares {
+		infos = append(infos, us.info(r))
+	}
+	serveJSON(w, infos)
+}
+
+// retagShares moves the user's shares of tag from to tag to, or deletes
+// them if to is empty.
+func retagShares(gn *backend.Store, uk *backend.Key, from, to string) error {
+	q := backend.NewQuery(gn.Kind(&UserShare{})).Ancestor(uk)
+	var shares []*UserShare
+	if _, err := gn.GetAll(q, &shares); err != nil {
+		return err
+	}
+	var put []*UserShare
+	var del []*backend.Key
+	for _, us := range shares {
+		if us.Tag != from {
+			continue
+		}
+		if to == "" {
+			del = append(del, gn.Key(us))
+		} else {
+			us.Tag = to
+			put = append(put, us)
+		}
+	}
+	if len(put) > 0 {
+		if _, err := gn.PutMulti(put); err != nil {
+			return err
+		}
+	}
+	return deleteShares(gn, del)
+}
+
+// RevokeShare deletes the share with the id parameter as its id. If the
+// regenerate parameter is set, a share of the same stories with a new URL
+// replaces it.
+func RevokeShare(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	us, err := userShare(gn, uk, r.FormValue("id"))
+	if err == backend.ErrNoSuchEntity {
+		http.Error(w, "no such share", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := deleteShares(gn, []*backend.Key{gn.Key(us)}); err != nil {
+		serveError(w, err)
+		return
+	}
+	if r.FormValue("regenerate") == "" {
+		return
+	}
+	ns, err := newShare(uk, us.Tag, us.Notes)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := putShare(gn, ns); err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, ns.info(r))
+}
+
+// Share serves the Atom feed of the share with the id route variable.
+func Share(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	us, err := userShare(gn, nil, mux.Vars(r)["id"])
+	if err == backend.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	uk := us.Parent
+	var keys []*backend.Key
+	var dates []time.Time
+	if us.Tag == tagStar {
+		var stars []*UserStar
+		q := backend.NewQuery(gn.Kind(&UserStar{})).Ancestor(uk).Order("-c").Limit(shareEntries)
+		keys, err = gn.GetAll(q, &stars)
+		for _, s := range stars {
+			dates = append(dates, s.Created)
+		}
+	} else {
+		var tagged []*UserTagged
+		q := taggedQuery(gn, uk, us.Tag).Order("-c").Limit(shareEntries)
+		keys, err = gn.GetAll(q, &tagged)
+		for _, t := range tagged {
+			dates = append(dates, t.Created)
+		}
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	var notes map[string]*starNote
+	if us.Notes {
+		notes = storyNotes(gn, keys)
+	}
+
+	// The ETag covers everything in the feed but the stories themselves,
+	// which rarely change once starred.
+	h := sha1.New()
+	fmt.Fprintln(h, us.Id, us.Tag, us.Notes)
+	for i, k := range keys {
+		fmt.Fprintln(h, starID(k), dates[i].UnixNano())
+		if n := notes[starID(k)]; n != nil {
+			fmt.Fprintln(h, n.Updated.UnixNano())
+		}
+	}
+	etag := fmt.Sprintf(`"%x"`, h.Sum(nil))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	smap, feeds := starStories(gn, keys)
+	titles := make(map[string]string)
+	for _, f := range feeds {
+		titles[f.Url] = f.Title
+	}
+	stories := make(map[string]*Story)
+	var scs []*StoryContent
+	for _, ss := range smap {
+		for _, s := range ss {
+			stories[starID(gn.Key(s))] = s
+			scs = append(scs, &StoryContent{Id: 1, Parent: gn.Key(s)})
+		}
+	}
+	gn.GetMulti(scs)
+	contents := make(map[string]string)
+	for _, sc := range scs {
+		contents[starID(sc.Parent)] = sc.content()
+	}
+
+	self := absURL(r, r.URL.Path)
+	feed := &atom.Feed{
+		Title:   "Starred stories",
+		ID:      self,
+		Link:    []atom.Link{{Rel: "self", Href: self}},
+		Updated: atom.Time(us.Created),
+	}
+	if us.Tag != tagStar {
+		feed.Title = "Stories tagged " + us.Tag
+	}
+	if len(dates) > 0 {
+		feed.Updated = atom.Time(dates[0])
+	}
+	for i, k := range keys {
+		id := starID(k)
+		s := stories[id]
+		if s == nil {
+			continue
+		}
+		content := contents[id]
+		if content == "" {
+			content = html.EscapeString(s.Summary)
+		}
+		if n := notes[id]; n != nil {
+			content = noteHTML(n) + content
+		}
+		published := s.Published
+		if published.IsZero() {
+			published = s.Created
+		}
+		e := &atom.Entry{
+			Title:     &atom.Text{Body: s.Title},
+			ID:        s.Parent.StringID() + "#" + s.Id,
+			Link:      []atom.Link{{Rel: "alternate", Href: s.Link}},
+			Published: atom.Time(published),
+			Updated:   atom.Time(dates[i]),
+			Content:   &atom.Text{Type: "html", Body: content},
+		}
+		if s.Author != "" {
+			e.Author = &atom.Person{Name: s.Author}
+		} else if t := titles[s.Parent.StringID()]; t != "" {
+			e.Author = &atom.Person{Name: t}
+		}
+		feed.Entry = append(feed.Entry, e)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).EncodeElement(feed, xml.StartElement{Name: atom.FeedName}); err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// noteHTML returns the note and highlights of n as HTML.
+func noteHTML(n *starNote) string {
+	var b bytes.Buffer
+	if n.Note != "" {
+		b.WriteString("<p>")
+		b.WriteString(strings.Replace(html.EscapeString(n.Note), "\n", "<br>", -1))
+		b.WriteString("</p>")
+	}
+	for _, h := range n.Highlights {
+		b.WriteString("<blockquote>")
+		b.WriteString(html.EscapeString(h.Text))
+		b.WriteString("</blockquote>")
+	}
+	if b.Len() > 0 {
+		b.WriteString("<hr>")
+	}
+	return b.String()
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+const (
+	// syncOverlap is how long before its token a sync looks for changes
+	// and stories, so that those still being written when the token was
+	// made are not missed. Clients may see them twice.
+	syncOverlap = time.Minute
+	// syncRetention is how long changes are kept. Older tokens must
+	// reset with a full list-feeds.
+	syncRetention = time.Hour * 24 * 7
+)
+
+// newChange returns a change to the data of the user uk. Changes made
+// together get consecutive ids.
+func newChange(uk *backend.Key, kind, feed string, stories ...string) *UserChange {
+	return &UserChange{
+		Parent:  uk,
+		Id:      time.Now().UnixNano(),
+		Kind:    kind,
+		Feed:    feed,
+		Stories: stories,
+	}
+}
+
+// recordChanges saves changes for /user/sync. Failures are logged: the
+// change itself has already been made.
+func recordChanges(c backend.Context, changes ...*UserChange) {
+	for i, ch := range changes {
+		ch.Id += int64(i)
+	}
+	if _, err := c.Store().PutMulti(changes); err != nil {
+		c.Errorf("record changes: %v", err)
+	}
+}
+
+func syncToken(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 36)
+}
+
+func parseSyncToken(s string) (time.Time, error) {
+	n, err := strconv.ParseInt(s, 36, 64)
+	return time.Unix(0, n), err
+}
+
+// pruneChanges deletes the user's changes older than syncRetention.
+func pruneChanges(gn *backend.Store, uk *backend.Key) error {
+	old := &UserChange{Parent: uk, Id: time.Now().Add(-syncRetention).UnixNano()}
+	q := backend.NewQuery(gn.Kind(old)).
+		Ancestor(uk).
+		Filter("__key__ <", gn.Key(old)).
+		KeysOnly()
+	keys, err := gn.GetAll(q, nil)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return gn.DeleteMulti(keys)
+}
+
+// syncChanges is the net effect of a run of changes. Stars are feed|story
+// ids.
+type syncChanges struct {
+	read, unread   []readStory
+	stars, unstars []string
+	opml, options  bool
+}
+
+// mergeChanges returns the net effect of changes, oldest first: the last
+// read or unread, and star or unstar, of each story wins. Stories are in
+// the order they first changed.
+func mergeChanges(changes []*UserChange) syncChanges {
+	var sc syncChanges
+	read := make(map[readStory]bool)
+	stars := make(map[string]bool)
+	var readOrder []readStory
+	var starOrder []string
+	for _, ch := range changes {
+		for _, s := range ch.Stories {
+			rs := readStory{Feed: ch.Feed, Story: s}
+			switch ch.Kind {
+			case changeRead, changeUnread:
+				if _, ok := read[rs]; !ok {
+					readOrder = append(readOrder, rs)
+				}
+				read[rs] = ch.Kind == changeRead
+			case changeStar, changeUnstar:
+				id := ch.Feed + "|" + s
+				if _, ok := stars[id]; !ok {
+					starOrder = append(starOrder, id)
+				}
+				stars[id] = ch.Kind == changeStar
+			}
+		}
+		switch ch.Kind {
+		case changeOpml:
+			sc.opml = true
+		case changeOptions:
+			sc.options = true
+		}
+	}
+	for _, rs := range readOrder {
+		if read[rs] {
+			sc.read = append(sc.read, rs)
+		} else {
+			sc.unread = append(sc.unread, rs)
+		}
+	}
+	for _, id := range starOrder {
+		if stars[id] {
+			sc.stars = append(sc.stars, id)
+		} else {
+			sc.unstars = append(sc.unstars, id)
+		}
+	}
+	return sc
+}
+
+// Sync returns the changes to the user's data since the token from the
+// previous sync or list-feeds. Stories and changes may repeat across
+// syncs. If Reset is set the client must call list-feeds instead.
+func Sync(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	gn := c.Store()
+	now := time.Now()
+	u := &User{Id: cu.ID}
+	ud := &UserData{Id: "data", Parent: gn.Key(u)}
+	if err := gn.GetMulti([]interface{}{u, ud}); err != nil && !backend.NotFound(err, 1) {
+		serveError(w, err)
+		return
+	}
+	o := struct {
+		Token      string
+		Reset      bool                `json:",omitempty"`
+		Stories    map[string][]*Story `json:",omitempty"`
+		Read       []readStory         `json:",omitempty"`
+		Unread     []readStory         `json:",omitempty"`
+		Stars      []string            `json:",omitempty"`
+		Unstars    []string            `json:",omitempty"`
+		Opml       []*OpmlOutline      `json:",omitempty"`
+		Feeds      []*Feed             `json:",omitempty"`
+		Options    *string             `json:",omitempty"`
+		UnreadDate time.Time
+	}{
+		Token:      syncToken(now),
+		UnreadDate: u.Read,
+	}
+	since, err := parseSyncToken(r.FormValue("token"))
+	if err != nil || now.Sub(since) > syncRetention {
+		o.Reset = true
+		b, _ := json.Marshal(o)
+		w.Write(b)
+		return
+	}
+	since = since.Add(-syncOverlap)
+
+	var changes []*UserChange
+	c.Step("changes", func(c Context) {
+		start := &UserChange{Parent: ud.Parent, Id: since.UnixNano()}
+		q := backend.NewQuery(gn.Kind(start)).
+			Ancestor(ud.Parent).
+			Filter("__key__ >=", gn.Key(start))
+		_, err = gn.GetAll(q, &changes)
+	})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	sc := mergeChanges(changes)
+	o.Read, o.Unread = sc.read, sc.unread
+	o.Stars, o.Unstars = sc.stars, sc.unstars
+	if sc.options {
+		o.Options = &u.Options
+	}
+
+	var uf Opml
+	json.Unmarshal(ud.Opml, &uf)
+	var feeds []string
+	for _, outline := range uf.Outline {
+		if outline.XmlUrl == "" {
+			for _, so := range outline.Outline {
+				feeds = append(feeds, so.XmlUrl)
+			}
+		} else {
+			feeds = append(feeds, outline.XmlUrl)
+		}
+	}
+	if sc.opml {
+		o.Opml = uf.Outline
+		o.Feeds = make([]*Feed, len(feeds))
+		for i, f := range feeds {
+			o.Feeds[i] = &Feed{Url: f}
+		}
+		gn.GetMulti(o.Feeds)
+	}
+
+	isRead, err := getRead(gn, cu.ID, feeds)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	from := since
+	if from.Before(u.Read) {
+		from = u.Read
+	}
+	o.Stories = make(map[string][]*Story)
+	c.Step("stories", func(c Context) {
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		queue := make(chan string)
+		for i := 0; i < 20; i++ {
+			go func() {
+				for f := range queue {
+					gn := c.Timeout(time.Minute).Store()
+					fk := gn.Key(&Feed{Url: f})
+					q := backend.NewQuery(gn.Kind(&Story{})).
+						Ancestor(fk).
+						Filter(IDX_COL+" >=", from).
+						KeysOnly().
+						Order("-" + IDX_COL).
+						Limit(250)
+					keys, _ := gn.GetAll(q, nil)
+					var stories []*Story
+					for _, key := range keys {
+						if !isRead[readStory{Feed: f, Story: key.StringID()}] {
+							stories = append(stories, &Story{Id: key.StringID(), Parent: fk})
+						}
+					}
+					gn.GetMulti(stories)
+					if len(stories) > 0 {
+						lock.Lock()
+						o.Stories[f] = stories
+						lock.Unlock()
+					}
+					wg.Done()
+				}
+			}()
+		}
+		for _, f := range feeds {
+			wg.Add(1)
+			queue <- f
+		}
+		close(queue)
+		wg.Wait()
+	})
+	c.Step("rules", func(c Context) {
+		var rules *ruleSet
+		if rules, err = loadRules(c, ud.Parent); err == nil {
+			o.Stars = append(o.Stars, applyRules(c, ud.Parent, rules, o.Stories)...)
+		}
+	})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjibson/goread/backend/local"
+)
+
+func TestParseSyncToken(t *testing.T) {
+	now := time.Unix(1600000000, 123456789)
+	tests := []struct {
+		s  string
+		ok bool
+		t  time.Time
+	}{
+		{syncToken(now), true, now},
+		{syncToken(time.Unix(0, 1)), true, time.Unix(0, 1)},
+		{"", false, time.Time{}},
+		{"not a token!", false, time.Time{}},
+		{"zzzzzzzzzzzzzzzz", false, time.Time{}},
+	}
+	for i, test := range tests {
+		got, err := parseSyncToken(test.s)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: %q: got error %v, expected ok %v", i, test.s, err, test.ok)
+			continue
+		}
+		if test.ok && !got.Equal(test.t) {
+			t.Errorf("%v: %q: got %v, expected %v", i, test.s, got, test.t)
+		}
+	}
+}
+
+func TestMergeChanges(t *testing.T) {
+	ch := func(kind, feed string, stories ...string) *UserChange {
+		return &UserChange{Kind: kind, Feed: feed, Stories: stories}
+	}
+	rs := func(feed, story string) readStory {
+		return readStory{Feed: feed, Story: story}
+	}
+	tests := []struct {
+		changes []*UserChange
+		merged  syncChanges
+	}{
+		{nil, syncChanges{}},
+		{
+			[]*UserChange{ch(changeRead, "a", "1", "2"), ch(changeUnread, "b", "1")},
+			syncChanges{read: []readStory{rs("a", "1"), rs("a", "2")}, unread: []readStory{rs("b", "1")}},
+		},
+		{
+			// The last change of a story wins, in the order it first changed.
+			[]*UserChange{ch(changeRead, "a", "1", "2"), ch(changeUnread, "a", "1"), ch(changeRead, "a", "3"), ch(changeRead, "a", "1")},
+			syncChanges{read: []readStory{rs("a", "1"), rs("a", "2"), rs("a", "3")}},
+		},
+		{
+			[]*UserChange{ch(changeRead, "a", "1"), ch(changeUnread, "a", "1")},
+			syncChanges{unread: []readStory{rs("a", "1")}},
+		},
+		{
+			// Stars don't change read state, and the same story in another
+			// feed is another story.
+			[]*UserChange{ch(changeStar, "a", "1"), ch(changeStar, "b", "1"), ch(changeUnstar, "a", "1"), ch(changeRead, "b", "1")},
+			syncChanges{read: []readStory{rs("b", "1")}, stars: []string{"b|1"}, unstars: []string{"a|1"}},
+		},
+		{
+			[]*UserChange{ch(changeOpml, ""), ch(changeOptions, "")},
+			syncChanges{opml: true, options: true},
+		},
+		{
+			[]*UserChange{ch(changeOpml, ""), ch(changeStar, "a", "1")},
+			syncChanges{stars: []string{"a|1"}, opml: true},
+		},
+	}
+	for i, test := range tests {
+		if merged := mergeChanges(test.changes); !reflect.DeepEqual(merged, test.merged) {
+			t.Errorf("%v: got %+v, expected %+v", i, merged, test.merged)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := local.Open(local.Config{Database: filepath.Join(dir, "goread.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := Context{Context: b.NewContext(nil)}
+	gn := c.Store()
+	u := &User{Id: "test", Email: "test@example.com", Read: time.Now().Add(-time.Hour)}
+	uk := gn.Key(u)
+	_, ut, err := newToken(uk, u.Email, "test", scopeFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gn.Put(u); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	recordChanges(c, newChange(uk, changeRead, "a", "1"), newChange(uk, changeUnread, "a", "1"), newChange(uk, changeStar, "a", "2"))
+
+	type result struct {
+		Token   string
+		Reset   bool
+		Read    []readStory
+		Unread  []readStory
+		Stars   []string
+		Unstars []string
+	}
+	sync := func(token string) *result {
+		r := httptest.NewRequest("GET", "/user/sync?token="+token, nil)
+		w := httptest.NewRecorder()
+		Sync(asUser(Context{Context: b.NewContext(r)}, u, ut), w, r)
+		var res result
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		return &res
+	}
+	for _, token := range []string{"", "bad!", syncToken(start.Add(-syncRetention - time.Minute))} {
+		if res := sync(token); !res.Reset || res.Token == "" {
+			t.Errorf("%q: got %+v, expected reset", token, res)
+		}
+	}
+	res := sync(syncToken(start))
+	expected := &result{
+		Token:  res.Token,
+		Unread: []readStory{{Feed: "a", Story: "1"}},
+		Stars:  []string{"a|2"},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("got %+v, expected %+v", res, expected)
+	}
+	if next, err := parseSyncToken(res.Token); err != nil || next.Before(start) {
+		t.Errorf("got token %q", res.Token)
+	}
+}
@@ -0,0 +1,436 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// tagStar is the built-in tag of starred stories. It is kept as UserStars
+// so stars work as they always have.
+const tagStar = "star"
+
+const maxTagLen = 100
+
+var errBuiltInTag = errors.New("star is a built-in tag")
+
+// tagName returns name trimmed, or an error if it can't name a tag.
+func tagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("no tag name")
+	}
+	if len(name) > maxTagLen {
+		return "", errors.New("tag name too long")
+	}
+	return name, nil
+}
+
+// taggedKey returns the key of the tags of story in feed.
+func taggedKey(uk *backend.Key, feed, story string) *UserTagged {
+	return &UserTagged{Parent: backend.NewKey("USF", feed, 0, uk), Id: story}
+}
+
+// taggedQuery selects the user's tagged stories with tag.
+func taggedQuery(gn *backend.Store, uk *backend.Key, tag string) *backend.Query {
+	return backend.NewQuery(gn.Kind(&UserTagged{})).
+		Ancestor(uk).
+		Filter("t =", tag)
+}
+
+// tagStories adds tags to stories, keyed by feed, or removes them if add
+// is false. The star tag stars or unstars the stories. Tags the user
+// doesn't have yet are created.
+func tagStories(c Context, uk *backend.Key, stories map[string][]string, tags []string, add bool) error {
+	if len(stories) == 0 || len(tags) == 0 {
+		return nil
+	}
+	gn := c.Store()
+	var names []string
+	for _, t := range tags {
+		if t == tagStar {
+			if err := setStarred(c, uk, stories, add); err != nil {
+				return err
+			}
+		} else {
+			names = append(names, t)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if add {
+		uts := make([]*UserTag, len(names))
+		for i, t := range names {
+			uts[i] = &UserTag{Parent: uk, Id: t}
+		}
+		err := gn.GetMulti(uts)
+		if _, ok := err.(backend.MultiError); err != nil && !ok {
+			return err
+		}
+		var missing []*UserTag
+		for i, ut := range uts {
+			if backend.NotFound(err, i) {
+				ut.Created = time.Now()
+				missing = append(missing, ut)
+			}
+		}
+		if len(missing) > 0 {
+			if _, err := gn.PutMulti(missing); err != nil {
+				return err
+			}
+		}
+	}
+	var tagged []*UserTagged
+	for f, ids := range stories {
+		for _, id := range ids {
+			tagged = append(tagged, taggedKey(uk, f, id))
+		}
+	}
+	err := gn.GetMulti(tagged)
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
+		return err
+	}
+	var put []*UserTagged
+	var del []*backend.Key
+	for _, ut := range tagged {
+		changed := false
+		for _, t := range names {
+			if add {
+				changed = addTag(ut, t) || changed
+			} else {
+				changed = removeTag(ut, t) || changed
+			}
+		}
+		if !changed {
+			continue
+		}
+		if len(ut.Tags) == 0 {
+			del = append(del, gn.Key(ut))
+			continue
+		}
+		if add {
+			ut.Created = time.Now()
+		}
+		put = append(put, ut)
+	}
+	if len(put) > 0 {
+		if _, err := gn.PutMulti(put); err != nil {
+			return err
+		}
+	}
+	if len(del) > 0 {
+		return gn.DeleteMulti(del)
+	}
+	return nil
+}
+
+// addTag adds tag to ut and reports whether it wasn't already there.
+func addTag(ut *UserTagged, tag string) bool {
+	for _, t := range ut.Tags {
+		if t == tag {
+			return false
+		}
+	}
+	ut.Tags = append(ut.Tags, tag)
+	return true
+}
+
+// removeTag removes tag from ut and reports whether it was there.
+func removeTag(ut *UserTagged, tag string) bool {
+	for i, t := range ut.Tags {
+		if t == tag {
+			ut.Tags = append(ut.Tags[:i], ut.Tags[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// retag replaces from with to, or removes from if to is empty, on all of
+// the user's stories tagged with from.
+func retag(gn *backend.Store, uk *backend.Key, from, to string) error {
+	var tagged []*UserTagged
+	if _, err := gn.GetAll(taggedQuery(gn, uk, from), &tagged); err != nil {
+		return err
+	}
+	var put []*UserTagged
+	var del []*backend.Key
+	for _, ut := range tagged {
+		removeTag(ut, from)
+		if to != "" {
+			addTag(ut, to)
+		}
+		if len(ut.Tags) == 0 {
+			del = append(del, gn.Key(ut))
+		} else {
+			put = append(put, ut)
+		}
+	}
+	if len(put) > 0 {
+		if _, err := gn.PutMulti(put); err != nil {
+			return err
+		}
+	}
+	if len(del) > 0 {
+		return gn.DeleteMulti(del)
+	}
+	return nil
+}
+
+// tagCount is a tag and how many stories have it.
+type tagCount struct {
+	Name  string
+	Count int
+}
+
+// tagCounts returns the user's tags, star first and the rest by name, and
+// how many stories have each.
+func tagCounts(c Context, uk *backend.Key) ([]tagCount, error) {
+	gn := c.Store()
+	keys, err := gn.GetAll(backend.NewQuery(gn.Kind(&UserTag{})).Ancestor(uk).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]tagCount, len(keys)+1)
+	counts[0].Name = tagStar
+	for i, k := range keys {
+		counts[i+1].Name = k.StringID()
+	}
+	sort.Slice(counts[1:], func(i, j int) bool {
+		return counts[i+1].Name < counts[j+1].Name
+	})
+	errs := make([]error, len(counts))
+	var wg sync.WaitGroup
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := backend.NewQuery(gn.Kind(&UserStar{})).Ancestor(uk)
+			if i > 0 {
+				q = taggedQuery(gn, uk, counts[i].Name)
+			}
+			counts[i].Count, errs[i] = gn.Count(q.KeysOnly())
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+func ListTags(c Context, w http.ResponseWriter, r *http.Request) {
+	counts, err := tagCounts(c, c.Store().Key(&User{Id: c.User().ID}))
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, counts)
+}
+
+// CreateTag creates a tag named by the name parameter.
+func CreateTag(c Context, w http.ResponseWriter, r *http.Request) {
+	name, err := tagName(r.FormValue("name"))
+	if err == nil && name == tagStar {
+		err = errBuiltInTag
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gn := c.Store()
+	ut := &UserTag{Parent: gn.Key(&User{Id: c.User().ID}), Id: name}
+	if err := gn.Get(ut); err == nil {
+		return
+	} else if err != backend.ErrNoSuchEntity {
+		serveError(w, err)
+		return
+	}
+	ut.Created = time.Now()
+	if _, err := gn.Put(ut); err != nil {
+		serveError(w, err)
+	}
+}
+
+// RenameTag renames the tag named by the name parameter to the to
+// parameter, along with its shares. If to already exists the tags are
+// merged.
+func RenameTag(c Context, w http.ResponseWriter, r *http.Request) {
+	from := r.FormValue("name")
+	to, err := tagName(r.FormValue("to"))
+	if err == nil && (from == tagStar || to == tagStar) {
+		err = errBuiltInTag
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	old := &UserTag{Parent: uk, Id: from}
+	if err := gn.Get(old); err == backend.ErrNoSuchEntity {
+		http.Error(w, "no such tag", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	if from == to {
+		return
+	}
+	ut := &UserTag{Parent: uk, Id: to}
+	if err := gn.Get(ut); err == backend.ErrNoSuchEntity {
+		ut.Created = old.Created
+		if _, err := gn.Put(ut); err != nil {
+			serveError(w, err)
+			return
+		}
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := retag(gn, uk, from, to); err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := retagShares(gn, uk, from, to); err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := gn.Delete(gn.Key(old)); err != nil {
+		serveError(w, err)
+	}
+}
+
+// DeleteTag deletes the tag named by the name parameter, removes it from
+// all stories and deletes its shares.
+func DeleteTag(c Context, w http.ResponseWriter, r *http.Request) {
+	name, err := tagName(r.FormValue("name"))
+	if err == nil && name == tagStar {
+		err = errBuiltInTag
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
+	if err := retag(gn, uk, name, ""); err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := retagShares(gn, uk, name, ""); err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := gn.Delete(gn.Key(&UserTag{Parent: uk, Id: name})); err != nil {
+		serveError(w, err)
+	}
+}
+
+// TagStories adds the tag query parameters to the stories of the JSON
+// request body, a list of feed and story pairs like mark-read's. If the del
+// query parameter is set the tags are removed instead.
+func TagStories(c Context, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var tags []string
+	for _, t := range query["tag"] {
+		name, err := tagName(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tags = append(tags, name)
+	}
+	var stories []readStory
+	defer r.Body.Close()
+	b, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(b, &stories); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	byFeed := make(map[string][]string)
+	for _, s := range stories {
+		byFeed[s.Feed] = append(byFeed[s.Feed], s.Story)
+	}
+	uk := c.Store().Key(&User{Id: c.User().ID})
+	if err := tagStories(c, uk, byFeed, tags, query.Get("del") == ""); err != nil {
+		serveError(w, err)
+	}
+}
+
+// GetTagged lists the stories with the tag parameter, most recently tagged
+// first, 20 at a time like GetStars. Tagged holds each story's tags.
+func GetTagged(c Context, w http.ResponseWriter, r *http.Request) {
+	tag := r.FormValue("tag")
+	if tag == tagStar {
+		GetStars(c, w, r)
+		return
+	}
+	gn := c.Store()
+	q := taggedQuery(gn, gn.Key(&User{Id: c.User().ID}), tag).
+		Order("-c").
+		Limit(20)
+	if cur := r.FormValue("c"); cur != "" {
+		if dc, err := backend.DecodeCursor(cur); err == nil {
+			q = q.Start(dc)
+		}
+	}
+	iter := gn.Run(q)
+	tagged := make(map[string][]string)
+	var keys []*backend.Key
+	for {
+		var ut UserTagged
+		if k, err := iter.Next(&ut); err == nil {
+			tagged[starID(k)] = ut.Tags
+			keys = append(keys, k)
+		} else if err == backend.Done {
+			break
+		} else {
+			serveError(w, err)
+			return
+		}
+	}
+	cursor := ""
+	if ic, err := iter.Cursor(); err == nil {
+		cursor = ic.String()
+	}
+	smap, feeds := starStories(gn, keys)
+	serveJSON(w, struct {
+		Cursor  string
+		Stories map[string][]*Story
+		Tagged  map[string][]string
+		Feeds   []*Feed
+	}{
+		Cursor:  cursor,
+		Stories: smap,
+		Tagged:  tagged,
+		Feeds:   feeds,
+	})
+}
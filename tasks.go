@@ -17,37 +17,32 @@
 package goapp
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mjibson/goread/_third_party/code.google.com/p/go-charset/charset"
-	mpg "github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler_gae"
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
-
-	"appengine"
-	"appengine/blobstore"
-	"appengine/datastore"
-	"appengine/taskqueue"
-	"appengine/urlfetch"
+	"github.com/mjibson/goread/backend"
 )
 
-func ImportOpmlTask(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
+func ImportOpmlTask(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
 	userid := r.FormValue("user")
 	bk := r.FormValue("key")
 	del := func() {
-		blobstore.Delete(c, appengine.BlobKey(bk))
+		c.Blobs().Delete(backend.BlobKey(bk))
 	}
 
 	var skip int
@@ -56,11 +51,17 @@ func ImportOpmlTask(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 	c.Debugf("reader import for %v, skip %v", userid, skip)
 
-	d := xml.NewDecoder(blobstore.NewReader(c, appengine.BlobKey(bk)))
+	br, err := c.Blobs().NewReader(backend.BlobKey(bk))
+	if err != nil {
+		del()
+		c.Warningf("blob read failed: %v", err.Error())
+		return
+	}
+	d := xml.NewDecoder(br)
 	d.CharsetReader = charset.NewReader
 	d.Strict = false
 	opml := Opml{}
-	err := d.Decode(&opml)
+	err = d.Decode(&opml)
 	if err != nil {
 		del()
 		c.Warningf("gob decode failed: %v", err.Error())
@@ -111,26 +112,30 @@ func ImportOpmlTask(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	wg.Wait()
 
 	ud := UserData{Id: "data", Parent: gn.Key(&User{Id: userid})}
-	if err := gn.RunInTransaction(func(gn *goon.Goon) error {
+	if err := gn.RunInTransaction(func(gn *backend.Store) error {
 		gn.Get(&ud)
 		if err := mergeUserOpml(c, &ud, userOpml...); err != nil {
 			return err
 		}
-		_, err := gn.Put(&ud)
-		return err
-	}, nil); err != nil {
+		if _, err := gn.PutMulti([]interface{}{&ud, newChange(ud.Parent, changeOpml, "")}); err != nil {
+			return err
+		}
+		var o Opml
+		json.Unmarshal(ud.Opml, &o)
+		return updateSearches(gn, ud.Parent, &o)
+	}); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		c.Errorf("ude update error: %v", err.Error())
 		return
 	}
 
 	if len(userOpml) == IMPORT_LIMIT {
-		task := taskqueue.NewPOSTTask(routeUrl("import-opml-task"), url.Values{
+		task := backend.NewPOSTTask(routeUrl("import-opml-task"), url.Values{
 			"key":  {bk},
 			"user": {userid},
 			"skip": {strconv.Itoa(skip + IMPORT_LIMIT)},
 		})
-		taskqueue.Add(c, task, "import-reader")
+		c.Queue().Add(task, "import-reader")
 	} else {
 		del()
 		c.Infof("opml import done: %v", userid)
@@ -139,8 +144,8 @@ func ImportOpmlTask(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 
 const IMPORT_LIMIT = 10
 
-func SubscribeCallback(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
+func SubscribeCallback(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
 	furl := r.FormValue("feed")
 	b, _ := base64.URLEncoding.DecodeString(furl)
 	f := Feed{Url: string(b)}
@@ -187,9 +192,9 @@ func SubscribeCallback(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 }
 
 // Task used to subscribe a feed to push.
-func SubscribeFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func SubscribeFeed(c Context, w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	gn := goon.FromContext(c)
+	gn := c.Store()
 	f := Feed{Url: r.FormValue("feed")}
 	fk := gn.Key(&f)
 	s := ""
@@ -219,10 +224,7 @@ func SubscribeFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	req, err := http.NewRequest("POST", f.Hub, strings.NewReader(u.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	cl := &http.Client{
-		Transport: &urlfetch.Transport{
-			Context:  c,
-			Deadline: time.Minute,
-		},
+		Transport: c.Transport(time.Minute),
 	}
 	resp, err := cl.Do(req)
 	if err != nil {
@@ -241,34 +243,72 @@ func SubscribeFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func UpdateFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	q := datastore.NewQuery("F").KeysOnly().Filter("n <=", time.Now())
+func UpdateFeeds(c Context, w http.ResponseWriter, r *http.Request) {
+	q := backend.NewQuery("F").Filter("n <=", time.Now())
 	q = q.Limit(10 * 60 * 2) // 10/s queue, 2 min cron
-	it := q.Run(appengine.Timeout(c, time.Minute))
-	tc := make(chan *taskqueue.Task)
-	done := make(chan bool)
-	i := 0
+	gn := c.Timeout(time.Minute).Store()
+	var feeds []*Feed
+	if _, err := gn.GetAll(q, &feeds); err != nil {
+		c.Errorf("get feeds error: %v", err.Error())
+		return
+	}
 	u := routeUrl("update-feed")
-	go taskSender(c, "update-feed", tc, done)
-	for {
-		k, err := it.Next(nil)
-		if err == datastore.Done {
-			break
-		} else if err != nil {
-			c.Errorf("next error: %v", err.Error())
-			break
-		}
-		tc <- taskqueue.NewPOSTTask(u, url.Values{
-			"feed": {k.StringID()},
+	hosts := make(map[string]int)
+	tasks := make([]*backend.Task, len(feeds))
+	now := time.Now()
+	for i, f := range feeds {
+		// spread out feeds on the same host, past the cron interval if
+		// there are more than fit in it
+		h := feedHost(f.Url)
+		delay := time.Duration(hosts[h]) * hostSpacing
+		hosts[h]++
+		// hold the feed until well after its task is due so later runs
+		// don't queue it again; UpdateFeed recognizes its own lease
+		f.NextUpdate = now.Add(delay + updateFeedsInterval)
+		tasks[i] = backend.NewPOSTTask(u, url.Values{
+			"feed":  {f.Url},
+			"lease": {strconv.FormatInt(f.NextUpdate.Unix(), 10)},
 		})
-		i++
+		tasks[i].Delay = delay
+	}
+	if _, err := gn.PutMulti(feeds); err != nil {
+		c.Errorf("put feeds error: %v", err.Error())
+		return
+	}
+	tc := make(chan *backend.Task)
+	done := make(chan bool)
+	go taskSender(c, "update-feed", tc, done)
+	for _, t := range tasks {
+		tc <- t
 	}
 	close(tc)
 	<-done
-	c.Infof("updating %d feeds", i)
+	c.Infof("updating %d feeds", len(tasks))
+}
+
+var (
+	errNotModified = errors.New("feed not modified")
+	errGone        = errors.New("feed gone")
+)
+
+func fetchFeed(c Context, origUrl, fetchUrl string) (*Feed, []*Story, error) {
+	return fetchFeedHeader(c, origUrl, fetchUrl, nil)
 }
 
-func fetchFeed(c mpg.Context, origUrl, fetchUrl string) (*Feed, []*Story, error) {
+// fetchFeedIfModified fetches f with the validators from its last fetch.
+// errNotModified is returned if the server reports no change.
+func fetchFeedIfModified(c Context, f *Feed) (*Feed, []*Story, error) {
+	h := make(http.Header)
+	if f.ETag != "" {
+		h.Set("If-None-Match", f.ETag)
+	}
+	if f.LastModified != "" {
+		h.Set("If-Modified-Since", f.LastModified)
+	}
+	return fetchFeedHeader(c, f.Url, f.Url, h)
+}
+
+func fetchFeedHeader(c Context, origUrl, fetchUrl string, header http.Header) (*Feed, []*Story, error) {
 	u, err := url.Parse(fetchUrl)
 	if err != nil {
 		return nil, nil, err
@@ -290,13 +330,34 @@ func fetchFeed(c mpg.Context, origUrl, fetchUrl string) (*Feed, []*Story, error)
 		}
 	}
 
+	// record where the feed ends up if every redirect is permanent
+	var redirect string
+	permanent := true
 	cl := &http.Client{
-		Transport: &urlfetch.Transport{
-			Context:  c,
-			Deadline: time.Minute,
+		Transport: c.Transport(time.Minute),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			if permanent && req.Response != nil {
+				switch req.Response.StatusCode {
+				case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+					redirect = req.URL.String()
+				default:
+					permanent = false
+				}
+			}
+			return nil
 		},
 	}
-	if resp, err := cl.Get(fetchUrl); err == nil && resp.StatusCode == http.StatusOK {
+	req, err := http.NewRequest("GET", fetchUrl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if resp, err := cl.Do(req); err == nil && resp.StatusCode == http.StatusOK {
 		const sz = 1 << 21
 		reader := &io.LimitedReader{R: resp.Body, N: sz}
 		defer resp.Body.Close()
@@ -321,18 +382,77 @@ func fetchFeed(c mpg.Context, origUrl, fetchUrl string) (*Feed, []*Story, error)
 				return fetchFeed(c, origUrl, autoUrl)
 			}
 		}
-		return ParseFeed(c, resp.Header.Get("Content-Type"), origUrl, fetchUrl, b)
+		feed, stories, err := ParseFeed(c, resp.Header.Get("Content-Type"), origUrl, fetchUrl, b)
+		// validators only apply to the URL they came from, so skip them
+		// when the feed was autodiscovered from another page
+		if err == nil && origUrl == fetchUrl {
+			feed.ETag = resp.Header.Get("ETag")
+			feed.LastModified = resp.Header.Get("Last-Modified")
+			if redirect != origUrl {
+				feed.Redirect = redirect
+			}
+		}
+		return feed, stories, err
+	} else if err == nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, nil, errNotModified
+	} else if err == nil && resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, nil, errGone
+	} else if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		resp.Body.Close()
+		c.Warningf("fetch feed error: status code: %s, retry after: %q", resp.Status, resp.Header.Get("Retry-After"))
+		re := &retryError{Code: resp.StatusCode, Status: resp.Status}
+		if t, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			re.After = t
+		}
+		return nil, nil, re
 	} else if err != nil {
 		c.Warningf("fetch feed error: %v", err)
 		return nil, nil, fmt.Errorf("Could not fetch feed")
 	} else {
+		resp.Body.Close()
 		c.Warningf("fetch feed error: status code: %s", resp.Status)
-		return nil, nil, fmt.Errorf("Bad response code from server")
+		return nil, nil, fmt.Errorf("Bad response code from server: %s", resp.Status)
 	}
 }
 
-func updateFeed(c mpg.Context, url string, feed *Feed, stories []*Story, updateAll, fromSub, updateLast bool) error {
-	gn := goon.FromContext(c)
+// retryError is returned when a server asks us to slow down. After is zero
+// if it did not say for how long.
+type retryError struct {
+	Code   int
+	Status string
+	After  time.Time
+}
+
+func (e *retryError) Error() string {
+	if e.After.IsZero() {
+		return e.Status
+	}
+	return fmt.Sprintf("%s, retry after %v", e.Status, e.After)
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, false
+	}
+	if i, err := strconv.Atoi(v); err == nil {
+		if i < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Second * time.Duration(i)), true
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func updateFeed(c Context, url string, feed *Feed, stories []*Story, updateAll, fromSub, updateLast bool) error {
+	gn := c.Store()
 	f := Feed{Url: url}
 	if err := gn.Get(&f); err != nil {
 		return fmt.Errorf("feed not found: %s", url)
@@ -356,6 +476,15 @@ func updateFeed(c mpg.Context, url string, feed *Feed, stories []*Story, updateA
 	feed.Date = f.Date
 	feed.Average = f.Average
 	feed.LastViewed = f.LastViewed
+	feed.MovedTo = f.MovedTo
+	feed.FullText = f.FullText
+	feed.Policy = f.Policy
+	if fromSub || (feed.Redirect != "" && feed.Redirect == f.Redirect) {
+		feed.Redirect = f.Redirect
+		feed.RedirectSince = f.RedirectSince
+	} else if feed.Redirect != "" {
+		feed.RedirectSince = time.Now()
+	}
 	f = *feed
 	if updateLast {
 		f.LastViewed = time.Now()
@@ -379,13 +508,13 @@ func updateFeed(c mpg.Context, url string, feed *Feed, stories []*Story, updateA
 		getStories[i] = &Story{Id: s.Id, Parent: fk}
 	}
 	err := gn.GetMulti(getStories)
-	if _, ok := err.(appengine.MultiError); err != nil && !ok {
+	if _, ok := err.(backend.MultiError); err != nil && !ok {
 		c.Errorf("GetMulti error: %v", err)
 		return err
 	}
 	var updateStories []*Story
 	for i, s := range getStories {
-		if goon.NotFound(err, i) {
+		if backend.NotFound(err, i) {
 			updateStories = append(updateStories, stories[i])
 		} else if (!stories[i].Updated.IsZero() && !stories[i].Updated.Equal(s.Updated)) || updateAll {
 			if !s.Created.IsZero() {
@@ -394,6 +523,7 @@ func updateFeed(c mpg.Context, url string, feed *Feed, stories []*Story, updateA
 			if !s.Published.IsZero() {
 				stories[i].Published = s.Published
 			}
+			stories[i].ItemID = s.ItemID
 			updateStories = append(updateStories, stories[i])
 		}
 	}
@@ -405,15 +535,7 @@ func updateFeed(c mpg.Context, url string, feed *Feed, stories []*Story, updateA
 			Id:     1,
 			Parent: gn.Key(s),
 		}
-		buf := &bytes.Buffer{}
-		if gz, err := gzip.NewWriterLevel(buf, gzip.BestCompression); err == nil {
-			gz.Write([]byte(s.content))
-			gz.Close()
-			sc.Compressed = buf.Bytes()
-		}
-		if len(sc.Compressed) == 0 {
-			sc.Content = s.content
-		}
+		sc.setContent(s.content)
 		if _, err := gn.Put(&sc); err != nil {
 			c.Errorf("put sc err: %v", err)
 			return err
@@ -440,12 +562,24 @@ func updateFeed(c mpg.Context, url string, feed *Feed, stories []*Story, updateA
 	_, err = gn.PutMulti(puts)
 	if err != nil {
 		c.Errorf("update put err: %v", err)
+		return err
+	}
+	if err := indexStories(c, url, updateStories); err != nil {
+		c.Errorf("index err: %v", err)
+	}
+	if err := matchSearches(c, url, updateStories); err != nil {
+		c.Errorf("match searches err: %v", err)
+	}
+	if f.FullText > 0 {
+		if err := queueExtract(c, url, updateStories); err != nil {
+			c.Errorf("queue extract err: %v", err)
+		}
 	}
-	return err
+	return nil
 }
 
-func UpdateFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(appengine.Timeout(c, time.Minute))
+func UpdateFeed(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Timeout(time.Minute).Store()
 	url := r.FormValue("feed")
 	if url == "" {
 		c.Errorf("empty update feed")
@@ -462,23 +596,44 @@ func UpdateFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			Text:   "UpdateFeed - " + s,
 		})
 	}()
-	if err := gn.Get(&f); err == datastore.ErrNoSuchEntity {
+	if err := gn.Get(&f); err == backend.ErrNoSuchEntity {
 		c.Errorf("no such entity - " + url)
 		s += "NSE"
 		return
 	} else if err != nil {
 		s += "err - " + err.Error()
 		return
+	} else if f.MovedTo != "" {
+		s += "moved to " + f.MovedTo
+		return
 	} else if last {
 		// noop
+	} else if lease := r.FormValue("lease"); lease != "" && lease == strconv.FormatInt(f.NextUpdate.Unix(), 10) {
+		// queued by UpdateFeeds, which held the feed until now
 	} else if time.Now().Before(f.NextUpdate) {
 		c.Errorf("feed %v already updated: %v", url, f.NextUpdate)
 		s += "already updated"
 		return
 	}
 
+	host := feedHost(f.Url)
+	if until, blocked := hostBlocked(c, host); blocked {
+		s += "host blocked until " + until.String()
+		f.NextUpdate = until.Add(time.Duration(rand.Int63n(int64(UpdateJitter))))
+		gn.Put(&f)
+		return
+	}
+	if !acquireHost(c, host) {
+		s += "host busy"
+		f.NextUpdate = time.Now().Add(hostBusyDelay + time.Duration(rand.Int63n(int64(UpdateJitter))))
+		gn.Put(&f)
+		return
+	}
+	defer releaseHost(c, host)
+
 	feedError := func(err error) {
 		s += "feed err - " + err.Error()
+		f.LastError = err.Error()
 		f.Errors++
 		v := f.Errors + 1
 		const max = 24 * 7
@@ -492,11 +647,52 @@ func UpdateFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		c.Warningf("error with %v (%v), bump next update to %v, %v", url, f.Errors, f.NextUpdate, err)
 	}
 
-	if feed, stories, err := fetchFeed(c, f.Url, f.Url); err == nil {
+	if feed, stories, err := fetchFeedIfModified(c, &f); err == errNotModified {
+		s += "not modified"
+		f.Checked = time.Now()
+		f.Errors = 0
+		f.LastError = ""
+		if last {
+			f.LastViewed = time.Now()
+		}
+		scheduleNextUpdate(c, &f)
+		gn.Put(&f)
+	} else if err == errGone {
+		s += "gone"
+		f.Gone = true
+		f.LastError = err.Error()
+		f.Checked = time.Now()
+		f.NextUpdate = time.Now().Add(goneRecheck)
+		gn.Put(&f)
+		c.Warningf("feed gone: %v, next check %v", url, f.NextUpdate)
+	} else if re, ok := err.(*retryError); ok {
+		after := re.After
+		if after.IsZero() && re.Code == http.StatusTooManyRequests {
+			after = time.Now().Add(hostRetryDefault)
+		}
+		if after.IsZero() {
+			feedError(err)
+		} else {
+			if max := time.Now().Add(hostRetryMax); after.After(max) {
+				after = max
+			}
+			s += "feed err - " + err.Error()
+			f.LastError = err.Error()
+			f.Errors++
+			f.NextUpdate = after
+			gn.Put(&f)
+			blockHost(c, host, after)
+			c.Warningf("%v asked us to wait until %v", host, after)
+		}
+	} else if err == nil {
 		if err := updateFeed(c, f.Url, feed, stories, false, false, last); err != nil {
 			feedError(err)
 		} else {
 			s += "success"
+			if feed.RedirectConfirmed() {
+				s += " - moving to " + feed.Redirect
+				migrateFeed(c, f.Url, feed.Redirect)
+			}
 		}
 	} else {
 		feedError(err)
@@ -504,8 +700,390 @@ func UpdateFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	f.Subscribe(c)
 }
 
-func UpdateFeedLast(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
+// Gone feeds are checked this often in case they come back.
+const goneRecheck = time.Hour * 24 * 7
+
+func migrateFeed(c Context, from, to string) {
+	t := backend.NewPOSTTask(routeUrl("migrate-feed"), url.Values{
+		"from": {from},
+		"to":   {to},
+	})
+	if err := c.Queue().Add(t, ""); err != nil {
+		c.Errorf("taskqueue error: %v", err.Error())
+	}
+}
+
+// migrateUser queues the move of one user's data from a moved feed, for
+// subscribers the feed-wide migration did not find.
+func migrateUser(c Context, uid, from, to string) {
+	t := backend.NewPOSTTask(routeUrl("migrate-feed"), url.Values{
+		"from": {from},
+		"to":   {to},
+		"step": {"user"},
+		"u":    {uid},
+	})
+	if err := c.Queue().Add(t, ""); err != nil {
+		c.Errorf("taskqueue error: %v", err.Error())
+	}
+}
+
+// MigrateFeed moves a permanently redirected feed to its new URL. The old
+// feed is marked as moved, its stories are copied under the new feed, and
+// then each subscriber's subscriptions, read stories and stars are
+// rewritten. Subscribers are found by their read records of the old feed;
+// the rest are migrated by ListFeeds when it sees the move.
+func MigrateFeed(c Context, w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-AppEngine-QueueName") == "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	gn := c.Timeout(time.Minute).Store()
+	from := Feed{Url: r.FormValue("from")}
+	to := Feed{Url: r.FormValue("to")}
+	if from.Url == "" || to.Url == "" || from.Url == to.Url {
+		c.Errorf("bad migrate: %v -> %v", from.Url, to.Url)
+		return
+	}
+	next := func(step string, it backend.Iterator) {
+		values := url.Values{
+			"from": {from.Url},
+			"to":   {to.Url},
+			"step": {step},
+		}
+		if it != nil {
+			if cur, err := it.Cursor(); err == nil {
+				values.Set("c", cur.String())
+			} else {
+				c.Errorf("cursor err: %v", err)
+				return
+			}
+		}
+		if err := c.Queue().Add(backend.NewPOSTTask(routeUrl("migrate-feed"), values), ""); err != nil {
+			c.Errorf("taskqueue error: %v", err.Error())
+		}
+	}
+	start := func(q *backend.Query) *backend.Query {
+		if cur, err := backend.DecodeCursor(r.FormValue("c")); err == nil {
+			q = q.Start(cur)
+		}
+		return q
+	}
+
+	switch r.FormValue("step") {
+	case "":
+		if err := gn.RunInTransaction(func(gn *backend.Store) error {
+			if err := gn.Get(&from); err != nil {
+				return err
+			}
+			if from.MovedTo != "" && from.MovedTo != to.Url {
+				return fmt.Errorf("already moved to %v", from.MovedTo)
+			}
+			from.MovedTo = to.Url
+			from.NextUpdate = timeMax
+			_, err := gn.PutMulti([]interface{}{&from, &Log{
+				Parent: gn.Key(&from),
+				Id:     time.Now().UnixNano(),
+				Text:   "MigrateFeed - moved to " + to.Url,
+			}})
+			return err
+		}); err != nil {
+			c.Errorf("migrate %v: %v", from.Url, err)
+			return
+		}
+		if err := gn.Get(&to); err == backend.ErrNoSuchEntity {
+			nf := from
+			nf.Url = to.Url
+			nf.MovedTo = ""
+			nf.Redirect = ""
+			nf.RedirectSince = time.Time{}
+			nf.Subscribed = time.Time{}
+			nf.ETag = ""
+			nf.LastModified = ""
+			nf.NextUpdate = time.Now()
+			if _, err := gn.Put(&nf); err != nil {
+				c.Errorf("put err: %v", err)
+				return
+			}
+		} else if err != nil {
+			c.Errorf("get err: %v", err)
+			return
+		}
+		c.Infof("migrating %v to %v", from.Url, to.Url)
+		next("stories", nil)
+
+	case "stories":
+		fk, tk := gn.Key(&from), gn.Key(&to)
+		q := start(backend.NewQuery(gn.Kind(&Story{})).Ancestor(fk).KeysOnly())
+		it := gn.Run(q)
+		var stories, existing []*Story
+		var contents []*StoryContent
+		done := false
+		for len(stories) < 100 {
+			k, err := it.Next(nil)
+			if err == backend.Done {
+				done = true
+				break
+			} else if err != nil {
+				c.Errorf("next err: %v", err)
+				return
+			}
+			s := &Story{Id: k.StringID(), Parent: fk}
+			stories = append(stories, s)
+			contents = append(contents, &StoryContent{Id: 1, Parent: k})
+			existing = append(existing, &Story{Id: k.StringID(), Parent: tk})
+		}
+		if len(stories) > 0 {
+			if err := gn.GetMulti(stories); err != nil {
+				c.Errorf("get err: %v", err)
+				return
+			}
+			cerr := gn.GetMulti(contents)
+			cmerr, _ := cerr.(backend.MultiError)
+			if cerr != nil && cmerr == nil {
+				c.Errorf("get err: %v", cerr)
+				return
+			}
+			err := gn.GetMulti(existing)
+			if _, ok := err.(backend.MultiError); err != nil && !ok {
+				c.Errorf("get err: %v", err)
+				return
+			}
+			var puts []interface{}
+			var moved []*Story
+			for i, s := range stories {
+				if !backend.NotFound(err, i) {
+					continue
+				}
+				if cmerr != nil && cmerr[i] != nil && cmerr[i] != backend.ErrNoSuchEntity {
+					c.Errorf("get content %v: %v", s.Id, cmerr[i])
+					return
+				}
+				ns := *s
+				ns.Parent = tk
+				ns.ItemID = 0
+				ns.content = contents[i].content()
+				sc := *contents[i]
+				sc.Parent = gn.Key(&ns)
+				puts = append(puts, &ns, &sc)
+				moved = append(moved, &ns)
+			}
+			if len(puts) > 0 {
+				if _, err := gn.PutMulti(puts); err != nil {
+					c.Errorf("put err: %v", err)
+					return
+				}
+			}
+			if err := indexStories(c, to.Url, moved); err != nil {
+				c.Errorf("index err: %v", err)
+			}
+		}
+		if done {
+			next("users", nil)
+		} else {
+			next("stories", it)
+		}
+
+	case "users":
+		q := start(backend.NewQuery(gn.Kind(&UserRead{})).Filter("f =", from.Url))
+		it := gn.Run(q)
+		done := false
+		for i := 0; i < 50; i++ {
+			var ur UserRead
+			_, err := it.Next(&ur)
+			if err == backend.Done {
+				done = true
+				break
+			} else if err != nil {
+				c.Errorf("next err: %v", err)
+				return
+			}
+			if err := migrateUserFeed(c, gn.Key(&User{Id: ur.User}), from.Url, to.Url); err != nil {
+				c.Errorf("migrate user %v: %v", ur.User, err)
+			}
+		}
+		if done {
+			c.Infof("migrated %v to %v", from.Url, to.Url)
+		} else {
+			next("users", it)
+		}
+
+	case "user":
+		if err := gn.Get(&from); err != nil {
+			c.Errorf("get err: %v", err)
+			return
+		}
+		if from.MovedTo != to.Url {
+			c.Errorf("bad migrate: %v not moved to %v", from.Url, to.Url)
+			return
+		}
+		uid := r.FormValue("u")
+		if err := migrateUserFeed(c, gn.Key(&User{Id: uid}), from.Url, to.Url); err != nil {
+			c.Errorf("migrate user %v: %v", uid, err)
+		}
+	}
+}
+
+// migrateUserFeed moves a user's subscription, read stories, stars, tags
+// and notes from one feed URL to another.
+func migrateUserFeed(c Context, uk *backend.Key, from, to string) error {
+	gn := c.Store()
+	if err := migrateUserRead(c, uk); err != nil {
+		return err
+	}
+	ur := &UserRead{Id: userReadID(uk.StringID(), from)}
+	if err := gn.Get(ur); err == nil {
+		if err := markRead(c, uk.StringID(), map[string][]string{to: ur.Stories}); err != nil {
+			return err
+		}
+		if err := gn.Delete(gn.Key(ur)); err != nil {
+			return err
+		}
+	} else if err != backend.ErrNoSuchEntity {
+		return err
+	}
+	var oldFull, newFull map[string]bool
+	if err := gn.RunInTransaction(func(gn *backend.Store) error {
+		oldFull, newFull = nil, nil
+		ud := UserData{Id: "data", Parent: uk}
+		if err := gn.Get(&ud); err == backend.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		changed := false
+		var fs Opml
+		if err := json.Unmarshal(ud.Opml, &fs); err == nil {
+			full := fullTextFeeds(&fs)
+			if rewriteOpmlUrl(&fs, from, to) {
+				b, err := json.Marshal(&fs)
+				if err != nil {
+					return err
+				}
+				ud.Opml = b
+				changed = true
+				oldFull, newFull = full, fullTextFeeds(&fs)
+			}
+		}
+		if !changed {
+			return nil
+		}
+		if _, err := gn.PutMulti([]interface{}{&ud, &Log{
+			Parent: uk,
+			Id:     time.Now().UnixNano(),
+			Text:   fmt.Sprintf("feed moved: %v -> %v", from, to),
+		}, newChange(uk, changeOpml, "")}); err != nil {
+			return err
+		}
+		return updateSearches(gn, uk, &fs)
+	}); err != nil {
+		return err
+	}
+	countFullText(c, oldFull, newFull)
+
+	if err := moveUnderUSF(gn, uk, from, to, gn.Kind(&UserStar{}), &[]*UserStar{}); err != nil {
+		return err
+	}
+	if err := moveUnderUSF(gn, uk, from, to, gn.Kind(&UserTagged{}), &[]*UserTagged{}); err != nil {
+		return err
+	}
+	return moveUnderUSF(gn, uk, from, to, gn.Kind(&UserStarNote{}), &[]*UserStarNote{})
+}
+
+// moveUnderUSF moves the user's entities of kind from under the USF key
+// of one feed to that of another. dst is a pointer to an empty slice of
+// pointers to the kind's structs, which have a Parent field.
+func moveUnderUSF(gn *backend.Store, uk *backend.Key, from, to, kind string, dst interface{}) error {
+	q := backend.NewQuery(kind).Ancestor(backend.NewKey("USF", from, 0, uk))
+	keys, err := gn.GetAll(q, dst)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	parent := reflect.ValueOf(backend.NewKey("USF", to, 0, uk))
+	v := reflect.ValueOf(dst).Elem()
+	for i := 0; i < v.Len(); i++ {
+		v.Index(i).Elem().FieldByName("Parent").Set(parent)
+	}
+	if _, err := gn.PutMulti(v.Interface()); err != nil {
+		return err
+	}
+	return gn.DeleteMulti(keys)
+}
+
+// rewriteOpmlUrl replaces from with to in the subscription list. If the user
+// already subscribes to to, from is dropped instead. It reports whether the
+// list changed.
+func rewriteOpmlUrl(fs *Opml, from, to string) bool {
+	has := false
+	for _, o := range fs.Outline {
+		if o.XmlUrl == to {
+			has = true
+		}
+		for _, so := range o.Outline {
+			if so.XmlUrl == to {
+				has = true
+			}
+		}
+	}
+	changed := false
+	rewrite := func(outlines []*OpmlOutline) []*OpmlOutline {
+		var n []*OpmlOutline
+		for _, o := range outlines {
+			if o.XmlUrl == from {
+				changed = true
+				if has {
+					continue
+				}
+				o.XmlUrl = to
+			}
+			n = append(n, o)
+		}
+		return n
+	}
+	fs.Outline = rewrite(fs.Outline)
+	for _, o := range fs.Outline {
+		if o.XmlUrl == "" {
+			o.Outline = rewrite(o.Outline)
+		}
+	}
+	return changed
+}
+
+// MigrateRead converts the read data of every user from UserData.Read to
+// UserRead records, 50 users per task.
+func MigrateRead(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Timeout(time.Minute).Store()
+	q := backend.NewQuery(gn.Kind(&User{})).KeysOnly()
+	if cur, err := backend.DecodeCursor(r.FormValue("c")); err == nil {
+		q = q.Start(cur)
+	}
+	it := gn.Run(q)
+	for i := 0; i < 50; i++ {
+		k, err := it.Next(nil)
+		if err == backend.Done {
+			c.Infof("migrate read done")
+			return
+		} else if err != nil {
+			c.Errorf("next err: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := migrateUserRead(c, k); err != nil {
+			c.Errorf("migrate read %v: %v", k.StringID(), err)
+		}
+	}
+	cur, err := it.Cursor()
+	if err != nil {
+		c.Errorf("cursor err: %v", err)
+		return
+	}
+	t := backend.NewPOSTTask(routeUrl("migrate-read"), url.Values{"c": {cur.String()}})
+	if err := c.Queue().Add(t, ""); err != nil {
+		c.Errorf("taskqueue error: %v", err.Error())
+	}
+}
+
+func UpdateFeedLast(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
 	url := r.FormValue("feed")
 	c.Debugf("update feed last %s", url)
 	f := Feed{Url: url}
@@ -516,31 +1094,31 @@ func UpdateFeedLast(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	gn.Put(&f)
 }
 
-func DeleteBlobs(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.Timeout(c, time.Minute)
-	q := datastore.NewQuery("__BlobInfo__").KeysOnly()
-	it := q.Run(ctx)
+func DeleteBlobs(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Timeout(time.Minute).Store()
+	q := backend.NewQuery("__BlobInfo__").KeysOnly()
+	it := gn.Run(q)
 	wg := sync.WaitGroup{}
 	something := false
 	for _i := 0; _i < 20; _i++ {
-		var bk []appengine.BlobKey
+		var bk []backend.BlobKey
 		for i := 0; i < 1000; i++ {
 			k, err := it.Next(nil)
-			if err == datastore.Done {
+			if err == backend.Done {
 				break
 			} else if err != nil {
 				c.Errorf("err: %v", err)
 				continue
 			}
-			bk = append(bk, appengine.BlobKey(k.StringID()))
+			bk = append(bk, backend.BlobKey(k.StringID()))
 		}
 		if len(bk) == 0 {
 			break
 		}
-		go func(bk []appengine.BlobKey) {
+		go func(bk []backend.BlobKey) {
 			something = true
 			c.Errorf("deleteing %v blobs", len(bk))
-			err := blobstore.DeleteMulti(ctx, bk)
+			err := c.Blobs().DeleteMulti(bk)
 			if err != nil {
 				c.Errorf("blobstore delete err: %v", err)
 			}
@@ -550,23 +1128,22 @@ func DeleteBlobs(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 	wg.Wait()
 	if something {
-		taskqueue.Add(c, taskqueue.NewPOSTTask("/tasks/delete-blobs", nil), "")
+		c.Queue().Add(backend.NewPOSTTask("/tasks/delete-blobs", nil), "")
 	}
 }
 
-func DeleteOldFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.Timeout(c, time.Minute)
-	gn := goon.FromContext(c)
-	q := datastore.NewQuery(gn.Kind(&Feed{})).Filter("n=", timeMax).KeysOnly()
-	if cur, err := datastore.DecodeCursor(r.FormValue("c")); err == nil {
+func DeleteOldFeeds(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Timeout(time.Minute).Store()
+	q := backend.NewQuery(gn.Kind(&Feed{})).Filter("n=", timeMax).KeysOnly()
+	if cur, err := backend.DecodeCursor(r.FormValue("c")); err == nil {
 		q = q.Start(cur)
 	}
-	it := q.Run(ctx)
+	it := gn.Run(q)
 	done := false
-	var tasks []*taskqueue.Task
+	var tasks []*backend.Task
 	for i := 0; i < 10000 && len(tasks) < 100; i++ {
 		k, err := it.Next(nil)
-		if err == datastore.Done {
+		if err == backend.Done {
 			c.Criticalf("done")
 			done = true
 			break
@@ -576,11 +1153,11 @@ func DeleteOldFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		}
 		values := make(url.Values)
 		values.Add("f", k.StringID())
-		tasks = append(tasks, taskqueue.NewPOSTTask("/tasks/delete-old-feed", values))
+		tasks = append(tasks, backend.NewPOSTTask("/tasks/delete-old-feed", values))
 	}
 	if len(tasks) > 0 {
 		c.Errorf("deleting %v feeds", len(tasks))
-		if _, err := taskqueue.AddMulti(c, tasks, ""); err != nil {
+		if err := c.Queue().AddMulti(tasks, ""); err != nil {
 			c.Errorf("err: %v", err)
 		}
 	}
@@ -588,16 +1165,15 @@ func DeleteOldFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		if cur, err := it.Cursor(); err == nil {
 			values := make(url.Values)
 			values.Add("c", cur.String())
-			taskqueue.Add(c, taskqueue.NewPOSTTask("/tasks/delete-old-feeds", values), "")
+			c.Queue().Add(backend.NewPOSTTask("/tasks/delete-old-feeds", values), "")
 		} else {
 			c.Errorf("err: %v", err)
 		}
 	}
 }
 
-func DeleteOldFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.Timeout(c, time.Minute)
-	g := goon.FromContext(ctx)
+func DeleteOldFeed(c Context, w http.ResponseWriter, r *http.Request) {
+	g := c.Timeout(time.Minute).Store()
 	oldDate := time.Now().Add(-time.Hour * 24 * 90)
 	feed := Feed{Url: r.FormValue("f")}
 	if err := g.Get(&feed); err != nil {
@@ -607,14 +1183,21 @@ func DeleteOldFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	if feed.LastViewed.After(oldDate) {
 		return
 	}
-	q := datastore.NewQuery(g.Kind(&Story{})).Ancestor(g.Key(&feed)).KeysOnly()
-	keys, err := q.GetAll(ctx, nil)
+	q := backend.NewQuery(g.Kind(&Story{})).Ancestor(g.Key(&feed)).KeysOnly()
+	keys, err := g.GetAll(q, nil)
 	if err != nil {
 		c.Criticalf("err: %v", err)
 		return
 	}
-	q = datastore.NewQuery(g.Kind(&StoryContent{})).Ancestor(g.Key(&feed)).KeysOnly()
-	sckeys, err := q.GetAll(ctx, nil)
+	docs := make([]*backend.Document, len(keys))
+	for i, k := range keys {
+		docs[i] = &backend.Document{Feed: feed.Url, Story: k.StringID()}
+	}
+	if err := c.Index(storyIndex).Delete(docs); err != nil {
+		c.Criticalf("index delete err: %v", err)
+	}
+	q = backend.NewQuery(g.Kind(&StoryContent{})).Ancestor(g.Key(&feed)).KeysOnly()
+	sckeys, err := g.GetAll(q, nil)
 	if err != nil {
 		c.Criticalf("err: %v", err)
 		return
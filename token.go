@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mjibson/goread/backend"
+)
+
+// API tokens are the user's id, base64 encoded, and a random secret
+// joined by a period. Only a hash of the secret is stored.
+
+var errBadToken = errors.New("bad token")
+
+// Token scopes. Read tokens can only use handlers that don't change the
+// user's data.
+const (
+	scopeRead = "read"
+	scopeFull = "full"
+)
+
+// tokenUsedPrecision is how stale a token's last used time may get before
+// it is saved again.
+const tokenUsedPrecision = 5 * time.Minute
+
+// allows returns whether ut may be used for scope.
+func (ut *UserToken) allows(scope string) bool {
+	// Tokens from before scopes are full.
+	return ut.Scope == "" || ut.Scope == scopeFull || ut.Scope == scope
+}
+
+// useToken records that ut was used.
+func useToken(c Context, ut *UserToken) {
+	if time.Since(ut.Used) < tokenUsedPrecision {
+		return
+	}
+	ut.Used = time.Now()
+	if _, err := c.Store().Put(ut); err != nil {
+		c.Errorf("token used: %v", err)
+	}
+}
+
+// bearerToken returns the token of an Authorization: Bearer header.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+func tokenHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// newToken creates a token with scope for the user uk with email address
+// email and returns it with its entity, which the caller saves.
+func newToken(uk *backend.Key, email, name, scope string) (string, *UserToken, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := hex.EncodeToString(b)
+	token := base64.RawURLEncoding.EncodeToString([]byte(uk.StringID())) + "." + secret
+	fever := md5.Sum([]byte(email + ":" + token))
+	return token, &UserToken{
+		Parent:   uk,
+		Id:       tokenHash(secret),
+		Name:     name,
+		Scope:    scope,
+		Created:  time.Now(),
+		FeverKey: hex.EncodeToString(fever[:]),
+	}, nil
+}
+
+// tokenUser returns the user and the entity of token.
+func tokenUser(gn *backend.Store, token string) (*User, *UserToken, error) {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return nil, nil, errBadToken
+	}
+	uid, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return nil, nil, errBadToken
+	}
+	u := &User{Id: string(uid)}
+	ut := &UserToken{Parent: gn.Key(u), Id: tokenHash(token[i+1:])}
+	if err := gn.GetMulti([]interface{}{u, ut}); err != nil {
+		if backend.NotFound(err, 0) || backend.NotFound(err, 1) {
+			return nil, nil, errBadToken
+		}
+		return nil, nil, err
+	}
+	return u, ut, nil
+}
+
+// feverUser returns the user and the entity of the token with Fever API
+// key key.
+func feverUser(gn *backend.Store, key string) (*User, *UserToken, error) {
+	if key == "" {
+		return nil, nil, errBadToken
+	}
+	q := backend.NewQuery(gn.Kind(&UserToken{})).
+		Filter("f =", strings.ToLower(key)).
+		KeysOnly().
+		Limit(1)
+	keys, err := gn.GetAll(q, nil)
+	if err != nil {
+		return nil, nil, err
+	} else if len(keys) == 0 {
+		return nil, nil, errBadToken
+	}
+	u := &User{Id: keys[0].Parent().StringID()}
+	ut := &UserToken{Parent: keys[0].Parent(), Id: keys[0].StringID()}
+	if err := gn.GetMulti([]interface{}{u, ut}); err != nil {
+		if backend.NotFound(err, 0) || backend.NotFound(err, 1) {
+			return nil, nil, errBadToken
+		}
+		return nil, nil, err
+	}
+	return u, ut, nil
+}
+
+// userContext is a backend context whose user was signed in by goread
+// instead of the backend, such as with an API token.
+type userContext struct {
+	backend.Context
+	user *backend.User
+	// readOnly is set for tokens that may not change the user's data.
+	readOnly bool
+}
+
+func (c userContext) User() *backend.User {
+	return c.user
+}
+
+func (c userContext) Timeout(d time.Duration) backend.Context {
+	return userContext{c.Context.Timeout(d), c.user, c.readOnly}
+}
+
+// asUser returns c with u, signed in with ut, as its user.
+func asUser(c Context, u *User, ut *UserToken) Context {
+	c.Context = userContext{c.Context, &backend.User{ID: u.Id, Email: u.Email}, !ut.allows(scopeFull)}
+	return c
+}
+
+// readOnly reports whether c's user signed in with a token that may not
+// change their data, so handlers shared with full access skip their side
+// effects.
+func readOnly(c Context) bool {
+	uc, ok := c.Context.(userContext)
+	return ok && uc.readOnly
+}
+
+// CreateToken creates an API token named by the name parameter with the
+// scope parameter as its scope. The token is only shown here.
+func CreateToken(c Context, w http.ResponseWriter, r *http.Request) {
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = scopeFull
+	} else if scope != scopeRead && scope != scopeFull {
+		http.Error(w, "bad scope", http.StatusBadRequest)
+		return
+	}
+	cu := c.User()
+	gn := c.Store()
+	token, ut, err := newToken(gn.Key(&User{Id: cu.ID}), cu.Email, r.FormValue("name"), scope)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if _, err := gn.Put(ut); err != nil {
+		serveError(w, err)
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Token string
+		*UserToken
+	}{
+		Token:     token,
+		UserToken: ut,
+	})
+	w.Write(b)
+}
+
+func ListTokens(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	q := backend.NewQuery(gn.Kind(&UserToken{})).Ancestor(gn.Key(&User{Id: c.User().ID}))
+	tokens := []*UserToken{}
+	if _, err := gn.GetAll(q, &tokens); err != nil {
+		serveError(w, err)
+		return
+	}
+	b, _ := json.Marshal(tokens)
+	w.Write(b)
+}
+
+// RevokeToken deletes the token with the id parameter as its id.
+func RevokeToken(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	ut := &UserToken{Parent: gn.Key(&User{Id: c.User().ID}), Id: r.FormValue("id")}
+	if ut.Id == "" {
+		http.Error(w, "no id", http.StatusBadRequest)
+		return
+	}
+	if err := gn.Delete(gn.Key(ut)); err != nil {
+		serveError(w, err)
+		return
+	}
+}
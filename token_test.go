@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2013 Matt Jibson <matt.jibson@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package goapp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjibson/goread/_third_party/github.com/boltdb/bolt"
+	"github.com/mjibson/goread/backend/local"
+)
+
+// dumpDB returns every key and value in the database at path.
+func dumpDB(t *testing.T, path string) map[string]string {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := make(map[string]string)
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				m[string(name)+"/"+string(k)] = string(v)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestReadOnlyTokenWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goread.db")
+	b, err := local.Open(local.Config{Database: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Give ListFeeds everything it cleans up: an old unread date, a stale
+	// read record and a changed feed link. It lists the saved search too.
+	now := time.Now()
+	gn := b.NewContext(nil).Store()
+	u := &User{Id: "test", Email: "test@example.com", Read: now.Add(-oldDuration * 2)}
+	uk := gn.Key(u)
+	const feed = "http://example.com/feed"
+	opml, _ := json.Marshal(&Opml{Outline: []*OpmlOutline{
+		{Title: "Example", XmlUrl: feed, HtmlUrl: "http://example.com/old"},
+	}})
+	_, ut, err := newToken(uk, u.Email, "reader", scopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut.Used = now
+	fk := gn.Key(&Feed{Url: feed})
+	if _, err := gn.PutMulti([]interface{}{
+		u,
+		ut,
+		&UserData{Id: "data", Parent: uk, Opml: opml},
+		&Feed{Url: feed, Title: "Example", Link: "http://example.com/", Date: now, LastViewed: now, NextUpdate: now.Add(time.Hour)},
+		&Story{Id: "1", Parent: fk, Title: "One", Created: now.Add(-time.Hour)},
+		&UserRead{Id: userReadID(u.Id, feed), User: u.Id, Feed: feed, Stories: []string{"gone"}},
+		&UserSearch{Id: 1, Parent: uk, Title: "One", Query: "one", Created: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	before := dumpDB(t, path)
+
+	if b, err = local.Open(local.Config{Database: path}); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(f func(Context, http.ResponseWriter, *http.Request), target string) []byte {
+		r := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		f(asUser(Context{Context: b.NewContext(r)}, u, ut), w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: %v %s", target, w.Code, w.Body)
+		}
+		return w.Body.Bytes()
+	}
+	serve(ListFeeds, "/user/list-feeds")
+	var stream struct {
+		Items []struct {
+			Id string `json:"id"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(serve(GReaderStreamContents, greaderStreamContents), &stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.Items) != 1 {
+		t.Fatalf("got %v items, expected 1", len(stream.Items))
+	}
+	// The item id wasn't saved, but can still be looked up.
+	var items struct {
+		Items []struct {
+			Title string `json:"title"`
+		} `json:"items"`
+	}
+	body := serve(GReaderItemContents, "/reader/api/0/stream/items/contents?i="+url.QueryEscape(stream.Items[0].Id))
+	if err := json.Unmarshal(body, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 1 || items.Items[0].Title != "One" {
+		t.Errorf("got items %s", body)
+	}
+	b.Close()
+
+	after := dumpDB(t, path)
+	if !reflect.DeepEqual(before, after) {
+		for k, v := range after {
+			if before[k] != v {
+				t.Errorf("changed: %q", k)
+			}
+		}
+		for k := range before {
+			if _, ok := after[k]; !ok {
+				t.Errorf("deleted: %q", k)
+			}
+		}
+	}
+}
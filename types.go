@@ -25,12 +25,7 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
-
-	"appengine"
-	"appengine/datastore"
-	"appengine/taskqueue"
-	"appengine/user"
+	"github.com/mjibson/goread/backend"
 )
 
 type User struct {
@@ -57,20 +52,22 @@ func (u *User) String() string {
 
 // parent: User, key: "data"
 type UserData struct {
-	_kind  string         `goon:"kind,UD"`
-	Id     string         `datastore:"-" goon:"id"`
-	Parent *datastore.Key `datastore:"-" goon:"parent"`
-	Opml   []byte         `datastore:"o,noindex"`
-	Read   []byte         `datastore:"r,noindex"`
+	_kind  string       `goon:"kind,UD"`
+	Id     string       `datastore:"-" goon:"id"`
+	Parent *backend.Key `datastore:"-" goon:"parent"`
+	Opml   []byte       `datastore:"o,noindex"`
+	// Read is a gob encoded Read, replaced by UserRead records. It is
+	// converted by migrateUserRead.
+	Read []byte `datastore:"r,noindex"`
 }
 
 // parent: User, key: time.Now().UnixNano()
 type UserOpml struct {
-	_kind      string         `goon:"kind,UO"`
-	Id         int64          `datastore:"-" goon:"id"`
-	Parent     *datastore.Key `datastore:"-" goon:"parent"`
-	Opml       []byte         `datastore:"o,noindex"`
-	Compressed []byte         `datastore:"z,noindex"`
+	_kind      string       `goon:"kind,UO"`
+	Id         int64        `datastore:"-" goon:"id"`
+	Parent     *backend.Key `datastore:"-" goon:"parent"`
+	Opml       []byte       `datastore:"o,noindex"`
+	Compressed []byte       `datastore:"z,noindex"`
 }
 
 func (uo *UserOpml) opml() []byte {
@@ -87,31 +84,90 @@ func (uo *UserOpml) opml() []byte {
 }
 
 type UserStarFeed struct {
-	_kind  string         `goon:"kind,USF"`
-	Id     string         `datastore:"-" goon:"id"`
-	Parent *datastore.Key `datastore:"-" goon:"parent"`
+	_kind  string       `goon:"kind,USF"`
+	Id     string       `datastore:"-" goon:"id"`
+	Parent *backend.Key `datastore:"-" goon:"parent"`
 }
 
 // parent: UserStarFeed, key: Story.Key.Encode()
 type UserStar struct {
-	_kind   string         `goon:"kind,US"`
-	Id      string         `datastore:"-" goon:"id"`
-	Parent  *datastore.Key `datastore:"-" goon:"parent"`
-	Created time.Time      `datastore:"c"`
+	_kind   string       `goon:"kind,US"`
+	Id      string       `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent"`
+	Created time.Time    `datastore:"c"`
+}
+
+// parent: UserStarFeed, key: Story.Id
+//
+// UserStarNote is a user's note on, and highlights of, a starred story.
+// Words are the words of both for search.
+type UserStarNote struct {
+	_kind      string       `goon:"kind,USN"`
+	Id         string       `datastore:"-" goon:"id"`
+	Parent     *backend.Key `datastore:"-" goon:"parent"`
+	Note       string       `datastore:"n,noindex"`
+	Highlights []byte       `datastore:"h,noindex"`
+	Words      []string     `datastore:"w"`
+	Updated    time.Time    `datastore:"u,noindex"`
+}
+
+// parent: User, key: random secret
+//
+// UserShare publishes the user's stars, or the stories with Tag, as an
+// Atom feed.
+type UserShare struct {
+	_kind   string       `goon:"kind,USH"`
+	Id      string       `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent"`
+	Tag     string       `datastore:"t,noindex"`
+	Notes   bool         `datastore:"n,noindex"`
+	Created time.Time    `datastore:"c,noindex"`
+}
+
+// key: UserShare.Id
+//
+// ShareRef maps the id of a shared feed to its user, so share URLs don't
+// carry the user's id.
+type ShareRef struct {
+	_kind string `goon:"kind,SHR"`
+	Id    string `datastore:"-" goon:"id"`
+	User  string `datastore:"u,noindex"`
+}
+
+// parent: User, key: tag name
+//
+// UserTag is a tag the user files stories under.
+type UserTag struct {
+	_kind   string       `goon:"kind,UTG"`
+	Id      string       `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent"`
+	Created time.Time    `datastore:"c,noindex"`
+}
+
+// parent: UserStarFeed, key: Story.Id
+//
+// UserTagged holds the tags of one of the user's stories. Created is when
+// a tag was last added.
+type UserTagged struct {
+	_kind   string       `goon:"kind,UTS"`
+	Id      string       `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent"`
+	Tags    []string     `datastore:"t"`
+	Created time.Time    `datastore:"c"`
 }
 
-func starKey(c appengine.Context, feed, story string) *UserStar {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func starKey(c backend.Context, feed, story string) *UserStar {
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	uk := gn.Key(&u)
 	return &UserStar{
-		Parent: datastore.NewKey(c, "USF", feed, 0, uk),
+		Parent: backend.NewKey("USF", feed, 0, uk),
 		Id:     story,
 	}
 }
 
-func starID(key *datastore.Key) string {
+func starID(key *backend.Key) string {
 	return fmt.Sprintf("%s|%s", key.Parent().StringID(), key.StringID())
 }
 
@@ -121,6 +177,126 @@ type readStory struct {
 
 type Read map[readStory]bool
 
+// key: user id + "|" + feed url
+//
+// UserRead holds the ids of a feed's stories that a user has read since
+// User.Read. Stories created before User.Read are read. Records are root
+// entities so that marking stories read in different feeds does not
+// contend on the user's entity group.
+type UserRead struct {
+	_kind   string   `goon:"kind,UR"`
+	Id      string   `datastore:"-" goon:"id"`
+	User    string   `datastore:"u"`
+	Feed    string   `datastore:"f"`
+	Stories []string `datastore:"s,noindex"`
+}
+
+// key: sessionKeyID or imageKeyID
+//
+// SessionKey is a random key that signs session cookies when SESSION_KEY
+// is not set, or image proxy URLs when IMAGE_PROXY_KEY is not.
+type SessionKey struct {
+	_kind string `goon:"kind,SK"`
+	Id    int64  `datastore:"-" goon:"id"`
+	Key   []byte `datastore:"k,noindex"`
+}
+
+// parent: User, key: hex encoded SHA-256 of the token's secret
+type UserToken struct {
+	_kind   string       `goon:"kind,UT"`
+	Id      string       `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent" json:"-"`
+	Name    string       `datastore:"n,noindex"`
+	Scope   string       `datastore:"s,noindex"`
+	Created time.Time    `datastore:"c,noindex"`
+	Used    time.Time    `datastore:"u,noindex"`
+
+	// Fever clients sign in with the MD5 of "email:token".
+	FeverKey string `datastore:"f" json:"-"`
+}
+
+// parent: User, key: allocated
+//
+// UserRule acts on the user's stories that match it. A rule with a Feed
+// applies to that feed, one with a Folder to the feeds in that folder and
+// one with neither to all feeds.
+type UserRule struct {
+	_kind   string       `goon:"kind,RU"`
+	Id      int64        `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent" json:"-"`
+	Feed    string       `datastore:"f,noindex" json:",omitempty"`
+	Folder  string       `datastore:"d,noindex" json:",omitempty"`
+	Field   string       `datastore:"i,noindex"`
+	Regexp  bool         `datastore:"r,noindex" json:",omitempty"`
+	Pattern string       `datastore:"p,noindex"`
+	Action  string       `datastore:"a,noindex"`
+	Created time.Time    `datastore:"c,noindex"`
+}
+
+// parent: User, key: allocated
+//
+// UserSearch is a saved search shown as a virtual feed. Feeds are the
+// feeds it searches, those in Folder or all of the user's subscriptions.
+// ListFeeds keeps them current so that updateFeed can find the searches
+// of a feed.
+type UserSearch struct {
+	_kind   string       `goon:"kind,SS"`
+	Id      int64        `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent" json:"-"`
+	Title   string       `datastore:"t,noindex"`
+	Query   string       `datastore:"q,noindex"`
+	Folder  string       `datastore:"d,noindex" json:",omitempty"`
+	Feeds   []string     `datastore:"f" json:"-"`
+	Created time.Time    `datastore:"c,noindex"`
+}
+
+// parent: UserSearch, key: feed url + "|" + story id
+//
+// UserSearchMatch is a story matched by a saved search. Created is the
+// story's.
+type UserSearchMatch struct {
+	_kind   string       `goon:"kind,SM"`
+	Id      string       `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent"`
+	Feed    string       `datastore:"f,noindex"`
+	Story   string       `datastore:"s,noindex"`
+	Created time.Time    `datastore:"c"`
+}
+
+// key: itemID(story)
+//
+// StoryRef maps the integer item ids of the Google Reader and Fever APIs
+// back to stories. A story whose id is taken by another story gets the
+// next free one.
+type StoryRef struct {
+	_kind string `goon:"kind,SR"`
+	Id    int64  `datastore:"-" goon:"id"`
+	Feed  string `datastore:"f,noindex"`
+	Story string `datastore:"s,noindex"`
+}
+
+// parent: User, key: time.Now().UnixNano()
+//
+// UserChange records a change to a user's data for /user/sync.
+type UserChange struct {
+	_kind   string       `goon:"kind,UC"`
+	Id      int64        `datastore:"-" goon:"id"`
+	Parent  *backend.Key `datastore:"-" goon:"parent"`
+	Kind    string       `datastore:"k,noindex"`
+	Feed    string       `datastore:"f,noindex"`
+	Stories []string     `datastore:"s,noindex"`
+}
+
+// UserChange kinds.
+const (
+	changeRead    = "read"
+	changeUnread  = "unread"
+	changeStar    = "star"
+	changeUnstar  = "unstar"
+	changeOpml    = "opml"
+	changeOptions = "options"
+)
+
 type Feed struct {
 	_kind      string        `goon:"kind,F"`
 	Url        string        `datastore:"-" goon:"id"`
@@ -138,20 +314,51 @@ type Feed struct {
 	Average    time.Duration `datastore:"a,noindex" json:"-"`
 	LastViewed time.Time     `datastore:"v" json:"-"`
 	NoAds      bool          `datastore:"o,noindex" json:"-"`
+
+	// HTTP validators from the last successful fetch, sent back as
+	// If-None-Match and If-Modified-Since.
+	ETag         string `datastore:"et,noindex" json:"-"`
+	LastModified string `datastore:"lm,noindex" json:"-"`
+
+	// Redirect is the target of a permanent redirect seen when fetching,
+	// first seen at RedirectSince. MovedTo is set once the feed has been
+	// migrated there. Gone is set when the server responds 410.
+	Redirect      string    `datastore:"rd,noindex" json:"-"`
+	RedirectSince time.Time `datastore:"rs,noindex" json:"-"`
+	MovedTo       string    `datastore:"mt,noindex" json:"-"`
+	Gone          bool      `datastore:"go,noindex" json:",omitempty"`
+
+	// LastError is the reason the last update failed.
+	LastError string `datastore:"le,noindex" json:",omitempty"`
+
+	// FullText is the number of subscribers who want the full text of
+	// the feed's stories. While it is positive, new stories have their
+	// article extracted from their links.
+	FullText int `datastore:"ft,noindex" json:"-"`
+
+	// Policy is the name of the sanitizer policy the feed's stories are
+	// stored with. The default is used if it is empty.
+	Policy string `datastore:"sp,noindex" json:"-"`
+
+	// Scheduling hints from the publisher: the minimum time between
+	// updates, and GMT hours and weekdays during which not to update.
+	Interval  time.Duration `datastore:"ti,noindex" json:"-"`
+	SkipHours []int         `datastore:"sh,noindex" json:"-"`
+	SkipDays  []int         `datastore:"sd,noindex" json:"-"`
 }
 
-func (f *Feed) Subscribe(c appengine.Context) {
+func (f *Feed) Subscribe(c backend.Context) {
 	if !f.IsSubscribed() {
-		gn := goon.FromContext(c)
+		gn := c.Store()
 		gn.Put(&Log{
 			Parent: gn.Key(&f),
 			Id:     time.Now().UnixNano(),
 			Text:   fmt.Sprintf("Subscribe %v", f.Subscribed.String()),
 		})
-		t := taskqueue.NewPOSTTask(routeUrl("subscribe-feed"), url.Values{
+		t := backend.NewPOSTTask(routeUrl("subscribe-feed"), url.Values{
 			"feed": {f.Url},
 		})
-		if _, err := taskqueue.Add(c, t, "update-manual"); err != nil {
+		if err := c.Queue().Add(t, "update-manual"); err != nil {
 			c.Errorf("taskqueue error: %v", err.Error())
 		} else {
 			c.Warningf("subscribe feed: %v", f.Url)
@@ -160,7 +367,7 @@ func (f *Feed) Subscribe(c appengine.Context) {
 }
 
 func (f *Feed) IsSubscribed() bool {
-	return !ENABLE_PUBSUBHUBBUB || f.Hub == "" || time.Now().Before(f.Subscribed)
+	return !ENABLE_PUBSUBHUBBUB || isDevServer || f.Hub == "" || time.Now().Before(f.Subscribed)
 }
 
 func (f *Feed) PubSubURL() string {
@@ -178,33 +385,52 @@ func (f *Feed) NotViewed() bool {
 	return time.Since(f.LastViewed) > notViewedDisabled
 }
 
+// A feed is migrated once it has permanently redirected for this long.
+const redirectConfirm = time.Hour * 24 * 7
+
+func (f *Feed) RedirectConfirmed() bool {
+	return f.Redirect != "" && time.Since(f.RedirectSince) > redirectConfirm
+}
+
 // parent: Feed, key: story ID
 type Story struct {
-	_kind        string         `goon:"kind,S"`
-	Id           string         `datastore:"-" goon:"id"`
-	Parent       *datastore.Key `datastore:"-" goon:"parent" json:"-"`
-	Title        string         `datastore:"t,noindex"`
-	Link         string         `datastore:"l,noindex"`
-	Created      time.Time      `datastore:"c"`
-	Published    time.Time      `datastore:"p,noindex" json:"-"`
-	Updated      time.Time      `datastore:"u,noindex" json:"-"`
-	Date         int64          `datastore:"e,noindex"`
-	Author       string         `datastore:"a,noindex" json:",omitempty"`
-	Summary      string         `datastore:"s,noindex"`
-	MediaContent string         `datastore:"m,noindex" json:",omitempty"`
+	_kind        string       `goon:"kind,S"`
+	Id           string       `datastore:"-" goon:"id"`
+	Parent       *backend.Key `datastore:"-" goon:"parent" json:"-"`
+	Title        string       `datastore:"t,noindex"`
+	Link         string       `datastore:"l,noindex"`
+	Created      time.Time    `datastore:"c"`
+	Published    time.Time    `datastore:"p,noindex" json:"-"`
+	Updated      time.Time    `datastore:"u,noindex" json:"-"`
+	Date         int64        `datastore:"e,noindex"`
+	Author       string       `datastore:"a,noindex" json:",omitempty"`
+	Summary      string       `datastore:"s,noindex"`
+	MediaContent string       `datastore:"m,noindex" json:",omitempty"`
+	// MediaType is the MIME type of MediaContent, if known.
+	MediaType string `datastore:"mt,noindex" json:",omitempty"`
+	// Attachments are the URLs of any further JSON Feed attachments, with
+	// their MIME types at the same index of AttachmentTypes.
+	Attachments     []string `datastore:"ma,noindex" json:",omitempty"`
+	AttachmentTypes []string `datastore:"mat,noindex" json:",omitempty"`
+	// ItemID is the story's item id once the APIs have assigned it.
+	ItemID int64 `datastore:"i,noindex" json:"-"`
+
+	// Highlight is set on stories matched by a highlight rule.
+	Highlight bool `datastore:"-" json:",omitempty"`
 
 	content string
 }
 
 const IDX_COL = "c"
 
-// parent: Story, key: 1
+// parent: Story, key: 1, or fullContentID for the article extracted from
+// the story's link
 type StoryContent struct {
-	_kind      string         `goon:"kind,SC"`
-	Id         int64          `datastore:"-" goon:"id"`
-	Parent     *datastore.Key `datastore:"-" goon:"parent"`
-	Content    string         `datastore:"c,noindex"`
-	Compressed []byte         `datastore:"z,noindex"`
+	_kind      string       `goon:"kind,SC"`
+	Id         int64        `datastore:"-" goon:"id"`
+	Parent     *backend.Key `datastore:"-" goon:"parent"`
+	Content    string       `datastore:"c,noindex"`
+	Compressed []byte       `datastore:"z,noindex"`
 }
 
 func (sc *StoryContent) content() string {
@@ -220,6 +446,20 @@ func (sc *StoryContent) content() string {
 	return sc.Content
 }
 
+// setContent stores s compressed, or as is if it can't be compressed.
+func (sc *StoryContent) setContent(s string) {
+	sc.Content, sc.Compressed = "", nil
+	buf := &bytes.Buffer{}
+	if gz, err := gzip.NewWriterLevel(buf, gzip.BestCompression); err == nil {
+		gz.Write([]byte(s))
+		gz.Close()
+		sc.Compressed = buf.Bytes()
+	}
+	if len(sc.Compressed) == 0 {
+		sc.Content = s
+	}
+}
+
 type OpmlOutline struct {
 	Outline []*OpmlOutline `xml:"outline" json:",omitempty"`
 	Title   string         `xml:"title,attr,omitempty" json:",omitempty"`
@@ -227,6 +467,13 @@ type OpmlOutline struct {
 	Type    string         `xml:"type,attr,omitempty" json:",omitempty"`
 	Text    string         `xml:"text,attr,omitempty" json:",omitempty"`
 	HtmlUrl string         `xml:"htmlUrl,attr,omitempty" json:",omitempty"`
+
+	// FullText is set if the user wants the feed's stories' full text.
+	FullText bool `xml:"-" json:",omitempty"`
+
+	// Policy is the name of the sanitizer policy the user wants the
+	// feed's stories shown with, if it is not the feed's.
+	Policy string `xml:"-" json:",omitempty"`
 }
 
 type Opml struct {
@@ -236,11 +483,18 @@ type Opml struct {
 	Outline []*OpmlOutline `xml:"body>outline"`
 }
 
+// key: hex encoded SHA-1 of Url
+//
+// Image is a copy of the image at Url served by the image proxy.
 type Image struct {
-	_kind string            `goon:"kind,I"`
-	Id    string            `datastore:"-" goon:"id"`
-	Blob  appengine.BlobKey `datastore:"b,noindex"`
-	Url   string            `datastore:"u,noindex"`
+	_kind string          `goon:"kind,I"`
+	Id    string          `datastore:"-" goon:"id"`
+	Blob  backend.BlobKey `datastore:"b,noindex"`
+	Url   string          `datastore:"u,noindex"`
+
+	Type    string    `datastore:"t,noindex"`
+	Data    []byte    `datastore:"d,noindex"`
+	Fetched time.Time `datastore:"f"`
 }
 
 type Stories []*Story
@@ -250,8 +504,8 @@ func (s Stories) Less(i, j int) bool { return s[i].Created.Before(s[j].Created)
 func (s Stories) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
 type Log struct {
-	_kind  string         `goon:"kind,L"`
-	Id     int64          `datastore:"-" goon:"id"`
-	Parent *datastore.Key `datastore:"-" goon:"parent"`
-	Text   string         `datastore:"t,noindex"`
+	_kind  string       `goon:"kind,L"`
+	Id     int64        `datastore:"-" goon:"id"`
+	Parent *backend.Key `datastore:"-" goon:"parent"`
+	Text   string       `datastore:"t,noindex"`
 }
@@ -20,10 +20,10 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
-	"encoding/gob"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -35,73 +35,161 @@ import (
 
 	"github.com/mjibson/goread/_third_party/code.google.com/p/go-charset/charset"
 	_ "github.com/mjibson/goread/_third_party/code.google.com/p/go-charset/data"
-	mpg "github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler_gae"
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
+	"github.com/mjibson/goread/_third_party/github.com/gorilla/mux"
+	"github.com/mjibson/goread/auth"
+	"github.com/mjibson/goread/backend"
 	"github.com/mjibson/goread/sanitizer"
-
-	"appengine"
-	"appengine/blobstore"
-	"appengine/datastore"
-	"appengine/taskqueue"
-	"appengine/user"
 )
 
-func LoginGoogle(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	if cu := user.Current(c); cu != nil {
-		gn := goon.FromContext(c)
-		u := &User{Id: cu.ID}
-		if err := gn.Get(u); err == datastore.ErrNoSuchEntity {
-			u.Email = cu.Email
-			u.Read = time.Now().Add(-time.Hour * 24)
-			gn.Put(u)
+var loginTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>go read</title>
+	<link rel="stylesheet" href="/static/css/bootstrap.min.css">
+</head>
+<body>
+	<div class="container">
+		<div class="col-md-offset-4 col-md-4">
+			<h1>Log in</h1>
+			{{range .}}
+			<p><a class="btn btn-primary btn-lg" href="{{.URL}}">log in with {{.Name}}</a></p>
+			{{end}}
+		</div>
+	</div>
+</body>
+</html>
+`))
+
+// loginDestCookie holds where to go after signing in.
+const loginDestCookie = "goread-login-dest"
+
+// Login lets the user pick a sign in provider, or starts signing in if
+// there is only one. The dest parameter is where to go afterward.
+func Login(c Context, w http.ResponseWriter, r *http.Request) {
+	if dest := r.FormValue("dest"); strings.HasPrefix(dest, "/") && !strings.HasPrefix(dest, "//") {
+		http.SetCookie(w, &http.Cookie{
+			Name:     loginDestCookie,
+			Value:    url.QueryEscape(dest),
+			Path:     "/",
+			MaxAge:   int((10 * time.Minute).Seconds()),
+			HttpOnly: true,
+		})
+	}
+	if len(AUTH_PROVIDERS) == 1 {
+		http.Redirect(w, r, routeUrl("login-provider", "provider", AUTH_PROVIDERS[0].Name()), http.StatusFound)
+		return
+	}
+	type link struct {
+		Name string
+		URL  string
+	}
+	var links []link
+	for _, p := range AUTH_PROVIDERS {
+		links = append(links, link{p.Name(), routeUrl("login-provider", "provider", p.Name())})
+	}
+	if err := loginTemplate.Execute(w, links); err != nil {
+		serveError(w, err)
+	}
+}
+
+func authProvider(name string) auth.Provider {
+	for _, p := range AUTH_PROVIDERS {
+		if p.Name() == name {
+			return p
 		}
 	}
+	return nil
+}
 
-	http.Redirect(w, r, routeUrl("main"), http.StatusFound)
+// LoginProvider starts signing in with a provider.
+func LoginProvider(c Context, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	p := authProvider(name)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// providers see the backend's user, not the session's
+	p.Login(be.NewContext(r), w, r, routeUrl("login-callback", "provider", name))
 }
 
-func LoginRedirect(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	url, err := user.LoginURL(c, r.FormValue("redirect"))
-	if err != nil {
+// LoginCallback finishes signing in with a provider, creating the user if
+// they are new, and starts their session.
+func LoginCallback(c Context, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	p := authProvider(name)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	cu, err := p.Callback(be.NewContext(r), w, r)
+	if err == auth.ErrBadLogin {
+		http.Error(w, "bad login", http.StatusUnauthorized)
+		return
+	} else if err != nil {
 		serveError(w, err)
 		return
 	}
-	http.Redirect(w, r, url, http.StatusFound)
+	gn := c.Store()
+	u := &User{Id: cu.ID}
+	if err := gn.Get(u); err == backend.ErrNoSuchEntity {
+		u.Email = cu.Email
+		u.Read = time.Now().Add(-time.Hour * 24)
+		gn.Put(u)
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+	sessions(c).Set(w, r, cu, name)
+	dest := routeUrl("main")
+	if ck, err := r.Cookie(loginDestCookie); err == nil {
+		if d, err := url.QueryUnescape(ck.Value); err == nil {
+			dest = d
+		}
+		http.SetCookie(w, &http.Cookie{Name: loginDestCookie, Path: "/", MaxAge: -1})
+	}
+	http.Redirect(w, r, dest, http.StatusFound)
 }
 
-func Logout(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	if appengine.IsDevAppServer() {
-		if u, err := user.LogoutURL(c, routeUrl("main")); err == nil {
-			http.Redirect(w, r, u, http.StatusFound)
-			return
-		}
-	} else {
-		http.SetCookie(w, &http.Cookie{
-			Name:    "ACSID",
-			Value:   "",
-			Expires: time.Time{},
-		})
-		http.SetCookie(w, &http.Cookie{
-			Name:    "SACSID",
-			Value:   "",
-			Expires: time.Time{},
-		})
+func LoginRedirect(c Context, w http.ResponseWriter, r *http.Request) {
+	v := url.Values{"dest": {r.FormValue("redirect")}}
+	http.Redirect(w, r, routeUrl("login")+"?"+v.Encode(), http.StatusFound)
+}
+
+// requireLogin sends page loads to sign in, and fails other requests.
+func requireLogin(c Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	v := url.Values{"dest": {r.URL.RequestURI()}}
+	http.Redirect(w, r, routeUrl("login")+"?"+v.Encode(), http.StatusFound)
+}
+
+// Logout ends the session and signs out of the provider that started it.
+func Logout(c Context, w http.ResponseWriter, r *http.Request) {
+	s := sessions(c)
+	_, name := s.Get(r)
+	s.Clear(w, r)
+	if p := authProvider(name); p != nil {
+		p.Logout(be.NewContext(r), w, r, routeUrl("main"))
+		return
 	}
 	http.Redirect(w, r, routeUrl("main"), http.StatusFound)
 }
 
-func UploadUrl(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	uploadURL, err := blobstore.UploadURL(c, routeUrl("import-opml"), nil)
+func UploadUrl(c Context, w http.ResponseWriter, r *http.Request) {
+	uploadURL, err := c.Blobs().UploadURL(routeUrl("import-opml"))
 	if err != nil {
 		serveError(w, err)
 		return
 	}
-	w.Write([]byte(uploadURL.String()))
+	w.Write([]byte(uploadURL))
 }
 
-func ImportOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func ImportOpml(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	if err := gn.Get(&u); err != nil {
 		serveError(w, err)
@@ -109,7 +197,7 @@ func ImportOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 	backupOPML(c)
 
-	blobs, _, err := blobstore.ParseUpload(r)
+	blobs, _, err := c.Blobs().ParseUpload(r)
 	if err != nil {
 		serveError(w, err)
 		return
@@ -120,9 +208,14 @@ func ImportOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	file := fs[0]
-	fr := blobstore.NewReader(c, file.BlobKey)
 	del := func() {
-		blobstore.Delete(c, file.BlobKey)
+		c.Blobs().Delete(file.BlobKey)
+	}
+	fr, err := c.Blobs().NewReader(file.BlobKey)
+	if err != nil {
+		del()
+		serveError(w, err)
+		return
 	}
 
 	fdata, err := ioutil.ReadAll(fr)
@@ -159,57 +252,71 @@ func ImportOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task := taskqueue.NewPOSTTask(routeUrl("import-opml-task"), url.Values{
+	task := backend.NewPOSTTask(routeUrl("import-opml-task"), url.Values{
 		"key":  {string(file.BlobKey)},
 		"user": {cu.ID},
 	})
-	taskqueue.Add(c, task, "import-reader")
+	c.Queue().Add(task, "import-reader")
 }
 
-func AddSubscription(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	backupOPML(c)
-	cu := user.Current(c)
-	url := r.FormValue("url")
+func AddSubscription(c Context, w http.ResponseWriter, r *http.Request) {
 	o := &OpmlOutline{
 		Outline: []*OpmlOutline{
-			{XmlUrl: url},
+			{XmlUrl: r.FormValue("url")},
 		},
 	}
-	if err := addFeed(c, cu.ID, o); err != nil {
-		c.Errorf("add sub error (%s): %s", url, err.Error())
+	if err := addSubscription(c, o); err != nil {
 		serveError(w, err)
 		return
 	}
+	if r.Method == "GET" {
+		http.Redirect(w, r, routeUrl("main"), http.StatusFound)
+	}
+}
 
-	gn := goon.FromContext(c)
+// addSubscription subscribes the user to the feed of o, an outline holding
+// one feed and titled by the folder to put it in, if any.
+func addSubscription(c Context, o *OpmlOutline) error {
+	backupOPML(c)
+	cu := c.User()
+	url := o.Outline[0].XmlUrl
+	if err := addFeed(c, cu.ID, o); err != nil {
+		c.Errorf("add sub error (%s): %s", url, err.Error())
+		return err
+	}
+
+	gn := c.Store()
 	ud := UserData{Id: "data", Parent: gn.Key(&User{Id: cu.ID})}
 	gn.Get(&ud)
 	if err := mergeUserOpml(c, &ud, o); err != nil {
 		c.Errorf("add sub error opml (%v): %v", url, err)
-		serveError(w, err)
-		return
+		return err
 	}
 	gn.PutMulti([]interface{}{&ud, &Log{
 		Parent: ud.Parent,
 		Id:     time.Now().UnixNano(),
 		Text:   fmt.Sprintf("add sub: %v", url),
-	}})
-	if r.Method == "GET" {
-		http.Redirect(w, r, routeUrl("main"), http.StatusFound)
+	}, newChange(ud.Parent, changeOpml, "")})
+	var uf Opml
+	json.Unmarshal(ud.Opml, &uf)
+	if err := updateSearches(gn, ud.Parent, &uf); err != nil {
+		c.Errorf("add sub searches (%v): %v", url, err)
 	}
 	backupOPML(c)
+	return nil
 }
 
 const oldDuration = time.Hour * 24 * 7 * 2 // two weeks
 const numStoriesLimit = 1000
 const accountFreeDuration = 30 * time.Hour * 24 // 30 days
 
-func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func ListFeeds(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	gn := c.Store()
+	token := syncToken(time.Now())
 	u := &User{Id: cu.ID}
 	ud := &UserData{Id: "data", Parent: gn.Key(u)}
-	if err := gn.GetMulti([]interface{}{u, ud}); err != nil && !goon.NotFound(err, 1) {
+	if err := gn.GetMulti([]interface{}{u, ud}); err != nil && !backend.NotFound(err, 1) {
 		serveError(w, err)
 		return
 	}
@@ -219,6 +326,9 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		Text:   "list feeds",
 	}
 	l.Text += fmt.Sprintf(", len opml %v", len(ud.Opml))
+	// Read-only tokens see the user's data as it is cleaned up below, but
+	// none of it is saved.
+	ro := readOnly(c)
 	putU := false
 	putUD := false
 	fixRead := false
@@ -244,17 +354,25 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		}
 		trialRemaining = int((accountFreeDuration-time.Since(u.Created))/time.Hour/24) + 1
 	}
-	read := make(Read)
+	if len(ud.Read) > 0 && !ro {
+		c.Step("migrate read", func(c Context) {
+			if err := migrateUserRead(c, ud.Parent); err != nil {
+				c.Errorf("migrate read: %v", err)
+				return
+			}
+			ud.Read = nil
+			l.Text += ", migrate read"
+		})
+	}
 	var uf Opml
-	c.Step("unmarshal user data", func(c mpg.Context) {
-		gob.NewDecoder(bytes.NewReader(ud.Read)).Decode(&read)
+	c.Step("unmarshal user data", func(c Context) {
 		json.Unmarshal(ud.Opml, &uf)
 	})
 	var feeds []*Feed
 	opmlMap := make(map[string]*OpmlOutline)
 	var merr error
-	c.Step("fetch feeds", func(c mpg.Context) {
-		gn := goon.FromContext(appengine.Timeout(c, time.Minute))
+	c.Step("fetch feeds", func(c Context) {
+		gn := c.Timeout(time.Minute).Store()
 		for _, outline := range uf.Outline {
 			if outline.XmlUrl == "" {
 				for _, so := range outline.Outline {
@@ -268,9 +386,33 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		}
 		merr = gn.GetMulti(feeds)
 	})
+	for i, f := range feeds {
+		if f.MovedTo != "" && !backend.NotFound(merr, i) && !ro {
+			migrateUser(c, cu.ID, f.Url, f.MovedTo)
+		}
+	}
+	var read Read
+	var rules *ruleSet
+	var rerr error
+	c.Step("read stories", func(c Context) {
+		urls := make([]string, len(feeds))
+		for i, f := range feeds {
+			urls[i] = f.Url
+		}
+		read, rerr = getRead(c.Store(), cu.ID, urls)
+	})
+	if rerr == nil {
+		c.Step("rules", func(c Context) {
+			rules, rerr = loadRules(c, ud.Parent)
+		})
+	}
+	if rerr != nil {
+		serveError(w, rerr)
+		return
+	}
 	lock := sync.Mutex{}
 	fl := make(map[string][]*Story)
-	q := datastore.NewQuery(gn.Kind(&Story{})).
+	q := backend.NewQuery(gn.Kind(&Story{})).
 		Filter(IDX_COL+" >=", u.Read).
 		KeysOnly().
 		Order("-" + IDX_COL).
@@ -279,18 +421,19 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
 	numStories := 0
 	var stars []string
+	var tags []tagCount
 
-	c.Step(fmt.Sprintf("feed unreads: %v", u.Read), func(c mpg.Context) {
+	c.Step(fmt.Sprintf("feed unreads: %v", u.Read), func(c Context) {
 		queue := make(chan *Feed)
-		tc := make(chan *taskqueue.Task)
+		tc := make(chan *backend.Task)
 		done := make(chan bool)
 		wg := sync.WaitGroup{}
 		feedProc := func() {
 			for f := range queue {
-				c.Step(f.Title, func(c mpg.Context) {
+				c.Step(f.Title, func(c Context) {
 					defer wg.Done()
 					var stories []*Story
-					gn := goon.FromContext(appengine.Timeout(c, time.Minute))
+					gn := c.Timeout(time.Minute).Store()
 
 					if !f.Date.Before(u.Read) {
 						fk := gn.Key(f)
@@ -313,19 +456,19 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 					manualDone := false
 					if time.Since(f.LastViewed) > time.Hour*24*2 {
 						if !f.NextUpdate.Before(timeMax) {
-							tc <- taskqueue.NewPOSTTask(routeUrl("update-feed-manual"), url.Values{
+							tc <- backend.NewPOSTTask(routeUrl("update-feed-manual"), url.Values{
 								"feed": {f.Url},
 								"last": {"1"},
 							})
 							manualDone = true
 						} else {
-							tc <- taskqueue.NewPOSTTask(routeUrl("update-feed-last"), url.Values{
+							tc <- backend.NewPOSTTask(routeUrl("update-feed-last"), url.Values{
 								"feed": {f.Url},
 							})
 						}
 					}
 					if !manualDone && now.Sub(f.NextUpdate) >= 0 {
-						tc <- taskqueue.NewPOSTTask(routeUrl("update-feed-manual"), url.Values{
+						tc <- backend.NewPOSTTask(routeUrl("update-feed-manual"), url.Values{
 							"feed": {f.Url},
 						})
 					}
@@ -341,16 +484,16 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			go feedProc()
 		}
 		for i, f := range feeds {
-			if goon.NotFound(merr, i) {
+			if backend.NotFound(merr, i) {
 				continue
 			}
 			wg.Add(1)
 			queue <- f
 		}
 		close(queue)
-		c.Step("stars", func(c mpg.Context) {
-			gn := goon.FromContext(c)
-			q := datastore.NewQuery(gn.Kind(&UserStar{})).
+		c.Step("stars", func(c Context) {
+			gn := c.Store()
+			q := backend.NewQuery(gn.Kind(&UserStar{})).
 				Ancestor(ud.Parent).
 				KeysOnly().
 				Filter("c >=", u.Read).
@@ -361,6 +504,12 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 				stars[i] = starID(key)
 			}
 		})
+		c.Step("tags", func(c Context) {
+			var err error
+			if tags, err = tagCounts(c, ud.Parent); err != nil {
+				c.Errorf("tag counts: %v", err)
+			}
+		})
 		// wait for feeds to complete so there are no more tasks to queue
 		wg.Wait()
 		// then finish enqueuing tasks
@@ -368,7 +517,7 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		<-done
 	})
 	if numStories > 0 {
-		c.Step("numStories", func(c mpg.Context) {
+		c.Step("numStories", func(c Context) {
 			stories := make([]*Story, 0, numStories)
 			for _, v := range fl {
 				stories = append(stories, v...)
@@ -392,22 +541,24 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		})
 	}
 	if fixRead {
-		c.Step("fix read", func(c mpg.Context) {
-			nread := make(Read)
+		c.Step("fix read", func(c Context) {
+			current := make(Read)
 			for k, v := range fl {
 				for _, s := range v {
-					rs := readStory{Feed: k, Story: s.Id}
-					if read[rs] {
-						nread[rs] = true
-					}
+					current[readStory{Feed: k, Story: s.Id}] = true
 				}
 			}
-			if len(nread) != len(read) {
-				read = nread
-				var b bytes.Buffer
-				gob.NewEncoder(&b).Encode(&read)
-				ud.Read = b.Bytes()
-				putUD = true
+			stale := make(map[string][]string)
+			for rs := range read {
+				if !current[rs] {
+					stale[rs.Feed] = append(stale[rs.Feed], rs.Story)
+					delete(read, rs)
+				}
+			}
+			if len(stale) > 0 && !ro {
+				if err := unmarkRead(c, cu.ID, stale); err != nil {
+					c.Errorf("fix read: %v", err)
+				}
 				l.Text += ", fix read"
 			}
 		})
@@ -426,9 +577,14 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	if numStories == 0 {
 		l.Text += ", clear read"
 		fixRead = false
-		if ud.Read != nil {
-			putUD = true
-			ud.Read = nil
+		if len(read) > 0 && !ro {
+			stale := make(map[string][]string)
+			for rs := range read {
+				stale[rs.Feed] = append(stale[rs.Feed], rs.Story)
+			}
+			if err := unmarkRead(c, cu.ID, stale); err != nil {
+				c.Errorf("clear read: %v", err)
+			}
 		}
 		last := u.Read
 		for _, v := range feeds {
@@ -442,28 +598,68 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			u.Read = last
 		}
 	}
-	if updatedLinks {
+	if numStories > 0 {
+		c.Step("apply rules", func(c Context) {
+			stars = append(stars, applyRules(c, ud.Parent, rules, fl)...)
+		})
+	}
+	outlines := uf.Outline
+	var searches map[string][]string
+	c.Step("searches", func(c Context) {
+		gn := c.Store()
+		uss, err := loadSearches(gn, ud.Parent)
+		if err != nil {
+			c.Errorf("searches: %v", err)
+			return
+		}
+		unread := make(map[string]bool)
+		for f, ss := range fl {
+			for _, s := range ss {
+				unread[f+"|"+s.Id] = true
+			}
+		}
+		searches = make(map[string][]string)
+		for _, us := range uss {
+			ids, err := searchUnread(gn, gn.Key(us), u.Read, unread)
+			if err != nil {
+				c.Errorf("search %v: %v", us.Id, err)
+			}
+			url := searchFeedURL(us.Id)
+			searches[url] = ids
+			feeds = append(feeds, &Feed{Url: url, Title: us.Title})
+		}
+		outlines = withSearches(uf.Outline, uss)
+	})
+	if ro {
+		// nothing is saved
+	} else if updatedLinks {
 		backupOPML(c)
 		if o, err := json.Marshal(&uf); err == nil {
 			ud.Opml = o
 			putUD = true
+			recordChanges(c, newChange(ud.Parent, changeOpml, ""))
 			l.Text += ", update links"
 		} else {
 			c.Errorf("json UL err: %v, %v", err, uf)
 		}
 	}
-	if putU {
-		gn.Put(u)
-		l.Text += ", putU"
-	}
-	if putUD {
-		gn.Put(ud)
-		l.Text += ", putUD"
+	if !ro {
+		if putU {
+			gn.Put(u)
+			l.Text += ", putU"
+		}
+		if putUD {
+			gn.Put(ud)
+			l.Text += ", putUD"
+		}
+		l.Text += fmt.Sprintf(", len opml %v", len(ud.Opml))
+		gn.Put(l)
+		if err := pruneChanges(gn, ud.Parent); err != nil {
+			c.Errorf("prune changes: %v", err)
+		}
 	}
-	l.Text += fmt.Sprintf(", len opml %v", len(ud.Opml))
-	gn.Put(l)
-	c.Step("json marshal", func(c mpg.Context) {
-		gn := goon.FromContext(c)
+	c.Step("json marshal", func(c Context) {
+		gn := c.Store()
 		o := struct {
 			Opml           []*OpmlOutline
 			Stories        map[string][]*Story
@@ -471,17 +667,23 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			TrialRemaining int
 			Feeds          []*Feed
 			Stars          []string
+			Tags           []tagCount
+			Searches       map[string][]string `json:",omitempty"`
 			UnreadDate     time.Time
 			UntilDate      int64
+			SyncToken      string
 		}{
-			Opml:           uf.Outline,
+			Opml:           outlines,
 			Stories:        fl,
 			Options:        u.Options,
 			TrialRemaining: trialRemaining,
 			Feeds:          feeds,
 			Stars:          stars,
+			Tags:           tags,
+			Searches:       searches,
 			UnreadDate:     u.Read,
 			UntilDate:      u.Until.Unix(),
+			SyncToken:      token,
 		}
 		b, err := json.Marshal(o)
 		if err != nil {
@@ -492,7 +694,9 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 					if n != s.Summary {
 						s.Summary = n
 						c.Errorf("cleaned %v", s.Id)
-						gn.Put(s)
+						if !ro {
+							gn.Put(s)
+						}
 					}
 				}
 			}
@@ -502,10 +706,10 @@ func ListFeeds(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func MarkRead(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
-	read := make(Read)
+// MarkRead and MarkUnread expect the user's read data to have been
+// migrated, which ListFeeds does before the client shows any stories.
+func MarkRead(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
 	var stories []readStory
 	defer r.Body.Close()
 	b, _ := ioutil.ReadAll(r.Body)
@@ -513,54 +717,34 @@ func MarkRead(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		serveError(w, err)
 		return
 	}
-	gn.RunInTransaction(func(gn *goon.Goon) error {
-		u := &User{Id: cu.ID}
-		ud := &UserData{
-			Id:     "data",
-			Parent: gn.Key(u),
-		}
-		if err := gn.Get(ud); err != nil {
-			return err
-		}
-		gob.NewDecoder(bytes.NewReader(ud.Read)).Decode(&read)
-		for _, s := range stories {
-			read[s] = true
-		}
-		var b bytes.Buffer
-		gob.NewEncoder(&b).Encode(&read)
-		ud.Read = b.Bytes()
-		_, err := gn.Put(ud)
-		return err
-	}, nil)
+	byFeed := make(map[string][]string)
+	for _, s := range stories {
+		byFeed[s.Feed] = append(byFeed[s.Feed], s.Story)
+	}
+	if err := markRead(c, cu.ID, byFeed); err != nil {
+		serveError(w, err)
+		return
+	}
+	uk := c.Store().Key(&User{Id: cu.ID})
+	var changes []*UserChange
+	for f, ids := range byFeed {
+		changes = append(changes, newChange(uk, changeRead, f, ids...))
+	}
+	recordChanges(c, changes...)
 }
 
-func MarkUnread(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
-	read := make(Read)
+func MarkUnread(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
 	f := r.FormValue("feed")
 	s := r.FormValue("story")
-	rs := readStory{Feed: f, Story: s}
-	u := &User{Id: cu.ID}
-	ud := &UserData{
-		Id:     "data",
-		Parent: gn.Key(u),
-	}
-	gn.RunInTransaction(func(gn *goon.Goon) error {
-		if err := gn.Get(ud); err != nil {
-			return err
-		}
-		gob.NewDecoder(bytes.NewReader(ud.Read)).Decode(&read)
-		delete(read, rs)
-		b := bytes.Buffer{}
-		gob.NewEncoder(&b).Encode(&read)
-		ud.Read = b.Bytes()
-		_, err := gn.Put(ud)
-		return err
-	}, nil)
+	if err := unmarkRead(c, cu.ID, map[string][]string{f: {s}}); err != nil {
+		serveError(w, err)
+		return
+	}
+	recordChanges(c, newChange(c.Store().Key(&User{Id: cu.ID}), changeUnread, f, s))
 }
 
-func GetContents(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func GetContents(c Context, w http.ResponseWriter, r *http.Request) {
 	var reqs []struct {
 		Feed  string
 		Story string
@@ -572,28 +756,59 @@ func GetContents(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	scs := make([]*StoryContent, len(reqs))
-	gn := goon.FromContext(c)
+	gn := c.Store()
+	o := userOpml(gn, gn.Key(&User{Id: c.User().ID}))
+	fullText := fullTextFeeds(o)
+	policies := userPolicies(o)
+	var full []*StoryContent
 	for i, r := range reqs {
 		f := &Feed{Url: r.Feed}
 		s := &Story{Id: r.Story, Parent: gn.Key(f)}
 		scs[i] = &StoryContent{Id: 1, Parent: gn.Key(s)}
+		if fullText[r.Feed] {
+			full = append(full, &StoryContent{Id: fullContentID, Parent: gn.Key(s)})
+		}
 	}
 	gn.GetMulti(scs)
 	ret := make([]string, len(reqs))
 	for i, sc := range scs {
 		ret[i] = sc.content()
 	}
+	// Articles replace the feed's content when they have been extracted.
+	if len(full) > 0 {
+		err := gn.GetMulti(full)
+		merr, _ := err.(backend.MultiError)
+		j := 0
+		for i, r := range reqs {
+			if !fullText[r.Feed] {
+				continue
+			}
+			if err == nil || merr != nil && merr[j] == nil {
+				ret[i] = full[j].content()
+			}
+			j++
+		}
+	}
+	// Content was sanitized when stored, so is only sanitized again with
+	// the user's policies, and to load its images through the proxy.
+	for i, r := range reqs {
+		p := policies[r.Feed]
+		if p == nil {
+			p = sanitizer.Permissive
+		}
+		ret[i], _ = sanitizer.SanitizePolicy(ret[i], nil, proxyImages(c, p))
+	}
 	b, _ = json.Marshal(&ret)
 	w.Write(b)
 }
 
-func ExportOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
+func ExportOpml(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
 	var u User
-	if uid := r.FormValue("u"); len(uid) != 0 && user.IsAdmin(c) {
+	if uid := r.FormValue("u"); len(uid) != 0 && c.User().Admin {
 		u = User{Id: uid}
 	} else {
-		cu := user.Current(c)
+		cu := c.User()
 		u = User{Id: cu.ID}
 	}
 	ud := UserData{Id: "data", Parent: gn.Key(&u)}
@@ -626,7 +841,7 @@ func downloadOpml(w http.ResponseWriter, ob []byte, email string) {
 	fmt.Fprint(w, xml.Header, string(b))
 }
 
-func UploadOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func UploadOpml(c Context, w http.ResponseWriter, r *http.Request) {
 	opml := Opml{}
 	if err := json.Unmarshal([]byte(r.FormValue("opml")), &opml.Outline); err != nil {
 		serveError(w, err)
@@ -638,9 +853,10 @@ func UploadOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	opml.Outline = withoutSearches(opml.Outline)
 	backupOPML(c)
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	ud := UserData{Id: "data", Parent: gn.Key(&u)}
 	if err := gn.Get(&ud); err != nil {
@@ -648,6 +864,8 @@ func UploadOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		c.Errorf("get err: %v", err)
 		return
 	}
+	var old Opml
+	json.Unmarshal(ud.Opml, &old)
 	if b, err := json.Marshal(&opml); err != nil {
 		serveError(w, err)
 		c.Errorf("json err: %v", err)
@@ -659,17 +877,22 @@ func UploadOpml(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			Text:   fmt.Sprintf("upload opml: %v -> %v", len(ud.Opml), len(b)),
 		}
 		ud.Opml = b
-		if _, err := gn.PutMulti([]interface{}{&ud, &l}); err != nil {
+		if _, err := gn.PutMulti([]interface{}{&ud, &l, newChange(ud.Parent, changeOpml, "")}); err != nil {
+			serveError(w, err)
+			return
+		}
+		if err := updateSearches(gn, ud.Parent, &opml); err != nil {
 			serveError(w, err)
 			return
 		}
 		backupOPML(c)
+		countFullText(c, fullTextFeeds(&old), fullTextFeeds(&opml))
 	}
 }
 
-func backupOPML(c mpg.Context) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func backupOPML(c Context) {
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	ud := UserData{Id: "data", Parent: gn.Key(&u)}
 	if err := gn.Get(&ud); err != nil {
@@ -688,13 +911,13 @@ func backupOPML(c mpg.Context) {
 	gn.Put(&uo)
 }
 
-func FeedHistory(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+func FeedHistory(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	uk := gn.Key(&u)
 	if v := r.FormValue("v"); len(v) == 0 {
-		q := datastore.NewQuery(gn.Kind(&UserOpml{})).Ancestor(uk).KeysOnly()
+		q := backend.NewQuery(gn.Kind(&UserOpml{})).Ancestor(uk).KeysOnly()
 		keys, err := gn.GetAll(q, nil)
 		if err != nil {
 			serveError(w, err)
@@ -717,10 +940,10 @@ func FeedHistory(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func SaveOptions(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
-	gn.RunInTransaction(func(gn *goon.Goon) error {
+func SaveOptions(c Context, w http.ResponseWriter, r *http.Request) {
+	cu := c.User()
+	gn := c.Store()
+	gn.RunInTransaction(func(gn *backend.Store) error {
 		u := User{Id: cu.ID}
 		if err := gn.Get(&u); err != nil {
 			serveError(w, err)
@@ -731,30 +954,30 @@ func SaveOptions(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 			Parent: gn.Key(&u),
 			Id:     time.Now().UnixNano(),
 			Text:   fmt.Sprintf("save options: %v", len(u.Options)),
-		}})
+		}, newChange(gn.Key(&u), changeOptions, "")})
 		return err
-	}, nil)
+	})
 }
 
-func GetFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
+func GetFeed(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
 	f := Feed{Url: r.FormValue("f")}
 	var stars []string
 	wg := sync.WaitGroup{}
 	fk := gn.Key(&f)
-	q := datastore.NewQuery(gn.Kind(&Story{})).Ancestor(fk).KeysOnly()
+	q := backend.NewQuery(gn.Kind(&Story{})).Ancestor(fk).KeysOnly()
 	q = q.Order("-" + IDX_COL)
 	if cur := r.FormValue("c"); cur != "" {
-		if dc, err := datastore.DecodeCursor(cur); err == nil {
+		if dc, err := backend.DecodeCursor(cur); err == nil {
 			q = q.Start(dc)
 		}
 	} else {
 		// grab the stars list on the first run
 		wg.Add(1)
-		go c.Step("stars", func(c mpg.Context) {
-			gn := goon.FromContext(c)
+		go c.Step("stars", func(c Context) {
+			gn := c.Store()
 			usk := starKey(c, f.Url, "")
-			q := datastore.NewQuery(gn.Kind(&UserStar{})).Ancestor(gn.Key(usk).Parent()).KeysOnly()
+			q := backend.NewQuery(gn.Kind(&UserStar{})).Ancestor(gn.Key(usk).Parent()).KeysOnly()
 			keys, _ := gn.GetAll(q, nil)
 			stars = make([]string, len(keys))
 			for i, key := range keys {
@@ -771,7 +994,7 @@ func GetFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 				Id:     k.StringID(),
 				Parent: k.Parent(),
 			})
-		} else if err == datastore.Done {
+		} else if err == backend.Done {
 			break
 		} else {
 			serveError(w, err)
@@ -783,6 +1006,21 @@ func GetFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 		cursor = ic.String()
 	}
 	gn.GetMulti(&stories)
+	rules, err := loadRules(c, gn.Key(&User{Id: c.User().ID}))
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if len(stories) > 0 {
+		fl := map[string][]*Story{f.Url: stories}
+		if err := rules.loadContents(c, fl); err != nil {
+			serveError(w, err)
+			return
+		}
+		rules.filter(fl, false)
+		// An empty list, not null, so the client fetches the next page.
+		stories = append([]*Story{}, fl[f.Url]...)
+	}
 	wg.Wait()
 	b, _ := json.Marshal(struct {
 		Cursor  string
@@ -796,78 +1034,91 @@ func GetFeed(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func DeleteAccount(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func DeleteAccount(c Context, w http.ResponseWriter, r *http.Request) {
 	if _, err := doUncheckout(c); err != nil {
 		c.Errorf("uncheckout err: %v", err)
 	}
-	cu := user.Current(c)
-	gn := goon.FromContext(c)
+	cu := c.User()
+	gn := c.Store()
 	u := User{Id: cu.ID}
 	uk := gn.Key(&u)
-	q := datastore.NewQuery("").KeysOnly().Ancestor(uk)
+	ud := UserData{Id: "data", Parent: uk}
+	if err := gn.Get(&ud); err != nil && err != backend.ErrNoSuchEntity {
+		serveError(w, err)
+		return
+	}
+	var opml Opml
+	json.Unmarshal(ud.Opml, &opml)
+	q := backend.NewQuery("").KeysOnly().Ancestor(uk)
 	keys, err := gn.GetAll(q, nil)
 	if err != nil {
 		serveError(w, err)
 		return
 	}
+	for _, k := range keys {
+		if k.Kind() == gn.Kind(&UserShare{}) {
+			keys = append(keys, gn.Key(&ShareRef{Id: k.StringID()}))
+		}
+	}
 	err = gn.DeleteMulti(keys)
 	if err != nil {
 		serveError(w, err)
 		return
 	}
+	countFullText(c, fullTextFeeds(&opml), nil)
+	if err := deleteUserRead(gn, cu.ID); err != nil {
+		serveError(w, err)
+		return
+	}
 	http.Redirect(w, r, routeUrl("logout"), http.StatusFound)
 }
 
-func SetStar(c mpg.Context, w http.ResponseWriter, r *http.Request) {
+func SetStar(c Context, w http.ResponseWriter, r *http.Request) {
 	feed := r.FormValue("feed")
 	story := r.FormValue("story")
 	if len(feed) == 0 || len(story) == 0 {
 		return
 	}
+	gn := c.Store()
+	uk := gn.Key(&User{Id: c.User().ID})
 	del := r.FormValue("del") != ""
-	us := starKey(c, feed, story)
-	gn := goon.FromContext(c)
+	if err := setStarred(c, uk, map[string][]string{feed: {story}}, !del); err != nil {
+		c.Errorf("set star err: %v", err)
+		serveError(w, err)
+		return
+	}
+	// Unstarring here deletes the note too. API clients don't know about
+	// notes, so theirs are kept.
 	if del {
-		gn.Delete(gn.Key(us))
-	} else {
-		us.Created = time.Now()
-		_, err := gn.Put(us)
-		if err != nil {
-			c.Errorf("star put err: %v", err)
+		if err := gn.Delete(gn.Key(noteKey(uk, feed, story))); err != nil {
+			c.Errorf("delete note err: %v", err)
 			serveError(w, err)
 		}
 	}
 }
 
-func GetStars(c mpg.Context, w http.ResponseWriter, r *http.Request) {
-	gn := goon.FromContext(c)
-	cu := user.Current(c)
+func GetStars(c Context, w http.ResponseWriter, r *http.Request) {
+	gn := c.Store()
+	cu := c.User()
 	u := User{Id: cu.ID}
-	q := datastore.NewQuery(gn.Kind(&UserStar{})).
+	q := backend.NewQuery(gn.Kind(&UserStar{})).
 		Ancestor(gn.Key(&u)).
 		Order("-c").
 		Limit(20)
 	if cur := r.FormValue("c"); cur != "" {
-		if dc, err := datastore.DecodeCursor(cur); err == nil {
+		if dc, err := backend.DecodeCursor(cur); err == nil {
 			q = q.Start(dc)
 		}
 	}
 	iter := gn.Run(q)
 	stars := make(map[string]int64)
 	var us UserStar
-	var stories []*Story
-	var feeds []*Feed
-	feedm := make(map[string]*Feed)
+	var keys []*backend.Key
 	for {
 		if k, err := iter.Next(&us); err == nil {
 			stars[starID(k)] = us.Created.Unix()
-			feed := &Feed{Url: k.Parent().StringID()}
-			stories = append(stories, &Story{
-				Id:     k.StringID(),
-				Parent: gn.Key(feed),
-			})
-			feedm[feed.Url] = feed
-		} else if err == datastore.Done {
+			keys = append(keys, k)
+		} else if err == backend.Done {
 			break
 		} else {
 			serveError(w, err)
@@ -878,31 +1129,50 @@ func GetStars(c mpg.Context, w http.ResponseWriter, r *http.Request) {
 	if ic, err := iter.Cursor(); err == nil {
 		cursor = ic.String()
 	}
-	var smap map[string][]*Story
-	if len(stories) > 0 {
-		gn.GetMulti(&stories)
-		smap = make(map[string][]*Story)
-		for _, s := range stories {
-			f := s.Parent.StringID()
-			smap[f] = append(smap[f], s)
-		}
-	}
-	if len(feedm) > 0 {
-		for _, v := range feedm {
-			feeds = append(feeds, v)
-		}
-		gn.GetMulti(&feeds)
-	}
+	smap, feeds := starStories(gn, keys)
 	b, _ := json.Marshal(struct {
 		Cursor  string
 		Stories map[string][]*Story
 		Stars   map[string]int64
+		Notes   map[string]*starNote `json:",omitempty"`
 		Feeds   []*Feed
 	}{
 		Cursor:  cursor,
 		Stories: smap,
 		Stars:   stars,
+		Notes:   storyNotes(gn, keys),
 		Feeds:   feeds,
 	})
 	w.Write(b)
 }
+
+// starStories loads the stories, keyed by feed, and feeds of keys whose
+// parents are UserStarFeeds and whose ids are story ids, such as the keys
+// of UserStars.
+func starStories(gn *backend.Store, keys []*backend.Key) (map[string][]*Story, []*Feed) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	stories := make([]*Story, len(keys))
+	feedm := make(map[string]*Feed)
+	for i, k := range keys {
+		feed := &Feed{Url: k.Parent().StringID()}
+		stories[i] = &Story{
+			Id:     k.StringID(),
+			Parent: gn.Key(feed),
+		}
+		feedm[feed.Url] = feed
+	}
+	gn.GetMulti(&stories)
+	smap := make(map[string][]*Story)
+	for _, s := range stories {
+		f := s.Parent.StringID()
+		smap[f] = append(smap[f], s)
+	}
+	var feeds []*Feed
+	for _, v := range feedm {
+		feeds = append(feeds, v)
+	}
+	gn.GetMulti(&feeds)
+	return smap, feeds
+}
@@ -18,6 +18,7 @@ package goapp
 
 import (
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"html"
@@ -25,34 +26,48 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"mime"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 	"unicode/utf8"
 
-	mpg "github.com/mjibson/goread/_third_party/github.com/MiniProfiler/go/miniprofiler_gae"
-	"github.com/mjibson/goread/_third_party/github.com/mjibson/goon"
 	"github.com/mjibson/goread/_third_party/golang.org/x/net/html/charset"
 	"github.com/mjibson/goread/_third_party/golang.org/x/text/encoding"
 	"github.com/mjibson/goread/_third_party/golang.org/x/text/encoding/charmap"
 	"github.com/mjibson/goread/_third_party/golang.org/x/text/transform"
 	"github.com/mjibson/goread/atom"
+	"github.com/mjibson/goread/backend"
+	"github.com/mjibson/goread/jsonfeed"
 	"github.com/mjibson/goread/rdf"
 	"github.com/mjibson/goread/rss"
 	"github.com/mjibson/goread/sanitizer"
-
-	"appengine"
-	"appengine/memcache"
-	"appengine/taskqueue"
-	"appengine/urlfetch"
-	"appengine/user"
 )
 
 func serveError(w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+}
+
+// absURL returns path as an absolute URL on r's host.
+func absURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
 type Includes struct {
 	Angular             string
 	BootstrapCss        string
@@ -85,15 +100,16 @@ var (
 	subURL       string
 )
 
-func init() {
+// setIncludes serves scripts and styles locally on dev servers, and
+// otherwise from CDNs.
+func setIncludes(dev bool) {
 	angular_ver := "1.2.1"
 	bootstrap_ver := "3.0.2"
 	font_awesome_ver := "4.0.3"
 	jquery_ver := "2.0.3"
 	jqueryui_ver := "1.10.3.sortable"
-	isDevServer = appengine.IsDevAppServer()
 
-	if appengine.IsDevAppServer() {
+	if dev {
 		Angular = "/static/js/angular.js"
 		BootstrapCss = "/static/css/bootstrap.css"
 		BootstrapJs = "/static/js/bootstrap.js"
@@ -112,7 +128,7 @@ func init() {
 	}
 }
 
-func includes(c mpg.Context, w http.ResponseWriter, r *http.Request) *Includes {
+func includes(c Context, w http.ResponseWriter, r *http.Request) *Includes {
 	i := &Includes{
 		Angular:             Angular,
 		BootstrapCss:        BootstrapCss,
@@ -130,8 +146,8 @@ func includes(c mpg.Context, w http.ResponseWriter, r *http.Request) *Includes {
 		StripePlans:         STRIPE_PLANS,
 	}
 
-	if cu := user.Current(c); cu != nil {
-		gn := goon.FromContext(c)
+	if cu := c.User(); cu != nil {
+		gn := c.Store()
 		user := &User{Id: cu.ID}
 		if err := gn.Get(user); err == nil {
 			i.User = user
@@ -334,7 +350,7 @@ var dateFormats = []string{
 
 const dateFormatCount = 500
 
-func parseDate(c appengine.Context, feed *Feed, ds ...string) (t time.Time, err error) {
+func parseDate(c backend.Context, feed *Feed, ds ...string) (t time.Time, err error) {
 	for _, d := range ds {
 		d = strings.TrimSpace(d)
 		if d == "" {
@@ -345,11 +361,11 @@ func parseDate(c appengine.Context, feed *Feed, ds ...string) (t time.Time, err
 				return
 			}
 		}
-		df := memcache.Item{
+		df := backend.Item{
 			Key:   fmt.Sprintf("_dateformat-%v", rand.Int63n(dateFormatCount)),
 			Value: []byte(fmt.Sprintf("%v|%v", d, feed.Url)),
 		}
-		memcache.Add(c, &df)
+		c.Cache().Add(&df)
 	}
 	err = fmt.Errorf("could not parse date: %v", strings.Join(ds, ", "))
 	return
@@ -388,9 +404,18 @@ func nilCharsetReader(cs string, input io.Reader) (io.Reader, error) {
 	return input, nil
 }
 
-func ParseFeed(c appengine.Context, contentType, origUrl, fetchUrl string, body []byte) (*Feed, []*Story, error) {
+func ParseFeed(c backend.Context, contentType, origUrl, fetchUrl string, body []byte) (*Feed, []*Story, error) {
+	if isJSONFeed(contentType, body) {
+		feed, stories, err := parseJSONFeed(c, body)
+		if err == nil {
+			feed.Url = origUrl
+			return parseFix(c, feed, stories, fetchUrl)
+		}
+		// Servers send XML feeds as application/json too.
+		c.Warningf("json feed parse error: %s", err.Error())
+	}
 	cr := defaultCharsetReader
-	if !bytes.EqualFold(body[:len(xml.Header)], []byte(xml.Header)) {
+	if len(body) < len(xml.Header) || !bytes.EqualFold(body[:len(xml.Header)], []byte(xml.Header)) {
 		enc, err := encodingReader(body, contentType)
 		if err != nil {
 			return nil, nil, err
@@ -423,7 +448,7 @@ func ParseFeed(c appengine.Context, contentType, origUrl, fetchUrl string, body
 	return parseFix(c, feed, stories, fetchUrl)
 }
 
-func parseAtom(c appengine.Context, body []byte, charsetReader func(string, io.Reader) (io.Reader, error)) (*Feed, []*Story, error) {
+func parseAtom(c backend.Context, body []byte, charsetReader func(string, io.Reader) (io.Reader, error)) (*Feed, []*Story, error) {
 	var f Feed
 	var s []*Story
 	var err error
@@ -492,7 +517,7 @@ func parseAtom(c appengine.Context, body []byte, charsetReader func(string, io.R
 	return &f, s, nil
 }
 
-func parseRSS(c appengine.Context, body []byte, charsetReader func(string, io.Reader) (io.Reader, error)) (*Feed, []*Story, error) {
+func parseRSS(c backend.Context, body []byte, charsetReader func(string, io.Reader) (io.Reader, error)) (*Feed, []*Story, error) {
 	var f Feed
 	var s []*Story
 	r := rss.Rss{}
@@ -510,6 +535,11 @@ func parseRSS(c appengine.Context, body []byte, charsetReader func(string, io.Re
 	}
 	f.Link = r.BaseLink()
 	f.Hub = r.Hub()
+	f.Interval = r.Interval()
+	f.SkipHours = r.Hours()
+	for _, d := range r.Days() {
+		f.SkipDays = append(f.SkipDays, int(d))
+	}
 
 	for _, i := range r.Items {
 		st := Story{
@@ -548,7 +578,7 @@ func parseRSS(c appengine.Context, body []byte, charsetReader func(string, io.Re
 	return &f, s, nil
 }
 
-func parseRDF(c appengine.Context, body []byte, charsetReader func(string, io.Reader) (io.Reader, error)) (*Feed, []*Story, error) {
+func parseRDF(c backend.Context, body []byte, charsetReader func(string, io.Reader) (io.Reader, error)) (*Feed, []*Story, error) {
 	var f Feed
 	var s []*Story
 	rd := rdf.RDF{}
@@ -563,6 +593,7 @@ func parseRDF(c appengine.Context, body []byte, charsetReader func(string, io.Re
 		if t, err := parseDate(c, &f, rd.Channel.Date); err == nil {
 			f.Updated = t
 		}
+		f.Interval = rss.SyndicationInterval(rd.Channel.UpdatePeriod, rd.Channel.UpdateFrequency)
 	}
 
 	for _, i := range rd.Item {
@@ -586,6 +617,82 @@ func parseRDF(c appengine.Context, body []byte, charsetReader func(string, io.Re
 	return &f, s, nil
 }
 
+func isJSONFeed(contentType string, body []byte) bool {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mt {
+		case "application/feed+json", "application/json":
+			return true
+		}
+	}
+	return jsonfeed.Sniff(body)
+}
+
+func parseJSONFeed(c backend.Context, body []byte) (*Feed, []*Story, error) {
+	var f Feed
+	var s []*Story
+	j := jsonfeed.Feed{}
+	if err := json.Unmarshal(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), &j); err != nil {
+		return nil, nil, err
+	}
+	if !strings.Contains(j.Version, "jsonfeed.org/version/") {
+		return nil, nil, fmt.Errorf("unknown json feed version: %v", j.Version)
+	}
+	f.Title = j.Title
+	f.Link = j.HomePageURL
+	f.Hub = j.Hub()
+
+	for _, i := range j.Items {
+		st := Story{
+			Id:     string(i.ID),
+			Link:   i.URL,
+			Author: i.AuthorName(),
+		}
+		if st.Link == "" {
+			st.Link = i.ExternalURL
+		}
+		if i.ContentHTML != "" {
+			st.content = i.ContentHTML
+		} else if i.ContentText != "" {
+			st.content = strings.Replace(html.EscapeString(i.ContentText), "\n", "<br>", -1)
+		} else if i.Summary != "" {
+			st.content = html.EscapeString(i.Summary)
+		}
+		if i.Title != "" {
+			st.Title = i.Title
+		} else if i.Summary != "" {
+			st.Title = i.Summary
+		}
+		st.Title = textTitle(st.Title)
+		for _, a := range i.Attachments {
+			if a.URL == "" {
+				continue
+			}
+			if st.MediaContent == "" {
+				st.MediaContent = a.URL
+				st.MediaType = a.MimeType
+			} else {
+				st.Attachments = append(st.Attachments, a.URL)
+				st.AttachmentTypes = append(st.AttachmentTypes, a.MimeType)
+			}
+		}
+		if t, err := parseDate(c, &f, i.DatePublished); err == nil {
+			st.Published = t
+		}
+		if t, err := parseDate(c, &f, i.DateModified); err == nil {
+			st.Updated = t
+		} else {
+			st.Updated = st.Published
+		}
+		// JSON Feed has no feed-level date, so use the newest story's
+		// date to let updateFeed skip unchanged feeds.
+		if st.Updated.After(f.Updated) {
+			f.Updated = st.Updated
+		}
+		s = append(s, &st)
+	}
+	return &f, s, nil
+}
+
 func textTitle(t string) string {
 	return html.UnescapeString(t)
 }
@@ -600,7 +707,7 @@ func atomTitle(t *atom.Text) string {
 	return textTitle(t.Body)
 }
 
-func findBestAtomLink(c appengine.Context, links []atom.Link) string {
+func findBestAtomLink(c backend.Context, links []atom.Link) string {
 	getScore := func(l atom.Link) int {
 		switch {
 		case l.Rel == "hub":
@@ -631,8 +738,8 @@ func findBestAtomLink(c appengine.Context, links []atom.Link) string {
 	return bestlink
 }
 
-func parseFix(c appengine.Context, f *Feed, ss []*Story, fetchUrl string) (*Feed, []*Story, error) {
-	g := goon.FromContext(c)
+func parseFix(c backend.Context, f *Feed, ss []*Story, fetchUrl string) (*Feed, []*Story, error) {
+	g := c.Store()
 	f.Checked = time.Now()
 	fk := g.Key(f)
 	f.Link = strings.TrimSpace(f.Link)
@@ -647,6 +754,7 @@ func parseFix(c appengine.Context, f *Feed, ss []*Story, fetchUrl string) (*Feed
 	if err != nil {
 		c.Warningf("unable to parse link: %v", f.Link)
 	}
+	policy := feedPolicy(g, f.Url)
 
 	var nss []*Story
 	for _, s := range ss {
@@ -691,6 +799,9 @@ func parseFix(c appengine.Context, f *Feed, ss []*Story, fetchUrl string) (*Feed
 				c.Warningf("unable to resolve link: %v", s.Link)
 			}
 		}
+		if s.Link != "" {
+			s.Link = TRACKING.CleanLink(s.Link)
+		}
 		const keySize = 500
 		sk := g.Key(s)
 		if kl := len(sk.String()); kl > keySize {
@@ -703,7 +814,7 @@ func parseFix(c appengine.Context, f *Feed, ss []*Story, fetchUrl string) (*Feed
 			s.Link = ""
 		}
 		const snipLen = 100
-		s.content, s.Summary = sanitizer.Sanitize(s.content, su)
+		s.content, s.Summary = sanitizer.SanitizePolicy(s.content, su, policy)
 		s.Summary = sanitizer.SnipText(s.Summary, snipLen)
 		nss = append(nss, s)
 	}
@@ -711,7 +822,7 @@ func parseFix(c appengine.Context, f *Feed, ss []*Story, fetchUrl string) (*Feed
 	return f, nss, nil
 }
 
-func loadImage(c appengine.Context, f *Feed) {
+func loadImage(c backend.Context, f *Feed) {
 	if f.ImageDate.After(time.Now()) {
 		return
 	}
@@ -727,7 +838,7 @@ func loadImage(c appengine.Context, f *Feed) {
 	u.RawQuery = ""
 	u.Fragment = ""
 	p := "/favicon.ico"
-	client := urlfetch.Client(c)
+	client := &http.Client{Transport: c.Transport(0)}
 	if r, err := client.Get(u.String()); err == nil {
 		b, err := ioutil.ReadAll(r.Body)
 		r.Body.Close()
@@ -770,7 +881,7 @@ const notViewedDisabled = oldDuration + time.Hour*24*7
 
 var timeMax time.Time = time.Date(3000, time.January, 1, 0, 0, 0, 0, time.UTC)
 
-func scheduleNextUpdate(c appengine.Context, f *Feed) {
+func scheduleNextUpdate(c backend.Context, f *Feed) {
 	loadImage(c, f)
 	if f.NotViewed() {
 		f.NextUpdate = timeMax
@@ -779,7 +890,7 @@ func scheduleNextUpdate(c appengine.Context, f *Feed) {
 
 	now := time.Now()
 	if f.Date.IsZero() {
-		f.NextUpdate = now.Add(UpdateDefault)
+		f.NextUpdate = f.publisherHints(now, now.Add(UpdateDefault))
 		return
 	}
 
@@ -798,6 +909,11 @@ func scheduleNextUpdate(c appengine.Context, f *Feed) {
 		pause = time.Duration(float64(since) / UpdateLongFactor)
 	}
 
+	// don't check more often than the publisher asks
+	if pause < f.Interval {
+		pause = f.Interval
+	}
+
 	// enforce some limits
 	if pause < UpdateMin {
 		pause = UpdateMin
@@ -814,14 +930,115 @@ func scheduleNextUpdate(c appengine.Context, f *Feed) {
 	} else {
 		pause -= jitter
 	}
-	f.NextUpdate = time.Now().Add(pause)
+	f.NextUpdate = f.publisherHints(now, now.Add(pause))
+}
+
+// publisherHints moves next out of the feed's skipHours and skipDays, but
+// no further than UpdateMax from now.
+func (f *Feed) publisherHints(now, next time.Time) time.Time {
+	if f.Interval > 0 && next.Before(now.Add(f.Interval)) {
+		next = now.Add(f.Interval)
+	}
+	skip := func(t time.Time) bool {
+		t = t.UTC()
+		for _, h := range f.SkipHours {
+			if t.Hour() == h {
+				return true
+			}
+		}
+		for _, d := range f.SkipDays {
+			if int(t.Weekday()) == d {
+				return true
+			}
+		}
+		return false
+	}
+	max := now.Add(UpdateMax)
+	for skip(next) && next.Before(max) {
+		next = next.Truncate(time.Hour).Add(time.Hour)
+	}
+	if next.After(max) {
+		next = max
+	}
+	return next
+}
+
+const (
+	// updateFeedsInterval is how often the update-feeds cron runs.
+	updateFeedsInterval = time.Minute * 2
+	// hostSpacing is the delay between update tasks for feeds on one host.
+	hostSpacing = time.Second * 2
+	// hostConcurrency is the number of concurrent fetches allowed per host.
+	hostConcurrency = 4
+	// hostBusyDelay is how long to wait when a host is at its limit.
+	hostBusyDelay = time.Minute * 5
+	// hostRetryDefault is how long to back off a host that returned 429
+	// without a Retry-After header; hostRetryMax bounds Retry-After.
+	hostRetryDefault = time.Hour
+	hostRetryMax     = time.Hour * 24 * 7
+)
+
+func feedHost(feed string) string {
+	u, err := url.Parse(feed)
+	if err != nil || u.Host == "" {
+		return feed
+	}
+	return strings.ToLower(u.Host)
+}
+
+// hostBlocked reports whether a server has asked us to stop fetching from
+// host, and until when.
+func hostBlocked(c backend.Context, host string) (time.Time, bool) {
+	item, err := c.Cache().Get("_hostretry-" + host)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var t time.Time
+	if err := t.UnmarshalBinary(item.Value); err != nil || time.Now().After(t) {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func blockHost(c backend.Context, host string, until time.Time) {
+	b, _ := until.MarshalBinary()
+	c.Cache().Set(&backend.Item{
+		Key:        "_hostretry-" + host,
+		Value:      b,
+		Expiration: until.Sub(time.Now()),
+	})
+}
+
+// acquireHost reserves one of host's concurrent fetch slots. It fails open
+// if memcache is unavailable. Callers must releaseHost when done.
+func acquireHost(c backend.Context, host string) bool {
+	key := "_hostactive-" + host
+	// expire the counter in case a release is lost
+	c.Cache().Add(&backend.Item{
+		Key:        key,
+		Value:      []byte("0"),
+		Expiration: time.Minute * 10,
+	})
+	n, err := c.Cache().Increment(key, 1, 0)
+	if err != nil {
+		return true
+	}
+	if n > hostConcurrency {
+		c.Cache().Increment(key, -1, 0)
+		return false
+	}
+	return true
+}
+
+func releaseHost(c backend.Context, host string) {
+	c.Cache().Increment("_hostactive-"+host, -1, 0)
 }
 
-func taskSender(c mpg.Context, queue string, tc chan *taskqueue.Task, done chan bool) {
+func taskSender(c Context, queue string, tc chan *backend.Task, done chan bool) {
 	const taskLimit = 100
-	tasks := make([]*taskqueue.Task, 0, taskLimit)
+	tasks := make([]*backend.Task, 0, taskLimit)
 	send := func() {
-		taskqueue.AddMulti(c, tasks, queue)
+		c.Queue().AddMulti(tasks, queue)
 		c.Infof("added %v tasks", len(tasks))
 		tasks = tasks[0:0]
 	}